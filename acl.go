@@ -0,0 +1,232 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// acl.go 文件实现了访问控制列表（ACL）。
+// ACL 按照客户端前缀、网络协议及查询名称后缀，在查询到达 Responser 之前决定是否允许该查询，
+// 被拒绝的查询可以被丢弃、以 REFUSED 回复，或交由自定义的 Responser 处理。
+
+package godns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// ACLAction 表示被拒绝的查询的处理方式
+type ACLAction string
+
+const (
+	// 以 REFUSED 回复（默认）
+	ACLActionRefuse ACLAction = "refuse"
+	// 丢弃查询，不发送回复
+	ACLActionDrop ACLAction = "drop"
+	// 交由 ACLConfig.Responser 处理
+	ACLActionResponser ACLAction = "responser"
+)
+
+// ACLRule 是一条访问控制规则，规则的各个条件同时满足时匹配，为空的条件匹配任意查询
+type ACLRule struct {
+	// 为 true 时拒绝匹配的查询，否则允许
+	Deny bool
+	// 客户端地址所在的网段
+	Networks []*net.IPNet
+	// 网络协议
+	Protocols []Protocol
+	// 查询名称后缀，按标签匹配且不区分大小写，如 "example.com" 匹配 "www.example.com"
+	Suffixes []string
+}
+
+// ACLConfig 记录访问控制列表的配置
+type ACLConfig struct {
+	// 访问控制规则，按顺序匹配，以第一条匹配的规则为准
+	Rules []ACLRule
+	// 没有规则匹配时是否拒绝查询
+	DefaultDeny bool
+	// 被拒绝的查询的处理方式，默认为 ACLActionRefuse
+	Action ACLAction
+	// Action 为 ACLActionResponser 时用于生成回复的 Responser
+	Responser Responser
+}
+
+// ACL 实现访问控制列表
+type ACL struct {
+	Config    ACLConfig
+	ACLLogger *slog.Logger
+	// 指标记录器，不为 nil 时记录被拒绝的查询数量
+	Metrics *Metrics
+}
+
+// metricACL 是被拒绝的查询数量的指标名称
+const metricACL = "godns_acl_denied_total"
+
+// NewACL 创建一个访问控制列表
+// 其接受参数为：
+//   - conf ACLConfig，访问控制配置
+//   - logger *slog.Logger，日志记录器，可以为 nil
+func NewACL(conf ACLConfig, logger *slog.Logger) *ACL {
+	if conf.Action == "" {
+		conf.Action = ACLActionRefuse
+	}
+	if logger == nil {
+		logger = newWriterLogger(nil, LogComponentGoDNS)
+	}
+	return &ACL{Config: conf, ACLLogger: logger}
+}
+
+// SetMetrics 设置指标记录器，并注册被拒绝的查询数量的计数器
+func (a *ACL) SetMetrics(m *Metrics) {
+	m.RegisterCounter(metricACL, "Number of queries denied by ACL.", "protocol", "action")
+	a.Metrics = m
+}
+
+// ParseCIDRs 解析以 CIDR 表示的网段，单个 IP 地址被视为仅包含该地址的网段
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// IsSubDomain 判断 name 是否为 zone 或其子域名，按标签比较且不区分大小写
+func IsSubDomain(zone, name string) bool {
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if zone == "" {
+		return true
+	}
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// Match 判断规则是否匹配该查询
+// 其接受参数为：
+//   - client net.IP，客户端地址
+//   - protocol Protocol，网络协议
+//   - qname string，查询名称
+func (rule ACLRule) Match(client net.IP, protocol Protocol, qname string) bool {
+	if len(rule.Networks) > 0 {
+		matched := false
+		for _, n := range rule.Networks {
+			if client != nil && n.Contains(client) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Protocols) > 0 {
+		matched := false
+		for _, p := range rule.Protocols {
+			if p == protocol {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Suffixes) > 0 {
+		matched := false
+		for _, suffix := range rule.Suffixes {
+			if IsSubDomain(suffix, qname) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed 判断是否允许该查询
+func (a *ACL) Allowed(client net.IP, protocol Protocol, qname string) bool {
+	for _, rule := range a.Config.Rules {
+		if rule.Match(client, protocol, qname) {
+			return !rule.Deny
+		}
+	}
+	return !a.Config.DefaultDeny
+}
+
+// InitRefused 根据查询信息初始化 REFUSED 回复，回复中仅包含问题部分
+func InitRefused(qry dns.DNSMessage) dns.DNSMessage {
+	resp := dns.DNSMessage{
+		Header: dns.DNSHeader{
+			ID:     qry.Header.ID,
+			QR:     true,
+			OpCode: qry.Header.OpCode,
+			RD:     qry.Header.RD,
+			RCode:  dns.DNSResponseCodeRefused,
+		},
+		Question: qry.Question,
+	}
+	resp.Header.QDCount = uint16(len(resp.Question))
+	return resp
+}
+
+// ACLMiddleware 返回一个访问控制中间件
+// 其接受参数为：
+//   - a *ACL，访问控制列表
+//
+// 被拒绝的查询不会到达后续的处理器，而是按照 ACLConfig.Action 处理。
+func ACLMiddleware(a *ACL) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			rec := connInfo.Record
+			if rec == nil {
+				rec = &QueryRecord{}
+			}
+			rec.fillQuery(connInfo)
+
+			client, _ := addrIPPort(connInfo.Address)
+			if a.Allowed(client, connInfo.Protocol, rec.QName) {
+				return next.ServeDNS(connInfo)
+			}
+
+			a.ACLLogger.Debug("Query denied by ACL", "client", connInfo.Address, "protocol", connInfo.Protocol, "qname", rec.QName, "action", a.Config.Action)
+			if a.Metrics != nil {
+				a.Metrics.Inc(metricACL, string(connInfo.Protocol), string(a.Config.Action))
+			}
+			switch a.Config.Action {
+			case ACLActionDrop:
+				return nil, nil
+			case ACLActionResponser:
+				if a.Config.Responser == nil {
+					return nil, fmt.Errorf("ACL responser is not configured")
+				}
+				return a.Config.Responser.Response(connInfo)
+			}
+			qry, err := ParseQuery(connInfo)
+			if err != nil {
+				// 无法解析的查询无法回复，直接丢弃
+				return nil, nil
+			}
+			resp := InitRefused(qry)
+			return resp.Encode(), nil
+		})
+	}
+}
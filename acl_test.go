@@ -0,0 +1,135 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// acl_test.go 文件定义了对 acl.go 的单元测试
+
+package godns
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// TestACLAllowed 测试规则的匹配顺序及各个匹配条件
+func TestACLAllowed(t *testing.T) {
+	testbed, err := ParseCIDRs("10.0.0.0/8", "2001:db8::/32")
+	if err != nil {
+		t.Fatalf("ParseCIDRs failed: %v", err)
+	}
+	blocked, _ := ParseCIDRs("10.0.0.66")
+	acl := NewACL(ACLConfig{
+		Rules: []ACLRule{
+			{Deny: true, Networks: blocked},
+			{Deny: true, Suffixes: []string{"internal.example.com"}, Protocols: []Protocol{ProtocolUDP}},
+			{Networks: testbed},
+		},
+		DefaultDeny: true,
+	}, discardLogger())
+
+	cases := []struct {
+		client   string
+		protocol Protocol
+		qname    string
+		expected bool
+	}{
+		{"10.1.2.3", ProtocolUDP, "www.example.com", true},
+		{"2001:db8::1", ProtocolTCP, "www.example.com", true},
+		{"192.0.2.1", ProtocolUDP, "www.example.com", false},
+		{"10.0.0.66", ProtocolUDP, "www.example.com", false},
+		{"10.1.2.3", ProtocolUDP, "A.Internal.Example.COM", false},
+		{"10.1.2.3", ProtocolTCP, "a.internal.example.com", true},
+		{"10.1.2.3", ProtocolUDP, "notinternal.example.com", true},
+	}
+	for _, c := range cases {
+		if got := acl.Allowed(net.ParseIP(c.client), c.protocol, c.qname); got != c.expected {
+			t.Errorf("Allowed(%s, %s, %s) got: %v, expected: %v", c.client, c.protocol, c.qname, got, c.expected)
+		}
+	}
+}
+
+// TestACLMiddleware 测试被拒绝查询的三种处理方式
+func TestACLMiddleware(t *testing.T) {
+	called := 0
+	next := HandlerFunc(func(ConnectionInfo) ([]byte, error) {
+		called++
+		return []byte{0x01}, nil
+	})
+	connInfo := func() ConnectionInfo {
+		return ConnectionInfo{
+			Protocol: ProtocolUDP,
+			Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Packet:   testQuery(7, "www.example.com", dns.DNSRRTypeA, 0, false),
+			Record:   &QueryRecord{},
+		}
+	}
+
+	// REFUSED
+	h := Chain(next, ACLMiddleware(NewACL(ACLConfig{DefaultDeny: true}, discardLogger())))
+	resp, err := h.ServeDNS(connInfo())
+	if err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(resp, 0); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if msg.Header.ID != 7 || !msg.Header.QR || msg.Header.RCode != dns.DNSResponseCodeRefused || len(msg.Question) != 1 {
+		t.Errorf("refused response got: %v", msg.String())
+	}
+
+	// 丢弃
+	m := NewMetrics(nil)
+	acl := NewACL(ACLConfig{DefaultDeny: true, Action: ACLActionDrop}, discardLogger())
+	acl.SetMetrics(m)
+	h = Chain(next, ACLMiddleware(acl))
+	if resp, err := h.ServeDNS(connInfo()); err != nil || len(resp) != 0 {
+		t.Errorf("dropped response got: %v (%v), expected: empty", resp, err)
+	}
+	if got := m.Counter(metricACL, "udp", "drop"); got != 1 {
+		t.Errorf("acl metric got: %d, expected: 1", got)
+	}
+
+	// 自定义 Responser
+	responser := &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}
+	h = Chain(next, ACLMiddleware(NewACL(ACLConfig{DefaultDeny: true, Action: ACLActionResponser, Responser: responser}, discardLogger())))
+	resp, _ = h.ServeDNS(connInfo())
+	expected, _ := responser.Response(connInfo())
+	if string(resp) != string(expected) {
+		t.Errorf("responser response got: %v, expected: %v", resp, expected)
+	}
+
+	if called != 0 {
+		t.Errorf("next handler called %d times, expected: 0", called)
+	}
+}
+
+// TestServerACLBeforeRRL 测试服务器的处理链中，被访问控制拒绝的查询不经过速率限制
+func TestServerACLBeforeRRL(t *testing.T) {
+	denied, _ := ParseCIDRs("192.0.2.1")
+	server := NewGoDNSServer(DNSServerConfig{
+		LogWriter:   io.Discard,
+		PoolCapcity: -1,
+		RRL:         &RRLConfig{ResponsesPerSecond: 1, Slip: -1},
+		ACL:         &ACLConfig{Rules: []ACLRule{{Deny: true, Networks: denied}}},
+	}, &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}})
+
+	for i := 0; i < 5; i++ {
+		resp, err := server.Handler().ServeDNS(ConnectionInfo{
+			Protocol: ProtocolUDP,
+			Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Packet:   testQuery(7, "www.example.com", dns.DNSRRTypeA, 0, false),
+			Record:   &QueryRecord{},
+		})
+		if err != nil || len(resp) == 0 {
+			t.Fatalf("refused query %d got: %v %v, expected: REFUSED", i, resp, err)
+		}
+	}
+	server.RRL.mu.Lock()
+	entries := len(server.RRL.entries)
+	server.RRL.mu.Unlock()
+	if entries != 0 {
+		t.Errorf("RRL entries got: %d, expected: 0", entries)
+	}
+}
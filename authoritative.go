@@ -0,0 +1,422 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// authoritative.go 文件定义了基于区域数据的权威回复器 AuthoritativeResponser。
+// 与 responser.go 中以代码合成回答的回复器不同，AuthoritativeResponser 按照
+// RFC 1034 4.3.2 节的算法查询已加载的区域：精确匹配、NODATA 与 NXDOMAIN（权威部分附带 SOA）、
+// 区域内的 CNAME 链、RFC 4592 通配符、附带 NS 及胶水记录的委派、RFC 6672 DNAME，
+// 并按照 RFC 8482 以单个 RRset 回复 ANY 查询。
+// 区域数据保存在 dns.Zone 中，每个查询在区域的快照上回答，因此区域可以在服务期间更新。
+// 查询的 DO 位为 1 时，回复会附带区域中对应的 RRSIG 记录，以及证明名称或类型不存在的 NSEC 记录。
+
+package godns
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// DefaultMaxChain 是跟随 CNAME 及 DNAME 的默认最大次数
+const DefaultMaxChain = 16
+
+// canonicalName 返回小写且不以 '.' 结尾的域名，根域名为 "."
+func canonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// parentName 返回域名的父域名，根域名的父域名为空字符串
+func parentName(name string) string {
+	if name == "." {
+		return ""
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// joinName 在域名前添加一个标签
+func joinName(label, name string) string {
+	if name == "." {
+		return label
+	}
+	return label + "." + name
+}
+
+// negativeSOA 返回否定回复所用的 SOA 记录，其 TTL 取 SOA 记录的 TTL 与其 MINIMUM 字段中的较小者，详见 RFC 2308 第 3 节
+func negativeSOA(s *dns.ZoneSnapshot) dns.DNSResourceRecord {
+	soa := *s.SOA()
+	if rdata, ok := soa.RData.(*dns.DNSRDATASOA); ok {
+		soa.TTL = min(soa.TTL, rdata.Minimum)
+	}
+	return soa
+}
+
+// zoneCut 自区域顶点向下查找 name 路径上的委派点及 DNAME 记录
+// 返回值为：
+//   - *dns.ZoneNode，委派点或 DNAME 记录的所有者节点
+//   - dns.DNSType，dns.DNSRRTypeNS 或 dns.DNSRRTypeDNAME，均不存在时为 0
+func zoneCut(s *dns.ZoneSnapshot, name string, qtype dns.DNSType) (*dns.ZoneNode, dns.DNSType) {
+	var path []string
+	for n := name; n != s.Origin; n = parentName(n) {
+		path = append(path, n)
+	}
+	path = append(path, s.Origin)
+	for i := len(path) - 1; i >= 0; i-- {
+		n := path[i]
+		node := s.Get(n)
+		if node == nil {
+			return nil, 0
+		}
+		// 委派点的 DS 记录由父区域权威回复
+		if n != s.Origin && len(node.RRSets[dns.DNSRRTypeNS]) > 0 && !(n == name && qtype == dns.DNSRRTypeDS) {
+			return node, dns.DNSRRTypeNS
+		}
+		// DNAME 仅重定向其所有者名称的子域名
+		if n != name && len(node.RRSets[dns.DNSRRTypeDNAME]) > 0 {
+			return node, dns.DNSRRTypeDNAME
+		}
+	}
+	return nil, 0
+}
+
+// AuthoritativeResponser 是一个基于区域数据的权威回复器
+// 每个查询都在所选区域的一个快照上回答，区域的更新不会阻塞查询，也不会使一次回答前后不一致。
+type AuthoritativeResponser struct {
+	// 所服务的区域，查询名称按照最长匹配选择区域
+	Zones []*dns.Zone
+	// 跟随 CNAME 及 DNAME 的最大次数，默认为 DefaultMaxChain
+	MaxChain int
+}
+
+// NewAuthoritativeResponser 创建一个权威回复器
+// 其接受参数为：
+//   - zones ...*dns.Zone，所服务的区域，区域顶点须含有 SOA 记录
+func NewAuthoritativeResponser(zones ...*dns.Zone) *AuthoritativeResponser {
+	return &AuthoritativeResponser{Zones: zones, MaxChain: DefaultMaxChain}
+}
+
+// findZone 返回包含 name 的最长区域的当前快照，不存在时返回 nil。
+// DS 记录属于委派点的父区域，因此查询区域顶点的 DS 记录时优先选择父区域，
+// 仅服务子区域时才由子区域回答，详见 RFC 4035 3.1.4.1 节。
+func (r *AuthoritativeResponser) findZone(name string, qtype dns.DNSType) *dns.ZoneSnapshot {
+	var best, apex *dns.Zone
+	for _, z := range r.Zones {
+		if !IsSubDomain(z.Origin, name) {
+			continue
+		}
+		if qtype == dns.DNSRRTypeDS && z.Origin == name && name != "." {
+			apex = z
+			continue
+		}
+		if best == nil || len(z.Origin) > len(best.Origin) || best.Origin == "." {
+			best = z
+		}
+	}
+	if best == nil {
+		best = apex
+	}
+	if best == nil {
+		return nil
+	}
+	if s := best.Snapshot(); s.SOA() != nil {
+		return s
+	}
+	return nil
+}
+
+// authAnswer 记录生成回复所需的状态
+type authAnswer struct {
+	resp *dns.DNSMessage
+	do   bool
+	// 已添加到权威部分的 NSEC 记录的所有者名称
+	nsec map[string]bool
+}
+
+// addSet 向回复的指定部分添加 RRset，owner 不为空时改写所有者名称（通配符合成），
+// DO 位为 1 时一并添加覆盖该 RRset 的 RRSIG 记录
+func (a *authAnswer) addSet(section *dns.DNSResponseSection, s *dns.ZoneSnapshot, source string, rtype dns.DNSType, owner string) {
+	node := s.Get(source)
+	if node == nil {
+		return
+	}
+	for _, rr := range node.RRSets[rtype] {
+		if owner != "" {
+			rr.Name = owner
+		}
+		*section = append(*section, rr)
+	}
+	if !a.do {
+		return
+	}
+	for _, rr := range node.Signatures[rtype] {
+		if owner != "" {
+			rr.Name = owner
+		}
+		*section = append(*section, rr)
+	}
+}
+
+// addNSEC 向权威部分添加 owner 的 NSEC 记录及其签名，每个所有者名称仅添加一次
+func (a *authAnswer) addNSEC(s *dns.ZoneSnapshot, owner string) {
+	if !a.do || a.nsec[owner] || len(s.RRSet(owner, dns.DNSRRTypeNSEC)) == 0 {
+		return
+	}
+	if a.nsec == nil {
+		a.nsec = make(map[string]bool)
+	}
+	a.nsec[owner] = true
+	a.addSet(&a.resp.Authority, s, owner, dns.DNSRRTypeNSEC, "")
+}
+
+// addCovering 向权威部分添加覆盖 name 的 NSEC 记录，证明 name 不存在，详见 RFC 4035 3.1.3 节
+// 委派点以下的胶水名称没有 NSEC 记录，因此沿规范顺序向前查找第一个含有 NSEC 记录的名称
+func (a *authAnswer) addCovering(s *dns.ZoneSnapshot, name string) {
+	if !a.do {
+		return
+	}
+	for node := s.Predecessor(name); node != nil; node = s.Predecessor(node.Name) {
+		if len(node.RRSets[dns.DNSRRTypeNSEC]) > 0 {
+			a.addNSEC(s, node.Name)
+			return
+		}
+	}
+}
+
+// addNegative 向权威部分添加 SOA 记录，NODATA 回复在 DO 位为 1 时还会附带所有者名称的 NSEC 记录
+func (a *authAnswer) addNegative(s *dns.ZoneSnapshot, nodata string) {
+	soa := negativeSOA(s)
+	a.resp.Authority = append(a.resp.Authority, soa)
+	if !a.do {
+		return
+	}
+	for _, rr := range s.Get(s.Origin).Signatures[dns.DNSRRTypeSOA] {
+		rr.TTL = min(rr.TTL, soa.TTL)
+		a.resp.Authority = append(a.resp.Authority, rr)
+	}
+	if nodata != "" {
+		a.addNSEC(s, nodata)
+	}
+}
+
+// addGlue 向附加部分添加区域中目标名称的地址记录
+func (a *authAnswer) addGlue(s *dns.ZoneSnapshot, targets []string) {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		target = canonicalName(target)
+		if seen[target] || !IsSubDomain(s.Origin, target) {
+			continue
+		}
+		seen[target] = true
+		a.addSet(&a.resp.Additional, s, target, dns.DNSRRTypeA, "")
+		a.addSet(&a.resp.Additional, s, target, dns.DNSRRTypeAAAA, "")
+	}
+}
+
+// additionalTargets 返回 NS 及 MX 记录中需要附加地址记录的目标名称
+func additionalTargets(rrs []dns.DNSResourceRecord) []string {
+	var targets []string
+	for _, rr := range rrs {
+		switch rdata := rr.RData.(type) {
+		case *dns.DNSRDATANS:
+			targets = append(targets, rdata.NSDNAME)
+		case *dns.DNSRDATAUnknown:
+			if rr.Type == dns.DNSRRTypeMX && len(rdata.RData) > 2 {
+				if exchange, _, err := dns.DecodeDomainNameFromBuffer(rdata.RData, 2); err == nil {
+					targets = append(targets, exchange)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// referral 生成委派回复：权威部分为委派点的 NS 记录，附加部分为胶水记录
+// DO 位为 1 时权威部分还会附带委派点的 DS 记录，或证明其不存在的 NSEC 记录
+func (a *authAnswer) referral(s *dns.ZoneSnapshot, cut *dns.ZoneNode) {
+	if len(a.resp.Answer) == 0 {
+		a.resp.Header.AA = false
+	}
+	a.addSet(&a.resp.Authority, s, cut.Name, dns.DNSRRTypeNS, "")
+	if a.do && len(cut.RRSets[dns.DNSRRTypeDS]) > 0 {
+		a.addSet(&a.resp.Authority, s, cut.Name, dns.DNSRRTypeDS, "")
+	} else {
+		a.addNSEC(s, cut.Name)
+	}
+	a.resp.Additional = append(a.resp.Additional, s.Glue(cut.Name)...)
+}
+
+// domainTarget 返回 CNAME 或 DNAME 记录的目标名称
+func domainTarget(rr dns.DNSResourceRecord) (string, bool) {
+	switch rdata := rr.RData.(type) {
+	case *dns.DNSRDATACNAME:
+		return canonicalName(rdata.CNAME), true
+	case *dns.DNSRDATAUnknown:
+		target, _, err := dns.DecodeDomainNameFromBuffer(rdata.RData, 0)
+		return canonicalName(target), err == nil
+	}
+	return "", false
+}
+
+// resolve 按照 RFC 1034 4.3.2 节的算法生成回答
+func (r *AuthoritativeResponser) resolve(a *authAnswer, qname string, qtype dns.DNSType) {
+	s := r.findZone(qname, qtype)
+	if s == nil {
+		a.resp.Header.RCode = dns.DNSResponseCodeRefused
+		a.resp.Header.AA = false
+		return
+	}
+	a.resp.Header.AA = true
+	a.resp.Header.RCode = dns.DNSResponseCodeNoErr
+
+	maxChain := r.MaxChain
+	if maxChain <= 0 {
+		maxChain = DefaultMaxChain
+	}
+	name := qname
+	for step := 0; ; step++ {
+		if step > maxChain {
+			a.resp.Header.RCode = dns.DNSResponseCodeServFail
+			return
+		}
+		// 跟随 CNAME 或 DNAME 离开所服务的区域时，由客户端继续解析
+		if s = r.findZone(name, qtype); s == nil {
+			return
+		}
+
+		cut, kind := zoneCut(s, name, qtype)
+		switch kind {
+		case dns.DNSRRTypeNS:
+			a.referral(s, cut)
+			return
+		case dns.DNSRRTypeDNAME:
+			dname := cut.RRSets[dns.DNSRRTypeDNAME][0]
+			target, ok := domainTarget(dname)
+			if !ok {
+				a.resp.Header.RCode = dns.DNSResponseCodeServFail
+				return
+			}
+			a.addSet(&a.resp.Answer, s, cut.Name, dns.DNSRRTypeDNAME, "")
+			// 以 DNAME 的目标替换查询名称中的所有者名称，合成 CNAME 记录，详见 RFC 6672 3.2 节
+			prefix := name
+			if cut.Name != "." {
+				prefix = strings.TrimSuffix(name, "."+cut.Name)
+			}
+			synthesized := joinName(prefix, target)
+			if len(synthesized) > 253 {
+				a.resp.Header.RCode = dns.DNSResponseCodeYXDomain
+				return
+			}
+			a.resp.Answer = append(a.resp.Answer, dns.DNSResourceRecord{
+				Name: name, Type: dns.DNSRRTypeCNAME, Class: dname.Class, TTL: dname.TTL,
+				RData: &dns.DNSRDATACNAME{CNAME: synthesized},
+			})
+			name = synthesized
+			continue
+		}
+
+		source, rewrite := name, ""
+		node, exact := s.ClosestEncloser(name)
+		if !exact {
+			// 查询名称不存在时，尝试以最近祖先的通配符合成回答，详见 RFC 4592 3.3.1 节
+			wildcard := s.Wildcard(name)
+			if wildcard == nil {
+				a.resp.Header.RCode = dns.DNSResponseCodeNXDomain
+				a.addNegative(s, "")
+				// 证明查询名称及最近祖先的通配符均不存在，详见 RFC 4035 3.1.3.2 节
+				a.addCovering(s, name)
+				a.addCovering(s, joinName("*", node.Name))
+				return
+			}
+			// 通配符回答须附带证明查询名称不存在的 NSEC 记录，详见 RFC 4035 3.1.3.3 节，
+			// 其在回答的其余部分生成后添加
+			defer a.addCovering(s, name)
+			node, source, rewrite = wildcard, wildcard.Name, name
+		}
+		rrsets := node.RRSets
+
+		switch {
+		case qtype == dns.DNSQTypeANY:
+			// 仅回复一个 RRset，详见 RFC 8482 4.1 节
+			types := make([]dns.DNSType, 0, len(rrsets))
+			for t := range rrsets {
+				types = append(types, t)
+			}
+			if len(types) == 0 {
+				a.addNegative(s, source)
+				return
+			}
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			a.addSet(&a.resp.Answer, s, source, types[0], rewrite)
+			return
+		case qtype == dns.DNSRRTypeRRSIG && len(node.Signatures) > 0:
+			for _, sigs := range node.Signatures {
+				for _, rr := range sigs {
+					if rewrite != "" {
+						rr.Name = rewrite
+					}
+					a.resp.Answer = append(a.resp.Answer, rr)
+				}
+			}
+			return
+		case len(rrsets[qtype]) > 0:
+			a.addSet(&a.resp.Answer, s, source, qtype, rewrite)
+			if qtype == dns.DNSRRTypeNS || qtype == dns.DNSRRTypeMX {
+				a.addGlue(s, additionalTargets(rrsets[qtype]))
+			}
+			return
+		case len(rrsets[dns.DNSRRTypeCNAME]) > 0:
+			a.addSet(&a.resp.Answer, s, source, dns.DNSRRTypeCNAME, rewrite)
+			target, ok := domainTarget(rrsets[dns.DNSRRTypeCNAME][0])
+			if !ok {
+				a.resp.Header.RCode = dns.DNSResponseCodeServFail
+				return
+			}
+			name = target
+		default:
+			a.addNegative(s, source)
+			return
+		}
+	}
+}
+
+// Response 根据已加载的区域生成权威回复
+// 查询不属于任何区域时回复 REFUSED；超出 UDP 负载大小的回复由 Netter 截断。
+func (r *AuthoritativeResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return []byte{}, err
+	}
+	resp := InitResponse(qry, NXDOMAINResponse)
+	resp.Header.OpCode = qry.Header.OpCode
+	resp.Header.RD = qry.Header.RD
+
+	var opt *dns.DNSResourceRecord
+	for i := range qry.Additional {
+		if qry.Additional[i].Type == dns.DNSRRTypeOPT {
+			opt = &qry.Additional[i]
+		}
+	}
+	switch {
+	case qry.Header.OpCode != dns.DNSOpCodeQuery:
+		resp.Header.RCode = dns.DNSResponseCodeNotImp
+		resp.Header.AA = false
+	case len(qry.Question) != 1:
+		resp.Header.RCode = dns.DNSResponseCodeFormErr
+		resp.Header.AA = false
+	default:
+		a := &authAnswer{resp: &resp, do: opt != nil && opt.TTL&0x8000 != 0}
+		r.resolve(a, canonicalName(qry.Question[0].Name), qry.Question[0].Type)
+	}
+
+	if opt != nil {
+		resp.Additional = append(resp.Additional, *dns.NewDNSRROPT(1232, int(dns.SetDNSRROPTTTL(0, 0, opt.TTL&0x8000 != 0, 0)), &dns.DNSRDATAOPT{}))
+	}
+	FixCount(&resp)
+	return resp.Encode(), nil
+}
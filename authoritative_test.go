@@ -0,0 +1,314 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// authoritative_test.go 文件定义了对 authoritative.go 的单元测试
+
+package godns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testAuthZoneFile 是用于测试权威回复器的区域文件
+const testAuthZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 3600 1209600 300
+	NS	ns1
+ns1	A	192.0.2.53
+www	A	192.0.2.1
+	AAAA	2001:db8::1
+	RRSIG	A 8 3 3600 20300101000000 20240101000000 12345 example.com. AAAA
+mail	MX	10 www
+alias	CNAME	www
+chain	CNAME	alias
+loop1	CNAME	loop2
+loop2	CNAME	loop1
+out	CNAME	www.example.org.
+*.wild	A	192.0.2.99
+	TXT	"wildcard"
+sub.wild	A	192.0.2.100
+a.b.c	TXT	"deep"
+child	NS	ns.child
+	NS	ns.other.net.
+	DS	12345 8 2 ABCDEF
+ns.child	A	192.0.2.54
+dn	DNAME	example.net.
+`
+
+// testAuthResponser 返回服务 example.com 及 example.net 的权威回复器
+func testAuthResponser(t *testing.T) *AuthoritativeResponser {
+	t.Helper()
+	com, err := dns.LoadZone(strings.NewReader(testAuthZoneFile), "example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	net, err := dns.LoadZone(strings.NewReader("@ 300 SOA ns hostmaster 1 2 3 4 60\nhost 300 A 192.0.2.7\n"), "example.net.")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	return NewAuthoritativeResponser(com, net)
+}
+
+// testSectionTypes 返回资源记录的类型列表
+func testSectionTypes(rrs []dns.DNSResourceRecord) string {
+	types := []string{}
+	for _, rr := range rrs {
+		if rr.Type != dns.DNSRRTypeOPT {
+			types = append(types, rr.Type.String())
+		}
+	}
+	return strings.Join(types, " ")
+}
+
+// TestAuthoritativeResponser 测试权威回复器的各类回答
+func TestAuthoritativeResponser(t *testing.T) {
+	responser := testAuthResponser(t)
+	cases := []struct {
+		name       string
+		qtype      dns.DNSType
+		do         bool
+		rcode      dns.DNSResponseCode
+		aa         bool
+		answer     string
+		authority  string
+		additional string
+	}{
+		// 精确匹配，不区分大小写
+		{"www.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "A", "", ""},
+		{"WWW.Example.COM", dns.DNSRRTypeAAAA, false, dns.DNSResponseCodeNoErr, true, "AAAA", "", ""},
+		{"www.example.com", dns.DNSRRTypeA, true, dns.DNSResponseCodeNoErr, true, "A RRSIG", "", ""},
+		// NODATA 与 NXDOMAIN，包括空非终端名称
+		{"www.example.com", dns.DNSRRTypeTXT, false, dns.DNSResponseCodeNoErr, true, "", "SOA", ""},
+		{"c.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "", "SOA", ""},
+		{"nothere.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNXDomain, true, "", "SOA", ""},
+		// CNAME 链
+		{"chain.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "CNAME CNAME A", "", ""},
+		{"alias.example.com", dns.DNSRRTypeCNAME, false, dns.DNSResponseCodeNoErr, true, "CNAME", "", ""},
+		{"out.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "CNAME", "", ""},
+		{"loop1.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeServFail, true, strings.TrimSpace(strings.Repeat("CNAME ", DefaultMaxChain+1)), "", ""},
+		// 通配符
+		{"x.wild.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "A", "", ""},
+		{"y.z.wild.example.com", dns.DNSRRTypeTXT, false, dns.DNSResponseCodeNoErr, true, "TXT", "", ""},
+		{"x.wild.example.com", dns.DNSRRTypeMX, false, dns.DNSResponseCodeNoErr, true, "", "SOA", ""},
+		{"x.sub.wild.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNXDomain, true, "", "SOA", ""},
+		// 委派，DS 记录由父区域回复
+		{"www.child.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, false, "", "NS NS", "A"},
+		{"child.example.com", dns.DNSRRTypeNS, true, dns.DNSResponseCodeNoErr, false, "", "NS NS DS", "A"},
+		{"child.example.com", dns.DNSRRTypeDS, false, dns.DNSResponseCodeNoErr, true, "DS", "", ""},
+		// DNAME 重定向至另一个区域
+		{"host.dn.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "DNAME CNAME A", "", ""},
+		{"dn.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNoErr, true, "", "SOA", ""},
+		// 附加部分
+		{"mail.example.com", dns.DNSRRTypeMX, false, dns.DNSResponseCodeNoErr, true, "MX", "", "A AAAA"},
+		{"example.com", dns.DNSRRTypeNS, false, dns.DNSResponseCodeNoErr, true, "NS", "", "A"},
+		// ANY 仅回复一个 RRset
+		{"www.example.com", dns.DNSQTypeANY, false, dns.DNSResponseCodeNoErr, true, "A", "", ""},
+		{"example.com", dns.DNSQTypeANY, false, dns.DNSResponseCodeNoErr, true, "NS", "", ""},
+		// 不属于任何区域
+		{"example.org", dns.DNSRRTypeA, false, dns.DNSResponseCodeRefused, false, "", "", ""},
+	}
+	for _, c := range cases {
+		desc := fmt.Sprintf("%s %s do=%v", c.name, c.qtype, c.do)
+		data, err := responser.Response(ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(0x1234, c.name, c.qtype, 0, c.do)})
+		if err != nil {
+			t.Fatalf("%s: Response failed: %v", desc, err)
+		}
+		resp := dns.DNSMessage{}
+		if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+			t.Fatalf("%s: error decoding response: %v", desc, err)
+		}
+		if resp.Header.ID != 0x1234 || !resp.Header.QR || !resp.Header.RD {
+			t.Errorf("%s: header got: %+v, expected: ID 0x1234 with QR and RD", desc, resp.Header)
+		}
+		if resp.Header.RCode != c.rcode || resp.Header.AA != c.aa {
+			t.Errorf("%s: rcode, AA got: %v %v, expected: %v %v", desc, resp.Header.RCode, resp.Header.AA, c.rcode, c.aa)
+		}
+		if got := testSectionTypes(resp.Answer); got != c.answer {
+			t.Errorf("%s: answer got: %q, expected: %q", desc, got, c.answer)
+		}
+		if got := testSectionTypes(resp.Authority); got != c.authority {
+			t.Errorf("%s: authority got: %q, expected: %q", desc, got, c.authority)
+		}
+		if got := testSectionTypes(resp.Additional); got != c.additional {
+			t.Errorf("%s: additional got: %q, expected: %q", desc, got, c.additional)
+		}
+	}
+}
+
+// TestAuthoritativeSynthesis 测试通配符、DNAME 合成的记录及否定回复的 TTL
+func TestAuthoritativeSynthesis(t *testing.T) {
+	responser := testAuthResponser(t)
+	query := func(name string, qtype dns.DNSType) dns.DNSMessage {
+		data, _ := responser.Response(ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(0x1234, name, qtype, 0, false)})
+		resp := dns.DNSMessage{}
+		resp.DecodeFromBuffer(data, 0)
+		return resp
+	}
+
+	if resp := query("X.wild.example.com", dns.DNSRRTypeA); resp.Answer[0].Name != "x.wild.example.com" {
+		t.Errorf("wildcard owner got: %s, expected: x.wild.example.com", resp.Answer[0].Name)
+	}
+	resp := query("host.dn.example.com", dns.DNSRRTypeA)
+	cname, ok := resp.Answer[1].RData.(*dns.DNSRDATACNAME)
+	if !ok || resp.Answer[1].Name != "host.dn.example.com" || cname.CNAME != "host.example.net" || resp.Answer[1].TTL != 3600 {
+		t.Errorf("synthesized CNAME got: %v, expected: host.dn.example.com CNAME host.example.net", resp.Answer[1])
+	}
+	if resp := query("nothere.example.com", dns.DNSRRTypeA); resp.Authority[0].TTL != 300 {
+		t.Errorf("negative SOA TTL got: %d, expected: 300", resp.Authority[0].TTL)
+	}
+}
+
+// TestAuthoritativeTruncation 测试超出 UDP 负载大小的回复由 Netter 截断，TCP 及 DoH 的回复不被截断
+func TestAuthoritativeTruncation(t *testing.T) {
+	zone := "@ 300 SOA ns hostmaster 1 2 3 4 60\n"
+	for i := 0; i < 40; i++ {
+		zone += fmt.Sprintf("big 300 TXT \"record number %d with some padding\"\n", i)
+	}
+	z, err := dns.LoadZone(strings.NewReader(zone), "example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	responser := NewAuthoritativeResponser(z)
+	var sent []byte
+	n := &Netter{NetterLogger: discardLogger()}
+	tp := &recordTransport{reply: func(b []byte) { sent = b }}
+
+	for _, c := range []struct {
+		protocol Protocol
+		tc       bool
+		answers  int
+	}{
+		{ProtocolUDP, true, 0},
+		{ProtocolTCP, false, 40},
+		{ProtocolDoH, false, 40},
+	} {
+		connInfo := ConnectionInfo{Protocol: c.protocol, Transport: tp, Packet: testQuery(0x1234, "big.example.com", dns.DNSRRTypeTXT, 0, true)}
+		data, _ := responser.Response(connInfo)
+		n.Send(connInfo, data)
+		resp := dns.DNSMessage{}
+		if _, err := resp.DecodeFromBuffer(sent, 0); err != nil {
+			t.Fatalf("%s: error decoding response: %v", c.protocol, err)
+		}
+		if resp.Header.TC != c.tc || len(resp.Answer) != c.answers || len(resp.Additional) != 1 {
+			t.Errorf("%s: TC, answers, additional got: %v %d %d, expected: %v %d 1",
+				c.protocol, resp.Header.TC, len(resp.Answer), len(resp.Additional), c.tc, c.answers)
+		}
+	}
+}
+
+// TestAuthoritativeChildApex 测试同时服务父子区域时，子区域顶点的 DS 记录由父区域回复
+func TestAuthoritativeChildApex(t *testing.T) {
+	parent := testAuthResponser(t).Zones[0]
+	child, err := dns.LoadZone(strings.NewReader("@ 300 SOA ns hostmaster 1 2 3 4 60\n@ 300 NS ns\nns 300 A 192.0.2.54\n"), "child.example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		zones     []*dns.Zone
+		qtype     dns.DNSType
+		answer    string
+		authority string
+	}{
+		{[]*dns.Zone{parent, child}, dns.DNSRRTypeDS, "DS", ""},
+		{[]*dns.Zone{child, parent}, dns.DNSRRTypeDS, "DS", ""},
+		{[]*dns.Zone{parent, child}, dns.DNSRRTypeNS, "NS", ""},
+		// 仅服务子区域时由子区域回复 NODATA
+		{[]*dns.Zone{child}, dns.DNSRRTypeDS, "", "SOA"},
+	} {
+		data, _ := NewAuthoritativeResponser(c.zones...).Response(ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(0x1234, "child.example.com", c.qtype, 0, false)})
+		resp := dns.DNSMessage{}
+		if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		if !resp.Header.AA || testSectionTypes(resp.Answer) != c.answer || testSectionTypes(resp.Authority) != c.authority {
+			t.Errorf("%d zones, %s: AA, answer, authority got: %v %q %q, expected: true %q %q", len(c.zones), c.qtype,
+				resp.Header.AA, testSectionTypes(resp.Answer), testSectionTypes(resp.Authority), c.answer, c.authority)
+		}
+	}
+}
+
+// testSignedZoneFile 是带有 NSEC 链的区域文件，规范顺序为 example.com、a、w（空非终端名称）、*.w、z
+const testSignedZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 3600 1209600 300
+	NSEC	a SOA NSEC
+a	A	192.0.2.1
+	NSEC	*.w A NSEC RRSIG
+	RRSIG	NSEC 8 3 300 20300101000000 20240101000000 12345 example.com. AAAA
+*.w	A	192.0.2.99
+	NSEC	z A NSEC
+z	A	192.0.2.26
+	NSEC	example.com. A NSEC
+`
+
+// TestAuthoritativeDenial 测试 DO 位为 1 时证明名称或类型不存在的 NSEC 记录
+func TestAuthoritativeDenial(t *testing.T) {
+	z, err := dns.LoadZone(strings.NewReader(testSignedZoneFile), "example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	responser := NewAuthoritativeResponser(z)
+	for _, c := range []struct {
+		name      string
+		qtype     dns.DNSType
+		do        bool
+		rcode     dns.DNSResponseCode
+		answer    string
+		authority string
+	}{
+		// 覆盖 b 的 NSEC（a）及覆盖 *.example.com 的 NSEC（example.com）
+		{"b.example.com", dns.DNSRRTypeA, true, dns.DNSResponseCodeNXDomain, "", "SOA NSEC RRSIG NSEC"},
+		{"b.example.com", dns.DNSRRTypeA, false, dns.DNSResponseCodeNXDomain, "", "SOA"},
+		// 通配符回答附带覆盖查询名称的 NSEC
+		{"x.w.example.com", dns.DNSRRTypeA, true, dns.DNSResponseCodeNoErr, "A", "NSEC"},
+		// 通配符 NODATA，通配符的 NSEC 同时覆盖查询名称，仅添加一次
+		{"x.w.example.com", dns.DNSRRTypeTXT, true, dns.DNSResponseCodeNoErr, "", "SOA NSEC"},
+		{"a.example.com", dns.DNSRRTypeTXT, true, dns.DNSResponseCodeNoErr, "", "SOA NSEC RRSIG"},
+		// 空非终端名称的 NODATA 回复不附带 NSEC
+		{"w.example.com", dns.DNSRRTypeA, true, dns.DNSResponseCodeNoErr, "", "SOA"},
+	} {
+		desc := fmt.Sprintf("%s %s do=%v", c.name, c.qtype, c.do)
+		data, _ := responser.Response(ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(0x1234, c.name, c.qtype, 0, c.do)})
+		resp := dns.DNSMessage{}
+		if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+			t.Fatalf("%s: error decoding response: %v", desc, err)
+		}
+		if resp.Header.RCode != c.rcode {
+			t.Errorf("%s: rcode got: %v, expected: %v", desc, resp.Header.RCode, c.rcode)
+		}
+		if got := testSectionTypes(resp.Answer); got != c.answer {
+			t.Errorf("%s: answer got: %q, expected: %q", desc, got, c.answer)
+		}
+		if got := testSectionTypes(resp.Authority); got != c.authority {
+			t.Errorf("%s: authority got: %q, expected: %q", desc, got, c.authority)
+		}
+	}
+}
+
+// TestAuthoritativeZoneUpdate 测试区域更新后回复器立即使用新的快照
+func TestAuthoritativeZoneUpdate(t *testing.T) {
+	z, err := dns.LoadZone(strings.NewReader("@ 300 SOA ns hostmaster 1 2 3 4 60\n"), "example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	responser := NewAuthoritativeResponser(z)
+	rcode := func() dns.DNSResponseCode {
+		data, _ := responser.Response(ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(0x1234, "new.example.com", dns.DNSRRTypeA, 0, false)})
+		resp := dns.DNSMessage{}
+		resp.DecodeFromBuffer(data, 0)
+		return resp.Header.RCode
+	}
+
+	if got := rcode(); got != dns.DNSResponseCodeNXDomain {
+		t.Errorf("rcode before update got: %v, expected: NXDOMAIN", got)
+	}
+	z.Add(dns.DNSResourceRecord{Name: "new.example.com", Type: dns.DNSRRTypeA, Class: dns.DNSClassIN, TTL: 300, RData: &dns.DNSRDATAA{Address: net.IPv4(192, 0, 2, 1)}})
+	if got := rcode(); got != dns.DNSResponseCodeNoErr {
+		t.Errorf("rcode after update got: %v, expected: NOERROR", got)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+//go:build linux
+
+// batch_linux.go 文件实现了 Linux 下 UDP 传输层的批量收发，
+// 其基于 golang.org/x/net 的 ReadBatch/WriteBatch（即 recvmmsg/sendmmsg），
+// 以减少逐包收发时的系统调用开销。
+
+package godns
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchSupported 表示当前平台是否支持批量收发
+const batchSupported = true
+
+// batchConn 是支持批量收发的数据包链接，ipv4.PacketConn 与 ipv6.PacketConn 均实现了该接口
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn 根据数据包链接的地址族创建对应的批量收发链接
+func newBatchConn(pktConn net.PacketConn) batchConn {
+	if addr, ok := pktConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(pktConn)
+	}
+	// 监听 ":port" 时为双栈套接字，需使用 ipv6 链接
+	return ipv6.NewPacketConn(pktConn)
+}
+
+// handlePktConnBatch 函数以批量的方式处理 数据包 链接
+// 其接收参数为：
+//   - pktConn: net.PacketConn，数据包链接
+//   - connChan: chan<- ConnectionInfo，链接信息通道
+//
+// 该函数每次调用 ReadBatch 读取至多 BatchSize 个数据包，并将其逐个发送到链接信息通道中。
+// 投递的 ConnectionInfo.PacketConn 会将回复放入发送队列，由发送协程批量发出。
+func (t *UDPTransport) handlePktConnBatch(pktConn net.PacketConn, connChan chan<- ConnectionInfo) error {
+	bConn := newBatchConn(pktConn)
+	size := t.Config.BatchSize
+
+	writer := newBatchWriter(pktConn, bConn, size, t.UDPLogger)
+	go writer.run()
+	defer writer.close()
+
+	parseDst := dstControl(pktConn)
+	ms := make([]ipv4.Message, size)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, 65535)}
+		if parseDst != nil {
+			ms[i].OOB = make([]byte, dstControlSize)
+		}
+	}
+
+	for {
+		n, err := bConn.ReadBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("error reading udp packets: %v", err)
+		}
+
+		for i := 0; i < n; i++ {
+			sz := ms[i].N
+			connInfo := ConnectionInfo{
+				Protocol:   ProtocolUDP,
+				Address:    ms[i].Addr,
+				PacketConn: writer,
+				Transport:  t,
+			}
+			if parseDst != nil {
+				connInfo.LocalAddress = parseDst(ms[i].OOB[:ms[i].NN])
+			}
+			if t.Config.PoolBuffers && sz <= pooledPacketSize {
+				connInfo.pooled = packetPool.Get().(*[]byte)
+				connInfo.Packet = (*connInfo.pooled)[:sz]
+			} else {
+				connInfo.Packet = make([]byte, sz)
+			}
+			copy(connInfo.Packet, ms[i].Buffers[0][:sz])
+
+			connChan <- connInfo
+		}
+	}
+}
+
+// batchWriter 包装了数据包链接，其 WriteTo 方法会将数据包放入发送队列，
+// 由发送协程调用 WriteBatch 批量发出。
+type batchWriter struct {
+	net.PacketConn
+
+	bConn  batchConn
+	size   int
+	logger *slog.Logger
+	queue  chan ipv4.Message
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newBatchWriter(pktConn net.PacketConn, bConn batchConn, size int, logger *slog.Logger) *batchWriter {
+	return &batchWriter{
+		PacketConn: pktConn,
+		bConn:      bConn,
+		size:       size,
+		logger:     logger,
+		queue:      make(chan ipv4.Message, size*4),
+		done:       make(chan struct{}),
+	}
+}
+
+// WriteTo 将数据包的副本放入发送队列。
+// 发送是异步进行的，发送失败时的错误将被记录到日志中。
+func (w *batchWriter) WriteTo(data []byte, addr net.Addr) (int, error) {
+	pkt := make([]byte, len(data))
+	copy(pkt, data)
+	select {
+	case w.queue <- ipv4.Message{Buffers: [][]byte{pkt}, Addr: addr}:
+		return len(data), nil
+	case <-w.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// run 不断从发送队列中取出数据包，并批量发出
+func (w *batchWriter) run() {
+	ms := make([]ipv4.Message, 0, w.size)
+	for {
+		select {
+		case m := <-w.queue:
+			ms = append(ms[:0], m)
+		case <-w.done:
+			return
+		}
+
+		// 取出队列中已有的数据包，凑成一批
+	drain:
+		for len(ms) < w.size {
+			select {
+			case m := <-w.queue:
+				ms = append(ms, m)
+			default:
+				break drain
+			}
+		}
+
+		for pending := ms; len(pending) > 0; {
+			n, err := w.bConn.WriteBatch(pending, 0)
+			if err != nil {
+				w.logger.Error("Error writing udp packets", "err", err)
+				break
+			}
+			pending = pending[n:]
+		}
+	}
+}
+
+// close 停止发送协程
+func (w *batchWriter) close() {
+	w.closed.Do(func() { close(w.done) })
+}
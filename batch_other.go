@@ -0,0 +1,17 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+//go:build !linux
+
+// batch_other.go 文件为非 Linux 平台提供批量收发的回退实现。
+
+package godns
+
+import "net"
+
+// batchSupported 表示当前平台是否支持批量收发
+const batchSupported = false
+
+// handlePktConnBatch 在非 Linux 平台上回退为逐包收发
+func (t *UDPTransport) handlePktConnBatch(pktConn net.PacketConn, connChan chan<- ConnectionInfo) error {
+	return t.handlePktConn(pktConn, connChan)
+}
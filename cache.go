@@ -0,0 +1,258 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cache.go 文件定义了 Cacher 的存储后端接口 Cache，及其内存实现与分层实现。
+// 内置的 Cache 实现包括：
+//   - MemoryCache，有容量上限的内存 LRU 缓存，每次运行都从空缓存开始；
+//   - DiskCache，每个缓存键对应目录中的一个文件；
+//   - FileCache，将所有条目保存在单个文件中的嵌入式存储；
+//   - TieredCache，在持久化的后端之前叠加一层内存缓存。
+
+package godns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache 是 Cacher 的存储后端，实现应可被并发调用。
+// Cache 只负责保存条目，缓存期限的判断由 Cacher 完成。
+type Cache interface {
+	// Get 返回缓存键对应的条目，条目不存在时返回 ErrCacheMiss
+	Get(key string) (*CacheEntry, error)
+	// Set 写入条目，已存在的同名条目将被覆盖
+	Set(entry *CacheEntry) error
+	// Delete 删除缓存键对应的条目，条目不存在时不返回错误
+	Delete(key string) error
+	// Purge 删除所有条目
+	Purge() error
+	// Stats 返回缓存的统计信息
+	Stats() CacheStats
+	// Range 依次对每个条目调用 fn，fn 返回 false 时停止遍历；遍历期间可以修改缓存
+	Range(fn func(*CacheEntry) bool) error
+}
+
+// CacheStats 是缓存的统计信息
+type CacheStats struct {
+	// 条目数量
+	Entries int `json:"entries"`
+	// 条目中回复的总字节数
+	Bytes int `json:"bytes"`
+}
+
+// CacheEntry 是一条缓存的回复
+type CacheEntry struct {
+	Key  string
+	Data []byte
+	// 写入缓存的时间
+	Stored time.Time
+	// 缓存期限（秒）
+	TTL uint32
+}
+
+// Expired 判断条目在 now 时是否已过期
+func (e *CacheEntry) Expired(now time.Time) bool {
+	return now.Sub(e.Stored) >= time.Duration(e.TTL)*time.Second
+}
+
+// cacheEntryHeaderSize 是持久化条目头部的大小：写入时间（Unix 纳秒）及缓存期限
+const cacheEntryHeaderSize = 12
+
+// encodeCacheEntry 将条目的写入时间、缓存期限及回复编码为持久化格式，缓存键不被编码
+func encodeCacheEntry(e *CacheEntry) []byte {
+	buf := make([]byte, cacheEntryHeaderSize+len(e.Data))
+	binary.BigEndian.PutUint64(buf, uint64(e.Stored.UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:], e.TTL)
+	copy(buf[cacheEntryHeaderSize:], e.Data)
+	return buf
+}
+
+// decodeCacheEntry 解码 encodeCacheEntry 编码的条目
+func decodeCacheEntry(key string, buf []byte) (*CacheEntry, error) {
+	if len(buf) < cacheEntryHeaderSize {
+		return nil, fmt.Errorf("cache entry %s: size %d is less than %d", key, len(buf), cacheEntryHeaderSize)
+	}
+	return &CacheEntry{
+		Key:    key,
+		Data:   append([]byte{}, buf[cacheEntryHeaderSize:]...),
+		Stored: time.Unix(0, int64(binary.BigEndian.Uint64(buf))),
+		TTL:    binary.BigEndian.Uint32(buf[8:]),
+	}, nil
+}
+
+// MemoryCache 是一个有容量上限的内存 LRU 缓存
+type MemoryCache struct {
+	// 条目数上限，为 0 时不限制
+	MaxEntries int
+	// 字节数上限，为 0 时不限制
+	MaxBytes int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	bytes   int
+}
+
+// NewMemoryCache 创建一个内存 LRU 缓存
+// 其接受参数为：
+//   - maxEntries int，条目数上限，为 0 时不限制
+//   - maxBytes int，字节数上限，为 0 时不限制
+func NewMemoryCache(maxEntries, maxBytes int) *MemoryCache {
+	return &MemoryCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get 返回缓存条目，并将其标记为最近使用
+func (m *MemoryCache) Get(key string) (*CacheEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	m.lru.MoveToFront(elem)
+	return elem.Value.(*CacheEntry), nil
+}
+
+// Set 写入缓存条目，并淘汰超出容量上限的最久未使用的条目
+func (m *MemoryCache) Set(e *CacheEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[e.Key]; ok {
+		m.bytes -= len(elem.Value.(*CacheEntry).Data)
+		elem.Value = e
+		m.lru.MoveToFront(elem)
+	} else {
+		m.entries[e.Key] = m.lru.PushFront(e)
+	}
+	m.bytes += len(e.Data)
+
+	for (m.MaxEntries > 0 && m.lru.Len() > m.MaxEntries) || (m.MaxBytes > 0 && m.bytes > m.MaxBytes && m.lru.Len() > 1) {
+		m.removeElement(m.lru.Back())
+	}
+	return nil
+}
+
+// Delete 删除缓存条目
+func (m *MemoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.removeElement(elem)
+	}
+	return nil
+}
+
+// Purge 删除所有缓存条目
+func (m *MemoryCache) Purge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Init()
+	m.entries = make(map[string]*list.Element)
+	m.bytes = 0
+	return nil
+}
+
+// Stats 返回缓存的条目数及字节数
+func (m *MemoryCache) Stats() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return CacheStats{Entries: m.lru.Len(), Bytes: m.bytes}
+}
+
+// Range 遍历调用时缓存中的条目，从最近使用的条目开始
+func (m *MemoryCache) Range(fn func(*CacheEntry) bool) error {
+	m.mu.Lock()
+	entries := make([]*CacheEntry, 0, m.lru.Len())
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*CacheEntry))
+	}
+	m.mu.Unlock()
+	for _, e := range entries {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// removeElement 删除链表中的条目，需持有锁
+func (m *MemoryCache) removeElement(elem *list.Element) {
+	e := m.lru.Remove(elem).(*CacheEntry)
+	delete(m.entries, e.Key)
+	m.bytes -= len(e.Data)
+}
+
+// TieredCache 在持久化的后端之前叠加一层内存缓存。
+// 读取时先查询 Memory，未命中时查询 Persistent 并将条目载入 Memory；
+// 写入及删除同时作用于两层。
+type TieredCache struct {
+	Memory     *MemoryCache
+	Persistent Cache
+}
+
+// NewTieredCache 创建一个分层缓存
+// 其接受参数为：
+//   - memory *MemoryCache，内存层
+//   - persistent Cache，持久化层
+func NewTieredCache(memory *MemoryCache, persistent Cache) *TieredCache {
+	return &TieredCache{Memory: memory, Persistent: persistent}
+}
+
+// Get 依次在内存层及持久化层中查找条目
+func (t *TieredCache) Get(key string) (*CacheEntry, error) {
+	if e, err := t.Memory.Get(key); err == nil {
+		return e, nil
+	}
+	e, err := t.Persistent.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	t.Memory.Set(e)
+	return e, nil
+}
+
+// Set 将条目写入两层
+func (t *TieredCache) Set(e *CacheEntry) error {
+	t.Memory.Set(e)
+	return t.Persistent.Set(e)
+}
+
+// Delete 从两层中删除条目
+func (t *TieredCache) Delete(key string) error {
+	t.Memory.Delete(key)
+	return t.Persistent.Delete(key)
+}
+
+// Purge 清空两层
+func (t *TieredCache) Purge() error {
+	t.Memory.Purge()
+	return t.Persistent.Purge()
+}
+
+// Stats 返回持久化层的统计信息，持久化层保存了内存层中的所有条目
+func (t *TieredCache) Stats() CacheStats {
+	return t.Persistent.Stats()
+}
+
+// Range 遍历持久化层中的条目
+func (t *TieredCache) Range(fn func(*CacheEntry) bool) error {
+	return t.Persistent.Range(fn)
+}
+
+// closeCache 关闭实现了 io.Closer 的缓存
+func closeCache(c Cache) error {
+	if t, ok := c.(*TieredCache); ok {
+		return closeCache(t.Persistent)
+	}
+	if closer, ok := c.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cache_test.go 文件定义了对 cache.go、diskcache.go 及 filecache.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testCacheBackend 测试 Cache 实现的基本操作
+func testCacheBackend(t *testing.T, name string, c Cache) {
+	stored := time.Unix(1700000000, 0)
+	entries := []*CacheEntry{
+		{Key: "www.example.com-A-IN", Data: []byte{1, 2, 3}, Stored: stored, TTL: 300},
+		{Key: "www.example.com-A-IN-ecs198.51.100.0/24", Data: []byte{4, 5}, Stored: stored, TTL: 60},
+	}
+	for _, e := range entries {
+		if err := c.Set(e); err != nil {
+			t.Fatalf("%s Set failed: %v", name, err)
+		}
+	}
+	for _, e := range entries {
+		got, err := c.Get(e.Key)
+		if err != nil {
+			t.Fatalf("%s Get %s failed: %v", name, e.Key, err)
+		}
+		if !bytes.Equal(got.Data, e.Data) || !got.Stored.Equal(e.Stored) || got.TTL != e.TTL {
+			t.Errorf("%s Get got: %v, expected: %v", name, got, e)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 2 || stats.Bytes != 5 {
+		t.Errorf("%s Stats got: %+v, expected: {Entries:2 Bytes:5}", name, stats)
+	}
+
+	// 覆盖及删除
+	c.Set(&CacheEntry{Key: entries[0].Key, Data: []byte{9}, Stored: stored, TTL: 10})
+	if got, _ := c.Get(entries[0].Key); got == nil || !bytes.Equal(got.Data, []byte{9}) {
+		t.Errorf("%s overwritten entry got: %v, expected: [9]", name, got)
+	}
+	if err := c.Delete(entries[1].Key); err != nil {
+		t.Errorf("%s Delete failed: %v", name, err)
+	}
+	if _, err := c.Get(entries[1].Key); err != ErrCacheMiss {
+		t.Errorf("%s deleted entry got: %v, expected: %v", name, err, ErrCacheMiss)
+	}
+	if err := c.Delete("missing"); err != nil {
+		t.Errorf("%s Delete of a missing key got: %v, expected: nil", name, err)
+	}
+
+	if err := c.Purge(); err != nil {
+		t.Errorf("%s Purge failed: %v", name, err)
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("%s entries after Purge got: %d, expected: 0", name, stats.Entries)
+	}
+}
+
+// TestCacheBackends 测试各个 Cache 实现
+func TestCacheBackends(t *testing.T) {
+	disk, err := NewDiskCache(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatalf("NewDiskCache failed: %v", err)
+	}
+	file, err := OpenFileCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("OpenFileCache failed: %v", err)
+	}
+	defer file.Close()
+	diskTier, _ := NewDiskCache(t.TempDir())
+
+	testCacheBackend(t, "memory", NewMemoryCache(0, 0))
+	testCacheBackend(t, "disk", disk)
+	testCacheBackend(t, "file", file)
+	testCacheBackend(t, "tiered", NewTieredCache(NewMemoryCache(1, 0), diskTier))
+}
+
+// TestDiskCachePurge 测试 DiskCache 仅读取及删除目录中的缓存文件
+func TestDiskCachePurge(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatalf("NewDiskCache failed: %v", err)
+	}
+	others := []string{"notes.txt", "www.example.com-A-IN", "short.cache", "bad%zz.cache"}
+	for _, name := range others {
+		content := []byte("not a cache entry, just some text")
+		if name == "short.cache" {
+			content = content[:4]
+		}
+		os.WriteFile(filepath.Join(dir, name), content, 0644)
+	}
+	disk.Set(&CacheEntry{Key: "www.example.com-A-IN", Data: []byte{1, 2, 3}, Stored: time.Unix(1700000000, 0), TTL: 300})
+	// 转义后超出文件名长度限制的缓存键使用哈希文件名
+	longKey := strings.Repeat("a/", 100) + "example.com-A-IN"
+	if err := disk.Set(&CacheEntry{Key: longKey, Data: []byte{4, 5}, Stored: time.Unix(1700000000, 0), TTL: 300}); err != nil {
+		t.Fatalf("Set with long key failed: %v", err)
+	}
+	if e, err := disk.Get(longKey); err != nil || !bytes.Equal(e.Data, []byte{4, 5}) {
+		t.Errorf("Get with long key got: %v %v, expected: [4 5]", e, err)
+	}
+	keys := map[string]bool{}
+	disk.Range(func(e *CacheEntry) bool {
+		keys[e.Key] = true
+		return true
+	})
+	if len(keys) != 2 || !keys[longKey] {
+		t.Errorf("Range keys got: %v, expected: both keys", keys)
+	}
+
+	if stats := disk.Stats(); stats.Entries != 2 || stats.Bytes != 5 {
+		t.Errorf("Stats got: %+v, expected: {Entries:2 Bytes:5}", stats)
+	}
+	if err := disk.Purge(); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	for _, key := range []string{"www.example.com-A-IN", longKey} {
+		if _, err := disk.Get(key); err != ErrCacheMiss {
+			t.Errorf("purged entry got: %v, expected: %v", err, ErrCacheMiss)
+		}
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Purge removed %s: %v", name, err)
+		}
+	}
+}
+
+// TestFileCacheReopen 测试重新打开缓存文件、截去不完整的记录及压缩
+func TestFileCacheReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	f, err := OpenFileCache(path)
+	if err != nil {
+		t.Fatalf("OpenFileCache failed: %v", err)
+	}
+	stored := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ {
+		f.Set(&CacheEntry{Key: "a", Data: bytes.Repeat([]byte{byte(i)}, 100), Stored: stored, TTL: 300})
+	}
+	f.Set(&CacheEntry{Key: "b", Data: []byte{1}, Stored: stored, TTL: 300})
+	f.Delete("b")
+	f.Close()
+
+	// 模拟写入到一半时崩溃
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x00})
+	file.Close()
+
+	f, err = OpenFileCache(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer f.Close()
+	got, err := f.Get("a")
+	if err != nil || !bytes.Equal(got.Data, bytes.Repeat([]byte{9}, 100)) {
+		t.Errorf("reopened entry got: %v %v, expected: latest value", got, err)
+	}
+	if _, err := f.Get("b"); err != ErrCacheMiss {
+		t.Errorf("deleted entry got: %v, expected: %v", err, ErrCacheMiss)
+	}
+
+	before, _ := os.Stat(path)
+	if err := f.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("size after Compact got: %d, expected: less than %d", after.Size(), before.Size())
+	}
+	if got, err := f.Get("a"); err != nil || got.Data[0] != 9 {
+		t.Errorf("entry after Compact got: %v %v", got, err)
+	}
+	f.Set(&CacheEntry{Key: "c", Data: []byte{3}, Stored: stored, TTL: 300})
+	if stats := f.Stats(); stats.Entries != 2 {
+		t.Errorf("entries after Compact got: %d, expected: 2", stats.Entries)
+	}
+}
+
+// TestCacherBackend 测试 Cacher 使用指定的存储后端，重新打开后仍可命中缓存
+func TestCacherBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	file, err := OpenFileCache(path)
+	if err != nil {
+		t.Fatalf("OpenFileCache failed: %v", err)
+	}
+	cacher := NewCacher(CacherConfig{Cache: file, Logger: discardLogger()}, nil)
+	cacher.CacheResponse(testAnswerConn(1, "www.example.com", 300))
+	cacher.Close()
+
+	file, err = OpenFileCache(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	cacher = NewCacher(CacherConfig{Cache: file, Logger: discardLogger()}, nil)
+	defer cacher.Close()
+	if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(2, "www.example.com", dns.DNSRRTypeA, 0, false)}); err != nil {
+		t.Errorf("FetchCache from reopened file got: %v, expected: hit", err)
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cacheadmin.go 文件实现了缓存的管理功能：
+// 按照名称、后缀或类型列出及清除条目，将缓存导出为 JSON Lines 文件并恢复，
+// 以及在服务器开始处理查询之前，从区域文件或抓包文件中预先填充缓存。
+// CacheAdmin 将这些功能以 HTTP 接口的形式提供，cmd/godns-cache 提供了对应的命令行工具。
+
+package godns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// CacheFilter 按照回复的查询名称及类型选择缓存条目，各条件均为空时匹配所有条目
+type CacheFilter struct {
+	// 查询名称，不区分大小写
+	Name string
+	// 查询名称后缀，匹配该名称及其所有子域名，不区分大小写
+	Suffix string
+	// 查询类型，为 0 时匹配任意类型
+	Type dns.DNSType
+}
+
+// Match 判断条目是否满足过滤条件
+func (f CacheFilter) Match(e *CacheEntry) bool {
+	qname, qtype, ok := entryQuestion(e.Data)
+	if !ok {
+		return f.Name == "" && f.Suffix == "" && f.Type == 0
+	}
+	if f.Name != "" && !strings.EqualFold(strings.TrimSuffix(f.Name, "."), qname) {
+		return false
+	}
+	if f.Suffix != "" && !IsSubDomain(strings.TrimSuffix(f.Suffix, "."), qname) {
+		return false
+	}
+	return f.Type == 0 || f.Type == qtype
+}
+
+// entryQuestion 返回回复中第一个问题的查询名称及类型
+func entryQuestion(data []byte) (string, dns.DNSType, bool) {
+	if len(data) < 12 {
+		return "", 0, false
+	}
+	qname, offset, err := dns.DecodeDomainNameFromBuffer(data, 12)
+	if err != nil || len(data) < offset+4 {
+		return "", 0, false
+	}
+	return qname, dns.DNSType(binary.BigEndian.Uint16(data[offset:])), true
+}
+
+// CacheEntryInfo 是缓存条目的摘要
+type CacheEntryInfo struct {
+	Key   string `json:"key"`
+	QName string `json:"qname"`
+	QType string `json:"qtype"`
+	RCode string `json:"rcode"`
+	// 写入缓存的时间、缓存期限及剩余期限（秒）
+	Stored    time.Time `json:"stored"`
+	TTL       uint32    `json:"ttl"`
+	Remaining uint32    `json:"remaining"`
+}
+
+// CacheDumpEntry 是导出文件中的一行，包含条目的摘要及回复
+type CacheDumpEntry struct {
+	CacheEntryInfo
+	Data []byte `json:"data"`
+}
+
+// entryInfo 返回条目在 now 时的摘要
+func entryInfo(e *CacheEntry, now time.Time) CacheEntryInfo {
+	info := CacheEntryInfo{Key: e.Key, Stored: e.Stored, TTL: e.TTL}
+	if qname, qtype, ok := entryQuestion(e.Data); ok {
+		info.QName, info.QType = qname, metricQType(qtype)
+	}
+	if len(e.Data) >= 4 {
+		info.RCode = metricRCode(dns.DNSResponseCode(e.Data[3] & 0x0f))
+	}
+	if age := now.Sub(e.Stored); age < time.Duration(e.TTL)*time.Second {
+		info.Remaining = e.TTL - uint32(age/time.Second)
+	}
+	return info
+}
+
+// List 返回满足过滤条件的条目摘要，包括已过期但尚未删除的条目
+func (c *Cacher) List(filter CacheFilter) ([]CacheEntryInfo, error) {
+	now := c.now()
+	infos := []CacheEntryInfo{}
+	err := c.Cache.Range(func(e *CacheEntry) bool {
+		if filter.Match(e) {
+			infos = append(infos, entryInfo(e, now))
+		}
+		return true
+	})
+	return infos, err
+}
+
+// PurgeMatching 删除满足过滤条件的条目，返回删除的条目数量
+func (c *Cacher) PurgeMatching(filter CacheFilter) (int, error) {
+	if filter == (CacheFilter{}) {
+		n := c.Cache.Stats().Entries
+		if err := c.Cache.Purge(); err != nil {
+			return 0, err
+		}
+		c.CacherLogger.Info("Cache purged", "entries", n)
+		return n, nil
+	}
+
+	var keys []string
+	if err := c.Cache.Range(func(e *CacheEntry) bool {
+		if filter.Match(e) {
+			keys = append(keys, e.Key)
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := c.Cache.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	c.CacherLogger.Info("Cache entries purged", "name", filter.Name, "suffix", filter.Suffix, "type", filter.Type, "entries", len(keys))
+	return len(keys), nil
+}
+
+// Dump 将所有条目以 JSON Lines 格式写入 w，返回写入的条目数量
+func (c *Cacher) Dump(w io.Writer) (int, error) {
+	now := c.now()
+	enc := json.NewEncoder(w)
+	n := 0
+	var werr error
+	err := c.Cache.Range(func(e *CacheEntry) bool {
+		if werr = enc.Encode(CacheDumpEntry{CacheEntryInfo: entryInfo(e, now), Data: e.Data}); werr != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// Restore 从 Dump 导出的文件中恢复条目，保留条目原本的写入时间及缓存期限，返回恢复的条目数量
+func (c *Cacher) Restore(r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	n := 0
+	for {
+		d := CacheDumpEntry{}
+		err := dec.Decode(&d)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := c.Cache.Set(&CacheEntry{Key: d.Key, Data: d.Data, Stored: d.Stored, TTL: d.TTL}); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// SeedZone 以区域文件中的记录预先填充缓存，返回写入的条目数量
+// 其接受参数为：
+//   - r io.Reader，区域文件
+//   - origin string，区域文件的初始 $ORIGIN
+//
+// 每个 RRset 被写入为对其名称及类型的权威回复，RRSIG 记录不单独写入。
+// 若 RRset 有对应的 RRSIG 记录，还会写入一条 DO 位为 1 的查询所对应的、附带签名的回复。
+// 条目的缓存键按照一个不含 EDNS 的 UDP 查询（或 DO 位为 1 的查询）计算。
+func (c *Cacher) SeedZone(r io.Reader, origin string) (int, error) {
+	rrs, err := dns.ParseZone(r, origin)
+	if err != nil {
+		return 0, err
+	}
+
+	type setKey struct {
+		name  string
+		rtype dns.DNSType
+	}
+	var order []setKey
+	sets := make(map[setKey][]dns.DNSResourceRecord)
+	sigs := make(map[setKey][]dns.DNSResourceRecord)
+	for _, rr := range rrs {
+		if rrsig, ok := rr.RData.(*dns.DNSRDATARRSIG); ok {
+			k := setKey{strings.ToLower(rr.Name), rrsig.TypeCovered}
+			sigs[k] = append(sigs[k], rr)
+			continue
+		}
+		k := setKey{strings.ToLower(rr.Name), rr.Type}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	n := 0
+	for _, k := range order {
+		set := sets[k]
+		for _, do := range []bool{false, true} {
+			answer := set
+			if do {
+				if len(sigs[k]) == 0 {
+					continue
+				}
+				answer = append(append([]dns.DNSResourceRecord{}, set...), sigs[k]...)
+			}
+			qry, resp := seedMessages(set[0].Name, k.rtype, answer, do)
+			connInfo := ConnectionInfo{Protocol: ProtocolUDP, Packet: qry}
+			if _, ok := ResponseTTL(resp); !ok {
+				continue
+			}
+			if err := c.CacheResponse(connInfo, resp); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	c.CacherLogger.Info("Cache seeded from zone", "origin", origin, "entries", n)
+	return n, nil
+}
+
+// seedMessages 构造预填充所用的查询及权威回复
+func seedMessages(name string, rtype dns.DNSType, answer []dns.DNSResourceRecord, do bool) ([]byte, []byte) {
+	qry := dns.DNSMessage{
+		Header:   dns.DNSHeader{QDCount: 1},
+		Question: []dns.DNSQuestion{{Name: name, Type: rtype, Class: dns.DNSClassIN}},
+	}
+	if do {
+		qry.Additional = append(qry.Additional, *dns.NewDNSRROPT(1232, int(dns.SetDNSRROPTTTL(0, 0, true, 0)), &dns.DNSRDATAOPT{}))
+	}
+	FixCount(&qry)
+
+	resp := dns.DNSMessage{
+		Header:     dns.DNSHeader{QR: true, OpCode: dns.DNSOpCodeQuery, AA: true, QDCount: 1},
+		Question:   qry.Question,
+		Answer:     answer,
+		Additional: qry.Additional,
+	}
+	FixCount(&resp)
+	return qry.Encode(), resp.Encode()
+}
+
+// SeedPcap 以抓包文件中的回复预先填充缓存，返回写入的条目数量
+// 其接受参数为：
+//   - r io.Reader，pcap 或 pcapng 格式的抓包文件
+//
+// 抓包中的每个回复按照与其配对的查询计算缓存键，不可缓存的回复将被跳过。
+func (c *Cacher) SeedPcap(r io.Reader) (int, error) {
+	queries, err := ReadReplayQueries(r)
+	if err != nil && len(queries) == 0 {
+		return 0, err
+	}
+	n := 0
+	for _, q := range queries {
+		if q.Captured == nil {
+			continue
+		}
+		if _, ok := ResponseTTL(q.Captured); !ok {
+			continue
+		}
+		if err := c.CacheResponse(q.connInfo(), q.Captured); err != nil {
+			return n, err
+		}
+		n++
+	}
+	c.CacherLogger.Info("Cache seeded from capture", "entries", n)
+	return n, nil
+}
+
+// CacheAdminConfig 记录缓存管理接口的配置
+type CacheAdminConfig struct {
+	// 监听地址，为 nil 时仅监听 127.0.0.1；管理接口没有鉴权，对外提供时需自行限制访问
+	ListenIP net.IP
+	// 监听端口
+	Port int
+	// 接口路径前缀，默认为 "/cache"
+	Path string
+}
+
+// CacheAdmin 以 HTTP 接口的形式提供缓存管理功能。
+// 以默认的路径前缀 "/cache" 为例，其提供的接口为：
+//   - GET  /cache/stats，返回条目数量及字节数；
+//   - GET  /cache/entries?name=&suffix=&type=，列出满足条件的条目；
+//   - POST /cache/purge?name=&suffix=&type=，删除满足条件的条目，无条件时清空缓存；
+//   - GET  /cache/dump，以 JSON Lines 格式导出所有条目；
+//   - POST /cache/restore，恢复请求体中导出的条目；
+//   - POST /cache/seed?format=zone&origin=，以请求体中的区域文件预先填充缓存；
+//   - POST /cache/seed?format=pcap，以请求体中的抓包文件预先填充缓存。
+type CacheAdmin struct {
+	Cacher *Cacher
+	// 接口路径前缀
+	Path string
+
+	mu  sync.Mutex
+	srv *http.Server
+}
+
+// NewCacheAdmin 创建一个缓存管理接口
+// 其接受参数为：
+//   - c *Cacher，被管理的缓存器
+//   - path string，接口路径前缀，为空时使用 "/cache"
+func NewCacheAdmin(c *Cacher, path string) *CacheAdmin {
+	if path == "" {
+		path = "/cache"
+	}
+	return &CacheAdmin{Cacher: c, Path: strings.TrimSuffix(path, "/")}
+}
+
+// parseCacheFilter 从请求参数中解析过滤条件
+func parseCacheFilter(r *http.Request) (CacheFilter, error) {
+	q := r.URL.Query()
+	filter := CacheFilter{Name: q.Get("name"), Suffix: q.Get("suffix")}
+	if t := q.Get("type"); t != "" {
+		rtype, err := dns.ParseDNSType(t)
+		if err != nil {
+			return filter, err
+		}
+		filter.Type = rtype
+	}
+	return filter, nil
+}
+
+// ServeHTTP 处理缓存管理请求
+func (a *CacheAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action, ok := strings.CutPrefix(r.URL.Path, a.Path+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON := func(v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	method := map[string]string{
+		"stats": http.MethodGet, "entries": http.MethodGet, "dump": http.MethodGet,
+		"purge": http.MethodPost, "restore": http.MethodPost, "seed": http.MethodPost,
+	}[action]
+	if method == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var n int
+	var err error
+	switch action {
+	case "stats":
+		writeJSON(a.Cacher.Cache.Stats())
+		return
+	case "entries", "purge":
+		filter, ferr := parseCacheFilter(r)
+		if ferr != nil {
+			http.Error(w, ferr.Error(), http.StatusBadRequest)
+			return
+		}
+		if action == "entries" {
+			infos, err := a.Cacher.List(filter)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(infos)
+			return
+		}
+		n, err = a.Cacher.PurgeMatching(filter)
+	case "dump":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if _, err := a.Cacher.Dump(w); err != nil {
+			a.Cacher.CacherLogger.Error("Error dumping cache", "err", err)
+		}
+		return
+	case "restore":
+		n, err = a.Cacher.Restore(r.Body)
+	case "seed":
+		switch r.URL.Query().Get("format") {
+		case "zone", "":
+			n, err = a.Cacher.SeedZone(r.Body, r.URL.Query().Get("origin"))
+		case "pcap":
+			n, err = a.Cacher.SeedPcap(r.Body)
+		default:
+			http.Error(w, "format must be zone or pcap", http.StatusBadRequest)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v (%d entries processed)", err, n), http.StatusBadRequest)
+		return
+	}
+	writeJSON(map[string]int{"entries": n})
+}
+
+// ListenAndServe 在配置的地址及端口上启动缓存管理 HTTP 监听器，直至 Shutdown 被调用。
+// 接口路径前缀由 NewCacheAdmin 指定，conf.Path 将被忽略。
+func (a *CacheAdmin) ListenAndServe(conf CacheAdminConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle(a.Path+"/", a)
+	if conf.ListenIP == nil {
+		conf.ListenIP = net.IPv4(127, 0, 0, 1)
+	}
+	srv := &http.Server{Addr: listenAddr(conf.ListenIP, conf.Port), Handler: mux}
+
+	a.mu.Lock()
+	a.srv = srv
+	a.mu.Unlock()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown 关闭缓存管理 HTTP 监听器
+func (a *CacheAdmin) Shutdown() error {
+	a.mu.Lock()
+	srv := a.srv
+	a.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
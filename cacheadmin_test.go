@@ -0,0 +1,163 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cacheadmin_test.go 文件定义了对 cacheadmin.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testSeedZone 是用于预先填充缓存的区域文件
+const testSeedZone = `$ORIGIN example.com.
+$TTL 300
+@	SOA	ns admin 1 7200 3600 604800 60
+	NS	ns
+ns	A	192.0.2.53
+www	A	192.0.2.1
+	RRSIG	A 8 3 300 20300101000000 20240101000000 12345 example.com. AAAA
+	TXT	"hello"
+mail.other.org.	A	192.0.2.25
+`
+
+// TestCacherSeedZone 测试从区域文件预先填充缓存，及按照条件列出、删除条目
+func TestCacherSeedZone(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	n, err := cacher.SeedZone(strings.NewReader(testSeedZone), "")
+	if err != nil {
+		t.Fatalf("SeedZone failed: %v", err)
+	}
+	// SOA、NS、ns A、www A（含签名及不含签名）、www TXT、mail A
+	if n != 7 {
+		t.Errorf("seeded entries got: %d, expected: 7", n)
+	}
+
+	// 不含 EDNS 的查询命中不含签名的回复，DO 位为 1 的查询命中附带签名的回复
+	for _, c := range []struct {
+		packet  []byte
+		answers int
+	}{
+		{testQuery(7, "WWW.example.com", dns.DNSRRTypeA, 0, false), 1},
+		{testQuery(7, "www.example.com", dns.DNSRRTypeA, 4096, true), 2},
+	} {
+		cache, err := cacher.FetchCache(ConnectionInfo{Packet: c.packet})
+		if err != nil {
+			t.Fatalf("FetchCache of seeded entry failed: %v", err)
+		}
+		msg := dns.DNSMessage{}
+		msg.DecodeFromBuffer(cache, 0)
+		if len(msg.Answer) != c.answers || !msg.Header.AA {
+			t.Errorf("seeded answers got: %d, expected: %d", len(msg.Answer), c.answers)
+		}
+	}
+
+	infos, _ := cacher.List(CacheFilter{Suffix: "example.com", Type: dns.DNSRRTypeA})
+	if len(infos) != 3 {
+		t.Errorf("listed A entries got: %d, expected: 3", len(infos))
+	}
+	if infos, _ := cacher.List(CacheFilter{Name: "mail.other.org."}); len(infos) != 1 || infos[0].QType != "A" || infos[0].Remaining != 300 {
+		t.Errorf("listed entry got: %+v", infos)
+	}
+
+	if n, _ := cacher.PurgeMatching(CacheFilter{Suffix: "www.example.com"}); n != 3 {
+		t.Errorf("purged entries got: %d, expected: 3", n)
+	}
+	if n, _ := cacher.PurgeMatching(CacheFilter{}); n != 4 {
+		t.Errorf("purged remaining entries got: %d, expected: 4", n)
+	}
+}
+
+// TestCacherDumpRestore 测试导出及恢复缓存
+func TestCacherDumpRestore(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	cacher.SeedZone(strings.NewReader(testSeedZone), "")
+	buf := bytes.Buffer{}
+	n, err := cacher.Dump(&buf)
+	if err != nil || n != 7 || strings.Count(buf.String(), "\n") != 7 {
+		t.Fatalf("Dump got: %d %v, expected: 7 lines", n, err)
+	}
+
+	restored := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	if n, err := restored.Restore(&buf); err != nil || n != 7 {
+		t.Fatalf("Restore got: %d %v, expected: 7", n, err)
+	}
+	if _, err := restored.FetchCache(ConnectionInfo{Packet: testQuery(1, "ns.example.com", dns.DNSRRTypeA, 0, false)}); err != nil {
+		t.Errorf("FetchCache of restored entry got: %v, expected: hit", err)
+	}
+}
+
+// TestCacherSeedPcap 测试从抓包文件预先填充缓存
+func TestCacherSeedPcap(t *testing.T) {
+	responser := &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}
+	file, err := os.Open(writeTestCapture(t, PcapFormatPcapng, responser))
+	if err != nil {
+		t.Fatalf("error opening capture: %v", err)
+	}
+	defer file.Close()
+
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	if n, err := cacher.SeedPcap(file); err != nil || n != 2 {
+		t.Fatalf("SeedPcap got: %d %v, expected: 2", n, err)
+	}
+	if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(9, "tcp.example.com", dns.DNSRRTypeA, 0, false)}); err != nil {
+		t.Errorf("FetchCache of captured response got: %v, expected: hit", err)
+	}
+}
+
+// TestCacheAdmin 测试缓存管理 HTTP 接口
+func TestCacheAdmin(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	srv := httptest.NewServer(NewCacheAdmin(cacher, ""))
+	defer srv.Close()
+
+	post := func(path, body string) map[string]int {
+		resp, err := srv.Client().Post(srv.URL+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("POST %s status got: %d, expected: 200", path, resp.StatusCode)
+		}
+		result := map[string]int{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+	if got := post("/cache/seed?format=zone", testSeedZone); got["entries"] != 7 {
+		t.Errorf("seed got: %v, expected: 7 entries", got)
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/cache/entries?suffix=example.com&type=TXT")
+	if err != nil {
+		t.Fatalf("GET entries failed: %v", err)
+	}
+	infos := []CacheEntryInfo{}
+	json.NewDecoder(resp.Body).Decode(&infos)
+	resp.Body.Close()
+	if len(infos) != 1 || infos[0].QName != "www.example.com" {
+		t.Errorf("entries got: %+v, expected: the TXT entry", infos)
+	}
+
+	if got := post("/cache/purge?type=A", ""); got["entries"] != 4 {
+		t.Errorf("purge got: %v, expected: 4 entries", got)
+	}
+	if stats := cacher.Cache.Stats(); stats.Entries != 3 {
+		t.Errorf("entries after purge got: %d, expected: 3", stats.Entries)
+	}
+
+	// 错误的方法及参数
+	if resp, _ := srv.Client().Get(srv.URL + "/cache/purge"); resp.StatusCode != 405 {
+		t.Errorf("GET purge status got: %d, expected: 405", resp.StatusCode)
+	}
+	if resp, _ := srv.Client().Get(srv.URL + "/cache/entries?type=BOGUS"); resp.StatusCode != 400 {
+		t.Errorf("bad type status got: %d, expected: 400", resp.StatusCode)
+	}
+}
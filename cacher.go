@@ -1,128 +1,359 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cacher.go 文件定义了 GoDNS 的回复缓存。
+// Cacher 将回复保存在有容量上限的内存 LRU 缓存中，缓存期限取自回复中最小的 TTL，
+// 否定回复（NXDOMAIN 与 NODATA）的缓存期限取自 SOA 记录，详见 RFC 2308 第 5 节；
+// 命中缓存时，回复中的 TTL 会减去已缓存的时间，ID 及问题部分会按照查询重新编码。
+// 缓存键由查询名称（不区分大小写）、类型及类别组成，并可以通过 CacheKeyConfig
+// 区分 DO、CD 位、EDNS 负载大小、ECS 选项、视图及传输协议。
+// 条目保存在可替换的存储后端 Cache 中，默认为内存 LRU 缓存；
+// 配置 CacheLocation 后，回复还会被写入磁盘，作为可选的持久化层。
+// 启用 ServeStaleConfig 后，过期的条目会被保留，并在后端失败时作为过期回复返回，详见 servestale.go。
+
 package godns
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/panjf2000/ants/v2"
 	"github.com/tochusc/godns/dns"
 )
 
+// ErrCacheMiss 表示缓存中没有可用的回复
+var ErrCacheMiss = errors.New("cache miss")
+
+// 缓存的默认配置
+const (
+	DefaultCacheMaxEntries = 10000
+	DefaultCacheMaxTTL     = 86400
+)
+
 type Cacher struct {
-	CacheLocation string
-	CacherLogger  *log.Logger
-	CacherPool    *ants.Pool
+	// 存储后端
+	Cache        Cache
+	CacherLogger *slog.Logger
+	CacherPool   *ants.Pool
+
+	// 缓存期限的上限（秒）
+	MaxTTL uint32
+	// 缓存键的组成
+	Key CacheKeyConfig
+	// 过期缓存回复的配置，为 nil 时不返回过期回复
+	Stale *ServeStaleConfig
+
+	// now 返回当前时间，便于测试时替换
+	now func() time.Time
 }
 
 type CacherConfig struct {
+	// 存储后端，为 nil 时使用内存 LRU 缓存，并在 CacheLocation 不为空时叠加磁盘持久化层
+	Cache Cache
+	// 持久化层所在的目录，为空时仅使用内存缓存
 	CacheLocation string
 	LogWriter     io.Writer
+	// 日志，为 nil 时向 LogWriter 输出文本日志
+	Logger *slog.Logger
+
+	// 内存缓存的条目数上限，默认为 DefaultCacheMaxEntries
+	MaxEntries int
+	// 内存缓存的字节数上限，为 0 时不限制
+	MaxBytes int
+	// 缓存期限的上限（秒），默认为 DefaultCacheMaxTTL
+	MaxTTL uint32
+	// 缓存键的组成，为 nil 时使用 DefaultCacheKeyConfig
+	Key *CacheKeyConfig
+	// 过期缓存回复的配置，为 nil 时不保留过期条目
+	Stale *ServeStaleConfig
 }
 
+// CacheKeyConfig 指定缓存键除查询名称、类型及类别外还需区分的查询属性
+type CacheKeyConfig struct {
+	// 区分查询 OPT 记录中的 DO 位，以免向请求 DNSSEC 记录的查询返回不含签名的回复
+	DO bool
+	// 区分查询头部的 CD 位
+	CD bool
+	// 区分查询是否含有 OPT 记录，及其中的 UDP 负载大小
+	BufferSize bool
+	// 区分查询中的 ECS 选项
+	ClientSubnet bool
+	// 区分查询的传输协议
+	Transport bool
+	// 不为 nil 时，区分该视图回复器为查询选中的视图
+	Views *ViewResponser
+}
+
+// DefaultCacheKeyConfig 是默认的缓存键组成，区分 DO 及 CD 位
+var DefaultCacheKeyConfig = CacheKeyConfig{DO: true, CD: true}
+
 func NewCacher(conf CacherConfig, pool *ants.Pool) *Cacher {
-	cacherLogger := log.New(conf.LogWriter, "Cacher: ", log.LstdFlags)
+	cacherLogger := conf.Logger
+	if cacherLogger == nil {
+		cacherLogger = newWriterLogger(conf.LogWriter, LogComponentCacher)
+	}
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = DefaultCacheMaxEntries
+	}
+	if conf.MaxTTL == 0 {
+		conf.MaxTTL = DefaultCacheMaxTTL
+	}
+	key := DefaultCacheKeyConfig
+	if conf.Key != nil {
+		key = *conf.Key
+	}
+	var stale *ServeStaleConfig
+	if conf.Stale != nil {
+		s := conf.Stale.withDefaults()
+		stale = &s
+	}
+
+	cache := conf.Cache
+	if cache == nil {
+		memory := NewMemoryCache(conf.MaxEntries, conf.MaxBytes)
+		cache = memory
+		if conf.CacheLocation != "" {
+			disk, err := NewDiskCache(conf.CacheLocation)
+			if err != nil {
+				cacherLogger.Error("Error creating cache directory", "path", conf.CacheLocation, "err", err)
+			} else {
+				cache = NewTieredCache(memory, disk)
+			}
+		}
+	}
 
 	return &Cacher{
-		CacheLocation: conf.CacheLocation,
-		CacherLogger:  cacherLogger,
-		CacherPool:    pool,
+		Cache:        cache,
+		CacherLogger: cacherLogger,
+		CacherPool:   pool,
+		MaxTTL:       conf.MaxTTL,
+		Key:          key,
+		Stale:        stale,
+		now:          time.Now,
 	}
 }
 
-func (c *Cacher) CacheResponse(data []byte) error {
-	ident, err := IdentifyMessage(data)
-	if err != nil {
-		c.CacherLogger.Printf("Error identifying response: %v", err)
-		return err
+// ResponseTTL 计算回复可被缓存的期限
+// 其接受参数为：
+//   - data []byte，DNS 回复
+//
+// 返回值为：
+//   - uint32，缓存期限（秒）
+//   - bool，回复是否可以被缓存
+//
+// 含有回答的 NOERROR 回复的缓存期限为所有记录（OPT 除外）中最小的 TTL；
+// NXDOMAIN 及 NODATA 回复的缓存期限为权威部分 SOA 记录的 TTL 与其 MINIMUM 字段中的较小者，
+// 不含 SOA 记录的否定回复不被缓存。被截断的回复及其他回复码的回复不被缓存。
+func ResponseTTL(data []byte) (uint32, bool) {
+	if len(data) < 12 || data[2]&0x80 == 0 || data[2]&0x02 != 0 {
+		return 0, false
+	}
+	rrs, ok := wireRRs(data)
+	if !ok {
+		return 0, false
 	}
 
-	path := filepath.Join(c.CacheLocation, ident)
+	rcode := dns.DNSResponseCode(data[3] & 0x0f)
+	answers := binary.BigEndian.Uint16(data[6:])
+	negative := rcode == dns.DNSResponseCodeNXDomain || (rcode == dns.DNSResponseCodeNoErr && answers == 0)
+	if rcode != dns.DNSResponseCodeNoErr && rcode != dns.DNSResponseCodeNXDomain {
+		return 0, false
+	}
 
-	// 将响应缓存到磁盘
+	if negative {
+		for _, rr := range rrs {
+			if rr.section != wireSectionAuthority || rr.rrType != dns.DNSRRTypeSOA || rr.rdata[1]-rr.rdata[0] < 20 {
+				continue
+			}
+			ttl := binary.BigEndian.Uint32(data[rr.ttl:])
+			minimum := binary.BigEndian.Uint32(data[rr.rdata[1]-4:])
+			return min(ttl, minimum), min(ttl, minimum) > 0
+		}
+		return 0, false
+	}
 
-	// 如果缓存目录不存在，创建目录
-	if _, err := os.Stat(c.CacheLocation); os.IsNotExist(err) {
-		err := os.MkdirAll(c.CacheLocation, 0755)
+	var ttl uint32
+	found := false
+	for _, rr := range rrs {
+		if rr.rrType == dns.DNSRRTypeOPT {
+			continue
+		}
+		t := binary.BigEndian.Uint32(data[rr.ttl:])
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	return ttl, found && ttl > 0
+}
+
+// CacheKey 返回查询的缓存键
+// 其接受参数为：
+//   - connInfo ConnectionInfo，查询的链接信息
+//   - qry dns.DNSMessage，解析后的查询
+func (c *Cacher) CacheKey(connInfo ConnectionInfo, qry dns.DNSMessage) (string, error) {
+	if len(qry.Question) == 0 {
+		return "", fmt.Errorf("query has no question")
+	}
+	q := qry.Question[0]
+	key := strings.Builder{}
+	fmt.Fprintf(&key, "%s-%s-%s", strings.ToLower(q.Name), q.Type.String(), q.Class.String())
+
+	var opt *dns.DNSResourceRecord
+	for i := range qry.Additional {
+		if qry.Additional[i].Type == dns.DNSRRTypeOPT {
+			opt = &qry.Additional[i]
+		}
+	}
+	if c.Key.DO && opt != nil && opt.TTL&0x8000 != 0 {
+		key.WriteString("-do")
+	}
+	if c.Key.CD && qry.Header.Z&0x01 != 0 {
+		key.WriteString("-cd")
+	}
+	if c.Key.BufferSize {
+		if opt == nil {
+			key.WriteString("-noedns")
+		} else {
+			key.WriteString("-bufsize" + strconv.Itoa(int(opt.Class)))
+		}
+	}
+	if c.Key.ClientSubnet {
+		if subnet, ok := ClientSubnet(qry); ok {
+			key.WriteString("-ecs" + subnet.String())
+		}
+	}
+	if c.Key.Transport {
+		key.WriteString("-" + string(connInfo.Protocol))
+	}
+	if c.Key.Views != nil {
+		view, err := c.Key.Views.Select(connInfo)
 		if err != nil {
-			c.CacherLogger.Printf("Error creating cache directory %s: %v", c.CacheLocation, err)
-			return err
+			return "", err
+		}
+		if view != nil {
+			key.WriteString("-view" + view.Name)
 		}
 	}
+	return key.String(), nil
+}
 
-	// 创建缓存文件
-	file, err := os.Create(path)
+// CacheResponse 将回复写入缓存，不可缓存的回复将被忽略
+// 其接受参数为：
+//   - connInfo ConnectionInfo，回复所对应查询的链接信息，用于计算缓存键
+//   - data []byte，DNS 回复
+func (c *Cacher) CacheResponse(connInfo ConnectionInfo, data []byte) error {
+	qry, err := ParseQuery(connInfo)
 	if err != nil {
-		c.CacherLogger.Printf("Error creating cache file %s: %v", ident, err)
+		c.CacherLogger.Error("Error identifying query", "err", err)
 		return err
 	}
-
-	_, err = file.Write(data)
+	ident, err := c.CacheKey(connInfo, qry)
 	if err != nil {
-		c.CacherLogger.Printf("Error writing cache file %s: %v", ident, err)
+		c.CacherLogger.Error("Error identifying query", "err", err)
 		return err
 	}
 
-	file.Close()
-	c.CacherLogger.Printf("Cache saved %s\n", ident)
-
+	ttl, ok := ResponseTTL(data)
+	if !ok {
+		c.CacherLogger.Debug("Response not cacheable", "key", ident)
+		return nil
+	}
+	entry := &CacheEntry{
+		Key:    ident,
+		Data:   append([]byte{}, data...),
+		Stored: c.now(),
+		TTL:    min(ttl, c.MaxTTL),
+	}
+	if err := c.Cache.Set(entry); err != nil {
+		c.CacherLogger.Error("Error saving cache", "key", ident, "err", err)
+		return err
+	}
+	c.CacherLogger.Debug("Cache saved", "key", ident, "ttl", entry.TTL)
 	return nil
 }
 
-func (c *Cacher) FetchCache(connInfo ConnectionInfo) ([]byte, error) {
-
-	ident, err := IdentifyMessage(connInfo.Packet)
+// lookup 在存储后端中查找未过期的条目，超出过期缓存保留期限的条目将被删除
+func (c *Cacher) lookup(key string, now time.Time) (*CacheEntry, bool) {
+	entry, err := c.Cache.Get(key)
 	if err != nil {
-		c.CacherLogger.Printf("Error identifying response: %v", err)
-		return []byte{}, err
+		if err != ErrCacheMiss {
+			c.CacherLogger.Error("Error reading cache", "key", key, "err", err)
+		}
+		return nil, false
+	}
+	if entry.Expired(now) {
+		if c.staleExpired(entry, now) {
+			c.Cache.Delete(key)
+		}
+		return nil, false
 	}
+	return entry, true
+}
 
-	path := filepath.Join(c.CacheLocation, ident)
+// Close 关闭存储后端
+func (c *Cacher) Close() error {
+	return closeCache(c.Cache)
+}
 
-	file, err := os.Open(path)
+// FetchCache 返回该查询的缓存回复
+// 回复的 TTL 已减去缓存时间，ID、RD 位及问题部分（包括查询名称的大小写）与查询一致。
+func (c *Cacher) FetchCache(connInfo ConnectionInfo) ([]byte, error) {
+	qry, err := ParseQuery(connInfo)
 	if err != nil {
-		c.CacherLogger.Printf("Cache miss %s\n", ident)
+		c.CacherLogger.Error("Error identifying query", "err", err)
 		return []byte{}, err
 	}
-	defer file.Close()
-
-	cache := make([]byte, 65535)
-	rd, err := file.Read(cache)
+	ident, err := c.CacheKey(connInfo, qry)
 	if err != nil {
-		c.CacherLogger.Printf("Error reading cache file %s: %v", ident, err)
+		c.CacherLogger.Error("Error identifying query", "err", err)
 		return []byte{}, err
 	}
 
-	c.CacherLogger.Printf("Cache hit %s\n", ident)
-
-	// 修改Cache内容
-	cache[0] = connInfo.Packet[0]
-	cache[1] = connInfo.Packet[1]
-	for i := 0; ; i++ {
-		cache[12+i] = connInfo.Packet[12+i]
+	now := c.now()
+	entry, ok := c.lookup(ident, now)
+	if !ok {
+		c.CacherLogger.Debug("Cache miss", "key", ident)
+		return []byte{}, ErrCacheMiss
+	}
+	c.CacherLogger.Debug("Cache hit", "key", ident)
 
-		if cache[12+i] > dns.NamePointerFlag {
-			cache[13+i] = connInfo.Packet[13+i]
-			break
-		}
-		if cache[12+i] == 0x00 {
-			break
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(entry.Data, 0); err != nil {
+		c.CacherLogger.Error("Error decoding cached response", "key", ident, "err", err)
+		c.Cache.Delete(ident)
+		return []byte{}, err
+	}
+	age := uint32(now.Sub(entry.Stored) / time.Second)
+	for _, rrs := range [][]dns.DNSResourceRecord{resp.Answer, resp.Authority, resp.Additional} {
+		for i := range rrs {
+			if rrs[i].Type != dns.DNSRRTypeOPT {
+				rrs[i].TTL -= min(rrs[i].TTL, age)
+			}
 		}
 	}
-
-	return cache[:rd], nil
+	resp.Header.ID = qry.Header.ID
+	resp.Header.RD = qry.Header.RD
+	resp.Question = qry.Question
+	resp.Header.QDCount = uint16(len(qry.Question))
+	return resp.Encode(), nil
 }
 
+// IdentifyMessage 返回消息中第一个问题的标识，由查询名称（小写）、类型及类别组成
 func IdentifyMessage(data []byte) (string, error) {
 	// 解析 DNS 请求
 	qName, offset, err := dns.DecodeDomainNameFromBuffer(data, 12)
 	if err != nil {
 		return "", err
 	}
+	if len(data) < offset+4 {
+		return "", fmt.Errorf("truncated question section")
+	}
 	qType := dns.DNSType(binary.BigEndian.Uint16(data[offset : offset+2]))
 	qClass := dns.DNSClass(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
-	return fmt.Sprintf("%s-%s-%s", qName, qType.String(), qClass.String()), nil
+	return fmt.Sprintf("%s-%s-%s", strings.ToLower(qName), qType.String(), qClass.String()), nil
 }
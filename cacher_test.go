@@ -0,0 +1,195 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// cacher_test.go 文件定义了对 cacher.go 的单元测试
+
+package godns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testAnswer 返回一个对 name 的 A 记录回复，回答的 TTL 分别为 ttls
+func testAnswer(id uint16, name string, ttls ...uint32) []byte {
+	qry := dns.DNSMessage{}
+	qry.DecodeFromBuffer(testQuery(id, name, dns.DNSRRTypeA, 0, false), 0)
+	resp := InitNXDOMAIN(qry)
+	resp.Header.RCode = dns.DNSResponseCodeNoErr
+	for i, ttl := range ttls {
+		resp.Answer = append(resp.Answer, dns.DNSResourceRecord{
+			Name: name, Type: dns.DNSRRTypeA, Class: dns.DNSClassIN, TTL: ttl,
+			RData: &dns.DNSRDATAA{Address: net.IPv4(10, 0, 0, byte(i+1))},
+		})
+	}
+	FixCount(&resp)
+	return resp.Encode()
+}
+
+// testAnswerConn 返回 testAnswer 的回复及其对应查询的链接信息
+func testAnswerConn(id uint16, name string, ttls ...uint32) (ConnectionInfo, []byte) {
+	return ConnectionInfo{Packet: testQuery(id, name, dns.DNSRRTypeA, 0, false)}, testAnswer(id, name, ttls...)
+}
+
+// TestResponseTTL 测试肯定及否定回复的缓存期限
+func TestResponseTTL(t *testing.T) {
+	qry := dns.DNSMessage{}
+	qry.DecodeFromBuffer(testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false), 0)
+	nx := testNXDOMAIN(qry)
+	servfail := testNXDOMAIN(qry)
+	servfail.Header.RCode = dns.DNSResponseCodeServFail
+	noSOA := InitNXDOMAIN(qry)
+	FixCount(&noSOA)
+	truncated := testAnswer(1, "www.example.com", 300)
+	truncated[2] |= 0x02
+
+	cases := []struct {
+		name      string
+		data      []byte
+		ttl       uint32
+		cacheable bool
+	}{
+		{"positive", testAnswer(1, "www.example.com", 300, 60, 120), 60, true},
+		{"negative", nx.Encode(), 300, true},
+		{"negative without SOA", noSOA.Encode(), 0, false},
+		{"servfail", servfail.Encode(), 0, false},
+		{"truncated", truncated, 0, false},
+		{"zero ttl", testAnswer(1, "www.example.com", 0), 0, false},
+		{"query", testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false), 0, false},
+	}
+	for _, c := range cases {
+		ttl, ok := ResponseTTL(c.data)
+		if ttl != c.ttl || ok != c.cacheable {
+			t.Errorf("%s got: %d %v, expected: %d %v", c.name, ttl, ok, c.ttl, c.cacheable)
+		}
+	}
+}
+
+// TestCacherTTL 测试命中缓存时 TTL 的递减及过期
+func TestCacherTTL(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	now := time.Unix(1700000000, 0)
+	cacher.now = func() time.Time { return now }
+
+	if err := cacher.CacheResponse(testAnswerConn(1, "www.example.com", 300, 60)); err != nil {
+		t.Fatalf("CacheResponse failed: %v", err)
+	}
+	now = now.Add(25 * time.Second)
+	cache, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(0x4242, "www.example.com", dns.DNSRRTypeA, 0, false)})
+	if err != nil {
+		t.Fatalf("FetchCache failed: %v", err)
+	}
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(cache, 0); err != nil {
+		t.Fatalf("error decoding cache: %v", err)
+	}
+	if msg.Header.ID != 0x4242 {
+		t.Errorf("ID got: %#x, expected: 0x4242", msg.Header.ID)
+	}
+	if msg.Answer[0].TTL != 275 || msg.Answer[1].TTL != 35 {
+		t.Errorf("TTL got: %d %d, expected: 275 35", msg.Answer[0].TTL, msg.Answer[1].TTL)
+	}
+
+	// 缓存期限为最小的 TTL
+	now = now.Add(35 * time.Second)
+	if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false)}); err != ErrCacheMiss {
+		t.Errorf("expired entry got: %v, expected: %v", err, ErrCacheMiss)
+	}
+	if n := cacher.Cache.Stats().Entries; n != 0 {
+		t.Errorf("entries after expiry got: %d, expected: 0", n)
+	}
+}
+
+// TestCacherLRU 测试超出条目数及字节数上限时淘汰最久未使用的条目
+func TestCacherLRU(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger(), MaxEntries: 2}, nil)
+	fetch := func(name string) bool {
+		_, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(1, name, dns.DNSRRTypeA, 0, false)})
+		return err == nil
+	}
+	cacher.CacheResponse(testAnswerConn(1, "a.example.com", 300))
+	cacher.CacheResponse(testAnswerConn(1, "b.example.com", 300))
+	fetch("a.example.com")
+	cacher.CacheResponse(testAnswerConn(1, "c.example.com", 300))
+	if !fetch("a.example.com") || fetch("b.example.com") || !fetch("c.example.com") {
+		t.Errorf("LRU eviction got: a=%v b=%v c=%v, expected: true false true",
+			fetch("a.example.com"), fetch("b.example.com"), fetch("c.example.com"))
+	}
+
+	data := testAnswer(1, "a.example.com", 300)
+	cacher = NewCacher(CacherConfig{Logger: discardLogger(), MaxBytes: 2*len(data) + 1}, nil)
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		cacher.CacheResponse(testAnswerConn(1, name, 300))
+	}
+	if n := cacher.Cache.Stats().Entries; n != 2 || fetch("a.example.com") {
+		t.Errorf("entries under byte limit got: %d, expected: 2", n)
+	}
+}
+
+// TestCacherPersistent 测试从持久化层读取缓存，并保留写入缓存的时间
+func TestCacherPersistent(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	cacher := NewCacher(CacherConfig{CacheLocation: dir, Logger: discardLogger()}, nil)
+	cacher.now = func() time.Time { return now.Add(-100 * time.Second) }
+	if err := cacher.CacheResponse(testAnswerConn(1, "www.example.com", 300)); err != nil {
+		t.Fatalf("CacheResponse failed: %v", err)
+	}
+
+	restarted := NewCacher(CacherConfig{CacheLocation: dir, Logger: discardLogger()}, nil)
+	restarted.now = func() time.Time { return now }
+	cache, err := restarted.FetchCache(ConnectionInfo{Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false)})
+	if err != nil {
+		t.Fatalf("FetchCache from disk failed: %v", err)
+	}
+	rrs, _ := wireRRs(cache)
+	if ttl := binary.BigEndian.Uint32(cache[rrs[0].ttl:]); ttl != 200 {
+		t.Errorf("TTL got: %d, expected: 200", ttl)
+	}
+	if n := restarted.Cache.(*TieredCache).Memory.Stats().Entries; n != 1 {
+		t.Errorf("entries loaded into memory got: %d, expected: 1", n)
+	}
+}
+
+// TestCacheKey 测试缓存键的组成，及按照查询重建缓存回复的 ID 与问题部分
+func TestCacheKey(t *testing.T) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger()}, nil)
+	resp := testAnswer(1, "www.example.com", 300)
+	cacher.CacheResponse(ConnectionInfo{Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 1232, false)}, resp)
+
+	// DO 位不同的查询不能命中缓存
+	if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(2, "www.example.com", dns.DNSRRTypeA, 1232, true)}); err != ErrCacheMiss {
+		t.Errorf("DO=1 query got: %v, expected: %v", err, ErrCacheMiss)
+	}
+	// 查询名称的大小写不同时仍命中缓存，回复的问题部分与查询一致
+	cache, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(0x5151, "wWw.ExAmple.COM", dns.DNSRRTypeA, 4096, false)})
+	if err != nil {
+		t.Fatalf("0x20 query got: %v, expected: hit", err)
+	}
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(cache, 0); err != nil {
+		t.Fatalf("error decoding cache: %v", err)
+	}
+	if msg.Header.ID != 0x5151 || msg.Question[0].Name != "wWw.ExAmple.COM" || len(msg.Answer) != 1 {
+		t.Errorf("rebuilt response got: %#x %s %d, expected: 0x5151 wWw.ExAmple.COM 1",
+			msg.Header.ID, msg.Question[0].Name, len(msg.Answer))
+	}
+
+	cacher = NewCacher(CacherConfig{Logger: discardLogger(), Key: &CacheKeyConfig{BufferSize: true, Transport: true}}, nil)
+	cases := []struct {
+		connInfo ConnectionInfo
+		key      string
+	}{
+		{ConnectionInfo{Protocol: ProtocolUDP, Packet: testQuery(1, "WWW.example.com", dns.DNSRRTypeA, 0, false)}, "www.example.com-A-IN-noedns-udp"},
+		{ConnectionInfo{Protocol: ProtocolTCP, Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 1232, true)}, "www.example.com-A-IN-bufsize1232-tcp"},
+	}
+	for _, c := range cases {
+		qry, _ := ParseQuery(c.connInfo)
+		if key, _ := cacher.CacheKey(c.connInfo, qry); key != c.key {
+			t.Errorf("CacheKey got: %s, expected: %s", key, c.key)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// godns-cache 是 GoDNS 缓存的命令行管理工具。
+// 它既可以直接操作磁盘缓存目录（-dir）或单文件缓存（-file），用于在服务器启动前预先填充缓存，
+// 也可以通过 -server 指定正在运行的服务器的缓存管理接口地址，在实验过程中查看及清除缓存。
+//
+// 用法：
+//
+//	godns-cache [-dir DIR | -file FILE | -server URL] 命令 [参数]
+//
+// 命令：
+//
+//	stats                                  输出条目数量及字节数
+//	list  [-name N] [-suffix S] [-type T]  列出满足条件的条目
+//	purge [-name N] [-suffix S] [-type T]  删除满足条件的条目，无条件时清空缓存
+//	dump  [-o FILE]                        以 JSON Lines 格式导出所有条目
+//	restore FILE                           恢复导出的条目
+//	seed-zone [-origin O] FILE             以区域文件预先填充缓存
+//	seed-pcap FILE                         以抓包文件中的回复预先填充缓存
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tochusc/godns"
+	"github.com/tochusc/godns/dns"
+)
+
+func main() {
+	dir := flag.String("dir", "", "磁盘缓存目录")
+	file := flag.String("file", "", "单文件缓存路径")
+	server := flag.String("server", "", "缓存管理接口地址，如 http://127.0.0.1:8053/cache")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: godns-cache [-dir DIR | -file FILE | -server URL] stats|list|purge|dump|restore|seed-zone|seed-pcap [args]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if *server != "" {
+		err = runRemote(strings.TrimSuffix(*server, "/"), flag.Arg(0), flag.Args()[1:])
+	} else {
+		err = runLocal(*dir, *file, flag.Arg(0), flag.Args()[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "godns-cache:", err)
+		os.Exit(1)
+	}
+}
+
+// commandFlags 解析子命令的参数
+type commandFlags struct {
+	fs     *flag.FlagSet
+	name   *string
+	suffix *string
+	rtype  *string
+	origin *string
+	output *string
+}
+
+func parseCommand(cmd string, args []string) (*commandFlags, error) {
+	f := &commandFlags{fs: flag.NewFlagSet(cmd, flag.ContinueOnError)}
+	f.name = f.fs.String("name", "", "查询名称")
+	f.suffix = f.fs.String("suffix", "", "查询名称后缀")
+	f.rtype = f.fs.String("type", "", "查询类型，如 A 或 TYPE65534")
+	f.origin = f.fs.String("origin", "", "区域文件的初始 $ORIGIN")
+	f.output = f.fs.String("o", "", "导出文件路径，默认为标准输出")
+	return f, f.fs.Parse(args)
+}
+
+// filter 返回子命令参数中的过滤条件
+func (f *commandFlags) filter() (godns.CacheFilter, error) {
+	filter := godns.CacheFilter{Name: *f.name, Suffix: *f.suffix}
+	if *f.rtype != "" {
+		t, err := dns.ParseDNSType(*f.rtype)
+		if err != nil {
+			return filter, err
+		}
+		filter.Type = t
+	}
+	return filter, nil
+}
+
+// input 打开子命令参数中指定的输入文件
+func (f *commandFlags) input() (*os.File, error) {
+	if f.fs.NArg() == 0 {
+		return nil, fmt.Errorf("%s requires an input file", f.fs.Name())
+	}
+	return os.Open(f.fs.Arg(0))
+}
+
+// output 打开导出文件，未指定时使用标准输出
+func (f *commandFlags) outputFile() (io.WriteCloser, error) {
+	if *f.output == "" {
+		return os.Stdout, nil
+	}
+	return os.Create(*f.output)
+}
+
+// runLocal 直接操作本地的缓存后端
+func runLocal(dir, file, cmd string, args []string) error {
+	var backend godns.Cache
+	switch {
+	case dir != "" && file != "":
+		return fmt.Errorf("-dir and -file are mutually exclusive")
+	case dir != "":
+		disk, err := godns.NewDiskCache(dir)
+		if err != nil {
+			return err
+		}
+		backend = disk
+	case file != "":
+		fc, err := godns.OpenFileCache(file)
+		if err != nil {
+			return err
+		}
+		defer fc.Close()
+		backend = fc
+	default:
+		return fmt.Errorf("one of -dir, -file or -server is required")
+	}
+	cacher := godns.NewCacher(godns.CacherConfig{Cache: backend, LogWriter: io.Discard}, nil)
+
+	f, err := parseCommand(cmd, args)
+	if err != nil {
+		return err
+	}
+	var n int
+	switch cmd {
+	case "stats":
+		return printJSON(backend.Stats())
+	case "list", "purge":
+		filter, err := f.filter()
+		if err != nil {
+			return err
+		}
+		if cmd == "list" {
+			infos, err := cacher.List(filter)
+			if err != nil {
+				return err
+			}
+			return printJSON(infos)
+		}
+		n, err = cacher.PurgeMatching(filter)
+		if err != nil {
+			return err
+		}
+	case "dump":
+		out, err := f.outputFile()
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		if n, err = cacher.Dump(out); err != nil {
+			return err
+		}
+		if out == os.Stdout {
+			return nil
+		}
+	case "restore", "seed-zone", "seed-pcap":
+		in, err := f.input()
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		switch cmd {
+		case "restore":
+			n, err = cacher.Restore(in)
+		case "seed-zone":
+			n, err = cacher.SeedZone(in, *f.origin)
+		default:
+			n, err = cacher.SeedPcap(in)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return printJSON(map[string]int{"entries": n})
+}
+
+// runRemote 通过缓存管理接口操作正在运行的服务器
+func runRemote(base, cmd string, args []string) error {
+	f, err := parseCommand(cmd, args)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for k, v := range map[string]string{"name": *f.name, "suffix": *f.suffix, "type": *f.rtype} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+
+	var resp *http.Response
+	switch cmd {
+	case "stats", "list", "dump":
+		action := map[string]string{"stats": "stats", "list": "entries", "dump": "dump"}[cmd]
+		resp, err = http.Get(base + "/" + action + "?" + query.Encode())
+	case "purge":
+		resp, err = http.Post(base+"/purge?"+query.Encode(), "", nil)
+	case "restore", "seed-zone", "seed-pcap":
+		in, ierr := f.input()
+		if ierr != nil {
+			return ierr
+		}
+		defer in.Close()
+		endpoint := base + "/restore"
+		if cmd == "seed-zone" {
+			endpoint = base + "/seed?format=zone&origin=" + url.QueryEscape(*f.origin)
+		} else if cmd == "seed-pcap" {
+			endpoint = base + "/seed?format=pcap"
+		}
+		resp, err = http.Post(endpoint, "application/octet-stream", in)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	out := io.WriteCloser(os.Stdout)
+	if cmd == "dump" {
+		if out, err = f.outputFile(); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,247 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// diskcache.go 文件定义了 DiskCache，它将每个缓存条目保存为目录中的一个文件，
+// 文件名为转义后的缓存键加上 .cache 扩展名，便于直接查看及手动删除。
+// 转义后超出文件名长度限制的缓存键改用 "#" 加上其 SHA-256 摘要作为文件名，
+// 此时缓存键被保存在文件开头。目录中的其他文件不会被读取或删除。
+
+package godns
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DiskCache 是将每个条目保存为一个文件的缓存
+type DiskCache struct {
+	// 缓存所在的目录
+	Dir string
+
+	// mu 保证同一进程内对同一文件的读写不会交错
+	mu sync.RWMutex
+}
+
+// NewDiskCache 创建一个基于目录的缓存，目录不存在时将被创建
+// 其接受参数为：
+//   - dir string，缓存所在的目录
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{Dir: dir}, nil
+}
+
+// diskCacheExt 是缓存文件的扩展名
+const diskCacheExt = ".cache"
+
+// diskCacheNameMax 是缓存文件名的最大长度，即常见文件系统的 NAME_MAX
+const diskCacheNameMax = 255
+
+// diskCacheHashPrefix 是哈希文件名的前缀，转义后的缓存键中不会出现该字符
+const diskCacheHashPrefix = "#"
+
+// diskCacheName 返回缓存键对应的文件名，以及文件名是否为缓存键的哈希
+func diskCacheName(key string) (string, bool) {
+	name := url.PathEscape(key) + diskCacheExt
+	if len(name) <= diskCacheNameMax {
+		return name, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	return diskCacheHashPrefix + hex.EncodeToString(sum[:]) + diskCacheExt, true
+}
+
+// entryKey 返回目录项对应的缓存键，哈希文件名的缓存键保存在文件中，此时返回空字符串及 true。
+// 仅当目录项为大小不小于条目头部的普通文件，且文件名为转义后的缓存键或其哈希加上扩展名时，
+// 才被视为缓存文件，否则返回 false。
+func entryKey(de fs.DirEntry) (key string, hashed bool, info fs.FileInfo, ok bool) {
+	name, ok := strings.CutSuffix(de.Name(), diskCacheExt)
+	if !ok || !de.Type().IsRegular() {
+		return "", false, nil, false
+	}
+	if sum, ok := strings.CutPrefix(name, diskCacheHashPrefix); ok {
+		b, err := hex.DecodeString(sum)
+		if err != nil || len(b) != sha256.Size || hex.EncodeToString(b) != sum {
+			return "", false, nil, false
+		}
+		hashed = true
+	} else {
+		var err error
+		key, err = url.PathUnescape(name)
+		if err != nil || url.PathEscape(key) != name {
+			return "", false, nil, false
+		}
+	}
+	info, err := de.Info()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < cacheEntryHeaderSize {
+		return "", false, nil, false
+	}
+	return key, hashed, info, true
+}
+
+// encodeDiskCacheEntry 编码缓存文件的内容，哈希文件名的文件以 varint 长度前缀保存缓存键
+func encodeDiskCacheEntry(e *CacheEntry, hashed bool) []byte {
+	if !hashed {
+		return encodeCacheEntry(e)
+	}
+	buf := binary.AppendUvarint(nil, uint64(len(e.Key)))
+	buf = append(buf, e.Key...)
+	return append(buf, encodeCacheEntry(e)...)
+}
+
+// cutDiskCacheKey 从哈希文件名的文件内容中切分出缓存键及条目
+func cutDiskCacheKey(buf []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return "", nil, errors.New("cache file: invalid key length")
+	}
+	return string(buf[n : n+int(l)]), buf[n+int(l):], nil
+}
+
+// readEntry 读取名为 name 的缓存文件，key 为空时使用文件中保存的缓存键
+func (d *DiskCache) readEntry(name, key string, hashed bool) (*CacheEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	buf, err := os.ReadFile(filepath.Join(d.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hashed {
+		stored, rest, err := cutDiskCacheKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" && stored != key {
+			// 哈希碰撞，视为未命中
+			return nil, ErrCacheMiss
+		}
+		key, buf = stored, rest
+	}
+	return decodeCacheEntry(key, buf)
+}
+
+// hashedKeySize 返回哈希文件名的文件中缓存键及其长度前缀所占的字节数
+func (d *DiskCache) hashedKeySize(name string) int {
+	f, err := os.Open(filepath.Join(d.Dir, name))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	l, err := binary.ReadUvarint(bufio.NewReader(f))
+	if err != nil {
+		return 0
+	}
+	return len(binary.AppendUvarint(nil, l)) + int(l)
+}
+
+// Get 读取缓存键对应的文件
+func (d *DiskCache) Get(key string) (*CacheEntry, error) {
+	name, hashed := diskCacheName(key)
+	return d.readEntry(name, key, hashed)
+}
+
+// Set 写入缓存键对应的文件，先写入临时文件再重命名，避免读取到不完整的条目
+func (d *DiskCache) Set(e *CacheEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tmp, err := os.CreateTemp(d.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	name, hashed := diskCacheName(e.Key)
+	if _, err := tmp.Write(encodeDiskCacheEntry(e, hashed)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.Dir, name))
+}
+
+// Delete 删除缓存键对应的文件
+func (d *DiskCache) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name, _ := diskCacheName(key)
+	err := os.Remove(filepath.Join(d.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Purge 删除目录中的所有缓存文件，其他文件将被保留
+func (d *DiskCache) Purge() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dirEntries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirEntries {
+		if _, _, _, ok := entryKey(de); !ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(d.Dir, de.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range 遍历目录中的缓存文件，无法读取的文件将被跳过
+func (d *DiskCache) Range(fn func(*CacheEntry) bool) error {
+	dirEntries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirEntries {
+		key, hashed, _, ok := entryKey(de)
+		if !ok {
+			continue
+		}
+		e, err := d.readEntry(de.Name(), key, hashed)
+		if err != nil {
+			continue
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stats 返回目录中缓存文件的数量及回复的总字节数
+func (d *DiskCache) Stats() CacheStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	stats := CacheStats{}
+	dirEntries, _ := os.ReadDir(d.Dir)
+	for _, de := range dirEntries {
+		_, hashed, info, ok := entryKey(de)
+		if !ok {
+			continue
+		}
+		stats.Entries++
+		stats.Bytes += int(info.Size()) - cacheEntryHeaderSize
+		if hashed {
+			stats.Bytes -= d.hashedKeySize(de.Name())
+		}
+	}
+	return stats
+}
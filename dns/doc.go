@@ -27,5 +27,8 @@ dns包中的每个结构体基本都实现了以下方法：
 
 dns包对 DNS 消息的格式没有强制限制，并且支持对 未知类型的资源记录 进行编解码，
 这使得其可以随意构造和解析 DNS 消息，来满足实验需求。
+
+[Zone] 以按照规范顺序排列的名称树保存区域数据，支持最近祖先、NSEC 前驱、通配符、委派点及胶水记录的查找。
+区域的每次更新都会生成新的 [ZoneSnapshot]，读取者持有的快照不受影响，更新也不会阻塞读取者。
 */
 package dns
@@ -81,6 +81,8 @@ func DNSRRRDATAFactory(rtype DNSType) DNSRRRDATA {
 		return &DNSRDATANS{}
 	case DNSRRTypeCNAME:
 		return &DNSRDATACNAME{}
+	case DNSRRTypeSOA:
+		return &DNSRDATASOA{}
 	case DNSRRTypeTXT:
 		return &DNSRDATATXT{}
 	case DNSRRTypeRRSIG:
@@ -346,6 +348,125 @@ func (rdata *DNSRDATACNAME) DecodeFromBuffer(buffer []byte, offset int, rdLen in
 // 长度字节指定了字符序列的长度，长度范围为 0-255，
 // <character-string>的长度范围为 1~256，1表示空字符串。
 
+// SOA RDATA 编码格式
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// /                     MNAME                     /
+// /                                               /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// /                     RNAME                     /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    SERIAL                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    REFRESH                    |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                     RETRY                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    EXPIRE                     |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    MINIMUM                    |
+// |                                               |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+// DNSRDATASOA 结构体表示 SOA 类型的 DNS 资源记录的 RDATA 部分。
+//   - MName 为区域的主权威服务器名称，RName 为管理员邮箱（以 '.' 代替 '@'）。
+//   - Serial 为区域的序列号，Refresh、Retry、Expire 为辅服务器同步区域所使用的时间（秒）。
+//   - Minimum 为否定回复的缓存时间（秒），详见 RFC 2308 第 4 节。
+//
+// RFC 1035 3.3.13 节 定义了 SOA 类型的 DNS 资源记录。
+// 其 Type 值为 6。
+type DNSRDATASOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (rdata *DNSRDATASOA) Type() DNSType {
+	return DNSRRTypeSOA
+}
+
+func (rdata *DNSRDATASOA) Size() int {
+	return GetDomainNameWireLen(&rdata.MName) + GetDomainNameWireLen(&rdata.RName) + 20
+}
+
+func (rdata *DNSRDATASOA) String() string {
+	return fmt.Sprint(
+		"### RDATA Section ###\n",
+		"MName: ", rdata.MName,
+		"\nRName: ", rdata.RName,
+		"\nSerial: ", rdata.Serial,
+		"\nRefresh: ", rdata.Refresh,
+		"\nRetry: ", rdata.Retry,
+		"\nExpire: ", rdata.Expire,
+		"\nMinimum: ", rdata.Minimum,
+	)
+}
+
+func (rdata *DNSRDATASOA) Equal(rr DNSRRRDATA) bool {
+	rrsoa, ok := rr.(*DNSRDATASOA)
+	if !ok {
+		return false
+	}
+	return *rdata == *rrsoa
+}
+
+func (rdata *DNSRDATASOA) Encode() []byte {
+	bytesArray := make([]byte, rdata.Size())
+	_, err := rdata.EncodeToBuffer(bytesArray)
+	if err != nil {
+		panic(fmt.Sprintf("method DNSRDATASOA Encode failed.\n%v", err))
+	}
+	return bytesArray
+}
+
+func (rdata *DNSRDATASOA) EncodeToBuffer(buffer []byte) (int, error) {
+	if len(buffer) < rdata.Size() {
+		return -1, fmt.Errorf("method DNSRDATASOA EncodeToBuffer failed: buffer length %d is less than SOA RDATA size %d", len(buffer), rdata.Size())
+	}
+	offset, err := EncodeDomainNameToBuffer(&rdata.MName, buffer)
+	if err != nil {
+		return -1, fmt.Errorf("method DNSRDATASOA EncodeToBuffer failed: encode MName failed.\n%v", err)
+	}
+	size, err := EncodeDomainNameToBuffer(&rdata.RName, buffer[offset:])
+	if err != nil {
+		return -1, fmt.Errorf("method DNSRDATASOA EncodeToBuffer failed: encode RName failed.\n%v", err)
+	}
+	offset += size
+	for _, v := range []uint32{rdata.Serial, rdata.Refresh, rdata.Retry, rdata.Expire, rdata.Minimum} {
+		binary.BigEndian.PutUint32(buffer[offset:], v)
+		offset += 4
+	}
+	return offset, nil
+}
+
+func (rdata *DNSRDATASOA) DecodeFromBuffer(buffer []byte, offset int, rdLen int) (int, error) {
+	var err error
+	rdata.MName, offset, err = DecodeDomainNameFromBuffer(buffer, offset)
+	if err != nil {
+		return -1, fmt.Errorf("method DNSRDATASOA DecodeFromBuffer failed: decode MName failed.\n%v", err)
+	}
+	rdata.RName, offset, err = DecodeDomainNameFromBuffer(buffer, offset)
+	if err != nil {
+		return -1, fmt.Errorf("method DNSRDATASOA DecodeFromBuffer failed: decode RName failed.\n%v", err)
+	}
+	if len(buffer) < offset+20 {
+		return -1, fmt.Errorf("method DNSRDATASOA DecodeFromBuffer failed: buffer length %d is less than offset %d + 20", len(buffer), offset)
+	}
+	fields := []*uint32{&rdata.Serial, &rdata.Refresh, &rdata.Retry, &rdata.Expire, &rdata.Minimum}
+	for _, field := range fields {
+		*field = binary.BigEndian.Uint32(buffer[offset:])
+		offset += 4
+	}
+	return offset, nil
+}
+
 // TXT RDATA 编码格式
 // +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
 // |                   TXT-DATA                    |
@@ -542,6 +663,10 @@ func (rdata *DNSRDATARRSIG) DecodeFromBuffer(buffer []byte, offset int, rdLen in
 	if err != nil {
 		return -1, fmt.Errorf("method DNSRDATARRSIG DecodeFromBuffer failed: decode RRSIG Signer Name failed.\n%v", err)
 	}
+	if offset > rdEnd || len(buffer) < rdEnd {
+		return -1, fmt.Errorf("method DNSRDATARRSIG DecodeFromBuffer failed: RRSIG Signer Name exceeds RDATA size %d", rdLen)
+	}
+	rdata.Signature = make([]byte, rdEnd-offset)
 	copy(rdata.Signature, buffer[offset:rdEnd])
 	return rdEnd, nil
 }
@@ -627,12 +752,13 @@ func (rdata *DNSRDATADNSKEY) DecodeFromBuffer(buffer []byte, offset int, rdLen i
 	if rdLen < 4 {
 		return -1, fmt.Errorf("method DNSRDATADNSKEY DecodeFromBuffer failed: DNSKEY RDATA size %d is less than 4", rdLen)
 	}
-	if len(buffer) < offset+4 {
+	if len(buffer) < rdEnd {
 		return -1, fmt.Errorf("method DNSRDATADNSKEY DecodeFromBuffer failed: buffer length %d is less than offset %d + DNSKEY RDATA size %d", len(buffer), offset, rdata.Size())
 	}
 	rdata.Flags = DNSKEYFlag(binary.BigEndian.Uint16(buffer[offset:]))
 	rdata.Protocol = DNSKEYProtocol(buffer[offset+2])
 	rdata.Algorithm = DNSSECAlgorithm(buffer[offset+3])
+	rdata.PublicKey = make([]byte, rdEnd-(offset+4))
 	copy(rdata.PublicKey, buffer[offset+4:rdEnd])
 	return rdEnd, nil
 }
@@ -713,6 +839,10 @@ func (rdata *DNSRDATANSEC) DecodeFromBuffer(buffer []byte, offset int, rdLen int
 	if err != nil {
 		return -1, fmt.Errorf("method DNSRDATANSEC DecodeFromBuffer failed: decode NSEC Next Domain Name failed.\n%v", err)
 	}
+	if offset > rdEnd {
+		return -1, fmt.Errorf("method DNSRDATANSEC DecodeFromBuffer failed: NSEC Next Domain Name exceeds RDATA size %d", rdLen)
+	}
+	rdata.TypeBitMaps = make([]byte, rdEnd-offset)
 	copy(rdata.TypeBitMaps, buffer[offset:rdEnd])
 	return rdEnd, nil
 }
@@ -804,6 +934,7 @@ func (rdata *DNSRDATADS) DecodeFromBuffer(buffer []byte, offset int, rdLen int)
 	rdata.KeyTag = binary.BigEndian.Uint16(buffer[offset:])
 	rdata.Algorithm = DNSSECAlgorithm(buffer[offset+2])
 	rdata.DigestType = DNSSECDigestType(buffer[offset+3])
+	rdata.Digest = make([]byte, rdEnd-(offset+4))
 	copy(rdata.Digest, buffer[offset+4:rdEnd])
 	return rdEnd, nil
 }
@@ -820,17 +951,27 @@ func (rdata *DNSRDATADS) DecodeFromBuffer(buffer []byte, offset int, rdLen int)
 // /                          OPTION-DATA                          /
 // /                                                               /
 // +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//
+// OPT 记录的 RDATA 可以为空（不含任何选项），此时 OptionCode、OptionLength 均为 0 且 OptionData 为空。
 type DNSRDATAOPT struct {
 	OptionCode   uint16
 	OptionLength uint16
 	OptionData   []byte
 }
 
+// empty 判断 RDATA 是否不含任何选项
+func (rdata *DNSRDATAOPT) empty() bool {
+	return rdata.OptionCode == 0 && rdata.OptionLength == 0 && len(rdata.OptionData) == 0
+}
+
 func (rdata *DNSRDATAOPT) Type() DNSType {
 	return DNSRRTypeOPT
 }
 
 func (rdata *DNSRDATAOPT) Size() int {
+	if rdata.empty() {
+		return 0
+	}
 	return 4 + len(rdata.OptionData)
 }
 
@@ -855,6 +996,9 @@ func (rdata *DNSRDATAOPT) Equal(rr DNSRRRDATA) bool {
 
 func (rdata *DNSRDATAOPT) Encode() []byte {
 	bytesArray := make([]byte, rdata.Size())
+	if rdata.empty() {
+		return bytesArray
+	}
 	binary.BigEndian.PutUint16(bytesArray, rdata.OptionCode)
 	binary.BigEndian.PutUint16(bytesArray[2:], rdata.OptionLength)
 	copy(bytesArray[4:], rdata.OptionData)
@@ -865,6 +1009,9 @@ func (rdata *DNSRDATAOPT) EncodeToBuffer(buffer []byte) (int, error) {
 	if len(buffer) < rdata.Size() {
 		return -1, fmt.Errorf("method DNSRDATAOPT EncodeToBuffer failed: buffer length %d is less than OPT RDATA size %d", len(buffer), rdata.Size())
 	}
+	if rdata.empty() {
+		return 0, nil
+	}
 	binary.BigEndian.PutUint16(buffer, rdata.OptionCode)
 	binary.BigEndian.PutUint16(buffer[2:], rdata.OptionLength)
 	copy(buffer[4:], rdata.OptionData)
@@ -873,6 +1020,10 @@ func (rdata *DNSRDATAOPT) EncodeToBuffer(buffer []byte) (int, error) {
 
 func (rdata *DNSRDATAOPT) DecodeFromBuffer(buffer []byte, offset int, rdLen int) (int, error) {
 	rdEnd := offset + rdLen
+	if rdLen == 0 {
+		*rdata = DNSRDATAOPT{}
+		return rdEnd, nil
+	}
 	if rdLen < 4 {
 		return -1, fmt.Errorf("method DNSRDATAOPT DecodeFromBuffer failed: OPT RDATA size %d is less than 4", rdLen)
 	}
@@ -168,6 +168,79 @@ func TestDNSRDATANSDecodeFromBuffer(t *testing.T) {
 	}
 }
 
+// 待测试的 SOA RDATA 对象。
+var testedDNSRDATASOA = DNSRDATASOA{
+	MName:   "ns.example.com",
+	RName:   "admin.example.com",
+	Serial:  2024010101,
+	Refresh: 7200,
+	Retry:   3600,
+	Expire:  1209600,
+	Minimum: 300,
+}
+
+// SOA RDATA 的期望编码结果。
+var testedDNSRDATASOAEncoded = []byte{
+	0x02, 'n', 's', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x05, 'a', 'd', 'm', 'i', 'n', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x78, 0xa3, 0xf1, 0x75,
+	0x00, 0x00, 0x1c, 0x20,
+	0x00, 0x00, 0x0e, 0x10,
+	0x00, 0x12, 0x75, 0x00,
+	0x00, 0x00, 0x01, 0x2c,
+}
+
+// 测试 SOA RDATA 的 Size 方法
+func TestDNSRDATASOASize(t *testing.T) {
+	size := testedDNSRDATASOA.Size()
+	expectedSize := len(testedDNSRDATASOAEncoded)
+	if size != expectedSize {
+		t.Errorf("function DNSRDATASOASize() failed:\ngot:%d\nexpected: %d",
+			size, expectedSize)
+	}
+}
+
+// 测试 SOA RDATA 的 Encode 方法
+func TestDNSRDATASOAEncode(t *testing.T) {
+	encodedDNSRDATASOA := testedDNSRDATASOA.Encode()
+	if !bytes.Equal(encodedDNSRDATASOA, testedDNSRDATASOAEncoded) {
+		t.Errorf("function DNSRDATASOAEncode() failed:\ngot:\n%v\nexpected:\n%v",
+			encodedDNSRDATASOA, testedDNSRDATASOAEncoded)
+	}
+
+	// 缓冲区长度不足
+	buffer := make([]byte, 1)
+	_, err := testedDNSRDATASOA.EncodeToBuffer(buffer)
+	if err == nil {
+		t.Error("function DNSRDATASOAEncodeToBuffer() failed: expected an error but got nil")
+	}
+}
+
+// 测试 SOA RDATA 的 DecodeFromBuffer 方法
+func TestDNSRDATASOADecodeFromBuffer(t *testing.T) {
+	// 正常情况
+	decodedDNSRDATASOA := DNSRDATASOA{}
+	offset, err := decodedDNSRDATASOA.DecodeFromBuffer(testedDNSRDATASOAEncoded, 0, len(testedDNSRDATASOAEncoded))
+	if err != nil {
+		t.Errorf("function DNSRDATASOADecodeFromBuffer() failed:\n%s", err)
+	}
+	if offset != len(testedDNSRDATASOAEncoded) {
+		t.Errorf("function DNSRDATASOADecodeFromBuffer() failed:\ngot:%d\nexpected: %d",
+			offset, len(testedDNSRDATASOAEncoded))
+	}
+	if decodedDNSRDATASOA != testedDNSRDATASOA {
+		t.Errorf("function DNSRDATASOADecodeFromBuffer() failed:\ngot:\n%v\nexpected:\n%v",
+			decodedDNSRDATASOA, testedDNSRDATASOA)
+	}
+
+	// 缓冲区长度不足
+	decodedDNSRDATASOA = DNSRDATASOA{}
+	_, err = decodedDNSRDATASOA.DecodeFromBuffer(testedDNSRDATASOAEncoded[:len(testedDNSRDATASOAEncoded)-1], 0, 0)
+	if err == nil {
+		t.Error("function DNSRDATASOADecodeFromBuffer() failed: expected an error but got nil")
+	}
+}
+
 // 待测试CNAME记录RDATA对象。
 var testedDNSRDATACNAME = DNSRDATACNAME{
 	CNAME: "www.example.com",
@@ -381,7 +454,7 @@ func TestDNSRDATARRSIGDecodeFromBuffer(t *testing.T) {
 		t.Errorf("function DNSRDATARRSIGDecodeFromBuffer() failed:\ngot:%d\nexpected: %d",
 			offset, len(testedDNSRDATARRSIGEncoded))
 	}
-	if decodedDNSRDATARRSIG.Equal(&testedDNSRDATARRSIG) {
+	if !decodedDNSRDATARRSIG.Equal(&testedDNSRDATARRSIG) {
 		t.Errorf("function DNSRDATARRSIGDecodeFromBuffer() failed:\ngot:\n%v\nexpected:\n%v",
 			decodedDNSRDATARRSIG.String(), testedDNSRDATARRSIG.String())
 	}
@@ -469,7 +542,7 @@ func TestDNSRDATADNSKEYDecodeFromBuffer(t *testing.T) {
 		t.Errorf("function DNSRDATADNSKEYDecodeFromBuffer() failed:\ngot:%d\nexpected: %d",
 			offset, len(testedDNSRDATADNSKEYEncoded))
 	}
-	if decodedDNSRDATADNSKEY.Equal(&testedDNSRDATADNSKEY) {
+	if !decodedDNSRDATADNSKEY.Equal(&testedDNSRDATADNSKEY) {
 		t.Errorf("function DNSRDATADNSKEYDecodeFromBuffer() failed:\ngot:\n%v\nexpected:\n%v",
 			decodedDNSRDATADNSKEY.String(), testedDNSRDATADNSKEY.String())
 	}
@@ -554,7 +627,7 @@ func TestDNSRDATANSECDecodeFromBuffer(t *testing.T) {
 		t.Errorf("function DNSRDATANSECDecodeFromBuffer() failed:\ngot:%d\nexpected: %d",
 			offset, len(testedDNSRDATANSECEncoded))
 	}
-	if decodedDNSRDATANSEC.Equal(&testedDNSRDATANSEC) {
+	if !decodedDNSRDATANSEC.Equal(&testedDNSRDATANSEC) {
 		t.Errorf("function DNSRDATANSECDecodeFromBuffer() failed:\ngot:\n%v\nexpected:\n%v",
 			decodedDNSRDATANSEC.String(), testedDNSRDATANSEC.String())
 	}
@@ -642,7 +715,7 @@ func TestDNSRDATADSDecodeFromBuffer(t *testing.T) {
 		t.Errorf("function DNSRDATADSDecodeFromBuffer() failed:\ngot:%d\nexpected: %d",
 			offset, len(testedDNSRDATADSEncoded))
 	}
-	if decodedDNSRDATADS.Equal(&testedDNSRDATADS) {
+	if !decodedDNSRDATADS.Equal(&testedDNSRDATADS) {
 		t.Errorf("function DNSRDATADSDecodeFromBuffer() failed:\ngot:\n%v\nexpected:\n%v",
 			decodedDNSRDATADS.String(), testedDNSRDATADS.String())
 	}
@@ -691,3 +764,17 @@ func TestDNSRDATAOPTDecodeFromBuffer(t *testing.T) {
 			})
 	}
 }
+
+// 测试不含任何选项的 OPT RDATA
+func TestDNSRDATAOPTEmpty(t *testing.T) {
+	opt := DNSRDATAOPT{}
+	if opt.Size() != 0 || len(opt.Encode()) != 0 {
+		t.Errorf("function DNSRDATAOPT.Size() failed:\ngot:\n%d\nexpected:\n%d", opt.Size(), 0)
+	}
+	decoded := DNSRDATAOPT{OptionCode: 10}
+	offset, err := decoded.DecodeFromBuffer([]byte{0x00, 0x29}, 2, 0)
+	if err != nil || offset != 2 || !decoded.Equal(&opt) {
+		t.Errorf("function DNSRDATAOPT.DecodeFromBuffer() failed:\ngot:\n%v %d %v\nexpected:\n%v %d",
+			decoded, offset, err, opt, 2)
+	}
+}
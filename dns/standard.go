@@ -47,6 +47,7 @@ package dns
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -231,6 +232,10 @@ func CountDomainNameLabels(name *string) int {
 	if (*name)[nameLen-1] == '.' {
 		nameLen--
 	}
+	// 根域名没有标签
+	if nameLen == 0 {
+		return 0
+	}
 	for i := 0; i < nameLen; i++ {
 		if (*name)[i] == '.' {
 			labelNum++
@@ -348,12 +353,9 @@ func (rrSet ByCanonicalOrder) Less(i, j int) bool {
 	return string(rdataBytesI) < string(rdataBytesJ)
 }
 
+// CanonicalSortRRSet 按照 RDATA 的规范顺序原地排序 RRset，详见 RFC 4034 6.3 节。
 func CanonicalSortRRSet(rrSet []DNSResourceRecord) {
-	rrSetLen := len(rrSet)
-	if rrSetLen == 0 {
-		return
-	}
-	rrSet = ByCanonicalOrder(rrSet)
+	sort.Sort(ByCanonicalOrder(rrSet))
 }
 
 // DNSMessageCompression 对 DNS 消息进行压缩。
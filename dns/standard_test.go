@@ -119,7 +119,20 @@ func TestCanonicalSortRRSet(t *testing.T) {
 		},
 	}
 	CanonicalSortRRSet(rrSet)
-	t.Logf("CanonicalSortRRSet: %v", rrSet)
+	for i, last := range []byte{4, 5, 6} {
+		if address := rrSet[i].RData.(*DNSRDATAA).Address.To4(); address[3] != last {
+			t.Errorf("function CanonicalSortRRSet() failed:\ngot:\n%v\nexpected:\n10.10.3.%d", address, last)
+		}
+	}
+}
+
+// 测试CountDomainNameLabels函数
+func TestCountDomainNameLabels(t *testing.T) {
+	for name, expected := range map[string]int{".": 0, "com": 1, "com.": 1, "www.example.com": 3, "*.example.com.": 3} {
+		if got := CountDomainNameLabels(&name); got != expected {
+			t.Errorf("function CountDomainNameLabels(%q) failed:\ngot:\n%d\nexpected:\n%d", name, got, expected)
+		}
+	}
 }
 
 func TestCompressDNSMessage(t *testing.T) {
@@ -17,6 +17,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/tochusc/godns/dns"
 )
@@ -90,6 +91,16 @@ func GenerateRRDNSKEY(
 	return rr, privKey
 }
 
+// rrsigLabels 返回 RRSIG 的 Labels 字段：所有者名称的标签数量，通配符标签 "*" 不计算在内，
+// 详见 RFC 4034 3.1.3 节。
+func rrsigLabels(name string) uint8 {
+	labels := dns.CountDomainNameLabels(&name)
+	if strings.HasPrefix(name, "*.") || name == "*" {
+		labels--
+	}
+	return uint8(labels)
+}
+
 // GenerateRDATARRSIG 根据传入参数生成 RRSIG RDATA，
 // 该函数目前无法将传入的 RRSET 进行 规范化 及 规范化排序，
 // 所以需要外部保证传入的 RRSET 是规范的，才可以成功生成正确的 RRSIG。
@@ -115,7 +126,7 @@ func GenerateRDATARRSIG(rrSet []dns.DNSResourceRecord, algo dns.DNSSECAlgorithm,
 	rrsig := dns.DNSRDATARRSIG{
 		TypeCovered: rrSet[0].Type,
 		Algorithm:   algo,
-		Labels:      uint8(dns.CountDomainNameLabels(&rrSet[0].Name)),
+		Labels:      rrsigLabels(rrSet[0].Name),
 		OriginalTTL: rrSet[0].TTL,
 		Expiration:  expiration,
 		Inception:   inception,
@@ -391,7 +402,7 @@ func GenerateRandomRDATARRSIG(rrSet []dns.DNSResourceRecord, algo dns.DNSSECAlgo
 	return dns.DNSRDATARRSIG{
 		TypeCovered: rrSet[0].Type,
 		Algorithm:   algo,
-		Labels:      uint8(dns.CountDomainNameLabels(&rrSet[0].Name)),
+		Labels:      rrsigLabels(rrSet[0].Name),
 		OriginalTTL: 3600,
 		Expiration:  expiration,
 		Inception:   inception,
@@ -470,8 +481,17 @@ type DNSSECAlgorithmer interface {
 	GenerateKey() ([]byte, []byte)
 }
 
+// ecdsaFixedBytes 将两个整数按照曲线的字节长度左侧补零后拼接，
+// ECDSA 签名 (r, s) 及公钥 (X, Y) 均须采用定长编码，详见 RFC 6605 第 4 节。
+func ecdsaFixedBytes(curve elliptic.Curve, a, b *big.Int) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	buf := make([]byte, 2*size)
+	a.FillBytes(buf[:size])
+	b.FillBytes(buf[size:])
+	return buf
+}
+
 // DNSSECAlgorithmFactory 生成 DNSSECAlgorithmer
-// ECDSAP系列算法有概率生成失败...具体原因仍不清楚
 func DNSSECAlgorithmerFactory(algo dns.DNSSECAlgorithm) DNSSECAlgorithmer {
 	switch algo {
 	case dns.DNSSECAlgorithmRSASHA1:
@@ -613,9 +633,7 @@ func (ECDSAP256SHA256) Sign(data, privKey []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to sign: %s", err)
 	}
 
-	signature := append(r.Bytes(), s.Bytes()...)
-
-	return signature, nil
+	return ecdsaFixedBytes(curve, r, s), nil
 }
 
 func (ECDSAP256SHA256) GenerateKey() ([]byte, []byte) {
@@ -624,7 +642,7 @@ func (ECDSAP256SHA256) GenerateKey() ([]byte, []byte) {
 		panic(fmt.Sprintf("failed to generate ECDSA key: %s", err))
 	}
 	privKeyBytes := privKey.D.Bytes()
-	pubKeyBytes := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
+	pubKeyBytes := ecdsaFixedBytes(privKey.Curve, privKey.PublicKey.X, privKey.PublicKey.Y)
 	return privKeyBytes, pubKeyBytes
 }
 
@@ -647,9 +665,7 @@ func (ECDSAP384SHA384) Sign(data, privKey []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to sign: %s", err)
 	}
 
-	signature := append(r.Bytes(), s.Bytes()...)
-
-	return signature, nil
+	return ecdsaFixedBytes(curve, r, s), nil
 }
 
 func (ECDSAP384SHA384) GenerateKey() ([]byte, []byte) {
@@ -658,6 +674,6 @@ func (ECDSAP384SHA384) GenerateKey() ([]byte, []byte) {
 		panic(fmt.Sprintf("failed to generate ECDSA key: %s", err))
 	}
 	privKeyBytes := privKey.D.Bytes()
-	pubKeyBytes := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
+	pubKeyBytes := ecdsaFixedBytes(privKey.Curve, privKey.PublicKey.X, privKey.PublicKey.Y)
 	return privKeyBytes, pubKeyBytes
 }
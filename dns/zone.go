@@ -0,0 +1,590 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// zone.go 文件定义了内存中的区域数据结构 Zone。
+// 区域中的名称按照 RFC 4034 6.1 节的规范顺序保存在一棵不可变（持久化）的树堆中，
+// 每个节点保存该名称下按类型分组的 RRset 及覆盖它们的 RRSIG 记录。
+// 更新区域时仅复制被修改的路径并原子地替换根节点，
+// 因此读取者持有的快照 ZoneSnapshot 不会被更新阻塞，也不会观察到更新的中间状态。
+
+package dns
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CompareDomainNames 按照 RFC 4034 6.1 节定义的规范顺序比较两个域名。
+//   - 其接收参数为 两个域名，不区分大小写，末尾的 '.' 可以省略，
+//   - 返回值为 -1、0 或 1，分别表示 a 排在 b 之前、二者相同、a 排在 b 之后。
+//
+// 规范顺序自最右侧的标签开始逐个比较标签，标签按照小写后的字节序比较，
+// 所有标签均相同时标签较少的域名排在前面，因此一个域名的所有子域名都紧随其后。
+func CompareDomainNames(a, b string) int {
+	return compareCanonicalNames(canonicalZoneName(a), canonicalZoneName(b))
+}
+
+// compareCanonicalNames 按照规范顺序比较两个规范形式的域名
+func compareCanonicalNames(a, b string) int {
+	for {
+		if a == "." || b == "." {
+			switch {
+			case a == b:
+				return 0
+			case a == ".":
+				return -1
+			default:
+				return 1
+			}
+		}
+		var la, lb string
+		la, a = lastLabel(a)
+		lb, b = lastLabel(b)
+		if c := strings.Compare(la, lb); c != 0 {
+			return c
+		}
+	}
+}
+
+// lastLabel 返回域名最右侧的标签及其余部分，仅有一个标签时其余部分为 "."
+func lastLabel(name string) (string, string) {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i+1:], name[:i]
+	}
+	return name, "."
+}
+
+// canonicalZoneName 返回小写且不以 '.' 结尾的域名，根域名为 "."
+func canonicalZoneName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// parentZoneName 返回域名的父域名，根域名的父域名为空字符串
+func parentZoneName(name string) string {
+	if name == "." {
+		return ""
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// isSubDomainName 判断 name 是否为 zone 或其子域名，二者均须为规范形式
+func isSubDomainName(zone, name string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// ZoneNode 是区域中的一个名称及其数据。
+// 节点一经放入区域即不可修改，不含任何记录的节点表示空非终端名称。
+type ZoneNode struct {
+	// 规范形式的名称
+	Name string
+	// 类型 -> RRset，不含 RRSIG 记录
+	RRSets map[DNSType][]DNSResourceRecord
+	// 所覆盖的类型 -> RRSIG 记录
+	Signatures map[DNSType][]DNSResourceRecord
+}
+
+// Empty 判断节点是否为空非终端名称
+func (n *ZoneNode) Empty() bool {
+	return len(n.RRSets) == 0 && len(n.Signatures) == 0
+}
+
+// newZoneNode 创建一个不含记录的节点
+func newZoneNode(name string) *ZoneNode {
+	return &ZoneNode{
+		Name:       name,
+		RRSets:     make(map[DNSType][]DNSResourceRecord),
+		Signatures: make(map[DNSType][]DNSResourceRecord),
+	}
+}
+
+// clone 返回节点的浅拷贝，RRset 切片在追加时须另行复制
+func (n *ZoneNode) clone() *ZoneNode {
+	c := &ZoneNode{
+		Name:       n.Name,
+		RRSets:     make(map[DNSType][]DNSResourceRecord, len(n.RRSets)),
+		Signatures: make(map[DNSType][]DNSResourceRecord, len(n.Signatures)),
+	}
+	for t, rrs := range n.RRSets {
+		c.RRSets[t] = rrs
+	}
+	for t, rrs := range n.Signatures {
+		c.Signatures[t] = rrs
+	}
+	return c
+}
+
+// zoneTree 是持久化树堆的节点，按照名称的规范顺序排列，按照优先级维持堆序
+type zoneTree struct {
+	node        *ZoneNode
+	prio        uint32
+	left, right *zoneTree
+}
+
+// zonePriority 以名称的哈希值作为树堆节点的优先级，使树的形状与插入顺序无关
+func zonePriority(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+func (t *zoneTree) get(name string) *ZoneNode {
+	for t != nil {
+		switch c := compareCanonicalNames(name, t.node.Name); {
+		case c < 0:
+			t = t.left
+		case c > 0:
+			t = t.right
+		default:
+			return t.node
+		}
+	}
+	return nil
+}
+
+// insert 返回插入（或替换）节点后的新树，原树保持不变
+func (t *zoneTree) insert(n *ZoneNode) *zoneTree {
+	if t == nil {
+		return &zoneTree{node: n, prio: zonePriority(n.Name)}
+	}
+	cp := *t
+	switch c := compareCanonicalNames(n.Name, t.node.Name); {
+	case c == 0:
+		cp.node = n
+	case c < 0:
+		cp.left = t.left.insert(n)
+		if cp.left.prio > cp.prio {
+			l := cp.left
+			cp.left = l.right
+			l.right = &cp
+			return l
+		}
+	default:
+		cp.right = t.right.insert(n)
+		if cp.right.prio > cp.prio {
+			r := cp.right
+			cp.right = r.left
+			r.left = &cp
+			return r
+		}
+	}
+	return &cp
+}
+
+// remove 返回删除节点后的新树，原树保持不变
+func (t *zoneTree) remove(name string) *zoneTree {
+	if t == nil {
+		return nil
+	}
+	switch c := compareCanonicalNames(name, t.node.Name); {
+	case c == 0:
+		return mergeZoneTrees(t.left, t.right)
+	case c < 0:
+		cp := *t
+		cp.left = t.left.remove(name)
+		return &cp
+	default:
+		cp := *t
+		cp.right = t.right.remove(name)
+		return &cp
+	}
+}
+
+// mergeZoneTrees 合并两棵树，a 中的名称均排在 b 中的名称之前
+func mergeZoneTrees(a, b *zoneTree) *zoneTree {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		cp := *a
+		cp.right = mergeZoneTrees(a.right, b)
+		return &cp
+	}
+	cp := *b
+	cp.left = mergeZoneTrees(a, b.left)
+	return &cp
+}
+
+// before 返回规范顺序中排在 name 之前的最后一个节点
+func (t *zoneTree) before(name string) *ZoneNode {
+	var found *ZoneNode
+	for t != nil {
+		if compareCanonicalNames(t.node.Name, name) < 0 {
+			found = t.node
+			t = t.right
+		} else {
+			t = t.left
+		}
+	}
+	return found
+}
+
+// after 返回规范顺序中排在 name 之后的第一个节点
+func (t *zoneTree) after(name string) *ZoneNode {
+	var found *ZoneNode
+	for t != nil {
+		if compareCanonicalNames(t.node.Name, name) > 0 {
+			found = t.node
+			t = t.left
+		} else {
+			t = t.right
+		}
+	}
+	return found
+}
+
+// walk 按照规范顺序遍历节点，fn 返回 false 时停止
+func (t *zoneTree) walk(fn func(*ZoneNode) bool) bool {
+	if t == nil {
+		return true
+	}
+	return t.left.walk(fn) && fn(t.node) && t.right.walk(fn)
+}
+
+// ZoneSnapshot 是区域在某一时刻的只读快照，可以被多个协程并发读取。
+// With、Without 等方法不会修改快照，而是返回新的快照。
+type ZoneSnapshot struct {
+	// 区域名称，为规范形式
+	Origin string
+	root   *zoneTree
+	size   int
+}
+
+// Len 返回快照中的节点数量，包括空非终端名称
+func (s *ZoneSnapshot) Len() int {
+	return s.size
+}
+
+// Get 返回名称对应的节点，名称不存在时返回 nil
+func (s *ZoneSnapshot) Get(name string) *ZoneNode {
+	return s.root.get(canonicalZoneName(name))
+}
+
+// RRSet 返回名称下指定类型的 RRset，不存在时返回 nil
+func (s *ZoneSnapshot) RRSet(name string, rtype DNSType) []DNSResourceRecord {
+	if n := s.Get(name); n != nil {
+		return n.RRSets[rtype]
+	}
+	return nil
+}
+
+// SOA 返回区域顶点的 SOA 记录，不存在时返回 nil
+func (s *ZoneSnapshot) SOA() *DNSResourceRecord {
+	if soa := s.RRSet(s.Origin, DNSRRTypeSOA); len(soa) > 0 {
+		return &soa[0]
+	}
+	return nil
+}
+
+// Walk 按照规范顺序遍历快照中的节点，fn 返回 false 时停止遍历
+func (s *ZoneSnapshot) Walk(fn func(*ZoneNode) bool) {
+	s.root.walk(fn)
+}
+
+// Records 按照规范顺序返回快照中的所有资源记录，每个 RRset 之后紧跟覆盖它的 RRSIG 记录
+func (s *ZoneSnapshot) Records() []DNSResourceRecord {
+	var rrs []DNSResourceRecord
+	s.Walk(func(n *ZoneNode) bool {
+		for _, t := range sortedTypes(n.RRSets) {
+			rrs = append(rrs, n.RRSets[t]...)
+			rrs = append(rrs, n.Signatures[t]...)
+		}
+		for _, t := range sortedTypes(n.Signatures) {
+			if _, ok := n.RRSets[t]; !ok {
+				rrs = append(rrs, n.Signatures[t]...)
+			}
+		}
+		return true
+	})
+	return rrs
+}
+
+// sortedTypes 返回按照类型值排列的 RRset 类型
+func sortedTypes(rrsets map[DNSType][]DNSResourceRecord) []DNSType {
+	types := make([]DNSType, 0, len(rrsets))
+	for t := range rrsets {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// With 返回添加资源记录后的新快照。
+//   - 其接收参数为 待添加的资源记录，与已有记录完全相同的记录会被忽略，
+//   - 返回值为 新快照 及 报错信息，记录不属于该区域时报错且不做任何修改。
+//
+// 添加记录时会自动创建其所有者名称与区域顶点之间的空非终端名称。
+func (s *ZoneSnapshot) With(rrs ...DNSResourceRecord) (*ZoneSnapshot, error) {
+	next := *s
+	for _, rr := range rrs {
+		rr.Name = canonicalZoneName(rr.Name)
+		if !isSubDomainName(s.Origin, rr.Name) {
+			return s, fmt.Errorf("record %s %s is outside of zone %s", rr.Name, rr.Type, s.Origin)
+		}
+
+		var node *ZoneNode
+		if old := next.root.get(rr.Name); old != nil {
+			node = old.clone()
+		} else {
+			node = newZoneNode(rr.Name)
+			// 补充空非终端名称
+			for p := parentZoneName(rr.Name); p != "" && isSubDomainName(s.Origin, p); p = parentZoneName(p) {
+				if next.root.get(p) != nil {
+					break
+				}
+				next.root = next.root.insert(newZoneNode(p))
+				next.size++
+			}
+			next.size++
+		}
+
+		set, key := node.RRSets, rr.Type
+		if rrsig, ok := rr.RData.(*DNSRDATARRSIG); ok {
+			set, key = node.Signatures, rrsig.TypeCovered
+		}
+		duplicate := false
+		for _, old := range set[key] {
+			if old.Type == rr.Type && old.Class == rr.Class && old.RData.Equal(rr.RData) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			// 复制切片，以免与旧快照共享底层数组
+			set[key] = append(append(make([]DNSResourceRecord, 0, len(set[key])+1), set[key]...), rr)
+		}
+		next.root = next.root.insert(node)
+	}
+	return &next, nil
+}
+
+// Without 返回删除名称下指定类型的 RRset 及覆盖它的 RRSIG 记录后的新快照。
+//   - 其接收参数为 名称 及 类型，类型为 DNSQTypeANY 时删除该名称下的所有记录，
+//   - 返回值为 新快照。
+//
+// 删除后不含任何记录且没有子域名的节点会被一并删除，其祖先中的空非终端名称亦然。
+func (s *ZoneSnapshot) Without(name string, rtype DNSType) *ZoneSnapshot {
+	name = canonicalZoneName(name)
+	old := s.root.get(name)
+	if old == nil {
+		return s
+	}
+	next := *s
+	node := old.clone()
+	if rtype == DNSQTypeANY {
+		node.RRSets = map[DNSType][]DNSResourceRecord{}
+		node.Signatures = map[DNSType][]DNSResourceRecord{}
+	} else {
+		delete(node.RRSets, rtype)
+		delete(node.Signatures, rtype)
+	}
+	next.root = next.root.insert(node)
+
+	// 自下而上删除不再需要的空非终端名称
+	for n := name; n != s.Origin && n != ""; n = parentZoneName(n) {
+		cur := next.root.get(n)
+		if cur == nil || !cur.Empty() {
+			break
+		}
+		if succ := next.root.after(n); succ != nil && isSubDomainName(n, succ.Name) {
+			break
+		}
+		next.root = next.root.remove(n)
+		next.size--
+	}
+	return &next
+}
+
+// ClosestEncloser 返回区域中存在的、name 的最近祖先（name 存在时即为其本身）。
+//   - 其接收参数为 域名，
+//   - 返回值为 最近祖先的节点 及 name 本身是否存在，name 不属于该区域时返回 nil。
+func (s *ZoneSnapshot) ClosestEncloser(name string) (*ZoneNode, bool) {
+	name = canonicalZoneName(name)
+	if !isSubDomainName(s.Origin, name) {
+		return nil, false
+	}
+	for n := name; n != ""; n = parentZoneName(n) {
+		if node := s.root.get(n); node != nil {
+			return node, n == name
+		}
+		if n == s.Origin {
+			break
+		}
+	}
+	return nil, false
+}
+
+// Wildcard 返回可以为不存在的 name 合成回答的通配符节点，详见 RFC 4592 3.3.1 节。
+//   - 其接收参数为 域名，
+//   - 返回值为 源通配符 "*.<最近祖先>" 的节点，name 存在或通配符不存在时返回 nil。
+func (s *ZoneSnapshot) Wildcard(name string) *ZoneNode {
+	encloser, exact := s.ClosestEncloser(name)
+	if encloser == nil || exact {
+		return nil
+	}
+	if encloser.Name == "." {
+		return s.root.get("*")
+	}
+	return s.root.get("*." + encloser.Name)
+}
+
+// Predecessor 返回规范顺序中排在 name 之前、含有记录的最后一个节点，用于查找覆盖 name 的 NSEC 记录。
+//   - 其接收参数为 域名，name 本身不必存在，
+//   - 返回值为 前驱节点，不存在时返回 nil。
+func (s *ZoneSnapshot) Predecessor(name string) *ZoneNode {
+	n := s.root.before(canonicalZoneName(name))
+	for n != nil && n.Empty() {
+		n = s.root.before(n.Name)
+	}
+	return n
+}
+
+// Successor 返回规范顺序中排在 name 之后、含有记录的第一个节点，用于构造 NSEC 链
+func (s *ZoneSnapshot) Successor(name string) *ZoneNode {
+	n := s.root.after(canonicalZoneName(name))
+	for n != nil && n.Empty() {
+		n = s.root.after(n.Name)
+	}
+	return n
+}
+
+// Delegation 返回 name 路径上最高的委派点，即区域顶点以下、含有 NS 记录的节点。
+//   - 其接收参数为 域名，
+//   - 返回值为 委派点的节点，name 不在任何委派点或其下方时返回 nil。
+//
+// 委派点（含）以下的数据属于子区域，除委派点的 NS、DS 记录及胶水记录外不是权威数据。
+func (s *ZoneSnapshot) Delegation(name string) *ZoneNode {
+	name = canonicalZoneName(name)
+	if !isSubDomainName(s.Origin, name) || name == s.Origin {
+		return nil
+	}
+	var path []string
+	for n := name; n != s.Origin; n = parentZoneName(n) {
+		path = append(path, n)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		node := s.root.get(path[i])
+		if node == nil {
+			return nil
+		}
+		if len(node.RRSets[DNSRRTypeNS]) > 0 {
+			return node
+		}
+	}
+	return nil
+}
+
+// IsGlue 判断名称下的地址记录是否为胶水记录，即名称位于某个委派点（含）的下方
+func (s *ZoneSnapshot) IsGlue(name string) bool {
+	return s.Delegation(name) != nil
+}
+
+// Glue 返回委派点 NS 记录所指向的名称在区域中的 A 及 AAAA 记录
+//   - 其接收参数为 委派点的名称，
+//   - 返回值为 按照 NS 记录顺序排列的地址记录，区域外的名称会被忽略。
+func (s *ZoneSnapshot) Glue(cut string) []DNSResourceRecord {
+	var glue []DNSResourceRecord
+	seen := make(map[string]bool)
+	for _, rr := range s.RRSet(cut, DNSRRTypeNS) {
+		ns, ok := rr.RData.(*DNSRDATANS)
+		if !ok {
+			continue
+		}
+		target := canonicalZoneName(ns.NSDNAME)
+		if seen[target] || !isSubDomainName(s.Origin, target) {
+			continue
+		}
+		seen[target] = true
+		glue = append(glue, s.RRSet(target, DNSRRTypeA)...)
+		glue = append(glue, s.RRSet(target, DNSRRTypeAAAA)...)
+	}
+	return glue
+}
+
+// Zone 是一个可以并发读取及更新的区域。
+// 读取者通过 Snapshot 获得一致的只读快照，更新者之间互斥，且不会阻塞读取者。
+type Zone struct {
+	// 区域名称，为规范形式
+	Origin string
+
+	mu       sync.Mutex
+	snapshot atomic.Pointer[ZoneSnapshot]
+}
+
+// NewZone 创建一个空区域。
+//   - 其接收参数为 区域名称，
+//   - 返回值为 区域。
+func NewZone(origin string) *Zone {
+	z := &Zone{Origin: canonicalZoneName(origin)}
+	var root *zoneTree
+	z.snapshot.Store(&ZoneSnapshot{Origin: z.Origin, root: root.insert(newZoneNode(z.Origin)), size: 1})
+	return z
+}
+
+// LoadZone 从区域文件创建区域，区域顶点须含有且仅含有一条 SOA 记录。
+//   - 其接收参数为 区域文件 及 区域名称（同时作为初始的 $ORIGIN），
+//   - 返回值为 区域 及 报错信息。
+func LoadZone(r io.Reader, origin string) (*Zone, error) {
+	rrs, err := ParseZone(r, origin)
+	if err != nil {
+		return nil, err
+	}
+	z := NewZone(origin)
+	if err := z.Add(rrs...); err != nil {
+		return nil, err
+	}
+	soa := z.Snapshot().RRSet(z.Origin, DNSRRTypeSOA)
+	if len(soa) != 1 {
+		return nil, fmt.Errorf("zone %s must have exactly one SOA record at the apex, got %d", z.Origin, len(soa))
+	}
+	if _, ok := soa[0].RData.(*DNSRDATASOA); !ok {
+		return nil, fmt.Errorf("zone %s has a malformed SOA record", z.Origin)
+	}
+	return z, nil
+}
+
+// Snapshot 返回区域当前的只读快照
+func (z *Zone) Snapshot() *ZoneSnapshot {
+	return z.snapshot.Load()
+}
+
+// Update 以 fn 返回的快照原子地替换区域的当前快照。
+//   - 其接收参数为 更新函数，其参数为当前快照，返回错误时不做任何修改，
+//   - 返回值为 更新函数返回的错误。
+func (z *Zone) Update(fn func(*ZoneSnapshot) (*ZoneSnapshot, error)) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	next, err := fn(z.snapshot.Load())
+	if err != nil {
+		return err
+	}
+	z.snapshot.Store(next)
+	return nil
+}
+
+// Add 向区域添加资源记录，任一记录不属于该区域时不做任何修改并报错
+func (z *Zone) Add(rrs ...DNSResourceRecord) error {
+	return z.Update(func(s *ZoneSnapshot) (*ZoneSnapshot, error) {
+		return s.With(rrs...)
+	})
+}
+
+// Remove 从区域删除名称下指定类型的 RRset，类型为 DNSQTypeANY 时删除该名称下的所有记录
+func (z *Zone) Remove(name string, rtype DNSType) {
+	z.Update(func(s *ZoneSnapshot) (*ZoneSnapshot, error) {
+		return s.Without(name, rtype), nil
+	})
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// zone_test.go 文件用于对 zone.go 中所实现的区域数据结构进行测试。
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 待测试的区域文件。
+const testedZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 3600 1209600 300
+	NS	ns1
+ns1	A	192.0.2.53
+www	A	192.0.2.1
+	RRSIG	A 8 3 3600 20300101000000 20240101000000 12345 example.com. AAAA
+*.wild	A	192.0.2.99
+a.b.c	TXT	"deep"
+child	NS	ns.child
+	NS	ns.other.net.
+ns.child	A	192.0.2.54
+	AAAA	2001:db8::54
+`
+
+// 测试 CompareDomainNames 函数，例子取自 RFC 4034 6.1 节
+func TestCompareDomainNames(t *testing.T) {
+	ordered := []string{
+		"example", "a.example", "yljkjljk.a.example", "Z.a.example",
+		"zABC.a.EXAMPLE", "z.example", "\001.z.example", "*.z.example", "\200.z.example",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			got := CompareDomainNames(ordered[i], ordered[j])
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if got != expected {
+				t.Errorf("function CompareDomainNames(%q, %q) failed:\ngot:\n%d\nexpected:\n%d", ordered[i], ordered[j], got, expected)
+			}
+		}
+	}
+	if CompareDomainNames(".", "com") != -1 || CompareDomainNames("Example.COM.", "example.com") != 0 {
+		t.Error("function CompareDomainNames() failed: root must sort first and case must be ignored")
+	}
+}
+
+// 测试从区域文件加载区域及按照规范顺序遍历
+func TestLoadZone(t *testing.T) {
+	z, err := LoadZone(strings.NewReader(testedZoneFile), "example.com")
+	if err != nil {
+		t.Fatalf("function LoadZone() failed:\n%s", err)
+	}
+	s := z.Snapshot()
+	var names []string
+	s.Walk(func(n *ZoneNode) bool {
+		names = append(names, n.Name)
+		return true
+	})
+	expected := []string{
+		"example.com", "c.example.com", "b.c.example.com", "a.b.c.example.com",
+		"child.example.com", "ns.child.example.com", "ns1.example.com",
+		"wild.example.com", "*.wild.example.com", "www.example.com",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("function Walk() failed:\ngot:\n%v\nexpected:\n%v", names, expected)
+	}
+	if s.Len() != len(expected) || len(s.Records()) != 11 {
+		t.Errorf("function Len() or Records() failed:\ngot:\n%d %d\nexpected:\n%d 11", s.Len(), len(s.Records()), len(expected))
+	}
+	if soa := s.SOA(); soa == nil || soa.Type != DNSRRTypeSOA {
+		t.Errorf("function SOA() failed:\ngot:\n%v", soa)
+	}
+	if sigs := s.Get("WWW.example.com").Signatures[DNSRRTypeA]; len(sigs) != 1 {
+		t.Errorf("function Get() failed: RRSIG of www A got: %d, expected: 1", len(sigs))
+	}
+
+	// 缺少 SOA 记录或记录不属于该区域
+	for _, file := range []string{"www 300 A 192.0.2.1\n", testedZoneFile + "www.example.org. 300 A 192.0.2.1\n"} {
+		if _, err := LoadZone(strings.NewReader(file), "example.com"); err == nil {
+			t.Errorf("function LoadZone(%q) failed: expected an error but got nil", file)
+		}
+	}
+}
+
+// 测试最近祖先、通配符、前驱、委派点及胶水记录的查找
+func TestZoneLookups(t *testing.T) {
+	z, _ := LoadZone(strings.NewReader(testedZoneFile), "example.com")
+	s := z.Snapshot()
+
+	for _, c := range []struct {
+		name     string
+		encloser string
+		exact    bool
+	}{
+		{"www.example.com", "www.example.com", true},
+		{"b.c.example.com", "b.c.example.com", true},
+		{"x.www.example.com", "www.example.com", false},
+		{"x.y.wild.example.com", "wild.example.com", false},
+		{"nothere.example.com", "example.com", false},
+	} {
+		node, exact := s.ClosestEncloser(c.name)
+		if node == nil || node.Name != c.encloser || exact != c.exact {
+			t.Errorf("function ClosestEncloser(%s) failed:\ngot:\n%v %v\nexpected:\n%s %v", c.name, node, exact, c.encloser, c.exact)
+		}
+	}
+	if node, _ := s.ClosestEncloser("example.org"); node != nil {
+		t.Errorf("function ClosestEncloser() failed: name outside of the zone got: %v, expected: nil", node)
+	}
+
+	if w := s.Wildcard("x.y.wild.example.com"); w == nil || w.Name != "*.wild.example.com" {
+		t.Errorf("function Wildcard() failed:\ngot:\n%v\nexpected:\n*.wild.example.com", w)
+	}
+	if w := s.Wildcard("nothere.example.com"); w != nil {
+		t.Errorf("function Wildcard() failed: got %v, expected: nil", w.Name)
+	}
+
+	for _, c := range []struct{ name, pred, succ string }{
+		// 空非终端名称被跳过
+		{"b.c.example.com", "example.com", "a.b.c.example.com"},
+		{"mmm.example.com", "ns.child.example.com", "ns1.example.com"},
+		{"x.wild.example.com", "*.wild.example.com", "www.example.com"},
+		{"zzz.example.com", "www.example.com", ""},
+	} {
+		pred, succ := s.Predecessor(c.name), s.Successor(c.name)
+		if pred == nil || pred.Name != c.pred || (succ == nil) != (c.succ == "") || (succ != nil && succ.Name != c.succ) {
+			t.Errorf("function Predecessor/Successor(%s) failed:\ngot:\n%v %v\nexpected:\n%s %s", c.name, pred, succ, c.pred, c.succ)
+		}
+	}
+
+	for _, c := range []struct{ name, cut string }{
+		{"child.example.com", "child.example.com"},
+		{"a.ns.child.example.com", "child.example.com"},
+		{"www.example.com", ""},
+		{"example.com", ""},
+	} {
+		cut := s.Delegation(c.name)
+		if (cut == nil) != (c.cut == "") || (cut != nil && cut.Name != c.cut) {
+			t.Errorf("function Delegation(%s) failed:\ngot:\n%v\nexpected:\n%s", c.name, cut, c.cut)
+		}
+	}
+	if !s.IsGlue("ns.child.example.com") || s.IsGlue("ns1.example.com") {
+		t.Error("function IsGlue() failed: only ns.child.example.com is glue")
+	}
+	if glue := s.Glue("child.example.com"); len(glue) != 2 || glue[0].Type != DNSRRTypeA || glue[1].Type != DNSRRTypeAAAA {
+		t.Errorf("function Glue() failed:\ngot:\n%v\nexpected:\nA and AAAA of ns.child.example.com", glue)
+	}
+}
+
+// 测试写时复制：更新不会影响已有的快照
+func TestZoneCopyOnWrite(t *testing.T) {
+	z, _ := LoadZone(strings.NewReader(testedZoneFile), "example.com")
+	before := z.Snapshot()
+
+	rr := DNSResourceRecord{Name: "new.deep.example.com", Type: DNSRRTypeA, Class: DNSClassIN, TTL: 300, RData: &DNSRDATAA{Address: net.IPv4(192, 0, 2, 2)}}
+	if err := z.Add(rr, rr); err != nil {
+		t.Fatalf("function Add() failed:\n%s", err)
+	}
+	z.Add(DNSResourceRecord{Name: "www.example.com", Type: DNSRRTypeA, Class: DNSClassIN, TTL: 3600, RData: &DNSRDATAA{Address: net.IPv4(192, 0, 2, 3)}})
+	after := z.Snapshot()
+
+	if before.Get("new.deep.example.com") != nil || len(before.RRSet("www.example.com", DNSRRTypeA)) != 1 {
+		t.Error("function Add() failed: the old snapshot was modified")
+	}
+	if len(after.RRSet("new.deep.example.com", DNSRRTypeA)) != 1 || after.Get("deep.example.com") == nil || after.Len() != before.Len()+2 {
+		t.Errorf("function Add() failed: new snapshot got %d nodes, expected: %d", after.Len(), before.Len()+2)
+	}
+	if len(after.RRSet("www.example.com", DNSRRTypeA)) != 2 {
+		t.Error("function Add() failed: the record was not added to the existing RRset")
+	}
+	if err := z.Add(DNSResourceRecord{Name: "www.example.org", Type: DNSRRTypeA, Class: DNSClassIN, RData: &DNSRDATAA{Address: net.IPv4(192, 0, 2, 4)}}); err == nil {
+		t.Error("function Add() failed: expected an error but got nil")
+	}
+
+	// 删除后，空非终端名称随之删除
+	z.Remove("new.deep.example.com", DNSRRTypeA)
+	if s := z.Snapshot(); s.Get("new.deep.example.com") != nil || s.Get("deep.example.com") != nil || s.Len() != before.Len() {
+		t.Errorf("function Remove() failed: got %d nodes, expected: %d", s.Len(), before.Len())
+	}
+	// 含有子域名的节点被保留为空非终端名称
+	z.Remove("child.example.com", DNSQTypeANY)
+	if n := z.Snapshot().Get("child.example.com"); n == nil || !n.Empty() {
+		t.Errorf("function Remove() failed: child.example.com got %v, expected: an empty non-terminal", n)
+	}
+	if after.Get("child.example.com").Empty() {
+		t.Error("function Remove() failed: the old snapshot was modified")
+	}
+}
+
+// 测试并发读取及更新
+func TestZoneConcurrency(t *testing.T) {
+	z := NewZone("example.com")
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				z.Add(DNSResourceRecord{Name: fmt.Sprintf("h%d.w%d.example.com", i, w), Type: DNSRRTypeA, Class: DNSClassIN, TTL: 60, RData: &DNSRDATAA{Address: net.IPv4(192, 0, 2, byte(i))}})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s := z.Snapshot()
+				count := 0
+				s.Walk(func(*ZoneNode) bool {
+					count++
+					return true
+				})
+				if count != s.Len() {
+					t.Errorf("function Snapshot() failed: walked %d nodes, Len() got %d", count, s.Len())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := z.Snapshot().Len(); n != 1+4+400 {
+		t.Errorf("function Add() failed: got %d nodes, expected: %d", n, 1+4+400)
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// zonefile.go 文件实现了 RFC 1035 第 5 节定义的区域文件（Master File）格式的解析。
+// 支持 $ORIGIN、$TTL 指令，括号跨行、注释、引号字符串及省略的所有者名称、TTL、类别；
+// RDATA 支持 A、AAAA、NS、CNAME、DNAME、PTR、MX、SOA、TXT、DS、DNSKEY、RRSIG、NSEC，
+// 其余类型可以使用 RFC 3597 定义的 "\# 长度 十六进制" 通用格式。
+
+package dns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zoneEntry 是区域文件中的一个条目（可能跨越多行）
+type zoneEntry struct {
+	tokens []string
+	// 条目是否以空白字符开始，即省略了所有者名称
+	blankOwner bool
+	line       int
+}
+
+// ParseZone 解析区域文件，返回其中的资源记录。
+//   - 其接收参数为 区域文件 及 初始的 $ORIGIN，
+//   - 返回值为 按照文件顺序排列的资源记录 及 报错信息。
+//
+// 返回的域名均为不以 '.' 结尾的绝对域名，根域名为 "."。
+// 未指定 TTL 的记录使用 $TTL 或上一条记录的 TTL，二者均不存在时报错。
+func ParseZone(r io.Reader, origin string) ([]DNSResourceRecord, error) {
+	entries, err := splitZoneEntries(r)
+	if err != nil {
+		return nil, err
+	}
+
+	origin = zoneAbsName(origin, ".")
+	var rrs []DNSResourceRecord
+	var owner string
+	var ttl uint32
+	// ttlSet 表示是否存在可沿用的 TTL，dollarTTL 表示该 TTL 是否来自 $TTL
+	ttlSet, dollarTTL := false, false
+	for _, e := range entries {
+		tokens := e.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN requires a domain name", e.line)
+			}
+			origin = zoneAbsName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: $TTL requires a value", e.line)
+			}
+			if ttl, err = parseZoneTTL(tokens[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", e.line, err)
+			}
+			ttlSet, dollarTTL = true, true
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, fmt.Errorf("line %d: %s is not supported", e.line, tokens[0])
+		}
+
+		if !e.blankOwner {
+			owner = zoneAbsName(tokens[0], origin)
+			tokens = tokens[1:]
+		} else if owner == "" {
+			return nil, fmt.Errorf("line %d: no owner name", e.line)
+		}
+
+		rr := DNSResourceRecord{Name: owner, Class: DNSClassIN, TTL: ttl}
+		explicitTTL := false
+		for len(tokens) > 0 {
+			if t, err := parseZoneTTL(tokens[0]); err == nil {
+				rr.TTL, explicitTTL = t, true
+			} else if c, ok := parseZoneClass(tokens[0]); ok {
+				rr.Class = c
+			} else {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: missing record type", e.line)
+		}
+		if !explicitTTL && !ttlSet {
+			return nil, fmt.Errorf("line %d: no TTL specified", e.line)
+		}
+		if explicitTTL && !dollarTTL {
+			// 没有 $TTL 时，后续记录沿用上一条记录的 TTL
+			ttl, ttlSet = rr.TTL, true
+		}
+
+		if rr.Type, err = ParseDNSType(tokens[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", e.line, err)
+		}
+		if rr.RData, err = parseZoneRDATA(rr.Type, tokens[1:], origin); err != nil {
+			return nil, fmt.Errorf("line %d: %s record: %v", e.line, tokens[0], err)
+		}
+		rr.RDLen = uint16(rr.RData.Size())
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// splitZoneEntries 将区域文件切分为条目，处理注释、引号及括号
+func splitZoneEntries(r io.Reader) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var cur *zoneEntry
+	token := strings.Builder{}
+	inToken, inQuote := false, false
+	depth := 0
+
+	flush := func() {
+		if inToken {
+			cur.tokens = append(cur.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+
+	br := bufio.NewReader(r)
+	line := 1
+	lineStart := true
+	for {
+		ch, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cur == nil {
+			cur = &zoneEntry{line: line, blankOwner: lineStart && (ch == ' ' || ch == '\t')}
+		}
+		lineStart = false
+
+		switch {
+		case ch == '\\':
+			next, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: dangling escape", line)
+			}
+			token.WriteByte(ch)
+			token.WriteByte(next)
+			inToken = true
+		case inQuote:
+			if ch == '"' {
+				inQuote = false
+			} else {
+				if ch == '\n' {
+					line++
+				}
+				token.WriteByte(ch)
+			}
+		case ch == '"':
+			inQuote, inToken = true, true
+		case ch == ';':
+			flush()
+			for ch != '\n' {
+				if ch, err = br.ReadByte(); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				br.UnreadByte()
+			}
+		case ch == '(':
+			flush()
+			depth++
+		case ch == ')':
+			flush()
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+			}
+			depth--
+		case ch == '\n':
+			flush()
+			line++
+			lineStart = true
+			if depth == 0 {
+				if len(cur.tokens) > 0 {
+					entries = append(entries, *cur)
+				}
+				cur = nil
+			}
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			flush()
+		default:
+			token.WriteByte(ch)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+	}
+	if cur != nil {
+		flush()
+		if len(cur.tokens) > 0 {
+			entries = append(entries, *cur)
+		}
+	}
+	return entries, nil
+}
+
+// zoneAbsName 将区域文件中的域名转换为不以 '.' 结尾的绝对域名
+func zoneAbsName(name, origin string) string {
+	name = unescapeZoneText(name)
+	switch {
+	case name == "@":
+		return origin
+	case name == ".":
+		return "."
+	case strings.HasSuffix(name, "."):
+		return name[:len(name)-1]
+	case origin == ".":
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// unescapeZoneText 处理区域文件中的 \X 及 \DDD 转义
+func unescapeZoneText(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if v, err := strconv.Atoi(s[i+1 : i+4]); err == nil && v < 256 {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+// parseZoneTTL 解析 TTL，支持纯数字及 BIND 风格的单位（如 1h30m）
+func parseZoneTTL(s string) (uint32, error) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+	var total, cur uint64
+	for _, ch := range strings.ToLower(s) {
+		if ch >= '0' && ch <= '9' {
+			cur = cur*10 + uint64(ch-'0')
+			continue
+		}
+		unit, ok := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[ch]
+		if !ok {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		total += cur * unit
+		cur = 0
+	}
+	total += cur
+	if total > 0xffffffff {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return uint32(total), nil
+}
+
+// parseZoneClass 解析类别助记符
+func parseZoneClass(s string) (DNSClass, bool) {
+	upper := strings.ToUpper(s)
+	for _, c := range []DNSClass{DNSClassIN, DNSClassCS, DNSClassCH, DNSClassHS} {
+		if upper == c.String() {
+			return c, true
+		}
+	}
+	if strings.HasPrefix(upper, "CLASS") {
+		if v, err := strconv.ParseUint(upper[5:], 10, 16); err == nil {
+			return DNSClass(v), true
+		}
+	}
+	return 0, false
+}
+
+// ParseDNSType 解析类型助记符，如 "AAAA" 或 RFC 3597 定义的 "TYPE65534"。
+//   - 其接收参数为 类型助记符（不区分大小写），
+//   - 返回值为 类型 及 报错信息。
+func ParseDNSType(s string) (DNSType, error) {
+	upper := strings.ToUpper(s)
+	if strings.HasPrefix(upper, "TYPE") {
+		if v, err := strconv.ParseUint(upper[4:], 10, 16); err == nil {
+			return DNSType(v), nil
+		}
+	}
+	if t, ok := dnsTypeByName[upper]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown type %q", s)
+}
+
+// dnsTypeByName 是类型助记符到类型的映射，由 DNSType.String 生成
+var dnsTypeByName = func() map[string]DNSType {
+	m := make(map[string]DNSType)
+	add := func(t int) {
+		if name := DNSType(t).String(); !strings.HasPrefix(name, "Unknown") {
+			m[name] = DNSType(t)
+		}
+	}
+	// 已分配的类型值均小于 512，或位于 32768 之后
+	for t := 1; t < 512; t++ {
+		add(t)
+	}
+	for t := 32768; t < 32770; t++ {
+		add(t)
+	}
+	return m
+}()
+
+// EncodeTypeBitMaps 将类型列表编码为 NSEC/NSEC3 记录的 Type Bit Maps 字段，详见 RFC 4034 4.1.2 节。
+//   - 其接收参数为 类型列表（无需排序，可以重复），
+//   - 返回值为 编码后的 Type Bit Maps。
+func EncodeTypeBitMaps(types []DNSType) []byte {
+	sorted := append([]DNSType{}, types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var out []byte
+	for i := 0; i < len(sorted); {
+		window := byte(sorted[i] >> 8)
+		bitmap := make([]byte, 32)
+		length := 0
+		for ; i < len(sorted) && byte(sorted[i]>>8) == window; i++ {
+			low := byte(sorted[i])
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = max(length, int(low/8)+1)
+		}
+		out = append(out, window, byte(length))
+		out = append(out, bitmap[:length]...)
+	}
+	return out
+}
+
+// DecodeTypeBitMaps 解码 NSEC/NSEC3 记录的 Type Bit Maps 字段，返回按照升序排列的类型列表。
+func DecodeTypeBitMaps(data []byte) []DNSType {
+	var types []DNSType
+	for len(data) >= 2 {
+		window, length := int(data[0]), int(data[1])
+		if length == 0 || length > 32 || len(data) < 2+length {
+			break
+		}
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, DNSType(window<<8|i*8+bit))
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types
+}
+
+// parseZoneRDATA 解析 RDATA 的文本表示
+func parseZoneRDATA(rrType DNSType, fields []string, origin string) (DNSRRRDATA, error) {
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseZoneGenericRDATA(rrType, fields[1:])
+	}
+	need := func(n int) error {
+		if len(fields) < n {
+			return fmt.Errorf("expected at least %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+	uints := func(bits int, fs ...string) ([]uint64, error) {
+		vs := make([]uint64, len(fs))
+		for i, f := range fs {
+			v, err := strconv.ParseUint(f, 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", f)
+			}
+			vs[i] = v
+		}
+		return vs, nil
+	}
+
+	switch rrType {
+	case DNSRRTypeA, DNSRRTypeAAAA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if rrType == DNSRRTypeA {
+			if ip = ip.To4(); ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+			}
+			return &DNSRDATAA{Address: ip}, nil
+		}
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		return &DNSRDATAUnknown{RRType: rrType, RData: ip.To16()}, nil
+	case DNSRRTypeNS, DNSRRTypeCNAME, DNSRRTypeDNAME, DNSRRTypePTR:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		name := zoneAbsName(fields[0], origin)
+		switch rrType {
+		case DNSRRTypeNS:
+			return &DNSRDATANS{NSDNAME: name}, nil
+		case DNSRRTypeCNAME:
+			return &DNSRDATACNAME{CNAME: name}, nil
+		}
+		return &DNSRDATAUnknown{RRType: rrType, RData: EncodeDomainName(&name)}, nil
+	case DNSRRTypeMX:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		pref, err := uints(16, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		name := zoneAbsName(fields[1], origin)
+		data := binary.BigEndian.AppendUint16(nil, uint16(pref[0]))
+		return &DNSRDATAUnknown{RRType: rrType, RData: append(data, EncodeDomainName(&name)...)}, nil
+	case DNSRRTypeSOA:
+		if err := need(7); err != nil {
+			return nil, err
+		}
+		vs := make([]uint32, 5)
+		for i, f := range fields[2:7] {
+			v, err := parseZoneTTL(f)
+			if err != nil {
+				return nil, err
+			}
+			vs[i] = v
+		}
+		return &DNSRDATASOA{
+			MName: zoneAbsName(fields[0], origin), RName: zoneAbsName(fields[1], origin),
+			Serial: vs[0], Refresh: vs[1], Retry: vs[2], Expire: vs[3], Minimum: vs[4],
+		}, nil
+	case DNSRRTypeTXT:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if len(fields) == 1 {
+			return &DNSRDATATXT{TXT: unescapeZoneText(fields[0])}, nil
+		}
+		var data []byte
+		for _, f := range fields {
+			s := unescapeZoneText(f)
+			data = append(data, EncodeCharacterStr(&s)...)
+		}
+		return &DNSRDATAUnknown{RRType: rrType, RData: data}, nil
+	case DNSRRTypeDS:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		vs, err := uints(16, fields[:3]...)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest: %v", err)
+		}
+		return &DNSRDATADS{KeyTag: uint16(vs[0]), Algorithm: DNSSECAlgorithm(vs[1]), DigestType: DNSSECDigestType(vs[2]), Digest: digest}, nil
+	case DNSRRTypeDNSKEY:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		vs, err := uints(16, fields[:3]...)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %v", err)
+		}
+		return &DNSRDATADNSKEY{Flags: DNSKEYFlag(vs[0]), Protocol: DNSKEYProtocol(vs[1]), Algorithm: DNSSECAlgorithm(vs[2]), PublicKey: key}, nil
+	case DNSRRTypeRRSIG:
+		if err := need(9); err != nil {
+			return nil, err
+		}
+		covered, err := ParseDNSType(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		vs, err := uints(32, fields[1], fields[2], fields[3], fields[6])
+		if err != nil {
+			return nil, err
+		}
+		expiration, err := parseZoneTime(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		inception, err := parseZoneTime(fields[5])
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.Join(fields[8:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature: %v", err)
+		}
+		return &DNSRDATARRSIG{
+			TypeCovered: covered, Algorithm: DNSSECAlgorithm(vs[0]), Labels: uint8(vs[1]),
+			OriginalTTL: uint32(vs[2]), Expiration: expiration, Inception: inception,
+			KeyTag: uint16(vs[3]), SignerName: zoneAbsName(fields[7], origin), Signature: sig,
+		}, nil
+	case DNSRRTypeNSEC:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		types := make([]DNSType, 0, len(fields)-1)
+		for _, f := range fields[1:] {
+			t, err := ParseDNSType(f)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, t)
+		}
+		return &DNSRDATANSEC{NextDomainName: zoneAbsName(fields[0], origin), TypeBitMaps: EncodeTypeBitMaps(types)}, nil
+	}
+	return nil, fmt.Errorf("unsupported presentation format, use \\# instead")
+}
+
+// parseZoneTime 解析 RRSIG 的时间字段，支持 YYYYMMDDHHmmSS 及 Unix 时间戳
+func parseZoneTime(s string) (uint32, error) {
+	if len(s) == 14 {
+		t, err := time.Parse("20060102150405", s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		return uint32(t.Unix()), nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return uint32(v), nil
+}
+
+// parseZoneGenericRDATA 解析 RFC 3597 定义的通用 RDATA 格式
+func parseZoneGenericRDATA(rrType DNSType, fields []string) (DNSRRRDATA, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing RDATA length")
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA length %q", fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA: %v", err)
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf("RDATA length %d does not match %d", len(data), length)
+	}
+	rdata := DNSRRRDATAFactory(rrType)
+	if _, err := rdata.DecodeFromBuffer(data, 0, len(data)); err != nil {
+		return &DNSRDATAUnknown{RRType: rrType, RData: data}, nil
+	}
+	return rdata, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// zonefile_test.go 文件定义了对 zonefile.go 的单元测试
+
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 测试区域文件的解析
+func TestParseZone(t *testing.T) {
+	zone := `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 admin (
+		2024010101 ; serial
+		7200 3600 1w 300 )
+	IN	NS	ns1
+ns1	300	IN	A	192.0.2.1
+	AAAA	2001:db8::1
+www	CNAME	@
+txt	TXT	"hello world" "second\"string"
+mail	MX	10 mx.example.net.
+*.wild	A	192.0.2.2
+sub	DS	12345 8 2 ( 0011 2233 )
+unknown	TYPE65534 \# 3 abcdef
+`
+	rrs, err := ParseZone(strings.NewReader(zone), "")
+	if err != nil {
+		t.Fatalf("function ParseZone() failed:\n%s", err)
+	}
+	expected := []struct {
+		name  string
+		rtype DNSType
+		ttl   uint32
+	}{
+		{"example.com", DNSRRTypeSOA, 3600},
+		{"example.com", DNSRRTypeNS, 3600},
+		{"ns1.example.com", DNSRRTypeA, 300},
+		{"ns1.example.com", DNSRRTypeAAAA, 3600},
+		{"www.example.com", DNSRRTypeCNAME, 3600},
+		{"txt.example.com", DNSRRTypeTXT, 3600},
+		{"mail.example.com", DNSRRTypeMX, 3600},
+		{"*.wild.example.com", DNSRRTypeA, 3600},
+		{"sub.example.com", DNSRRTypeDS, 3600},
+		{"unknown.example.com", DNSType(65534), 3600},
+	}
+	if len(rrs) != len(expected) {
+		t.Fatalf("function ParseZone() failed:\ngot:\n%d records\nexpected:\n%d records", len(rrs), len(expected))
+	}
+	for i, e := range expected {
+		if rrs[i].Name != e.name || rrs[i].Type != e.rtype || rrs[i].TTL != e.ttl {
+			t.Errorf("function ParseZone() failed:\ngot:\n%s %s %d\nexpected:\n%s %s %d",
+				rrs[i].Name, rrs[i].Type, rrs[i].TTL, e.name, e.rtype, e.ttl)
+		}
+	}
+
+	soa := rrs[0].RData.(*DNSRDATASOA)
+	if soa.MName != "ns1.example.com" || soa.Serial != 2024010101 || soa.Expire != 604800 || soa.Minimum != 300 {
+		t.Errorf("function ParseZone() failed:\ngot:\n%v", soa)
+	}
+	if cname := rrs[4].RData.(*DNSRDATACNAME); cname.CNAME != "example.com" {
+		t.Errorf("function ParseZone() failed:\ngot:\n%s\nexpected:\n%s", cname.CNAME, "example.com")
+	}
+	txt := rrs[5].RData.Encode()
+	if !bytes.Equal(txt, append([]byte("\x0bhello world"), []byte("\x0dsecond\"string")...)) {
+		t.Errorf("function ParseZone() failed:\ngot:\n%q", txt)
+	}
+	if ds := rrs[8].RData.(*DNSRDATADS); ds.KeyTag != 12345 || !bytes.Equal(ds.Digest, []byte{0x00, 0x11, 0x22, 0x33}) {
+		t.Errorf("function ParseZone() failed:\ngot:\n%v", ds)
+	}
+	if !bytes.Equal(rrs[9].RData.Encode(), []byte{0xab, 0xcd, 0xef}) {
+		t.Errorf("function ParseZone() failed:\ngot:\n%v", rrs[9].RData.Encode())
+	}
+
+	// 没有 $TTL 时，未指定 TTL 的记录沿用上一条记录的 TTL
+	rrs, err = ParseZone(strings.NewReader("www 300 A 192.0.2.1\n A 192.0.2.2\nmail 600 A 192.0.2.3\nftp A 192.0.2.4\n"), "example.com")
+	if err != nil {
+		t.Fatalf("function ParseZone() failed:\n%s", err)
+	}
+	for i, ttl := range []uint32{300, 300, 600, 600} {
+		if len(rrs) != 4 || rrs[i].TTL != ttl {
+			t.Fatalf("function ParseZone() failed:\ngot:\n%v\nexpected TTL:\n%d", rrs, ttl)
+		}
+	}
+
+	for _, bad := range []string{
+		"www A 192.0.2.1\n",
+		"$TTL 300\nwww A 2001:db8::1\n",
+		"$TTL 300\nwww A ( 192.0.2.1\n",
+		"$TTL 300\nwww BOGUS x\n",
+	} {
+		if _, err := ParseZone(strings.NewReader(bad), "example.com"); err == nil {
+			t.Errorf("function ParseZone() should fail on:\n%s", bad)
+		}
+	}
+}
+
+// 测试 Type Bit Maps 的编码及解码
+func TestTypeBitMaps(t *testing.T) {
+	types := []DNSType{DNSRRTypeRRSIG, DNSRRTypeA, DNSRRTypeNSEC, DNSRRTypeMX, DNSRRTypeCAA}
+	encoded := EncodeTypeBitMaps(types)
+	// RFC 4034 4.3 节的示例：A MX RRSIG NSEC，及窗口 1 中的 CAA
+	expected := []byte{
+		0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03,
+		0x01, 0x01, 0x40,
+	}
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("function EncodeTypeBitMaps() failed:\ngot:\n%v\nexpected:\n%v", encoded, expected)
+	}
+	decoded := DecodeTypeBitMaps(encoded)
+	if len(decoded) != 5 || decoded[0] != DNSRRTypeA || decoded[4] != DNSRRTypeCAA {
+		t.Errorf("function DecodeTypeBitMaps() failed:\ngot:\n%v", decoded)
+	}
+}
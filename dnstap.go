@@ -0,0 +1,416 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// dnstap.go 文件实现了 dnstap 输出，详见 https://dnstap.info。
+// DnstapWriter 将查询与回复编码为 dnstap 的 AUTH_QUERY/AUTH_RESPONSE 消息，
+// 并以 Frame Streams 的格式写入文件或 Unix 套接字，可直接被 dnstap 工具链读取。
+// 为了能在离线环境下使用，protobuf 编码由本文件自行实现，不依赖任何外部库。
+
+package godns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DnstapContentType 是 dnstap 在 Frame Streams 中的内容类型
+const DnstapContentType = "protobuf:dnstap.Dnstap"
+
+// DnstapConfig 记录 dnstap 输出的配置
+type DnstapConfig struct {
+	// 输出文件路径，与 Socket 二选一
+	Path string
+	// Unix 套接字路径，与 Path 二选一，将使用双向 Frame Streams 握手
+	Socket string
+
+	// dnstap 消息中的服务器标识及版本，为空时不设置
+	Identity string
+	Version  string
+
+	// 待写入消息的队列大小，默认为 1024，队列已满时消息将被丢弃
+	QueueSize int
+}
+
+// dnstap 消息类型，详见 dnstap.proto
+const (
+	dnstapTypeMessage = 1
+
+	DnstapAuthQuery    = 1
+	DnstapAuthResponse = 2
+
+	dnstapSocketFamilyINET  = 1
+	dnstapSocketFamilyINET6 = 2
+
+	dnstapSocketProtocolUDP = 1
+	dnstapSocketProtocolTCP = 2
+	dnstapSocketProtocolDOH = 4
+)
+
+// Frame Streams 控制帧类型及字段类型
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+)
+
+// DnstapWriter 以 Frame Streams 格式写出 dnstap 消息。
+// 消息由后台协程异步写出，不会阻塞查询的处理。
+type DnstapWriter struct {
+	Config       DnstapConfig
+	DnstapLogger *slog.Logger
+
+	conn io.ReadWriteCloser
+	bw   *bufio.Writer
+
+	queue   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	closed  sync.Once
+	dropped atomic.Uint64
+}
+
+// NewDnstapWriter 根据配置打开输出文件或连接 Unix 套接字，并写入 Frame Streams 起始帧
+// 其接受参数为：
+//   - conf DnstapConfig，dnstap 配置
+//   - logger *slog.Logger，日志
+//
+// 返回值为：
+//   - *DnstapWriter，dnstap 输出器
+//   - error，错误信息
+func NewDnstapWriter(conf DnstapConfig, logger *slog.Logger) (*DnstapWriter, error) {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 1024
+	}
+
+	w := &DnstapWriter{
+		Config:       conf,
+		DnstapLogger: logger,
+		queue:        make(chan []byte, conf.QueueSize),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	switch {
+	case conf.Socket != "":
+		conn, err := net.Dial("unix", conf.Socket)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting dnstap socket %s: %v", conf.Socket, err)
+		}
+		w.conn = conn
+		if err := w.handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	case conf.Path != "":
+		file, err := os.Create(conf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error creating dnstap file %s: %v", conf.Path, err)
+		}
+		w.conn = file
+	default:
+		return nil, errors.New("dnstap output path or socket is required")
+	}
+
+	w.bw = bufio.NewWriter(w.conn)
+	if err := writeControlFrame(w.bw, fstrmControlStart, true); err != nil {
+		w.conn.Close()
+		return nil, fmt.Errorf("error writing dnstap start frame: %v", err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// handshake 与 Unix 套接字另一端的接收方完成双向 Frame Streams 握手
+func (w *DnstapWriter) handshake() error {
+	if err := writeControlFrame(w.conn, fstrmControlReady, true); err != nil {
+		return fmt.Errorf("error writing dnstap ready frame: %v", err)
+	}
+	ctype, err := readControlFrame(w.conn)
+	if err != nil {
+		return fmt.Errorf("error reading dnstap accept frame: %v", err)
+	}
+	if ctype != fstrmControlAccept {
+		return fmt.Errorf("unexpected dnstap control frame type %d, expected accept", ctype)
+	}
+	return nil
+}
+
+// WriteQuery 写出一条 AUTH_QUERY 消息
+// 其接受参数为：
+//   - connInfo ConnectionInfo，链接信息
+//   - qTime time.Time，收到查询的时间
+func (w *DnstapWriter) WriteQuery(connInfo ConnectionInfo, qTime time.Time) {
+	w.enqueue(encodeDnstap(w.Config, DnstapAuthQuery, connInfo, qTime, nil, time.Time{}))
+}
+
+// WriteResponse 写出一条 AUTH_RESPONSE 消息
+// 其接受参数为：
+//   - connInfo ConnectionInfo，链接信息
+//   - qTime time.Time，收到查询的时间
+//   - resp []byte，回复
+//   - rTime time.Time，发送回复的时间
+func (w *DnstapWriter) WriteResponse(connInfo ConnectionInfo, qTime time.Time, resp []byte, rTime time.Time) {
+	w.enqueue(encodeDnstap(w.Config, DnstapAuthResponse, connInfo, qTime, resp, rTime))
+}
+
+// Dropped 返回因队列已满而丢弃的消息数量
+func (w *DnstapWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// enqueue 将编码后的消息放入写出队列，队列已满或已关闭时丢弃
+func (w *DnstapWriter) enqueue(frame []byte) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	select {
+	case w.queue <- frame:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// run 不断从队列中取出消息并写出，队列为空时刷新缓冲区
+func (w *DnstapWriter) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case frame := <-w.queue:
+			w.writeFrame(frame)
+			if len(w.queue) == 0 {
+				w.flush()
+			}
+		case <-w.done:
+			// 写出队列中剩余的消息
+			for {
+				select {
+				case frame := <-w.queue:
+					w.writeFrame(frame)
+				default:
+					w.flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *DnstapWriter) writeFrame(frame []byte) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	w.bw.Write(hdr[:])
+	if _, err := w.bw.Write(frame); err != nil {
+		w.DnstapLogger.Error("Error writing dnstap frame", "err", err)
+	}
+}
+
+func (w *DnstapWriter) flush() {
+	if err := w.bw.Flush(); err != nil {
+		w.DnstapLogger.Error("Error flushing dnstap output", "err", err)
+	}
+}
+
+// Close 写出队列中剩余的消息及 Frame Streams 终止帧，并关闭输出
+func (w *DnstapWriter) Close() error {
+	var err error
+	w.closed.Do(func() {
+		close(w.done)
+		// 等待后台协程写出剩余的消息
+		<-w.stopped
+
+		if err = writeControlFrame(w.bw, fstrmControlStop, false); err == nil {
+			err = w.bw.Flush()
+		}
+		if err == nil && w.Config.Socket != "" {
+			// 双向模式下，等待接收方的 FINISH 帧
+			var ctype uint32
+			ctype, err = readControlFrame(w.conn)
+			if err == nil && ctype != fstrmControlFinish {
+				err = fmt.Errorf("unexpected dnstap control frame type %d, expected finish", ctype)
+			}
+		}
+		if cerr := w.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// writeControlFrame 写出一个 Frame Streams 控制帧
+func writeControlFrame(wr io.Writer, ctype uint32, withContentType bool) error {
+	payload := binary.BigEndian.AppendUint32(nil, ctype)
+	if withContentType {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(DnstapContentType)))
+		payload = append(payload, DnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0) // 转义序列
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := wr.Write(frame)
+	return err
+}
+
+// readControlFrame 读取一个 Frame Streams 控制帧，并返回其类型
+func readControlFrame(rd io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, errors.New("expected control frame")
+	}
+	size := binary.BigEndian.Uint32(hdr[4:])
+	if size < 4 || size > 512 {
+		return 0, fmt.Errorf("invalid control frame length %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// encodeDnstap 将查询或回复编码为 dnstap.Dnstap protobuf 消息
+func encodeDnstap(conf DnstapConfig, mType uint64, connInfo ConnectionInfo, qTime time.Time, resp []byte, rTime time.Time) []byte {
+	msg := pbAppendVarintField(nil, 1, mType)
+
+	family := uint64(dnstapSocketFamilyINET)
+	qIP, qPort := addrIPPort(connInfo.Address)
+	if qIP != nil && qIP.To4() == nil {
+		family = dnstapSocketFamilyINET6
+	}
+	msg = pbAppendVarintField(msg, 2, family)
+
+	proto := uint64(dnstapSocketProtocolUDP)
+	switch connInfo.Protocol {
+	case ProtocolTCP:
+		proto = dnstapSocketProtocolTCP
+	case ProtocolDoH:
+		proto = dnstapSocketProtocolDOH
+	}
+	msg = pbAppendVarintField(msg, 3, proto)
+
+	if qIP != nil {
+		msg = pbAppendBytesField(msg, 4, dnstapIP(qIP, family))
+	}
+	rIP, rPort := connInfo.localAddr()
+	if rIP != nil {
+		msg = pbAppendBytesField(msg, 5, dnstapIP(rIP, family))
+	}
+	if qIP != nil {
+		msg = pbAppendVarintField(msg, 6, uint64(qPort))
+	}
+	if rIP != nil {
+		msg = pbAppendVarintField(msg, 7, uint64(rPort))
+	}
+
+	msg = pbAppendVarintField(msg, 8, uint64(qTime.Unix()))
+	msg = pbAppendFixed32Field(msg, 9, uint32(qTime.Nanosecond()))
+	if mType == DnstapAuthQuery {
+		msg = pbAppendBytesField(msg, 10, connInfo.Packet)
+	} else {
+		msg = pbAppendVarintField(msg, 12, uint64(rTime.Unix()))
+		msg = pbAppendFixed32Field(msg, 13, uint32(rTime.Nanosecond()))
+		msg = pbAppendBytesField(msg, 14, resp)
+	}
+
+	var frame []byte
+	if conf.Identity != "" {
+		frame = pbAppendBytesField(frame, 1, []byte(conf.Identity))
+	}
+	if conf.Version != "" {
+		frame = pbAppendBytesField(frame, 2, []byte(conf.Version))
+	}
+	frame = pbAppendBytesField(frame, 14, msg)
+	frame = pbAppendVarintField(frame, 15, dnstapTypeMessage)
+	return frame
+}
+
+// dnstapIP 按照套接字地址族返回 IP 地址的字节形式
+func dnstapIP(ip net.IP, family uint64) []byte {
+	if family == dnstapSocketFamilyINET {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return ip.To16()
+}
+
+// localAddr 返回接收该查询的本地地址及端口，无法获知时返回 nil
+func (connInfo ConnectionInfo) localAddr() (net.IP, int) {
+	if connInfo.LocalAddress != nil {
+		return addrIPPort(connInfo.LocalAddress)
+	}
+	var addr net.Addr
+	if connInfo.StreamConn != nil {
+		addr = connInfo.StreamConn.LocalAddr()
+	} else if connInfo.PacketConn != nil {
+		addr = connInfo.PacketConn.LocalAddr()
+	}
+	return addrIPPort(addr)
+}
+
+// 以下函数实现了 dnstap 所需的最小 protobuf 编码
+
+// pbAppendVarint 追加一个 varint 编码的整数
+func pbAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// pbAppendVarintField 追加一个 varint 类型（wire type 0）的字段
+func pbAppendVarintField(b []byte, field int, v uint64) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3)
+	return pbAppendVarint(b, v)
+}
+
+// pbAppendBytesField 追加一个长度前缀类型（wire type 2）的字段
+func pbAppendBytesField(b []byte, field int, v []byte) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3|2)
+	b = pbAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// pbAppendFixed32Field 追加一个 fixed32 类型（wire type 5）的字段
+func pbAppendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// DnstapMiddleware 返回一个为每个查询及其回复写出 dnstap 消息的中间件
+// 其接受参数为：
+//   - w *DnstapWriter，dnstap 输出器
+//
+// 为了记录实际发送的回复，该中间件应位于可能修改回复的中间件（如错误注入）的外层。
+func DnstapMiddleware(w *DnstapWriter) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			qTime := time.Now()
+			w.WriteQuery(connInfo, qTime)
+			resp, err := next.ServeDNS(connInfo)
+			if err == nil && len(resp) > 0 {
+				w.WriteResponse(connInfo, qTime, resp, time.Now())
+			}
+			return resp, err
+		})
+	}
+}
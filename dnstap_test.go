@@ -0,0 +1,238 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// dnstap_test.go 文件定义了对 dnstap.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// readTestFrame 读取一个 Frame Streams 帧，控制帧返回其类型，数据帧返回其内容
+func readTestFrame(t *testing.T, rd io.Reader) (data []byte, ctype uint32) {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		t.Fatalf("error reading frame: %v", err)
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	control := size == 0
+	if control {
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			t.Fatalf("error reading control frame: %v", err)
+		}
+		size = binary.BigEndian.Uint32(hdr[:])
+	}
+	data = make([]byte, size)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		t.Fatalf("error reading frame payload: %v", err)
+	}
+	if control {
+		return data, binary.BigEndian.Uint32(data)
+	}
+	return data, 0
+}
+
+// pbTestFields 将 protobuf 消息解析为字段号到值（varint 为 uint64，其余为 []byte）的映射
+func pbTestFields(t *testing.T, b []byte) map[int]any {
+	t.Helper()
+	fields := map[int]any{}
+	readVarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid varint in %v", b)
+		}
+		b = b[n:]
+		return v
+	}
+	for len(b) > 0 {
+		key := readVarint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			fields[field] = readVarint()
+		case 2:
+			l := readVarint()
+			fields[field] = b[:l]
+			b = b[l:]
+		case 5:
+			fields[field] = b[:4]
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// testDnstapConnInfo 返回一个用于测试的 UDP 链接信息
+func testDnstapConnInfo() ConnectionInfo {
+	return ConnectionInfo{
+		Protocol: ProtocolUDP,
+		Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+		Packet:   testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false),
+	}
+}
+
+// TestDnstapFile 测试写入文件的 dnstap 输出
+func TestDnstapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godns.dnstap")
+	w, err := NewDnstapWriter(DnstapConfig{Path: path, Identity: "godns"}, discardLogger())
+	if err != nil {
+		t.Fatalf("NewDnstapWriter failed: %v", err)
+	}
+	connInfo := testDnstapConnInfo()
+	qTime := time.Unix(1700000000, 123)
+	resp := []byte{0x12, 0x34, 0x81, 0x80}
+	w.WriteQuery(connInfo, qTime)
+	w.WriteResponse(connInfo, qTime, resp, qTime.Add(time.Millisecond))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading dnstap file: %v", err)
+	}
+	rd := bytes.NewReader(data)
+
+	start, ctype := readTestFrame(t, rd)
+	if ctype != fstrmControlStart || !bytes.Contains(start, []byte(DnstapContentType)) {
+		t.Errorf("start frame got: %v, expected start frame with content type", start)
+	}
+
+	expected := []struct {
+		mType   uint64
+		field   int
+		message []byte
+	}{
+		{DnstapAuthQuery, 10, connInfo.Packet},
+		{DnstapAuthResponse, 14, resp},
+	}
+	for _, e := range expected {
+		frame, _ := readTestFrame(t, rd)
+		dt := pbTestFields(t, frame)
+		if !bytes.Equal(dt[1].([]byte), []byte("godns")) {
+			t.Errorf("identity got: %s, expected: godns", dt[1])
+		}
+		msg := pbTestFields(t, dt[14].([]byte))
+		if msg[1] != e.mType {
+			t.Errorf("message type got: %v, expected: %v", msg[1], e.mType)
+		}
+		if !bytes.Equal(msg[4].([]byte), []byte{192, 0, 2, 1}) || msg[6] != uint64(5353) {
+			t.Errorf("query address got: %v:%v, expected: 192.0.2.1:5353", msg[4], msg[6])
+		}
+		if msg[8] != uint64(qTime.Unix()) {
+			t.Errorf("query time got: %v, expected: %v", msg[8], qTime.Unix())
+		}
+		if !bytes.Equal(msg[e.field].([]byte), e.message) {
+			t.Errorf("message got: %v, expected: %v", msg[e.field], e.message)
+		}
+	}
+
+	if _, ctype := readTestFrame(t, rd); ctype != fstrmControlStop {
+		t.Errorf("last frame type got: %d, expected: %d", ctype, fstrmControlStop)
+	}
+}
+
+// TestDnstapSocket 测试通过 Unix 套接字的双向 Frame Streams 输出
+func TestDnstapSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dnstap.sock")
+	lstr, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix socket not available: %v", err)
+	}
+	defer lstr.Close()
+
+	frames := make(chan int, 1)
+	go func() {
+		conn, err := lstr.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, ctype := readTestFrame(t, conn); ctype != fstrmControlReady {
+			t.Errorf("first frame type got: %d, expected: %d", ctype, fstrmControlReady)
+		}
+		writeControlFrame(conn, fstrmControlAccept, true)
+		if _, ctype := readTestFrame(t, conn); ctype != fstrmControlStart {
+			t.Errorf("second frame type got: %d, expected: %d", ctype, fstrmControlStart)
+		}
+		n := 0
+		for {
+			if _, ctype := readTestFrame(t, conn); ctype == fstrmControlStop {
+				break
+			}
+			n++
+		}
+		writeControlFrame(conn, fstrmControlFinish, false)
+		frames <- n
+	}()
+
+	w, err := NewDnstapWriter(DnstapConfig{Socket: sock}, discardLogger())
+	if err != nil {
+		t.Fatalf("NewDnstapWriter failed: %v", err)
+	}
+	h := Chain(HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+		return []byte{0x12, 0x34, 0x81, 0x80}, nil
+	}), DnstapMiddleware(w))
+	for i := 0; i < 3; i++ {
+		h.ServeDNS(testDnstapConnInfo())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := <-frames; n != 6 {
+		t.Errorf("data frames got: %d, expected: 6", n)
+	}
+}
+
+// TestServerDnstap 测试服务器中的 dnstap 中间件位于 ACL 外层，且输出无法创建时返回错误
+func TestServerDnstap(t *testing.T) {
+	conf := DNSServerConfig{LogWriter: io.Discard, PoolCapcity: -1}
+	conf.Dnstap = &DnstapConfig{Socket: filepath.Join(t.TempDir(), "missing.sock")}
+	if _, err := NewGoDNSServerE(conf, &DullResponser{}); err == nil {
+		t.Errorf("NewGoDNSServerE with unreachable socket got: nil error, expected: error")
+	}
+
+	path := filepath.Join(t.TempDir(), "godns.dnstap")
+	denied, _ := ParseCIDRs("192.0.2.1")
+	conf.Dnstap = &DnstapConfig{Path: path}
+	conf.ACL = &ACLConfig{Rules: []ACLRule{{Deny: true, Networks: denied}}}
+	server, err := NewGoDNSServerE(conf, &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}})
+	if err != nil {
+		t.Fatalf("NewGoDNSServerE failed: %v", err)
+	}
+	connInfo := testDnstapConnInfo()
+	connInfo.Record = &QueryRecord{}
+	resp, err := server.Handler().ServeDNS(connInfo)
+	if err != nil || len(resp) == 0 {
+		t.Fatalf("denied query got: %v %v, expected: REFUSED", resp, err)
+	}
+	if err := server.Dnstap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading dnstap file: %v", err)
+	}
+	rd := bytes.NewReader(data)
+	readTestFrame(t, rd)
+	for _, mType := range []uint64{DnstapAuthQuery, DnstapAuthResponse} {
+		frame, _ := readTestFrame(t, rd)
+		msg := pbTestFields(t, pbTestFields(t, frame)[14].([]byte))
+		if msg[1] != mType {
+			t.Errorf("message type got: %v, expected: %v", msg[1], mType)
+		}
+	}
+}
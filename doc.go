@@ -14,8 +14,29 @@
 //   - Responser: DNS回复器
 //
 // [Netter] 接收、解析、发送数据包，并维护连接状态。
+// Netter 会遍历其持有的 [Transport]（如 UDP、TCP、DoH），
+// 通过实现 Transport 接口即可添加新的传输方式。
 //
 // [Responser] 响应、解析、构造DNS回复。
+// 除以代码合成回答的回复器外，[AuthoritativeResponser] 会根据 [dns.Zone] 中的区域数据给出权威回答，区域可以在服务期间更新。
+//
+// 查询在到达 Responser 之前会依次经过若干 [Middleware]，
+// 日志、缓存等功能均以中间件的形式实现，可以通过 [GoDNSServer.Use] 添加自定义中间件。
+//
+// 启用缓存后，[Cacher] 将回复保存在内存 LRU 缓存中，缓存期限取自回复的最小 TTL 或 SOA 记录，
+// 配置 CacheLocation 后还会将回复写入磁盘作为持久化层。
+// 缓存的存储后端可以通过 [Cache] 接口替换为 [MemoryCache]、[DiskCache] 或单文件的 [FileCache]。
+// 启用 ServeStaleConfig 后，后端失败或超时时 [Cacher] 会返回附带 EDE 选项的过期回复（RFC 8767）。
+// [CacheAdmin] 通过 HTTP 接口列出、清除、导出及预先填充缓存条目，cmd/godns-cache 命令行工具提供相同的功能。
+//
+// 各组件通过 log/slog 输出结构化日志，每个查询都会输出一条 [QueryRecord]。
+// 可以通过 DNSServerConfig 的 LogFormat、LogHandler 及 LogLevels 选择 JSON 或文本格式、
+// 自定义日志处理器，并为各组件设置不同的日志级别。
+//
+// 配置 DNSServerConfig 的 Metrics 后，[Metrics] 会记录查询、回复码、耗时、缓存命中及线程池等指标，
+// 并以 Prometheus 文本格式在 HTTP 监听器上输出。
+// 配置 RRL 后，[RRL] 会按照客户端前缀及回复类别限制 UDP 回复的速率，避免服务器被用于放大攻击；
+// 配置 ACL 后，[ACL] 会按照客户端网段、协议及查询名称后缀拒绝查询。
 //
 // 示例
 //
@@ -56,6 +77,16 @@
 // 及许多辅助函数，如 “笨笨”处理器、[DNSSECResponser]、
 // [ParseQueryInfo]、[ParseResponseInfo] 等。
 //
+// [ViewResponser] 可以按照客户端地址、协议、ECS、TSIG 密钥或本地地址选择不同的子 Responser，
+// 从而为不同的客户端提供不同的回答；[FaultResponser] 及 [FaultMiddleware] 可以按照概率
+// 对回复注入丢弃、延迟、截断、篡改等故障，用于测试解析器的健壮性。
+// [ForwardingResponser] 将查询转发至上游服务器，并在回复发送前交由钩子函数修改，
+// 从而可以位于真实服务器之前，仅篡改部分回答。
+// [IterativeResolver] 是一个最简的迭代解析器，支持根提示、委派、胶水记录、CNAME、
+// 查询名称最小化，并记录每次解析的查询过程，可用于解析器相关的研究。
+// [Hierarchy] 根据 根 -> 顶级域 -> 区域 的声明式描述，在回环地址上启动多个权威服务器，
+// 自动添加委派、DS 记录及 NSEC 链并签名各区域，输出根区域的信任锚点，便于构建完全本地、完全签名的实验环境。
+//
 // 可以参考它们的实现方式来实现自定义的 Responser，
 // 从而随意构造 DNS 回复，实现更加复杂的回复逻辑。
 //
@@ -116,6 +147,11 @@
 //
 //   - GenKeyWithTag [该函数十分耗时] 用于生成一个具有指定 KeyTag 的 DNSKEY。
 //
+// # godnstest 子包
+//
+// godnstest 包提供了内存传输层 MemTransport 及 NewTestServer 函数，
+// 可以在不绑定真实端口的情况下端到端地测试 Responser。
+//
 // # English
 //
 // GoDNS is a fast and flexible experimental DNS server designed to help developers and researchers explore and experiment with various features of the DNS protocol.
@@ -130,9 +166,24 @@
 //   - Responser: DNS responder
 //
 // [Netter] receives, parses, and sends packets while maintaining connection states.
+// Netter iterates over its [Transport]s (such as UDP, TCP and DoH);
+// new transports can be added by implementing the Transport interface.
 //
 // [Responser] responds to, parses, and constructs DNS replies.
 //
+// Before reaching the Responser, each query passes through a chain of [Middleware]s.
+// Logging and caching are implemented as middlewares; custom ones can be added with [GoDNSServer.Use].
+//
+// All components log through log/slog, and every query is logged as a [QueryRecord].
+// LogFormat, LogHandler and LogLevels in DNSServerConfig select JSON or text output,
+// plug in a custom handler, and set per-component levels.
+//
+// Setting Metrics in DNSServerConfig enables [Metrics], which counts queries, rcodes,
+// latency, cache hits and pool usage, and serves them in the Prometheus text format over HTTP.
+// Setting RRL enables BIND-style [RRL], which limits UDP responses per client prefix and
+// response category so the server cannot be abused for amplification, and setting ACL
+// enables an [ACL] that denies queries by client network, protocol and qname suffix.
+//
 // # Example
 //
 // You can quickly start a basic GoDNS server with the following lines of code:
@@ -171,6 +222,18 @@
 // The responser.go file provides several examples of Responser implementations,
 // as well as many utility functions like [ParseQueryInfo], [ParseResponseInfo], etc.
 //
+// [ViewResponser] selects among child Responsers by client address, transport, ECS,
+// TSIG key or destination address, so different clients can see different answers.
+// [FaultResponser] and [FaultMiddleware] inject faults such as drops, delays, truncation
+// and corrupted bytes with a configurable probability, to test resolver robustness.
+// [ForwardingResponser] relays queries to upstream servers and lets a hook modify
+// the decoded answer, so godns can sit in front of a real server and tamper with only some replies.
+// [IterativeResolver] is a minimal iterative resolver with root hints, referral and glue handling,
+// CNAME chasing, optional QNAME minimisation and a per-query trace, for resolver research.
+// [Hierarchy] builds a local root -> TLD -> zone hierarchy from a declarative description: it adds
+// delegations, DS records and NSEC chains, signs every zone, starts authoritative servers on loopback
+// addresses and writes a root trust anchor, so a resolver under test can run against a fully signed local tree.
+//
 // You can refer to these implementations to create your own custom Responser,
 // allowing you to construct DNS responses in any way you choose, and implement more complex reply logic.
 //
@@ -223,4 +286,9 @@
 //   - GenWrongKeyWithTag: Generates an incorrect DNSKEY with a specified KeyTag.
 //
 //   - GenKeyWithTag [This function is resource-intensive]: Generates a DNSKEY with a specified KeyTag.
+//
+// # godnstest subpackage
+//
+// The godnstest package provides the in-memory MemTransport and the NewTestServer function,
+// allowing Responsers to be tested end to end without binding real ports.
 package godns
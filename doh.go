@@ -0,0 +1,303 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// doh.go 文件实现了 DNS-over-HTTPS（DoH）服务端，详见 RFC 8484。
+// DoHHandler 接收 GET（?dns= base64url）与 POST（application/dns-message）请求，
+// 将解码后的 DNS 消息以 ProtocolDoH 的形式交给 Responser 处理，
+// 并将回复以 application/dns-message 的形式写回客户端。
+// 通过 DoHFault 可以注入 HTTP 层面的错误，以测试客户端的行为。
+
+package godns
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// DoHMediaType 是 RFC 8484 规定的 DNS 消息媒体类型。
+const DoHMediaType = "application/dns-message"
+
+// DoHConfig 记录 DoH 服务端的配置
+type DoHConfig struct {
+	// 监听端口
+	Port int
+	// 服务路径，默认为 "/dns-query"
+	Path string
+
+	// TLS 证书及私钥文件，均不为空时启用 HTTPS，并由 net/http 协商 HTTP/2；
+	// 否则以明文 HTTP/1.1 提供服务。
+	CertFile string
+	KeyFile  string
+
+	// 等待回复的超时时间，默认为 5 秒
+	Timeout time.Duration
+
+	// HTTP 层面的错误注入，为 nil 时不注入
+	Fault *DoHFault
+}
+
+// DoHFault 描述在 HTTP 层面注入的错误
+type DoHFault struct {
+	// StatusCode 不为 0 时，使用该状态码代替 200
+	StatusCode int
+	// ContentType 不为空时，使用该值代替 application/dns-message
+	ContentType string
+	// OmitCacheControl 为 true 时，不设置 Cache-Control 头部
+	OmitCacheControl bool
+	// EmptyBody 为 true 时，不写入回复内容
+	EmptyBody bool
+}
+
+// DoHTransport 是基于 DNS-over-HTTPS 的传输层实现。
+type DoHTransport struct {
+	Config    DoHConfig
+	DoHLogger *slog.Logger
+
+	mu  sync.Mutex
+	srv *http.Server
+}
+
+// NewDoHTransport 创建一个 DoH 传输层
+func NewDoHTransport(conf DoHConfig, logger *slog.Logger) *DoHTransport {
+	return &DoHTransport{
+		Config:    conf,
+		DoHLogger: logger,
+	}
+}
+
+// Listen 启动 DoH 服务，并将收到的查询投递到链接信息通道中。
+// 配置了证书时以 HTTPS 提供服务（支持 HTTP/2），否则以明文 HTTP/1.1 提供服务。
+func (t *DoHTransport) Listen(connChan chan<- ConnectionInfo) error {
+	handler := NewDoHHandler(t.Config, connChan, t.DoHLogger)
+	handler.Transport = t
+
+	mux := http.NewServeMux()
+	mux.Handle(handler.Config.Path, handler)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", t.Config.Port),
+		Handler: mux,
+	}
+	t.mu.Lock()
+	t.srv = srv
+	t.mu.Unlock()
+
+	var err error
+	if t.Config.CertFile != "" && t.Config.KeyFile != "" {
+		err = srv.ListenAndServeTLS(t.Config.CertFile, t.Config.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Reply 将回复交给等待中的 DoH 处理器
+func (t *DoHTransport) Reply(connInfo ConnectionInfo, data []byte) error {
+	// 回复通道带有缓冲，DoH 处理器超时返回后也不会阻塞
+	select {
+	case connInfo.HTTPReply <- data:
+		return nil
+	default:
+		return fmt.Errorf("DoH reply to %s dropped", connInfo.Address)
+	}
+}
+
+// Close 关闭 DoH 服务
+func (t *DoHTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.srv == nil {
+		return nil
+	}
+	return t.srv.Close()
+}
+
+// DoHHandler 是一个实现了 http.Handler 接口的 DoH 处理器。
+// 其既可以由 DoHTransport 启动，也可以挂载在自定义的 http.Server 上。
+type DoHHandler struct {
+	Config    DoHConfig
+	ConnChan  chan<- ConnectionInfo
+	Transport Transport
+	DoHLogger *slog.Logger
+}
+
+// NewDoHHandler 创建一个 DoH 处理器
+// 其接受参数为：
+//   - conf DoHConfig，DoH 配置
+//   - connChan chan<- ConnectionInfo，链接信息通道
+//   - logger *slog.Logger，日志
+func NewDoHHandler(conf DoHConfig, connChan chan<- ConnectionInfo, logger *slog.Logger) *DoHHandler {
+	if conf.Path == "" {
+		conf.Path = "/dns-query"
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	return &DoHHandler{
+		Config:    conf,
+		ConnChan:  connChan,
+		Transport: NewDoHTransport(conf, logger),
+		DoHLogger: logger,
+	}
+}
+
+// ServeHTTP 处理 DoH 请求，并将其发送到链接信息通道中，等待回复。
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pkt, status, err := readDoHQuery(r)
+	if err != nil {
+		h.DoHLogger.Debug("Error reading DoH query", "client", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var addr net.Addr
+	addr, err = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		addr = &net.TCPAddr{}
+	}
+
+	// 服务器繁忙或客户端断开时不应阻塞在链接信息通道上，超时时间同时涵盖排队与等待回复
+	timeout := time.NewTimer(h.Config.Timeout)
+	defer timeout.Stop()
+	reply := make(chan []byte, 1)
+	select {
+	case h.ConnChan <- ConnectionInfo{
+		Protocol:  ProtocolDoH,
+		Address:   addr,
+		HTTPReply: reply,
+		Transport: h.Transport,
+		Packet:    pkt,
+	}:
+	case <-timeout.C:
+		h.DoHLogger.Warn("Timeout queueing DoH query", "client", r.RemoteAddr)
+		http.Error(w, "server busy", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	var resp []byte
+	select {
+	case resp = <-reply:
+		if resp == nil {
+			// 服务器放弃回复该查询
+			http.Error(w, "query dropped", http.StatusServiceUnavailable)
+			return
+		}
+	case <-timeout.C:
+		h.DoHLogger.Warn("Timeout waiting for DoH response", "client", r.RemoteAddr)
+		http.Error(w, "no response", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	h.writeResponse(w, resp)
+}
+
+// writeResponse 将 DNS 回复写入 HTTP 回复中，并按需注入错误。
+func (h *DoHHandler) writeResponse(w http.ResponseWriter, resp []byte) {
+	fault := h.Config.Fault
+	if fault == nil {
+		fault = &DoHFault{}
+	}
+
+	contentType := DoHMediaType
+	if fault.ContentType != "" {
+		contentType = fault.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if !fault.OmitCacheControl {
+		if maxAge, ok := DoHMaxAge(resp); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+		}
+	}
+
+	status := http.StatusOK
+	if fault.StatusCode != 0 {
+		status = fault.StatusCode
+	}
+
+	if fault.EmptyBody {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// readDoHQuery 从 HTTP 请求中读取 DNS 查询
+// 返回值为：
+//   - []byte，DNS 查询的编码
+//   - int，出错时应当返回的 HTTP 状态码
+//   - error，错误信息
+func readDoHQuery(r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing dns parameter")
+		}
+		// RFC 8484 要求使用无填充的 base64url 编码，此处同时兼容带填充的形式
+		pkt, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid dns parameter: %v", err)
+		}
+		return pkt, 0, nil
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != DoHMediaType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", ct)
+		}
+		pkt, err := io.ReadAll(io.LimitReader(r.Body, 65535))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("error reading body: %v", err)
+		}
+		return pkt, 0, nil
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+}
+
+// DoHMaxAge 根据 DNS 回复计算 Cache-Control 的 max-age 值，详见 RFC 8484 5.1 节。
+// 其取回答部分中最小的 TTL，若回答部分为空，则取权威部分中最小的 TTL。
+// 若回复无法解析或不包含任何记录，返回 false。
+func DoHMaxAge(resp []byte) (uint32, bool) {
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(resp, 0); err != nil {
+		return 0, false
+	}
+	if ttl, ok := minSectionTTL(msg.Answer); ok {
+		return ttl, true
+	}
+	return minSectionTTL(msg.Authority)
+}
+
+// minSectionTTL 返回记录部分中（除伪记录外）最小的 TTL
+func minSectionTTL(section dns.DNSResponseSection) (uint32, bool) {
+	found := false
+	minTTL := uint32(0)
+	for _, rr := range section {
+		if dns.IsPseudoRR(&rr) {
+			continue
+		}
+		if !found || rr.TTL < minTTL {
+			minTTL = rr.TTL
+			found = true
+		}
+	}
+	return minTTL, found
+}
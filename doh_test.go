@@ -0,0 +1,150 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// doh_test.go 文件定义了对 doh.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// newTestDoHServer 启动一个由 DullResponser 回复的 DoH 测试服务器
+func newTestDoHServer(t *testing.T, fault *DoHFault) *httptest.Server {
+	logger := discardLogger()
+	connChan := make(chan ConnectionInfo)
+	handler := NewDoHHandler(DoHConfig{Fault: fault}, connChan, logger)
+	netter := &Netter{NetterLogger: logger}
+	responser := &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}
+
+	go func() {
+		for connInfo := range connChan {
+			resp, err := responser.Response(connInfo)
+			if err != nil {
+				continue
+			}
+			netter.Send(connInfo, resp)
+		}
+	}()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		srv.Close()
+		close(connChan)
+	})
+	return srv
+}
+
+// TestDoHGet 测试 GET 方式的 DoH 查询
+func TestDoHGet(t *testing.T) {
+	srv := newTestDoHServer(t, nil)
+
+	param := base64.RawURLEncoding.EncodeToString(testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false))
+	resp, err := http.Get(srv.URL + "/dns-query?dns=" + param)
+	if err != nil {
+		t.Fatalf("DoH GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code got: %d, expected: %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != DoHMediaType {
+		t.Errorf("content type got: %s, expected: %s", ct, DoHMediaType)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=3600" {
+		t.Errorf("cache control got: %s, expected: max-age=3600", cc)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(body, 0); err != nil {
+		t.Fatalf("decode response failed: %v", err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].Type != dns.DNSRRTypeA {
+		t.Errorf("unexpected answer section:\n%s", msg.Answer.String())
+	}
+}
+
+// TestDoHPost 测试 POST 方式的 DoH 查询
+func TestDoHPost(t *testing.T) {
+	srv := newTestDoHServer(t, nil)
+
+	resp, err := http.Post(srv.URL+"/dns-query", DoHMediaType, bytes.NewReader(testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false)))
+	if err != nil {
+		t.Fatalf("DoH POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code got: %d, expected: %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// 错误的 Content-Type
+	resp, err = http.Post(srv.URL+"/dns-query", "text/plain", bytes.NewReader(testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false)))
+	if err != nil {
+		t.Fatalf("DoH POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("status code got: %d, expected: %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
+
+// TestDoHFault 测试 HTTP 层面的错误注入
+func TestDoHFault(t *testing.T) {
+	srv := newTestDoHServer(t, &DoHFault{
+		StatusCode:       http.StatusServiceUnavailable,
+		ContentType:      "text/html",
+		OmitCacheControl: true,
+	})
+
+	resp, err := http.Post(srv.URL+"/dns-query", DoHMediaType, bytes.NewReader(testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false)))
+	if err != nil {
+		t.Fatalf("DoH POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code got: %d, expected: %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("content type got: %s, expected: text/html", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		t.Errorf("cache control got: %s, expected none", cc)
+	}
+}
+
+// TestDoHBusy 测试链接信息通道无人读取时，处理器在超时或客户端断开后返回而不是一直阻塞
+func TestDoHBusy(t *testing.T) {
+	handler := NewDoHHandler(DoHConfig{Timeout: 50 * time.Millisecond}, make(chan ConnectionInfo), discardLogger())
+	param := base64.RawURLEncoding.EncodeToString(testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+param, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code got: %d, expected: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	handler.Config.Timeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dns-query?dns="+param, nil).WithContext(ctx))
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("ServeHTTP did not return after the client went away")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// edns.go 文件定义了读写 EDNS(0) 选项的工具函数。
+// dns.DNSRDATAOPT 只记录第一个选项的代码及长度，其余选项会被一并保存在 OptionData 中，
+// EDNSOptions 会将其重新切分为独立的选项，AppendEDNSOption 则按照相同的方式追加选项。
+
+package godns
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// 常用的 EDNS(0) 选项代码
+const (
+	// EDNS Client Subnet，RFC 7871
+	EDNSOptionCodeECS uint16 = 8
+	// Extended DNS Errors，RFC 8914
+	EDNSOptionCodeEDE uint16 = 15
+)
+
+// 常用的 Extended DNS Error 信息代码，RFC 8914 第 4 节
+const (
+	// 回复来自已过期的缓存，RFC 8767
+	EDECodeStaleAnswer uint16 = 3
+	// 回复来自已过期的 NXDOMAIN 缓存
+	EDECodeStaleNXDomainAnswer uint16 = 19
+)
+
+// EDNSOptions 返回消息中 OPT 记录携带的所有 EDNS(0) 选项
+// 其接受参数为：
+//   - msg dns.DNSMessage，DNS 消息
+//
+// 返回值为：
+//   - []dns.DNSRDATAOPT，按顺序排列的选项，消息不含 OPT 记录时为 nil
+func EDNSOptions(msg dns.DNSMessage) []dns.DNSRDATAOPT {
+	var opts []dns.DNSRDATAOPT
+	for _, rr := range msg.Additional {
+		if rr.Type != dns.DNSRRTypeOPT || rr.RData == nil {
+			continue
+		}
+		raw := rr.RData.Encode()
+		for len(raw) >= 4 {
+			size := int(binary.BigEndian.Uint16(raw[2:]))
+			if len(raw) < 4+size {
+				break
+			}
+			opts = append(opts, dns.DNSRDATAOPT{
+				OptionCode:   binary.BigEndian.Uint16(raw),
+				OptionLength: uint16(size),
+				OptionData:   raw[4 : 4+size],
+			})
+			raw = raw[4+size:]
+		}
+	}
+	return opts
+}
+
+// ClientSubnet 返回查询中 EDNS Client Subnet 选项携带的客户端网段
+// 其接受参数为：
+//   - qry dns.DNSMessage，DNS 查询
+//
+// 返回值为：
+//   - *net.IPNet，客户端网段，掩码长度为 SOURCE PREFIX-LENGTH
+//   - bool，查询是否携带合法的 ECS 选项
+func ClientSubnet(qry dns.DNSMessage) (*net.IPNet, bool) {
+	for _, opt := range EDNSOptions(qry) {
+		if opt.OptionCode != EDNSOptionCodeECS || len(opt.OptionData) < 4 {
+			continue
+		}
+		family := binary.BigEndian.Uint16(opt.OptionData)
+		prefix := int(opt.OptionData[2])
+		addr := opt.OptionData[4:]
+
+		var ip net.IP
+		switch family {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return nil, false
+		}
+		if prefix > len(ip)*8 || len(addr) > len(ip) {
+			return nil, false
+		}
+		copy(ip, addr)
+		mask := net.CIDRMask(prefix, len(ip)*8)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+	}
+	return nil, false
+}
+
+// ExtendedDNSError 构造一个 Extended DNS Error 选项
+// 其接受参数为：
+//   - code uint16，信息代码，如 EDECodeStaleAnswer
+//   - text string，附加的说明文字，可以为空
+func ExtendedDNSError(code uint16, text string) dns.DNSRDATAOPT {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	data = append(data, text...)
+	return dns.DNSRDATAOPT{
+		OptionCode:   EDNSOptionCodeEDE,
+		OptionLength: uint16(len(data)),
+		OptionData:   data,
+	}
+}
+
+// AppendEDNSOption 向消息的 OPT 记录追加一个 EDNS(0) 选项
+// 其接受参数为：
+//   - msg *dns.DNSMessage，DNS 消息
+//   - opt dns.DNSRDATAOPT，待追加的选项
+//
+// 返回值为：
+//   - bool，消息是否含有 OPT 记录，不含时不做任何修改
+func AppendEDNSOption(msg *dns.DNSMessage, opt dns.DNSRDATAOPT) bool {
+	for i := range msg.Additional {
+		rr := &msg.Additional[i]
+		if rr.Type != dns.DNSRRTypeOPT {
+			continue
+		}
+		rdata, ok := rr.RData.(*dns.DNSRDATAOPT)
+		if !ok || rdata.Size() == 0 {
+			rdata = &dns.DNSRDATAOPT{
+				OptionCode:   opt.OptionCode,
+				OptionLength: opt.OptionLength,
+				OptionData:   append([]byte{}, opt.OptionData...),
+			}
+		} else {
+			// 后续选项以完整的编码形式追加在第一个选项的数据之后
+			data := append([]byte{}, rdata.OptionData...)
+			data = binary.BigEndian.AppendUint16(data, opt.OptionCode)
+			data = binary.BigEndian.AppendUint16(data, opt.OptionLength)
+			rdata = &dns.DNSRDATAOPT{
+				OptionCode:   rdata.OptionCode,
+				OptionLength: rdata.OptionLength,
+				OptionData:   append(data, opt.OptionData...),
+			}
+		}
+		rr.RData = rdata
+		rr.RDLen = uint16(rdata.Size())
+		return true
+	}
+	return false
+}
+
+// UDPPayloadSize 返回查询通告的 UDP 负载大小
+// 查询不含 OPT 记录，或通告的大小小于 512 字节时返回 512，详见 RFC 6891 6.2.5 节
+func UDPPayloadSize(qry dns.DNSMessage) int {
+	size := 512
+	for _, rr := range qry.Additional {
+		if rr.Type == dns.DNSRRTypeOPT && int(rr.Class) > size {
+			size = int(rr.Class)
+		}
+	}
+	return size
+}
+
+// truncateUDP 在回复超出查询通告的 UDP 负载大小时截断回复，查询或回复无法解析时原样返回
+func truncateUDP(query, data []byte) []byte {
+	if len(data) <= 512 {
+		return data
+	}
+	qry := dns.DNSMessage{}
+	if _, err := qry.DecodeFromBuffer(query, 0); err != nil || len(data) <= UDPPayloadSize(qry) {
+		return data
+	}
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+		return data
+	}
+	TruncateResponse(&resp)
+	return resp.Encode()
+}
+
+// TruncateResponse 清空回复的回答、权威部分及 OPT 以外的附加记录，并设置 TC 位，
+// 客户端收到后将通过 TCP 重试，详见 RFC 2181 9 节
+func TruncateResponse(resp *dns.DNSMessage) {
+	var opt dns.DNSResponseSection
+	for _, rr := range resp.Additional {
+		if rr.Type == dns.DNSRRTypeOPT {
+			opt = append(opt, rr)
+		}
+	}
+	resp.Header.TC = true
+	resp.Answer, resp.Authority, resp.Additional = nil, nil, opt
+	FixCount(resp)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"sort"
@@ -72,7 +72,7 @@ var ExperiVec = KeyTrapVector{
 // }
 
 type KeyTrapResponser struct {
-	ResponserLogger *log.Logger
+	ResponserLogger *slog.Logger
 	DNSSECManager   godns.DNSSECManager
 }
 
@@ -371,7 +371,7 @@ func (r *KeyTrapResponser) Response(connInfo godns.ConnectionInfo) ([]byte, erro
 	// 解析查询信息
 	qry, err := godns.ParseQuery(connInfo)
 	if err != nil {
-		r.ResponserLogger.Printf("Error parsing query: %v", err)
+		r.ResponserLogger.Error("Error parsing query", "client", connInfo.Address, "err", err)
 		return []byte{}, err
 	}
 
@@ -380,8 +380,8 @@ func (r *KeyTrapResponser) Response(connInfo godns.ConnectionInfo) ([]byte, erro
 	qType := qry.Question[0].Type
 	qClass := qry.Question[0].Class
 
-	r.ResponserLogger.Printf("Recive DNS Query from %s,Protocol: %s,  Name: %s, Type: %s, Class: %s\n",
-		connInfo.Address.String(), connInfo.Protocol, qName, qType, qClass)
+	r.ResponserLogger.Debug("Receive DNS query", "client", connInfo.Address, "protocol", connInfo.Protocol,
+		"qname", qName, "qtype", qType.String(), "qclass", qClass.String())
 
 	// 初始化 NXDOMAIN 回复信息
 	resp := godns.InitNXDOMAIN(qry)
@@ -422,7 +422,7 @@ func (r *KeyTrapResponser) Response(connInfo godns.ConnectionInfo) ([]byte, erro
 
 	// crsp, err := dns.CompressDNSMessage(data)
 	// if err != nil {
-	// 	r.ResponserLogger.Printf("Error compressing response: %v", err)
+	// 	r.ResponserLogger.Error("Error compressing response", "err", err)
 	// 	return data, nil
 	// } else {
 	// 	return crsp, nil
@@ -453,20 +453,19 @@ func main() {
 
 	material := InitMaterial("test", dns.DNSSECAlgorithmECDSAP384SHA384, kskPublic, kskPriv)
 
-	dMap := sync.Map{}
-	dMap.Store("test", material)
+	manager := &KeyTrapManager{
+		DNSSECConf: godns.DNSSECConfig{
+			DAlgo: dns.DNSSECAlgorithmECDSAP384SHA384,
+			DType: dns.DNSSECDigestTypeSHA384,
+		},
+		AttackVec: ExperiVec,
+	}
+	manager.DNSSECMap.Store("test", material)
 
 	server := godns.NewGoDNSServer(conf,
 		&KeyTrapResponser{
-			ResponserLogger: log.New(conf.LogWriter, "KeyTrapResponser: ", log.LstdFlags),
-			DNSSECManager: &KeyTrapManager{
-				DNSSECConf: godns.DNSSECConfig{
-					DAlgo: dns.DNSSECAlgorithmECDSAP384SHA384,
-					DType: dns.DNSSECDigestTypeSHA384,
-				},
-				DNSSECMap: dMap,
-				AttackVec: ExperiVec,
-			},
+			ResponserLogger: godns.NewComponentLogger(conf, godns.LogComponentResponser),
+			DNSSECManager:   manager,
 		},
 	)
 
@@ -0,0 +1,325 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// fault.go 文件实现了故障注入。
+// FaultInjector 按照配置的概率及查询名称、类型，对 Responser 生成的回复注入故障：
+// 丢弃、延迟、重复发送、翻转头部比特、错误的 ID、错误的问题、截断、
+// 设置 TC 位、篡改 RDATA 字节，或额外发送一个未经请求的回复，用于测试解析器的健壮性。
+
+package godns
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// FaultType 表示故障的类型
+type FaultType string
+
+const (
+	// 丢弃回复
+	FaultDrop FaultType = "drop"
+	// 延迟 Delay 至 Delay+Jitter（均匀分布）后再发送回复
+	FaultDelay FaultType = "delay"
+	// 将回复发送两次
+	FaultDuplicate FaultType = "duplicate"
+	// 按照 FlipMask 翻转头部标志位，FlipMask 为 0 时随机翻转一位
+	FaultFlipBits FaultType = "flip-bits"
+	// 修改回复的 ID
+	FaultWrongID FaultType = "wrong-id"
+	// 修改问题部分的查询名称
+	FaultWrongQuestion FaultType = "wrong-question"
+	// 将回复截断为 Length 字节，Length 为 0 时截断为随机的非零长度
+	FaultTruncate FaultType = "truncate"
+	// 设置 TC 位但不截断回复
+	FaultSetTC FaultType = "set-tc"
+	// 随机篡改一条资源记录 RDATA 中的一个字节
+	FaultCorruptRDATA FaultType = "corrupt-rdata"
+	// 在回复之前额外发送一个 ID 随机的回复
+	FaultUnsolicited FaultType = "unsolicited"
+)
+
+// Fault 是一条故障注入规则
+type Fault struct {
+	Type FaultType
+	// 注入概率，取值为 0~1，为 0 时从不注入，大于等于 1 时总是注入
+	Probability float64
+
+	// 查询名称后缀，为空时匹配任意名称
+	QName string
+	// 查询类型，为空时匹配任意类型
+	QTypes []dns.DNSType
+
+	// FaultDelay 的参数
+	Delay  time.Duration
+	Jitter time.Duration
+	// FaultFlipBits 的参数，作用于头部第 3、4 字节（标志位）
+	FlipMask uint16
+	// FaultTruncate 的参数
+	Length int
+}
+
+// FaultConfig 记录故障注入的配置
+type FaultConfig struct {
+	// 故障注入规则，按顺序依次判断并注入
+	Faults []Fault
+	// 随机数种子，为 0 时使用随机种子；固定种子可以使故障注入的结果可复现
+	Seed uint64
+}
+
+// FaultInjector 实现故障注入，可被并发调用
+type FaultInjector struct {
+	Config      FaultConfig
+	FaultLogger *slog.Logger
+	// 指标记录器，不为 nil 时记录注入的故障数量
+	Metrics *Metrics
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+	// sleep 用于实现延迟，便于测试时替换
+	sleep func(time.Duration)
+}
+
+// metricFaults 是注入的故障数量的指标名称
+const metricFaults = "godns_faults_injected_total"
+
+// NewFaultInjector 创建一个故障注入器
+// 其接受参数为：
+//   - conf FaultConfig，故障注入配置
+//   - logger *slog.Logger，日志记录器，可以为 nil
+func NewFaultInjector(conf FaultConfig, logger *slog.Logger) *FaultInjector {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	if logger == nil {
+		logger = newWriterLogger(nil, LogComponentGoDNS)
+	}
+	return &FaultInjector{
+		Config:      conf,
+		FaultLogger: logger,
+		rnd:         rand.New(rand.NewPCG(seed, seed)),
+		sleep:       time.Sleep,
+	}
+}
+
+// SetMetrics 设置指标记录器，并注册注入故障数量的计数器
+func (f *FaultInjector) SetMetrics(m *Metrics) {
+	m.RegisterCounter(metricFaults, "Number of injected faults.", "fault")
+	f.Metrics = m
+}
+
+// intN 返回 [0, n) 中的随机整数
+func (f *FaultInjector) intN(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.IntN(n)
+}
+
+// hit 判断是否按照概率注入故障
+func (f *FaultInjector) hit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	if p >= 1 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Float64() < p
+}
+
+// match 判断故障规则是否匹配该查询
+func (fault *Fault) match(qname string, qtype dns.DNSType) bool {
+	if fault.QName != "" && !IsSubDomain(fault.QName, qname) {
+		return false
+	}
+	if len(fault.QTypes) == 0 {
+		return true
+	}
+	for _, t := range fault.QTypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Inject 对回复注入故障
+// 其接受参数为：
+//   - connInfo ConnectionInfo，链接信息，重复及未经请求的回复将通过其传输层发送
+//   - resp []byte，原始回复，不会被修改
+//
+// 返回值为：
+//   - []byte，注入故障后的回复，为空时表示回复被丢弃
+//   - []FaultType，实际注入的故障
+func (f *FaultInjector) Inject(connInfo ConnectionInfo, resp []byte) ([]byte, []FaultType) {
+	rec := connInfo.Record
+	if rec == nil {
+		rec = &QueryRecord{}
+	}
+	rec.fillQuery(connInfo)
+
+	var injected []FaultType
+	out := append([]byte{}, resp...)
+	for i := range f.Config.Faults {
+		fault := &f.Config.Faults[i]
+		if len(out) == 0 || !fault.match(rec.QName, rec.QType) || !f.hit(fault.Probability) {
+			continue
+		}
+		if !f.apply(fault, connInfo, &out) {
+			continue
+		}
+		injected = append(injected, fault.Type)
+		if f.Metrics != nil {
+			f.Metrics.Inc(metricFaults, string(fault.Type))
+		}
+	}
+	if len(injected) > 0 {
+		f.FaultLogger.Debug("Faults injected", "client", connInfo.Address, "qname", rec.QName, "faults", injected)
+	}
+	return out, injected
+}
+
+// apply 注入一个故障，返回故障是否被实际注入
+func (f *FaultInjector) apply(fault *Fault, connInfo ConnectionInfo, out *[]byte) bool {
+	resp := *out
+	switch fault.Type {
+	case FaultDrop:
+		*out = nil
+	case FaultDelay:
+		d := fault.Delay
+		if fault.Jitter > 0 {
+			d += time.Duration(f.intN(int(fault.Jitter)))
+		}
+		f.sleep(d)
+	case FaultDuplicate:
+		return f.sendExtra(connInfo, append([]byte{}, resp...))
+	case FaultUnsolicited:
+		if len(resp) < 2 {
+			return false
+		}
+		extra := append([]byte{}, resp...)
+		binary.BigEndian.PutUint16(extra, binary.BigEndian.Uint16(resp)^uint16(1+f.intN(0xffff)))
+		return f.sendExtra(connInfo, extra)
+	case FaultFlipBits:
+		if len(resp) < 4 {
+			return false
+		}
+		mask := fault.FlipMask
+		if mask == 0 {
+			mask = 1 << f.intN(16)
+		}
+		binary.BigEndian.PutUint16(resp[2:], binary.BigEndian.Uint16(resp[2:])^mask)
+	case FaultWrongID:
+		if len(resp) < 2 {
+			return false
+		}
+		binary.BigEndian.PutUint16(resp, binary.BigEndian.Uint16(resp)^uint16(1+f.intN(0xffff)))
+	case FaultWrongQuestion:
+		// 修改查询名称第一个标签的首字符；查询名称为根时修改查询类型
+		if len(resp) < 14 || binary.BigEndian.Uint16(resp[4:]) == 0 {
+			return false
+		}
+		if resp[12] > 0 && resp[12] < 64 {
+			resp[13] ^= 0x01
+		} else if len(resp) >= 15 {
+			resp[14] ^= 0x01
+		}
+	case FaultTruncate:
+		n := fault.Length
+		if n <= 0 || n >= len(resp) {
+			if len(resp) < 2 {
+				return false
+			}
+			n = 1 + f.intN(len(resp)-1)
+		}
+		*out = resp[:n]
+	case FaultSetTC:
+		if len(resp) < 3 {
+			return false
+		}
+		resp[2] |= 0x02
+	case FaultCorruptRDATA:
+		ranges := rdataRanges(resp)
+		if len(ranges) == 0 {
+			return false
+		}
+		r := ranges[f.intN(len(ranges))]
+		resp[r[0]+f.intN(r[1]-r[0])] ^= byte(1 + f.intN(0xff))
+	default:
+		return false
+	}
+	return true
+}
+
+// sendExtra 额外发送一个回复，DoH 等无法发送多个回复的传输方式将被跳过。
+// 流式链接上的回复会直接写入链接，而不经由传输层发送，以免链接在正式回复之前被关闭。
+func (f *FaultInjector) sendExtra(connInfo ConnectionInfo, data []byte) bool {
+	if connInfo.HTTPReply != nil {
+		return false
+	}
+	var err error
+	if connInfo.StreamConn != nil {
+		err = WriteStreamMessage(connInfo.StreamConn, data)
+	} else if connInfo.Transport != nil {
+		err = connInfo.Transport.Reply(connInfo, data)
+	} else {
+		return false
+	}
+	if err != nil {
+		f.FaultLogger.Debug("Error sending extra packet", "client", connInfo.Address, "err", err)
+		return false
+	}
+	return true
+}
+
+// rdataRanges 返回消息中所有 RDATA 非空的资源记录的 RDATA 区间 [start, end)，OPT 记录除外
+func rdataRanges(msg []byte) [][2]int {
+	rrs, _ := wireRRs(msg)
+	var ranges [][2]int
+	for _, rr := range rrs {
+		if rr.rdata[1] > rr.rdata[0] && rr.rrType != dns.DNSRRTypeOPT {
+			ranges = append(ranges, rr.rdata)
+		}
+	}
+	return ranges
+}
+
+// FaultMiddleware 返回一个故障注入中间件
+// 其接受参数为：
+//   - f *FaultInjector，故障注入器
+//
+// 该中间件应位于缓存中间件的外层，以免注入故障后的回复被缓存。
+func FaultMiddleware(f *FaultInjector) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			resp, err := next.ServeDNS(connInfo)
+			if err != nil || len(resp) == 0 {
+				return resp, err
+			}
+			out, _ := f.Inject(connInfo, resp)
+			return out, nil
+		})
+	}
+}
+
+// FaultResponser 是一个为任意 Responser 的回复注入故障的回复器
+type FaultResponser struct {
+	Responser Responser
+	Injector  *FaultInjector
+}
+
+// Response 调用被包装的 Responser 生成回复，并对回复注入故障
+func (r *FaultResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	resp, err := r.Responser.Response(connInfo)
+	if err != nil || len(resp) == 0 {
+		return resp, err
+	}
+	out, _ := r.Injector.Inject(connInfo, resp)
+	return out, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// fault_test.go 文件定义了对 fault.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// TestFaultInjector 测试各类故障对回复的修改
+func TestFaultInjector(t *testing.T) {
+	responser := &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}
+	var sent [][]byte
+	connInfo := func(name string) ConnectionInfo {
+		return ConnectionInfo{
+			Protocol:  ProtocolUDP,
+			Address:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Packet:    testQuery(0x1234, name, dns.DNSRRTypeA, 0, false),
+			Transport: &recordTransport{reply: func(b []byte) { sent = append(sent, b) }},
+			Record:    &QueryRecord{},
+		}
+	}
+	resp, _ := responser.Response(connInfo("www.example.com"))
+
+	inject := func(fault Fault) ([]byte, []FaultType) {
+		fault.Probability = 1
+		f := NewFaultInjector(FaultConfig{Faults: []Fault{fault}, Seed: 1}, discardLogger())
+		f.sleep = func(time.Duration) {}
+		return f.Inject(connInfo("www.example.com"), resp)
+	}
+
+	if out, faults := inject(Fault{Type: FaultDrop}); len(out) != 0 || len(faults) != 1 {
+		t.Errorf("drop got: %v %v, expected: empty", out, faults)
+	}
+	if out, _ := inject(Fault{Type: FaultWrongID}); binary.BigEndian.Uint16(out) == 0x1234 || !bytes.Equal(out[2:], resp[2:]) {
+		t.Errorf("wrong-id got: %v", out)
+	}
+	if out, _ := inject(Fault{Type: FaultSetTC}); len(out) != len(resp) || out[2]&0x02 == 0 {
+		t.Errorf("set-tc got: %v", out)
+	}
+	if out, _ := inject(Fault{Type: FaultFlipBits, FlipMask: 0x8000}); out[2]&0x80 != 0 {
+		t.Errorf("flip-bits should clear QR, got: %v", out[2])
+	}
+	if out, _ := inject(Fault{Type: FaultTruncate, Length: 20}); len(out) != 20 {
+		t.Errorf("truncate length got: %d, expected: 20", len(out))
+	}
+	if out, _ := inject(Fault{Type: FaultWrongQuestion}); bytes.Equal(out, resp) {
+		t.Errorf("wrong-question did not change the response")
+	} else {
+		msg := dns.DNSMessage{}
+		msg.DecodeFromBuffer(out, 0)
+		if msg.Question[0].Name == "www.example.com" {
+			t.Errorf("wrong-question name got: %s", msg.Question[0].Name)
+		}
+	}
+
+	out, _ := inject(Fault{Type: FaultCorruptRDATA})
+	ranges := rdataRanges(resp)
+	if len(ranges) != 1 || !bytes.Equal(out[:ranges[0][0]], resp[:ranges[0][0]]) || bytes.Equal(out, resp) {
+		t.Errorf("corrupt-rdata got: %v, expected: only RDATA changed", out)
+	}
+
+	sent = nil
+	inject(Fault{Type: FaultDuplicate})
+	inject(Fault{Type: FaultUnsolicited})
+	if len(sent) != 2 || !bytes.Equal(sent[0], resp) || binary.BigEndian.Uint16(sent[1]) == 0x1234 {
+		t.Errorf("extra packets got: %v", sent)
+	}
+
+	// 查询名称及类型不匹配时不注入
+	f := NewFaultInjector(FaultConfig{Faults: []Fault{
+		{Type: FaultDrop, Probability: 1, QName: "other.com"},
+		{Type: FaultDrop, Probability: 1, QTypes: []dns.DNSType{dns.DNSRRTypeTXT}},
+		{Type: FaultDrop},
+	}}, discardLogger())
+	if out, faults := f.Inject(connInfo("www.example.com"), resp); !bytes.Equal(out, resp) || len(faults) != 0 {
+		t.Errorf("unmatched faults got: %v", faults)
+	}
+}
+
+// TestFaultStream 测试流式链接上的额外回复先于正式回复写入，且不会关闭链接
+func TestFaultStream(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	tp := NewTCPTransport(0, discardLogger())
+	connInfo := ConnectionInfo{
+		Protocol:   ProtocolTCP,
+		Address:    &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+		StreamConn: server,
+		Transport:  tp,
+		Packet:     testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, false),
+	}
+	resp, _ := (&DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}).Response(connInfo)
+
+	f := NewFaultInjector(FaultConfig{Faults: []Fault{
+		{Type: FaultUnsolicited, Probability: 1},
+		{Type: FaultDuplicate, Probability: 1},
+	}, Seed: 1}, discardLogger())
+	go func() {
+		out, _ := f.Inject(connInfo, resp)
+		tp.Reply(connInfo, out)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var ids []uint16
+	for {
+		msg, err := ReadStreamMessage(client)
+		if err != nil {
+			break
+		}
+		ids = append(ids, binary.BigEndian.Uint16(msg))
+	}
+	if len(ids) != 3 || ids[0] == 0x1234 || ids[1] != 0x1234 || ids[2] != 0x1234 {
+		t.Errorf("stream message ids got: %v, expected: unsolicited, duplicate, response", ids)
+	}
+}
+
+// TestFaultProbability 测试注入概率及固定种子的可复现性
+func TestFaultProbability(t *testing.T) {
+	run := func() int {
+		m := NewMetrics(nil)
+		f := NewFaultInjector(FaultConfig{Faults: []Fault{{Type: FaultSetTC, Probability: 0.25}}, Seed: 42}, discardLogger())
+		f.SetMetrics(m)
+		for i := 0; i < 1000; i++ {
+			f.Inject(ConnectionInfo{Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false)}, []byte{0, 1, 0x81, 0x80})
+		}
+		return int(m.Counter(metricFaults, "set-tc"))
+	}
+	n := run()
+	if n < 150 || n > 350 {
+		t.Errorf("injected got: %d, expected: about 250", n)
+	}
+	if again := run(); again != n {
+		t.Errorf("injected with the same seed got: %d, expected: %d", again, n)
+	}
+}
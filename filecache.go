@@ -0,0 +1,344 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// filecache.go 文件定义了 FileCache，一个将所有缓存条目保存在单个文件中的嵌入式存储。
+// 文件以追加写入的日志形式组织，每条记录包含 CRC32 校验和、缓存键及条目，
+// 删除操作以墓碑记录表示；打开文件时重放日志重建索引，并截去末尾不完整的记录。
+// 失效记录占用的空间超过有效记录时，文件将被压缩重写。
+
+package godns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// fileCacheMagic 是缓存文件的文件头
+var fileCacheMagic = []byte("GODNSC01")
+
+const (
+	// 记录头部：CRC32、缓存键长度及条目长度
+	fileCacheRecordHeaderSize = 10
+	// 条目长度为该值时表示墓碑记录
+	fileCacheTombstone = 0xffffffff
+	// 失效记录超过该字节数，且超过有效记录时压缩文件
+	fileCacheCompactThreshold = 64 * 1024
+)
+
+// fileCacheLocation 记录条目在文件中的位置
+type fileCacheLocation struct {
+	// 条目的偏移量及长度
+	offset int64
+	size   uint32
+}
+
+// FileCache 是将所有条目保存在单个文件中的缓存
+type FileCache struct {
+	Path string
+	// 是否在每次写入后同步到磁盘
+	SyncWrites bool
+
+	mu    sync.RWMutex
+	file  *os.File
+	index map[string]fileCacheLocation
+	// 文件末尾的偏移量
+	end int64
+	// 有效条目及失效记录占用的字节数
+	live int64
+	dead int64
+}
+
+// OpenFileCache 打开或创建一个单文件缓存
+// 其接受参数为：
+//   - path string，缓存文件的路径
+//
+// 打开时将重放文件中的记录以重建索引，文件末尾不完整或校验失败的记录将被截去。
+func OpenFileCache(path string) (*FileCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileCache{Path: path, file: file}
+	if err := f.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load 重放文件中的记录，重建索引
+func (f *FileCache) load() error {
+	f.index = make(map[string]fileCacheLocation)
+	f.live, f.dead = 0, 0
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := f.file.WriteAt(fileCacheMagic, 0); err != nil {
+			return err
+		}
+		f.end = int64(len(fileCacheMagic))
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f.file, 0, info.Size()))
+	magic := make([]byte, len(fileCacheMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(fileCacheMagic) {
+		return fmt.Errorf("%s is not a godns cache file", f.Path)
+	}
+	offset := int64(len(fileCacheMagic))
+	for {
+		key, size, n, err := readFileCacheRecord(r)
+		if err != nil {
+			break
+		}
+		f.replace(key)
+		if size == fileCacheTombstone {
+			f.dead += n
+		} else {
+			f.index[key] = fileCacheLocation{offset: offset + n - int64(size), size: size}
+			f.live += int64(size)
+		}
+		offset += n
+	}
+	f.end = offset
+	// 截去末尾不完整的记录
+	if offset < info.Size() {
+		return f.file.Truncate(offset)
+	}
+	return nil
+}
+
+// readFileCacheRecord 读取一条记录，返回缓存键、条目长度及记录的总长度
+func readFileCacheRecord(r *bufio.Reader) (string, uint32, int64, error) {
+	header := make([]byte, fileCacheRecordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, 0, err
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[4:]))
+	size := binary.BigEndian.Uint32(header[6:])
+	bodyLen := keyLen
+	if size != fileCacheTombstone {
+		bodyLen += int(size)
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", 0, 0, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header) {
+		return "", 0, 0, errors.New("cache record checksum mismatch")
+	}
+	return string(body[:keyLen]), size, int64(fileCacheRecordHeaderSize + bodyLen), nil
+}
+
+// encodeFileCacheRecord 编码一条记录，value 为 nil 时编码为墓碑记录
+func encodeFileCacheRecord(key string, value []byte) []byte {
+	size := uint32(fileCacheTombstone)
+	if value != nil {
+		size = uint32(len(value))
+	}
+	record := make([]byte, fileCacheRecordHeaderSize, fileCacheRecordHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint16(record[4:], uint16(len(key)))
+	binary.BigEndian.PutUint32(record[6:], size)
+	record = append(record, key...)
+	record = append(record, value...)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// append 在文件末尾追加一条记录，需持有写锁
+func (f *FileCache) append(record []byte) error {
+	if _, err := f.file.WriteAt(record, f.end); err != nil {
+		return err
+	}
+	f.end += int64(len(record))
+	if f.SyncWrites {
+		return f.file.Sync()
+	}
+	return nil
+}
+
+// Get 读取缓存键对应的条目
+func (f *FileCache) Get(key string) (*CacheEntry, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	loc, ok := f.index[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	buf := make([]byte, loc.size)
+	if _, err := f.file.ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+	return decodeCacheEntry(key, buf)
+}
+
+// Set 追加写入一条记录
+func (f *FileCache) Set(e *CacheEntry) error {
+	if len(e.Key) > 0xffff {
+		return fmt.Errorf("cache key length %d exceeds 65535", len(e.Key))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value := encodeCacheEntry(e)
+	record := encodeFileCacheRecord(e.Key, value)
+	offset := f.end + int64(len(record)-len(value))
+	if err := f.append(record); err != nil {
+		return err
+	}
+	f.replace(e.Key)
+	f.index[e.Key] = fileCacheLocation{offset: offset, size: uint32(len(value))}
+	f.live += int64(len(value))
+	return f.maybeCompact()
+}
+
+// Delete 追加写入一条墓碑记录
+func (f *FileCache) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.index[key]; !ok {
+		return nil
+	}
+	record := encodeFileCacheRecord(key, nil)
+	if err := f.append(record); err != nil {
+		return err
+	}
+	f.replace(key)
+	f.dead += int64(len(record))
+	return f.maybeCompact()
+}
+
+// replace 将缓存键已有的记录计为失效记录，需持有写锁
+func (f *FileCache) replace(key string) {
+	if old, ok := f.index[key]; ok {
+		f.live -= int64(old.size)
+		f.dead += fileCacheRecordHeaderSize + int64(len(key)) + int64(old.size)
+		delete(f.index, key)
+	}
+}
+
+// Purge 清空缓存文件
+func (f *FileCache) Purge() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Truncate(int64(len(fileCacheMagic))); err != nil {
+		return err
+	}
+	f.index = make(map[string]fileCacheLocation)
+	f.end = int64(len(fileCacheMagic))
+	f.live, f.dead = 0, 0
+	return nil
+}
+
+// Stats 返回有效条目的数量及回复的总字节数
+func (f *FileCache) Stats() CacheStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return CacheStats{
+		Entries: len(f.index),
+		Bytes:   int(f.live) - len(f.index)*cacheEntryHeaderSize,
+	}
+}
+
+// Range 遍历调用时文件中的有效条目
+func (f *FileCache) Range(fn func(*CacheEntry) bool) error {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.index))
+	for key := range f.index {
+		keys = append(keys, key)
+	}
+	f.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		e, err := f.Get(key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// maybeCompact 在失效记录过多时压缩文件，需持有写锁
+func (f *FileCache) maybeCompact() error {
+	if f.dead < fileCacheCompactThreshold || f.dead < f.live {
+		return nil
+	}
+	return f.compact()
+}
+
+// Compact 将所有有效条目重写到新文件中，以回收失效记录占用的空间
+func (f *FileCache) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compact()
+}
+
+// compact 实现 Compact，需持有写锁
+func (f *FileCache) compact() error {
+	tmpPath := f.Path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	w.Write(fileCacheMagic)
+	index := make(map[string]fileCacheLocation, len(f.index))
+	offset := int64(len(fileCacheMagic))
+	for key, loc := range f.index {
+		value := make([]byte, loc.size)
+		if _, err = f.file.ReadAt(value, loc.offset); err != nil {
+			break
+		}
+		record := encodeFileCacheRecord(key, value)
+		if _, err = w.Write(record); err != nil {
+			break
+		}
+		index[key] = fileCacheLocation{offset: offset + int64(len(record)) - int64(loc.size), size: loc.size}
+		offset += int64(len(record))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, f.Path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f.file.Close()
+	f.file = tmp
+	f.index = index
+	f.end = offset
+	f.dead = 0
+	return nil
+}
+
+// Close 关闭缓存文件
+func (f *FileCache) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
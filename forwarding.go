@@ -0,0 +1,312 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// forwarding.go 文件实现了转发回复器 ForwardingResponser。
+// ForwardingResponser 将查询转发至配置的上游服务器，按照轮询或故障转移的策略选择上游，
+// 并在超时或失败时重试；UDP 回复被截断时改用 TCP 重新查询。
+// 上游回复被解码为 dns.DNSMessage 后交由 Hook 修改，仅当回复被修改时才重新编码，
+// 否则原样发送给客户端，从而使 GoDNS 可以位于真实服务器之前，仅篡改部分回答。
+
+package godns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+const (
+	// DefaultForwardTimeout 是等待上游回复的默认超时时间
+	DefaultForwardTimeout = 2 * time.Second
+	// DefaultForwardRetries 是查询失败后的默认重试次数
+	DefaultForwardRetries = 2
+)
+
+// ForwardPolicy 表示选择上游服务器的策略
+type ForwardPolicy string
+
+const (
+	// 每个查询依次从下一个上游开始，失败时尝试其后的上游
+	ForwardRoundRobin ForwardPolicy = "round-robin"
+	// 总是从第一个上游开始，失败时按顺序尝试其后的上游
+	ForwardFailover ForwardPolicy = "failover"
+)
+
+// ForwardHook 在上游回复被编码并发送给客户端前调用，可以修改回复
+// 其接受参数为：
+//   - connInfo ConnectionInfo，客户端的链接信息
+//   - qry dns.DNSMessage，客户端的查询
+//   - resp *dns.DNSMessage，已解码的上游回复，其 ID 已恢复为客户端查询的 ID
+//
+// 返回错误时不回复该查询。所有上游均失败时生成的 SERVFAIL 回复不会经过 Hook。
+type ForwardHook func(connInfo ConnectionInfo, qry dns.DNSMessage, resp *dns.DNSMessage) error
+
+// ForwardingConfig 记录转发的配置
+type ForwardingConfig struct {
+	// 上游服务器地址，形如 "192.0.2.53:53"，省略端口时使用 53
+	Upstreams []string
+	// 选择上游的策略，默认为 ForwardRoundRobin
+	Policy ForwardPolicy
+	// 查询上游所用的协议，默认为 ProtocolUDP，UDP 回复被截断时改用 TCP 重新查询
+	Protocol Protocol
+	// 每次查询等待上游回复的超时时间，默认为 DefaultForwardTimeout
+	Timeout time.Duration
+	// 查询失败后的重试次数，为 0 时使用 DefaultForwardRetries，为负数时不重试
+	Retries int
+	// 修改上游回复的钩子函数，为 nil 或未修改回复时原样转发上游回复的字节
+	Hook ForwardHook
+}
+
+// ForwardingResponser 是一个将查询转发至上游服务器的回复器，可被并发调用
+type ForwardingResponser struct {
+	Config        ForwardingConfig
+	ForwardLogger *slog.Logger
+
+	// 轮询策略的下一个起始上游
+	next atomic.Uint32
+}
+
+// NewForwardingResponser 创建一个转发回复器
+// 其接受参数为：
+//   - conf ForwardingConfig，转发配置
+//   - logger *slog.Logger，日志记录器，为 nil 时丢弃日志
+func NewForwardingResponser(conf ForwardingConfig, logger *slog.Logger) *ForwardingResponser {
+	if logger == nil {
+		logger = newWriterLogger(nil, LogComponentResponser)
+	}
+	return &ForwardingResponser{Config: conf, ForwardLogger: logger}
+}
+
+// upstreamAddr 为未指定端口的上游地址补充默认端口 53
+func upstreamAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
+
+// Forward 将查询转发至上游服务器
+// 其接受参数为：
+//   - qry dns.DNSMessage，待转发的查询
+//
+// 返回值为：
+//   - dns.DNSMessage，上游回复，其 ID 与查询相同
+//   - string，给出回复的上游地址
+//   - error，所有尝试均失败时返回最后一次的错误信息
+func (f *ForwardingResponser) Forward(qry dns.DNSMessage) (dns.DNSMessage, string, error) {
+	resp, _, addr, err := f.forward(qry)
+	return resp, addr, err
+}
+
+// forward 与 Forward 相同，但同时返回上游回复的原始字节
+func (f *ForwardingResponser) forward(qry dns.DNSMessage) (dns.DNSMessage, []byte, string, error) {
+	upstreams := f.Config.Upstreams
+	if len(upstreams) == 0 {
+		return dns.DNSMessage{}, nil, "", errors.New("no upstream configured")
+	}
+	timeout := f.Config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultForwardTimeout
+	}
+	retries := f.Config.Retries
+	if retries == 0 {
+		retries = DefaultForwardRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	start := 0
+	if f.Config.Policy != ForwardFailover {
+		start = int(f.next.Add(1)-1) % len(upstreams)
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		addr := upstreamAddr(upstreams[(start+attempt)%len(upstreams)])
+		var resp dns.DNSMessage
+		var raw []byte
+		resp, raw, err = exchange(f.Config.Protocol, addr, qry, timeout)
+		if err == nil {
+			return resp, raw, addr, nil
+		}
+		f.ForwardLogger.Debug("Upstream query failed", "upstream", addr, "attempt", attempt+1, "err", err)
+	}
+	return dns.DNSMessage{}, nil, "", err
+}
+
+// Response 将查询转发至上游服务器，并以经 Hook 修改后的上游回复作答
+// 未被 Hook 修改的回复将原样转发，以保留上游的名称压缩；
+// 所有上游均失败时回复 SERVFAIL（不经过 Hook）；超出 UDP 负载大小的回复由 Netter 截断。
+func (f *ForwardingResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	resp, raw, upstream, err := f.forward(qry)
+	if err != nil {
+		f.ForwardLogger.Warn("All upstreams failed", "qname", queryName(qry), "err", err)
+		servFail := InitServFail(qry)
+		FixCount(&servFail)
+		return servFail.Encode(), nil
+	}
+	if connInfo.Record != nil {
+		connInfo.Record.Upstream = upstream
+	}
+	if f.Config.Hook == nil {
+		return raw, nil
+	}
+
+	if err := f.Config.Hook(connInfo, qry, &resp); err != nil {
+		return []byte{}, err
+	}
+	// 重新解码原始回复，与 Hook 处理后的回复比较，判断回复是否被修改
+	orig := dns.DNSMessage{}
+	if _, err := orig.DecodeFromBuffer(raw, 0); err == nil && reflect.DeepEqual(orig, resp) {
+		return raw, nil
+	}
+	FixCount(&resp)
+	return resp.Encode(), nil
+}
+
+// queryName 返回查询的第一个问题的名称，没有问题时返回空字符串
+func queryName(qry dns.DNSMessage) string {
+	if len(qry.Question) == 0 {
+		return ""
+	}
+	return qry.Question[0].Name
+}
+
+// InitServFail 根据查询信息初始化 SERVFAIL 回复，回复中仅包含问题部分
+func InitServFail(qry dns.DNSMessage) dns.DNSMessage {
+	resp := InitRefused(qry)
+	resp.Header.RCode = dns.DNSResponseCodeServFail
+	return resp
+}
+
+// Exchange 向指定的服务器发送查询并等待回复
+// 其接受参数为：
+//   - protocol Protocol，查询所用的协议，为空时使用 ProtocolUDP
+//   - addr string，服务器地址，形如 "192.0.2.53:53"
+//   - qry dns.DNSMessage，查询
+//   - timeout time.Duration，每次查询的超时时间
+//
+// 返回值为：
+//   - dns.DNSMessage，服务器的回复，其 ID 与查询相同
+//   - error，错误信息
+//
+// 发送时查询使用随机的 ID，ID 或问题部分与查询不符的回复会被忽略。
+// 通过 UDP 收到 TC 位为 1 的回复时，改用 TCP 重新查询。
+func Exchange(protocol Protocol, addr string, qry dns.DNSMessage, timeout time.Duration) (dns.DNSMessage, error) {
+	resp, _, err := exchange(protocol, addr, qry, timeout)
+	return resp, err
+}
+
+// exchange 与 Exchange 相同，但同时返回回复的原始字节，其 ID 同样已恢复为查询的 ID
+func exchange(protocol Protocol, addr string, qry dns.DNSMessage, timeout time.Duration) (dns.DNSMessage, []byte, error) {
+	id := qry.Header.ID
+	qry.Header.ID = uint16(rand.UintN(1 << 16))
+	qry.Header.QDCount = uint16(len(qry.Question))
+	FixCount(&qry)
+	packet := qry.Encode()
+
+	var resp dns.DNSMessage
+	var raw []byte
+	var err error
+	if protocol != ProtocolTCP {
+		resp, raw, err = exchangeUDP(addr, qry, packet, timeout)
+		if err != nil {
+			return dns.DNSMessage{}, nil, err
+		}
+		if !resp.Header.TC {
+			resp.Header.ID = id
+			binary.BigEndian.PutUint16(raw, id)
+			return resp, raw, nil
+		}
+	}
+	resp, raw, err = exchangeTCP(addr, qry, packet, timeout)
+	if err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	resp.Header.ID = id
+	binary.BigEndian.PutUint16(raw, id)
+	return resp, raw, nil
+}
+
+// matchResponse 判断数据是否为查询的回复，并返回解码后的回复
+func matchResponse(qry dns.DNSMessage, data []byte) (dns.DNSMessage, bool) {
+	if len(data) < 12 || binary.BigEndian.Uint16(data) != qry.Header.ID || data[2]&0x80 == 0 {
+		return dns.DNSMessage{}, false
+	}
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+		return dns.DNSMessage{}, false
+	}
+	if len(resp.Question) != len(qry.Question) {
+		return dns.DNSMessage{}, false
+	}
+	for i, q := range qry.Question {
+		r := resp.Question[i]
+		if r.Type != q.Type || r.Class != q.Class || !strings.EqualFold(strings.TrimSuffix(r.Name, "."), strings.TrimSuffix(q.Name, ".")) {
+			return dns.DNSMessage{}, false
+		}
+	}
+	return resp, true
+}
+
+// exchangeUDP 通过 UDP 发送查询，并等待与之匹配的回复
+func exchangeUDP(addr string, qry dns.DNSMessage, packet []byte, timeout time.Duration) (dns.DNSMessage, []byte, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(packet); err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dns.DNSMessage{}, nil, err
+		}
+		if resp, ok := matchResponse(qry, buf[:n]); ok {
+			return resp, append([]byte{}, buf[:n]...), nil
+		}
+	}
+}
+
+// exchangeTCP 通过 TCP 发送带有长度前缀的查询，并读取回复
+func exchangeTCP(addr string, qry dns.DNSMessage, packet []byte, timeout time.Duration) (dns.DNSMessage, []byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...)); err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return dns.DNSMessage{}, nil, err
+	}
+	resp, ok := matchResponse(qry, data)
+	if !ok {
+		return dns.DNSMessage{}, nil, fmt.Errorf("mismatched response from %s", addr)
+	}
+	return resp, data, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// forwarding_test.go 文件定义了对 forwarding.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testUpstream 在回环地址上以同一端口监听 UDP 及 TCP，使用 responser 回复查询，并返回监听地址
+func testUpstream(t *testing.T, responser Responser) string {
+	t.Helper()
+	var pktConn net.PacketConn
+	var lstr net.Listener
+	for i := 0; i < 10 && lstr == nil; i++ {
+		var err error
+		if pktConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("listen udp failed: %v", err)
+		}
+		if lstr, err = net.Listen("tcp", pktConn.LocalAddr().String()); err != nil {
+			pktConn.Close()
+		}
+	}
+	if lstr == nil {
+		t.Fatal("failed to listen on the same udp and tcp port")
+	}
+	t.Cleanup(func() {
+		pktConn.Close()
+		lstr.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pktConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pkt := append([]byte{}, buf[:n]...)
+			if resp, err := responser.Response(ConnectionInfo{Protocol: ProtocolUDP, Address: addr, Packet: pkt}); err == nil && len(resp) > 0 {
+				pktConn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := lstr.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				pkt, err := ReadStreamMessage(conn)
+				if err != nil {
+					return
+				}
+				if resp, err := responser.Response(ConnectionInfo{Protocol: ProtocolTCP, Address: conn.RemoteAddr(), Packet: pkt}); err == nil && len(resp) > 0 {
+					WriteStreamMessage(conn, resp)
+				}
+			}()
+		}
+	}()
+	return pktConn.LocalAddr().String()
+}
+
+// countingResponser 记录被调用次数的回复器
+type countingResponser struct {
+	Responser
+	count atomic.Int32
+}
+
+func (c *countingResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	c.count.Add(1)
+	return c.Responser.Response(connInfo)
+}
+
+// testForwardUpstream 返回服务 testAuthZoneFile 的上游地址
+func testForwardUpstream(t *testing.T) (string, *countingResponser) {
+	t.Helper()
+	upstream := &countingResponser{Responser: testAuthResponser(t)}
+	return testUpstream(t, upstream), upstream
+}
+
+// testForward 以指定的协议向转发回复器发送查询，并返回解码后的回复
+func testForward(t *testing.T, f *ForwardingResponser, protocol Protocol, packet []byte) dns.DNSMessage {
+	t.Helper()
+	var sent []byte
+	connInfo := ConnectionInfo{
+		Protocol:  protocol,
+		Packet:    packet,
+		Transport: &recordTransport{reply: func(b []byte) { sent = b }},
+		Record:    &QueryRecord{},
+	}
+	data, err := f.Response(connInfo)
+	if err != nil {
+		t.Fatalf("Response failed: %v", err)
+	}
+	// 经由 Netter 发送，以包含 UDP 回复的截断
+	(&Netter{NetterLogger: discardLogger()}).Send(connInfo, data)
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(sent, 0); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	return resp
+}
+
+// TestForwardingResponser 测试转发查询及通过钩子修改上游回复
+func TestForwardingResponser(t *testing.T) {
+	addr, _ := testForwardUpstream(t)
+	f := NewForwardingResponser(ForwardingConfig{
+		Upstreams: []string{addr},
+		Hook: func(connInfo ConnectionInfo, qry dns.DNSMessage, resp *dns.DNSMessage) error {
+			for i, rr := range resp.Answer {
+				if rr.Type == dns.DNSRRTypeA {
+					resp.Answer[i].RData = &dns.DNSRDATAA{Address: net.IPv4(203, 0, 113, 1)}
+					resp.Answer[i].RDLen = 0
+				}
+			}
+			return nil
+		},
+	}, discardLogger())
+
+	record := &QueryRecord{}
+	data, err := f.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: testQuery(0x1234, "chain.example.com", dns.DNSRRTypeA, 0, false), Record: record})
+	if err != nil {
+		t.Fatalf("Response failed: %v", err)
+	}
+	resp := dns.DNSMessage{}
+	resp.DecodeFromBuffer(data, 0)
+	if resp.Header.ID != 0x1234 || !resp.Header.AA || testSectionTypes(resp.Answer) != "CNAME CNAME A" {
+		t.Fatalf("response got: %v, expected: ID 0x1234 with CNAME CNAME A", resp)
+	}
+	if a := resp.Answer[2].RData.(*dns.DNSRDATAA); !a.Address.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("hooked address got: %v, expected: 203.0.113.1", a.Address)
+	}
+	if record.Upstream != addr {
+		t.Errorf("record upstream got: %q, expected: %q", record.Upstream, addr)
+	}
+
+	// 钩子返回错误时不回复
+	f.Config.Hook = func(ConnectionInfo, dns.DNSMessage, *dns.DNSMessage) error { return errors.New("drop") }
+	if _, err := f.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, false)}); err == nil {
+		t.Error("Response expected an error from the hook but got nil")
+	}
+}
+
+// compressedResponser 以带有名称压缩指针的 A 记录回答查询
+type compressedResponser struct{}
+
+func (compressedResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	resp := append([]byte{}, connInfo.Packet...)
+	resp[2] |= 0x80
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	resp = append(resp, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04, 203, 0, 113, 7)
+	return resp, nil
+}
+
+// TestForwardingRaw 测试未被钩子修改的上游回复被原样转发，仅恢复其 ID
+func TestForwardingRaw(t *testing.T) {
+	addr := testUpstream(t, compressedResponser{})
+	qry := testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, false)
+	expected, _ := compressedResponser{}.Response(ConnectionInfo{Packet: qry})
+
+	hooks := []ForwardHook{
+		nil,
+		func(ConnectionInfo, dns.DNSMessage, *dns.DNSMessage) error { return nil },
+	}
+	for i, hook := range hooks {
+		f := NewForwardingResponser(ForwardingConfig{Upstreams: []string{addr}, Hook: hook}, discardLogger())
+		data, err := f.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: qry})
+		if err != nil {
+			t.Fatalf("Response failed: %v", err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("hook %d response got: %v, expected: %v", i, data, expected)
+		}
+	}
+
+	// 修改回复的钩子使回复被重新编码
+	f := NewForwardingResponser(ForwardingConfig{
+		Upstreams: []string{addr},
+		Hook: func(connInfo ConnectionInfo, qry dns.DNSMessage, resp *dns.DNSMessage) error {
+			resp.Answer[0].TTL = 60
+			return nil
+		},
+	}, discardLogger())
+	data, _ := f.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: qry})
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(data, 0); err != nil || resp.Header.ID != 0x1234 || len(resp.Answer) != 1 || resp.Answer[0].TTL != 60 {
+		t.Errorf("hooked response got: %v %v, expected: ID 0x1234 with TTL 60", resp, err)
+	}
+}
+
+// TestForwardingTCPFallback 测试上游 UDP 回复被截断时改用 TCP 重新查询
+func TestForwardingTCPFallback(t *testing.T) {
+	zone := "@ 300 SOA ns hostmaster 1 2 3 4 60\n"
+	for i := 0; i < 40; i++ {
+		zone += fmt.Sprintf("big 300 TXT \"record number %d with some padding\"\n", i)
+	}
+	z, err := dns.LoadZone(strings.NewReader(zone), "example.com")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	f := NewForwardingResponser(ForwardingConfig{Upstreams: []string{testUpstream(t, NewAuthoritativeResponser(z))}}, discardLogger())
+
+	qry := testQuery(0x1234, "big.example.com", dns.DNSRRTypeTXT, 0, false)
+	if resp := testForward(t, f, ProtocolTCP, qry); resp.Header.TC || len(resp.Answer) != 40 {
+		t.Errorf("tcp client TC, answers got: %v %d, expected: false 40", resp.Header.TC, len(resp.Answer))
+	}
+	if resp := testForward(t, f, ProtocolDoH, qry); resp.Header.TC || len(resp.Answer) != 40 {
+		t.Errorf("doh client TC, answers got: %v %d, expected: false 40", resp.Header.TC, len(resp.Answer))
+	}
+	// 客户端通过 UDP 查询时，回复超出其负载大小而被截断
+	if resp := testForward(t, f, ProtocolUDP, qry); !resp.Header.TC || len(resp.Answer) != 0 {
+		t.Errorf("udp client TC, answers got: %v %d, expected: true 0", resp.Header.TC, len(resp.Answer))
+	}
+}
+
+// TestForwardingPolicy 测试轮询及故障转移策略、重试与上游全部失败时的回复
+func TestForwardingPolicy(t *testing.T) {
+	first, a := testForwardUpstream(t)
+	second, b := testForwardUpstream(t)
+	qry := testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, false)
+
+	f := NewForwardingResponser(ForwardingConfig{Upstreams: []string{first, second}}, discardLogger())
+	for i := 0; i < 4; i++ {
+		testForward(t, f, ProtocolUDP, qry)
+	}
+	if a.count.Load() != 2 || b.count.Load() != 2 {
+		t.Errorf("round-robin queries got: %d %d, expected: 2 2", a.count.Load(), b.count.Load())
+	}
+
+	// 不可达的上游被跳过
+	pktConn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	dead := pktConn.LocalAddr().String()
+	pktConn.Close()
+	f = NewForwardingResponser(ForwardingConfig{
+		Upstreams: []string{dead, first},
+		Policy:    ForwardFailover,
+		Timeout:   200 * time.Millisecond,
+	}, discardLogger())
+	for i := 0; i < 2; i++ {
+		record := &QueryRecord{}
+		data, _ := f.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: qry, Record: record})
+		resp := dns.DNSMessage{}
+		resp.DecodeFromBuffer(data, 0)
+		if resp.Header.RCode != dns.DNSResponseCodeNoErr || record.Upstream != first {
+			t.Errorf("failover rcode, upstream got: %v %q, expected: NOERROR %q", resp.Header.RCode, record.Upstream, first)
+		}
+	}
+
+	// 上游全部失败时生成的 SERVFAIL 不经过钩子
+	hooked := false
+	f = NewForwardingResponser(ForwardingConfig{
+		Upstreams: []string{dead},
+		Timeout:   200 * time.Millisecond,
+		Retries:   -1,
+		Hook: func(ConnectionInfo, dns.DNSMessage, *dns.DNSMessage) error {
+			hooked = true
+			return nil
+		},
+	}, discardLogger())
+	if resp := testForward(t, f, ProtocolUDP, qry); resp.Header.RCode != dns.DNSResponseCodeServFail || resp.Header.ID != 0x1234 {
+		t.Errorf("all upstreams failed got: %v %#x, expected: SERVFAIL 0x1234", resp.Header.RCode, resp.Header.ID)
+	}
+	if hooked {
+		t.Error("hook called for SERVFAIL, expected: not called")
+	}
+}
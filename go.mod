@@ -2,6 +2,10 @@ module github.com/tochusc/godns
 
 go 1.23.2
 
-require github.com/panjf2000/ants/v2 v2.10.0
+require (
+	github.com/panjf2000/ants/v2 v2.10.0
+	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.26.0
+)
 
 require golang.org/x/sync v0.3.0 // indirect
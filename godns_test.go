@@ -0,0 +1,25 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// godns_test.go 文件定义了各个单元测试共用的辅助函数
+
+package godns
+
+import "github.com/tochusc/godns/dns"
+
+// testQuery 返回一个指定 ID、名称及类型的查询，其 RD 位为 1。
+// bufsize 大于 0 或 do 为 true 时携带 OPT 记录，bufsize 为 0 时 UDP 负载大小为 1232，
+// do 为 true 时 DO 位为 1。
+func testQuery(id uint16, name string, qtype dns.DNSType, bufsize int, do bool) []byte {
+	qry := dns.DNSMessage{
+		Header:   dns.DNSHeader{ID: id, RD: true, QDCount: 1},
+		Question: []dns.DNSQuestion{{Name: name, Type: qtype, Class: dns.DNSClassIN}},
+	}
+	if bufsize > 0 || do {
+		if bufsize == 0 {
+			bufsize = 1232
+		}
+		qry.Additional = append(qry.Additional, *dns.NewDNSRROPT(bufsize, int(dns.SetDNSRROPTTTL(0, 0, do, 0)), &dns.DNSRDATAOPT{}))
+	}
+	FixCount(&qry)
+	return qry.Encode()
+}
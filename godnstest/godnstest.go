@@ -0,0 +1,151 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// godnstest 包提供了用于测试 Responser 的工具，其用法类似于 net/http/httptest。
+//
+// NewTestServer 会启动一个仅使用内存传输层的 GoDNS 服务器，
+// 测试可以通过其返回的客户端链接发送查询，无需绑定任何真实端口，
+// 因此可以在多个测试中并行使用。
+//
+//	ts := godnstest.NewTestServer(&godns.DullResponser{ServerConf: conf})
+//	defer ts.Close()
+//	resp, err := ts.Exchange(qry)
+package godnstest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/tochusc/godns"
+	"github.com/tochusc/godns/dns"
+)
+
+// DefaultTimeout 是 Exchange 等待回复的默认超时时间
+var DefaultTimeout = 5 * time.Second
+
+// TestServer 是一个运行在内存中的 GoDNS 服务器
+type TestServer struct {
+	// 被测试的 GoDNS 服务器
+	Server *godns.GoDNSServer
+	// 服务器所使用的内存传输层
+	Transport *MemTransport
+
+	// 客户端数据报链接，以 UDP 的形式发送查询
+	PacketConn net.PacketConn
+	// 客户端流式链接，以 TCP 的形式发送查询，仅能完成一次查询
+	Conn net.Conn
+
+	done chan struct{}
+}
+
+// NewTestServer 以指定的 Responser 启动一个内存中的 GoDNS 服务器
+func NewTestServer(responser godns.Responser) *TestServer {
+	return NewTestServerWithConfig(godns.DNSServerConfig{
+		IP:          net.IPv4(127, 0, 0, 53),
+		Port:        53,
+		LogWriter:   io.Discard,
+		PoolCapcity: -1,
+	}, responser)
+}
+
+// NewTestServerWithConfig 以指定的配置及 Responser 启动一个内存中的 GoDNS 服务器。
+// 配置中的端口不会被绑定，服务器仅使用内存传输层。
+func NewTestServerWithConfig(conf godns.DNSServerConfig, responser godns.Responser) *TestServer {
+	if conf.LogWriter == nil {
+		conf.LogWriter = io.Discard
+	}
+	server := godns.NewGoDNSServer(conf, responser)
+	mem := NewMemTransport()
+	server.Netter.Transports = []godns.Transport{mem}
+
+	ts := &TestServer{
+		Server:    server,
+		Transport: mem,
+		done:      make(chan struct{}),
+	}
+	go func() {
+		server.Start()
+		close(ts.done)
+	}()
+
+	ts.PacketConn = mem.NewPacketConn()
+	conn, err := mem.Dial()
+	if err != nil {
+		panic(fmt.Sprintf("godnstest: dial memory transport failed: %v", err))
+	}
+	ts.Conn = conn
+	return ts
+}
+
+// Close 关闭客户端链接及服务器，并等待服务器退出
+func (ts *TestServer) Close() {
+	ts.PacketConn.Close()
+	ts.Conn.Close()
+	ts.Server.Stop()
+	<-ts.done
+	ts.Server.ThreadPool.Release()
+}
+
+// Exchange 通过一个新的数据报链接发送查询，并返回解析后的回复
+func (ts *TestServer) Exchange(qry dns.DNSMessage) (dns.DNSMessage, error) {
+	conn := ts.Transport.NewPacketConn()
+	defer conn.Close()
+
+	if _, err := conn.WriteTo(qry.Encode(), nil); err != nil {
+		return dns.DNSMessage{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	buf := make([]byte, 65535)
+	sz, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return dns.DNSMessage{}, err
+	}
+	return decodeMessage(buf[:sz])
+}
+
+// ExchangeStream 通过一个新的流式链接发送查询，并返回解析后的回复
+func (ts *TestServer) ExchangeStream(qry dns.DNSMessage) (dns.DNSMessage, error) {
+	conn, err := ts.Transport.Dial()
+	if err != nil {
+		return dns.DNSMessage{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	if err := godns.WriteStreamMessage(conn, qry.Encode()); err != nil {
+		return dns.DNSMessage{}, err
+	}
+	pkt, err := godns.ReadStreamMessage(conn)
+	if err != nil {
+		return dns.DNSMessage{}, err
+	}
+	return decodeMessage(pkt)
+}
+
+// NewQuery 返回一个查询指定名称及类型的 DNS 查询
+func NewQuery(name string, qType dns.DNSType) dns.DNSMessage {
+	return dns.DNSMessage{
+		Header: dns.DNSHeader{
+			ID:      0x1234,
+			OpCode:  dns.DNSOpCodeQuery,
+			RD:      true,
+			QDCount: 1,
+		},
+		Question: dns.DNSQuestionSection{
+			{Name: name, Type: qType, Class: dns.DNSClassIN},
+		},
+		Answer:     dns.DNSResponseSection{},
+		Authority:  dns.DNSResponseSection{},
+		Additional: dns.DNSResponseSection{},
+	}
+}
+
+// decodeMessage 解析 DNS 消息
+func decodeMessage(pkt []byte) (dns.DNSMessage, error) {
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(pkt, 0); err != nil {
+		return dns.DNSMessage{}, fmt.Errorf("error decoding response: %v", err)
+	}
+	return msg, nil
+}
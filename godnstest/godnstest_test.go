@@ -0,0 +1,113 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// godnstest_test.go 文件定义了对 godnstest 包的单元测试
+
+package godnstest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns"
+	"github.com/tochusc/godns/dns"
+)
+
+// newDullServer 启动一个由 DullResponser 回复的测试服务器
+func newDullServer(t *testing.T) *TestServer {
+	ts := NewTestServer(&godns.DullResponser{
+		ServerConf: godns.DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)},
+	})
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// checkDullAnswer 检查回复中是否包含指向 10.0.0.1 的 A 记录
+func checkDullAnswer(t *testing.T, resp dns.DNSMessage) {
+	t.Helper()
+	if resp.Header.ID != 0x1234 || !resp.Header.QR {
+		t.Errorf("unexpected header:\n%s", resp.Header.String())
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer count got: %d, expected: 1", len(resp.Answer))
+	}
+	a, ok := resp.Answer[0].RData.(*dns.DNSRDATAA)
+	if !ok || !a.Address.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("unexpected answer:\n%s", resp.Answer[0].String())
+	}
+}
+
+// TestExchange 测试以数据报形式完成查询
+func TestExchange(t *testing.T) {
+	t.Parallel()
+	ts := newDullServer(t)
+
+	resp, err := ts.Exchange(NewQuery("www.example.com", dns.DNSRRTypeA))
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	checkDullAnswer(t, resp)
+}
+
+// TestExchangeStream 测试以流式链接完成查询
+func TestExchangeStream(t *testing.T) {
+	t.Parallel()
+	ts := newDullServer(t)
+
+	resp, err := ts.ExchangeStream(NewQuery("www.example.com", dns.DNSRRTypeA))
+	if err != nil {
+		t.Fatalf("ExchangeStream failed: %v", err)
+	}
+	checkDullAnswer(t, resp)
+}
+
+// TestClientConns 测试直接使用 TestServer 提供的客户端链接
+func TestClientConns(t *testing.T) {
+	t.Parallel()
+	ts := newDullServer(t)
+	qry := NewQuery("www.example.com", dns.DNSRRTypeA)
+
+	// 数据报链接
+	if _, err := ts.PacketConn.WriteTo(qry.Encode(), nil); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	ts.PacketConn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	buf := make([]byte, 65535)
+	sz, _, err := ts.PacketConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	resp, err := decodeMessage(buf[:sz])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDullAnswer(t, resp)
+
+	// 流式链接
+	if err := godns.WriteStreamMessage(ts.Conn, qry.Encode()); err != nil {
+		t.Fatalf("WriteStreamMessage failed: %v", err)
+	}
+	pkt, err := godns.ReadStreamMessage(ts.Conn)
+	if err != nil {
+		t.Fatalf("ReadStreamMessage failed: %v", err)
+	}
+	resp, err = decodeMessage(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDullAnswer(t, resp)
+}
+
+// TestReadTimeout 测试数据报链接的读取超时
+func TestReadTimeout(t *testing.T) {
+	t.Parallel()
+	ts := newDullServer(t)
+
+	conn := ts.Transport.NewPacketConn()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := conn.ReadFrom(make([]byte, 512))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("ReadFrom got error: %v, expected timeout", err)
+	}
+}
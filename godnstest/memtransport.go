@@ -0,0 +1,275 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// memtransport.go 文件实现了一个完全位于内存中的传输层 MemTransport。
+// 客户端通过 NewPacketConn 获取数据报链接，通过 Dial 获取流式链接，
+// 二者均不会绑定任何真实端口。
+
+package godnstest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tochusc/godns"
+)
+
+// memDatagram 表示内存中传递的一个数据报
+type memDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// MemTransport 是一个内存传输层实现。
+// 通过 NewPacketConn 创建的链接以 UDP 的形式投递查询，
+// 通过 Dial 创建的链接以 TCP 的形式投递查询。
+type MemTransport struct {
+	// 服务端的数据报链接
+	server *memPacketConn
+
+	mu      sync.Mutex
+	clients map[string]*memPacketConn
+
+	accepts   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	nextPort atomic.Uint32
+}
+
+// NewMemTransport 创建一个内存传输层
+func NewMemTransport() *MemTransport {
+	t := &MemTransport{
+		clients: make(map[string]*memPacketConn),
+		accepts: make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	t.server = newMemPacketConn(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 53), Port: 53})
+	t.nextPort.Store(1024)
+	return t
+}
+
+// Listen 将内存中收到的查询投递到链接信息通道中，直至传输层被关闭。
+func (t *MemTransport) Listen(connChan chan<- godns.ConnectionInfo) error {
+	for {
+		select {
+		case dg := <-t.server.inbox:
+			connChan <- godns.ConnectionInfo{
+				Protocol:   godns.ProtocolUDP,
+				Address:    dg.addr,
+				PacketConn: t.server,
+				Transport:  t,
+				Packet:     dg.data,
+			}
+		case conn := <-t.accepts:
+			go t.handleStreamConn(conn, connChan)
+		case <-t.done:
+			return nil
+		}
+	}
+}
+
+// handleStreamConn 读取流式链接中的查询，并将其投递到链接信息通道中
+func (t *MemTransport) handleStreamConn(conn net.Conn, connChan chan<- godns.ConnectionInfo) {
+	pkt, err := godns.ReadStreamMessage(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case connChan <- godns.ConnectionInfo{
+		Protocol:   godns.ProtocolTCP,
+		Address:    conn.RemoteAddr(),
+		StreamConn: conn,
+		Transport:  t,
+		Packet:     pkt,
+	}:
+	case <-t.done:
+		conn.Close()
+	}
+}
+
+// Reply 将回复发送给内存中的客户端
+func (t *MemTransport) Reply(connInfo godns.ConnectionInfo, data []byte) error {
+	if connInfo.Protocol == godns.ProtocolTCP {
+		defer connInfo.StreamConn.Close()
+		return godns.WriteStreamMessage(connInfo.StreamConn, data)
+	}
+	_, err := t.server.WriteTo(data, connInfo.Address)
+	return err
+}
+
+// Close 关闭内存传输层，使 Listen 返回
+func (t *MemTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// NewPacketConn 创建一个连接到该传输层的客户端数据报链接，
+// 每个链接都拥有一个独立的 127.0.0.1 地址。
+func (t *MemTransport) NewPacketConn() net.PacketConn {
+	return t.NewPacketConnFrom(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(t.nextPort.Add(1))})
+}
+
+// NewPacketConnFrom 以指定的地址创建一个客户端数据报链接，
+// 可用于测试依赖客户端地址的逻辑。
+func (t *MemTransport) NewPacketConnFrom(addr *net.UDPAddr) net.PacketConn {
+	conn := newMemPacketConn(t, addr)
+	t.mu.Lock()
+	t.clients[addr.String()] = conn
+	t.mu.Unlock()
+	return conn
+}
+
+// Dial 创建一个连接到该传输层的客户端流式链接。
+// 与 TCPTransport 一致，每个流式链接仅能完成一次查询。
+func (t *MemTransport) Dial() (net.Conn, error) {
+	return t.DialFrom(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(t.nextPort.Add(1))})
+}
+
+// DialFrom 以指定的地址创建一个客户端流式链接
+func (t *MemTransport) DialFrom(addr *net.TCPAddr) (net.Conn, error) {
+	client, server := net.Pipe()
+	sConn := &addrConn{Conn: server, local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 53), Port: 53}, remote: addr}
+	cConn := &addrConn{Conn: client, local: addr, remote: sConn.local}
+	select {
+	case t.accepts <- sConn:
+		return cConn, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// route 投递数据报：客户端发出的数据报总是投递给服务端，
+// 服务端发出的数据报则投递给指定地址的客户端。
+func (t *MemTransport) route(data []byte, from *memPacketConn, to net.Addr) error {
+	var dst *memPacketConn
+	if from != t.server {
+		dst = t.server
+	} else {
+		if to == nil {
+			return errors.New("godnstest: missing destination address")
+		}
+		t.mu.Lock()
+		dst = t.clients[to.String()]
+		t.mu.Unlock()
+	}
+	if dst == nil {
+		// 与 UDP 一致，发往不存在地址的数据报将被静默丢弃
+		return nil
+	}
+
+	pkt := make([]byte, len(data))
+	copy(pkt, data)
+	select {
+	case dst.inbox <- memDatagram{data: pkt, addr: from.addr}:
+	case <-dst.closed:
+	default:
+		// 接收缓冲区已满，丢弃数据报
+	}
+	return nil
+}
+
+// memPacketConn 是 MemTransport 中的数据报链接，实现了 net.PacketConn 接口
+type memPacketConn struct {
+	t    *MemTransport
+	addr *net.UDPAddr
+
+	inbox     chan memDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline atomic.Int64
+}
+
+func newMemPacketConn(t *MemTransport, addr *net.UDPAddr) *memPacketConn {
+	return &memPacketConn{
+		t:      t,
+		addr:   addr,
+		inbox:  make(chan memDatagram, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+// ReadFrom 读取一个数据报，支持读取超时
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if dl := c.readDeadline.Load(); dl != 0 {
+		d := time.Until(time.Unix(0, dl))
+		if d <= 0 {
+			return 0, nil, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case dg := <-c.inbox:
+		return copy(p, dg.data), dg.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+// WriteTo 发送一个数据报。
+// 客户端链接会忽略 addr，总是将数据报发送给服务端。
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := c.t.route(p, c, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.t.mu.Lock()
+		if c.t.clients[c.addr.String()] == c {
+			delete(c.t.clients, c.addr.String())
+		}
+		c.t.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *memPacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.readDeadline.Store(0)
+	} else {
+		c.readDeadline.Store(t.UnixNano())
+	}
+	return nil
+}
+
+// SetWriteDeadline 写入从不阻塞，因此写入超时无意义
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// timeoutError 表示读取超时，实现了 net.Error 接口
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// addrConn 为 net.Pipe 返回的链接附加 TCP 地址
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
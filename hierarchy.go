@@ -0,0 +1,514 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// hierarchy.go 文件定义了本地 DNS 层级构建器 Hierarchy。
+// Hierarchy 根据 根 -> 顶级域 -> 区域 的声明式描述 HierarchyZone 构建各个区域：
+// 为每个区域生成 KSK 与 ZSK，在父区域中添加委派所需的 NS、胶水及 DS 记录，
+// 为各区域构建 NSEC 链并签名所有权威 RRset，最后输出根区域的信任锚点。
+// Start 在回环地址上为每个服务器地址启动一个 GoDNS 权威服务器，
+// 待测解析器以 RootHints 为根提示、以信任锚点文件为信任锚点，即可在完全本地、完全签名的层级中进行实验。
+// 区域数据保存在 dns.Zone 中，服务期间仍可修改，例如替换某个 RRset 以构造错误的签名。
+
+package godns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+	"github.com/tochusc/godns/dns/xperi"
+)
+
+const (
+	// DefaultHierarchyTTL 是 Hierarchy 自动生成的 SOA、NS 及地址记录的 TTL
+	DefaultHierarchyTTL = 3600
+	// DefaultHierarchySignatureValidity 是 Hierarchy 所生成签名的默认有效期
+	DefaultHierarchySignatureValidity = 30 * 24 * time.Hour
+)
+
+// HierarchyZone 是层级中一个区域的声明式描述
+type HierarchyZone struct {
+	// 区域名称，层级的顶层须为根区域 "."
+	Origin string
+	// 服务该区域的服务器地址，须为 IPv4 地址；为 nil 时自 127.0.0.2 起按照声明顺序依次分配。
+	// 地址相同的区域由同一服务器服务。
+	IP net.IP
+	// 区域域名服务器的名称，默认为 "ns.<Origin>"，根区域默认为 "a.root-servers.net"
+	NS string
+	// 区域文件形式的其他记录，相对名称以 Origin 补全，名称应为小写；
+	// 缺少 SOA 记录时自动生成，区域顶点的 NS 记录及域名服务器的地址记录总是自动添加
+	Records string
+	// 是否不签名该区域，其父区域中也不会添加 DS 记录，用于构造不安全的委派
+	Unsigned bool
+	// 子区域
+	Children []HierarchyZone
+}
+
+// HierarchyConfig 记录本地 DNS 层级的配置
+type HierarchyConfig struct {
+	// 根区域及其下的各级子区域
+	Root HierarchyZone
+	// 各服务器共用的端口，为 0 时自动选择一个空闲端口
+	Port int
+	// 签名算法及 DS 摘要算法，默认为 ECDSAP256SHA256 及 SHA-256
+	DNSSEC DNSSECConfig
+	// 签名的有效期，自构建前一小时起算，默认为 DefaultHierarchySignatureValidity
+	SignatureValidity time.Duration
+	// 信任锚点文件的路径，不为空时在构建后写入根区域的 DS 及 KSK 记录
+	TrustAnchorFile string
+	// 各服务器的日志输出，为 nil 时丢弃日志
+	LogWriter io.Writer
+}
+
+// Hierarchy 是一个本地 DNS 层级
+type Hierarchy struct {
+	Config HierarchyConfig
+	// 各区域的数据，键为规范形式的区域名称
+	Zones map[string]*dns.Zone
+	// 各签名区域的密钥，DNSKEYRespSec 为区域顶点签名后的 DNSKEY RRset 及其 RRSIG 记录
+	Keys map[string]DNSSECMaterial
+	// 各区域服务器的地址，形如 "127.0.0.2:5353"
+	Servers map[string]string
+	// 根区域的信任锚点：根区域 KSK 的 DS 记录及 KSK 本身，根区域不签名时为空
+	TrustAnchor []dns.DNSResourceRecord
+
+	zones   []*hierarchyZone
+	servers []*GoDNSServer
+}
+
+// hierarchyZone 记录构建过程中的一个区域
+type hierarchyZone struct {
+	HierarchyZone
+	parent *hierarchyZone
+	zone   *dns.Zone
+	ksk    dns.DNSResourceRecord
+}
+
+// NewHierarchy 根据配置构建并签名本地 DNS 层级，但不启动服务器
+// 其接受参数为：
+//   - conf HierarchyConfig，层级配置
+//
+// 返回值为：
+//   - *Hierarchy，构建完成的层级
+//   - error，描述有误、区域记录无法解析或信任锚点文件写入失败时的错误信息
+func NewHierarchy(conf HierarchyConfig) (*Hierarchy, error) {
+	if conf.DNSSEC.DAlgo == 0 {
+		conf.DNSSEC.DAlgo = dns.DNSSECAlgorithmECDSAP256SHA256
+	}
+	if conf.DNSSEC.DType == 0 {
+		conf.DNSSEC.DType = dns.DNSSECDigestTypeSHA256
+	}
+	if conf.SignatureValidity <= 0 {
+		conf.SignatureValidity = DefaultHierarchySignatureValidity
+	}
+	if conf.LogWriter == nil {
+		conf.LogWriter = io.Discard
+	}
+	h := &Hierarchy{
+		Config:  conf,
+		Zones:   make(map[string]*dns.Zone),
+		Keys:    make(map[string]DNSSECMaterial),
+		Servers: make(map[string]string),
+	}
+	if canonicalName(conf.Root.Origin) != "." {
+		return nil, fmt.Errorf("the top of the hierarchy must be the root zone, got %q", conf.Root.Origin)
+	}
+	nextIP := net.IPv4(127, 0, 0, 2).To4()
+	if err := h.declare(conf.Root, nil, &nextIP); err != nil {
+		return nil, err
+	}
+	for _, hz := range h.zones {
+		if err := h.delegate(hz); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.sign(); err != nil {
+		return nil, err
+	}
+	if conf.TrustAnchorFile != "" {
+		f, err := os.Create(conf.TrustAnchorFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.WriteTrustAnchor(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// declare 按照深度优先的顺序登记区域，补全默认值并载入其记录
+func (h *Hierarchy) declare(decl HierarchyZone, parent *hierarchyZone, nextIP *net.IP) error {
+	decl.Origin = canonicalName(decl.Origin)
+	if parent != nil && (decl.Origin == parent.Origin || !IsSubDomain(parent.Origin, decl.Origin)) {
+		return fmt.Errorf("zone %s is not below its parent %s", decl.Origin, parent.Origin)
+	}
+	if _, ok := h.Zones[decl.Origin]; ok {
+		return fmt.Errorf("zone %s is declared more than once", decl.Origin)
+	}
+	if decl.IP == nil {
+		decl.IP = *nextIP
+		next := append(net.IP{}, *nextIP...)
+		next[3]++
+		*nextIP = next
+	}
+	if decl.IP = decl.IP.To4(); decl.IP == nil {
+		return fmt.Errorf("zone %s must be served on an IPv4 address", decl.Origin)
+	}
+	if decl.NS == "" {
+		if decl.Origin == "." {
+			decl.NS = "a.root-servers.net"
+		} else {
+			decl.NS = joinName("ns", decl.Origin)
+		}
+	}
+	decl.NS = canonicalName(decl.NS)
+
+	rrs, err := dns.ParseZone(strings.NewReader(decl.Records), decl.Origin)
+	if err != nil {
+		return fmt.Errorf("zone %s: %v", decl.Origin, err)
+	}
+	zone := dns.NewZone(decl.Origin)
+	if err := zone.Add(rrs...); err != nil {
+		return err
+	}
+	hz := &hierarchyZone{HierarchyZone: decl, parent: parent, zone: zone}
+	h.zones = append(h.zones, hz)
+	h.Zones[decl.Origin] = zone
+	for _, child := range decl.Children {
+		if err := h.declare(child, hz, nextIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHierarchyRR 创建一条 Hierarchy 使用的资源记录
+func newHierarchyRR(name string, ttl uint32, rdata dns.DNSRRRDATA) dns.DNSResourceRecord {
+	return dns.DNSResourceRecord{
+		Name:  name,
+		Type:  rdata.Type(),
+		Class: dns.DNSClassIN,
+		TTL:   ttl,
+		RDLen: uint16(rdata.Size()),
+		RData: rdata,
+	}
+}
+
+// delegate 为区域补全 SOA 及顶点 NS 记录，添加其域名服务器的地址记录，
+// 在父区域中添加委派的 NS 及胶水记录，并为签名的区域生成密钥及父区域中的 DS 记录
+func (h *Hierarchy) delegate(hz *hierarchyZone) error {
+	rrs := []dns.DNSResourceRecord{
+		newHierarchyRR(hz.Origin, DefaultHierarchyTTL, &dns.DNSRDATANS{NSDNAME: hz.NS}),
+	}
+	if hz.zone.Snapshot().SOA() == nil {
+		rrs = append(rrs, newHierarchyRR(hz.Origin, DefaultHierarchyTTL, &dns.DNSRDATASOA{
+			MName:   hz.NS,
+			RName:   joinName("hostmaster", hz.Origin),
+			Serial:  1,
+			Refresh: 7200,
+			Retry:   3600,
+			Expire:  1209600,
+			Minimum: 300,
+		}))
+	}
+	if err := hz.zone.Add(rrs...); err != nil {
+		return err
+	}
+
+	// 域名服务器的地址记录写入包含其名称的最深区域，名称位于父区域中时同时作为父区域的胶水记录
+	addr := newHierarchyRR(hz.NS, DefaultHierarchyTTL, &dns.DNSRDATAA{Address: hz.IP})
+	var owner *hierarchyZone
+	for _, z := range h.zones {
+		if IsSubDomain(z.Origin, hz.NS) && (owner == nil || dns.CountDomainNameLabels(&z.Origin) > dns.CountDomainNameLabels(&owner.Origin)) {
+			owner = z
+		}
+	}
+	if err := owner.zone.Add(addr); err != nil {
+		return err
+	}
+
+	if !hz.Unsigned {
+		hz.ksk, h.Keys[hz.Origin] = h.generateKeys(hz.Origin)
+	}
+	if hz.parent == nil {
+		return nil
+	}
+	rrs = []dns.DNSResourceRecord{
+		newHierarchyRR(hz.Origin, DefaultHierarchyTTL, &dns.DNSRDATANS{NSDNAME: hz.NS}),
+	}
+	if IsSubDomain(hz.parent.Origin, hz.NS) {
+		rrs = append(rrs, addr)
+	}
+	if !hz.Unsigned {
+		rrs = append(rrs, xperi.GenerateRRDS(hz.Origin, *hz.ksk.RData.(*dns.DNSRDATADNSKEY), h.Config.DNSSEC.DType))
+	}
+	return hz.parent.zone.Add(rrs...)
+}
+
+// generateKeys 为区域生成 KSK 及 ZSK，返回 KSK 记录及尚未包含 DNSKEY 签名的 DNSSEC 材料
+func (h *Hierarchy) generateKeys(origin string) (dns.DNSResourceRecord, DNSSECMaterial) {
+	ksk, privKSK := xperi.GenerateRRDNSKEY(origin, h.Config.DNSSEC.DAlgo, dns.DNSKEYFlagSecureEntryPoint)
+	zsk, privZSK := xperi.GenerateRRDNSKEY(origin, h.Config.DNSSEC.DAlgo, dns.DNSKEYFlagZoneKey)
+	return ksk, DNSSECMaterial{
+		KSKTag:        int(xperi.CalculateKeyTag(*ksk.RData.(*dns.DNSRDATADNSKEY))),
+		ZSKTag:        int(xperi.CalculateKeyTag(*zsk.RData.(*dns.DNSRDATADNSKEY))),
+		PrivateKSK:    privKSK,
+		PrivateZSK:    privZSK,
+		DNSKEYRespSec: []dns.DNSResourceRecord{zsk, ksk},
+	}
+}
+
+// sign 在所有委派添加完成后签名各区域，并生成根区域的信任锚点
+func (h *Hierarchy) sign() error {
+	inception := time.Now().Add(-time.Hour)
+	expiration := inception.Add(h.Config.SignatureValidity)
+	for _, hz := range h.zones {
+		if hz.Unsigned {
+			continue
+		}
+		mat := h.Keys[hz.Origin]
+		err := hz.zone.Update(func(s *dns.ZoneSnapshot) (*dns.ZoneSnapshot, error) {
+			return signZone(s, mat, h.Config.DNSSEC.DAlgo, uint32(inception.Unix()), uint32(expiration.Unix()))
+		})
+		if err != nil {
+			return fmt.Errorf("zone %s: %v", hz.Origin, err)
+		}
+		snapshot := hz.zone.Snapshot()
+		mat.DNSKEYRespSec = append(snapshot.RRSet(hz.Origin, dns.DNSRRTypeDNSKEY), snapshot.Get(hz.Origin).Signatures[dns.DNSRRTypeDNSKEY]...)
+		h.Keys[hz.Origin] = mat
+	}
+	if root := h.zones[0]; !root.Unsigned {
+		h.TrustAnchor = []dns.DNSResourceRecord{
+			xperi.GenerateRRDS(".", *root.ksk.RData.(*dns.DNSRDATADNSKEY), h.Config.DNSSEC.DType),
+			root.ksk,
+		}
+	}
+	return nil
+}
+
+// signZone 为区域添加 DNSKEY 记录及 NSEC 链，并签名所有权威 RRset
+// 其接受参数为：
+//   - s *dns.ZoneSnapshot，待签名区域的快照
+//   - mat DNSSECMaterial，区域的密钥，DNSKEYRespSec 为未签名的 DNSKEY 记录
+//   - algo dns.DNSSECAlgorithm，签名算法
+//   - inception, expiration uint32，签名的生效及过期时间
+//
+// 返回值为：
+//   - *dns.ZoneSnapshot，签名后的快照
+//   - error，错误信息
+//
+// 委派点仅签名 DS 及 NSEC 记录，胶水记录等委派点以下的数据不签名，也不在 NSEC 链中，
+// 空非终端名称同样没有 NSEC 记录，详见 RFC 4035 2.2 及 2.3 节。
+func signZone(s *dns.ZoneSnapshot, mat DNSSECMaterial, algo dns.DNSSECAlgorithm, inception, expiration uint32) (*dns.ZoneSnapshot, error) {
+	s, err := s.With(mat.DNSKEYRespSec...)
+	if err != nil {
+		return nil, err
+	}
+	soa := s.SOA()
+	if soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", s.Origin)
+	}
+
+	// 权威名称按照规范顺序排列，委派点本身是权威名称
+	var names []string
+	s.Walk(func(n *dns.ZoneNode) bool {
+		if cut := s.Delegation(n.Name); !n.Empty() && (cut == nil || cut.Name == n.Name) {
+			names = append(names, n.Name)
+		}
+		return true
+	})
+	nsecTTL := negativeSOA(s).TTL
+	nsecs := make([]dns.DNSResourceRecord, 0, len(names))
+	for i, name := range names {
+		cut := s.Delegation(name) != nil
+		types := []dns.DNSType{dns.DNSRRTypeNSEC, dns.DNSRRTypeRRSIG}
+		for t := range s.Get(name).RRSets {
+			if !cut || t == dns.DNSRRTypeNS || t == dns.DNSRRTypeDS {
+				types = append(types, t)
+			}
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		nsecs = append(nsecs, newHierarchyRR(name, nsecTTL, &dns.DNSRDATANSEC{
+			NextDomainName: names[(i+1)%len(names)],
+			TypeBitMaps:    dns.EncodeTypeBitMaps(types),
+		}))
+	}
+	if s, err = s.With(nsecs...); err != nil {
+		return nil, err
+	}
+
+	var sigs []dns.DNSResourceRecord
+	for _, name := range names {
+		node := s.Get(name)
+		cut := s.Delegation(name) != nil
+		for t, rrSet := range node.RRSets {
+			if cut && t != dns.DNSRRTypeDS && t != dns.DNSRRTypeNSEC {
+				continue
+			}
+			keyTag, privKey := mat.ZSKTag, mat.PrivateZSK
+			if t == dns.DNSRRTypeDNSKEY {
+				keyTag, privKey = mat.KSKTag, mat.PrivateKSK
+			}
+			rrSet = append([]dns.DNSResourceRecord{}, rrSet...)
+			dns.CanonicalSortRRSet(rrSet)
+			sig := xperi.GenerateRRRRSIG(rrSet, algo, expiration, inception, uint16(keyTag), s.Origin, privKey)
+			sig.TTL = rrSet[0].TTL
+			sigs = append(sigs, sig)
+		}
+	}
+	return s.With(sigs...)
+}
+
+// hierarchyPortAttempts 是自动选择端口时的最大尝试次数
+const hierarchyPortAttempts = 5
+
+// Start 为每个服务器地址启动一个 GoDNS 权威服务器，并等待所有服务器开始监听。
+// 自动选择端口时，若端口在探测后被占用而导致服务器未能开始监听，将换用另一个端口重试。
+// 返回值为：
+//   - error，任一服务器未能开始监听时的错误信息，此时已启动的服务器会被停止
+func (h *Hierarchy) Start() error {
+	byIP := make(map[string][]*dns.Zone)
+	var ips []string
+	for _, hz := range h.zones {
+		ip := hz.IP.String()
+		if _, ok := byIP[ip]; !ok {
+			ips = append(ips, ip)
+		}
+		byIP[ip] = append(byIP[ip], hz.zone)
+	}
+	if h.Config.Port != 0 {
+		return h.startServers(ips, byIP)
+	}
+
+	var err error
+	for i := 0; i < hierarchyPortAttempts; i++ {
+		if h.Config.Port, err = probePort(ips); err != nil {
+			continue
+		}
+		if err = h.startServers(ips, byIP); err == nil {
+			return nil
+		}
+	}
+	h.Config.Port = 0
+	return err
+}
+
+// probePort 返回一个在所有地址上 UDP 及 TCP 均可绑定的端口
+func probePort(ips []string) (int, error) {
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	pktConn, err := net.ListenPacket("udp", net.JoinHostPort(ips[0], "0"))
+	if err != nil {
+		return 0, err
+	}
+	closers = append(closers, pktConn)
+	port := pktConn.LocalAddr().(*net.UDPAddr).Port
+	for i, ip := range ips {
+		addr := listenAddr(net.ParseIP(ip), port)
+		if i > 0 {
+			c, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return 0, err
+			}
+			closers = append(closers, c)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return 0, err
+		}
+		closers = append(closers, l)
+	}
+	return port, nil
+}
+
+// startServers 在 Config.Port 上为每个服务器地址启动服务器，任一服务器未能开始监听时停止所有服务器
+func (h *Hierarchy) startServers(ips []string, byIP map[string][]*dns.Zone) error {
+	for _, ip := range ips {
+		server := NewGoDNSServer(DNSServerConfig{
+			IP:          net.ParseIP(ip),
+			ListenIP:    net.ParseIP(ip),
+			Port:        h.Config.Port,
+			LogWriter:   h.Config.LogWriter,
+			PoolCapcity: -1,
+		}, NewAuthoritativeResponser(byIP[ip]...))
+		go server.Start()
+		h.servers = append(h.servers, server)
+		if err := waitListening(server); err != nil {
+			h.Stop()
+			return fmt.Errorf("server on %s: %v", listenAddr(net.ParseIP(ip), h.Config.Port), err)
+		}
+	}
+	for _, hz := range h.zones {
+		h.Servers[hz.Origin] = listenAddr(hz.IP, h.Config.Port)
+	}
+	return nil
+}
+
+// waitListening 等待服务器的所有传输层开始监听，最多等待两秒
+func waitListening(server *GoDNSServer) error {
+	for _, tp := range server.Netter.Transports {
+		a, ok := tp.(interface{ Addr() net.Addr })
+		if !ok {
+			continue
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for a.Addr() == nil {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("transport did not start listening")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Stop 停止层级中的所有服务器
+func (h *Hierarchy) Stop() error {
+	var err error
+	for _, server := range h.servers {
+		if serr := server.Stop(); err == nil {
+			err = serr
+		}
+	}
+	h.servers = nil
+	return err
+}
+
+// RootHints 返回根区域服务器的地址，可直接作为 ResolverConfig.RootHints 使用，
+// 解析器查询其他服务器时所用的端口须设置为 Config.Port
+func (h *Hierarchy) RootHints() []string {
+	return []string{listenAddr(h.zones[0].IP, h.Config.Port)}
+}
+
+// WriteTrustAnchor 以区域文件格式写出根区域的信任锚点，即根区域 KSK 的 DS 记录及 KSK 本身
+func (h *Hierarchy) WriteTrustAnchor(w io.Writer) error {
+	for _, rr := range h.TrustAnchor {
+		var line string
+		switch rdata := rr.RData.(type) {
+		case *dns.DNSRDATADS:
+			line = fmt.Sprintf("%d %d %d %X", rdata.KeyTag, rdata.Algorithm, rdata.DigestType, rdata.Digest)
+		case *dns.DNSRDATADNSKEY:
+			line = fmt.Sprintf("%d %d %d %s", rdata.Flags, rdata.Protocol, rdata.Algorithm, base64.StdEncoding.EncodeToString(rdata.PublicKey))
+		default:
+			continue
+		}
+		if _, err := fmt.Fprintf(w, ". %d IN %s %s\n", rr.TTL, rr.Type, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
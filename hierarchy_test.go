@@ -0,0 +1,261 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// hierarchy_test.go 文件定义了对 hierarchy.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+	"github.com/tochusc/godns/dns/xperi"
+)
+
+// testHierarchyConfig 返回测试所用的层级描述：根 -> com -> example.com，以及不签名的 net
+func testHierarchyConfig(t *testing.T) HierarchyConfig {
+	return HierarchyConfig{
+		Root: HierarchyZone{
+			Origin: ".",
+			Children: []HierarchyZone{
+				{
+					Origin: "com",
+					Children: []HierarchyZone{{
+						Origin:  "example.com",
+						Records: "www 3600 A 192.0.2.1\nwww 3600 A 192.0.2.2\n*.wild 3600 TXT \"wildcard\"\n",
+					}},
+				},
+				{Origin: "net", Unsigned: true},
+			},
+		},
+		TrustAnchorFile: filepath.Join(t.TempDir(), "root.key"),
+	}
+}
+
+// testVerifyRRSIG 使用 ECDSAP256SHA256 公钥验证 RRSIG 记录对 RRset 的签名
+func testVerifyRRSIG(rrSet []dns.DNSResourceRecord, sig dns.DNSResourceRecord, key dns.DNSRDATADNSKEY) bool {
+	rrsig := *sig.RData.(*dns.DNSRDATARRSIG)
+	signature := rrsig.Signature
+	rrsig.Signature = []byte{}
+
+	rrSet = append([]dns.DNSResourceRecord{}, rrSet...)
+	dns.CanonicalSortRRSet(rrSet)
+	plainText := rrsig.Encode()
+	for _, rr := range rrSet {
+		rr.TTL = rrsig.OriginalTTL
+		plainText = append(plainText, rr.Encode()...)
+	}
+	digest := sha256.Sum256(plainText)
+	if len(key.PublicKey) != 64 || len(signature) != 64 {
+		return false
+	}
+	pubKey := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(key.PublicKey[:32]),
+		Y:     new(big.Int).SetBytes(key.PublicKey[32:]),
+	}
+	return ecdsa.Verify(&pubKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+}
+
+// TestNewHierarchy 测试层级中的委派、DS 记录、NSEC 链、签名及信任锚点
+func TestNewHierarchy(t *testing.T) {
+	conf := testHierarchyConfig(t)
+	h, err := NewHierarchy(conf)
+	if err != nil {
+		t.Fatalf("NewHierarchy failed: %v", err)
+	}
+
+	// 父区域中的 DS 记录与子区域的 KSK 相符，不签名的子区域没有 DS 记录
+	for child, parent := range map[string]string{"com": ".", "example.com": "com"} {
+		ksk := h.Keys[child].DNSKEYRespSec[1]
+		ds := h.Zones[parent].Snapshot().RRSet(child, dns.DNSRRTypeDS)
+		expected := xperi.GenerateRDATADS(child, *ksk.RData.(*dns.DNSRDATADNSKEY), dns.DNSSECDigestTypeSHA256)
+		if len(ds) != 1 || !ds[0].RData.Equal(&expected) {
+			t.Errorf("DS of %s in %s got: %v, expected: %v", child, parent, ds, expected)
+		}
+	}
+	if ds := h.Zones["."].Snapshot().RRSet("net", dns.DNSRRTypeDS); len(ds) != 0 {
+		t.Errorf("DS of unsigned net got: %v, expected: none", ds)
+	}
+	if glue := h.Zones["com"].Snapshot().Glue("example.com"); testSectionTypes(glue) != "A" {
+		t.Errorf("glue of example.com got: %v, expected: A", glue)
+	}
+	if _, ok := h.Keys["net"]; ok || len(h.Zones["net"].Snapshot().RRSet("net", dns.DNSRRTypeDNSKEY)) != 0 {
+		t.Error("unsigned zone net has keys")
+	}
+
+	// 每个权威 RRset 都由区域的密钥签名，委派点仅签名 DS 及 NSEC 记录
+	for _, origin := range []string{".", "com", "example.com"} {
+		s := h.Zones[origin].Snapshot()
+		keys := map[uint16]dns.DNSRDATADNSKEY{}
+		for _, rr := range s.RRSet(origin, dns.DNSRRTypeDNSKEY) {
+			key := *rr.RData.(*dns.DNSRDATADNSKEY)
+			keys[xperi.CalculateKeyTag(key)] = key
+		}
+		nsecs := 0
+		s.Walk(func(n *dns.ZoneNode) bool {
+			cut := s.Delegation(n.Name)
+			for rtype, rrSet := range n.RRSets {
+				unsigned := cut != nil && (cut.Name != n.Name || (rtype != dns.DNSRRTypeDS && rtype != dns.DNSRRTypeNSEC))
+				sigs := n.Signatures[rtype]
+				if unsigned != (len(sigs) == 0) {
+					t.Errorf("zone %s: %s %s has %d signatures", origin, n.Name, rtype, len(sigs))
+					continue
+				}
+				for _, sig := range sigs {
+					rrsig := sig.RData.(*dns.DNSRDATARRSIG)
+					if rrsig.SignerName != origin || sig.TTL != rrSet[0].TTL || !testVerifyRRSIG(rrSet, sig, keys[rrsig.KeyTag]) {
+						t.Errorf("zone %s: signature of %s %s does not verify", origin, n.Name, rtype)
+					}
+				}
+				if rtype == dns.DNSRRTypeNSEC {
+					nsecs++
+				}
+			}
+			return true
+		})
+		if nsecs == 0 {
+			t.Errorf("zone %s has no NSEC records", origin)
+		}
+	}
+
+	// NSEC 链按照规范顺序首尾相连，并跳过委派点以下的胶水记录
+	s := h.Zones["example.com"].Snapshot()
+	chain := []string{}
+	for name := "example.com"; len(chain) < 10; {
+		chain = append(chain, name)
+		name = s.RRSet(name, dns.DNSRRTypeNSEC)[0].RData.(*dns.DNSRDATANSEC).NextDomainName
+		if name == "example.com" {
+			break
+		}
+	}
+	if got := strings.Join(chain, " "); got != "example.com ns.example.com *.wild.example.com www.example.com" {
+		t.Errorf("NSEC chain got: %v", chain)
+	}
+	if nsec := h.Zones["."].Snapshot().RRSet("com", dns.DNSRRTypeNSEC); len(nsec) != 1 ||
+		!bytes.Equal(nsec[0].RData.(*dns.DNSRDATANSEC).TypeBitMaps, dns.EncodeTypeBitMaps([]dns.DNSType{dns.DNSRRTypeNS, dns.DNSRRTypeRRSIG, dns.DNSRRTypeNSEC, dns.DNSRRTypeDS})) {
+		t.Errorf("NSEC of com in root got: %v", nsec)
+	}
+
+	// 信任锚点文件可以作为区域文件解析，其中的 DS 记录与根区域的 KSK 相符
+	data, err := os.ReadFile(conf.TrustAnchorFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	anchors, err := dns.ParseZone(bytes.NewReader(data), ".")
+	if err != nil || testSectionTypes(anchors) != "DS DNSKEY" {
+		t.Fatalf("trust anchor got: %v %v, expected: DS DNSKEY\n%s", anchors, err, data)
+	}
+	expected := xperi.GenerateRDATADS(".", *anchors[1].RData.(*dns.DNSRDATADNSKEY), dns.DNSSECDigestTypeSHA256)
+	if anchors[0].Name != "." || !anchors[0].RData.Equal(&expected) || !anchors[1].RData.Equal(h.Keys["."].DNSKEYRespSec[1].RData) {
+		t.Errorf("trust anchor does not match the root KSK:\n%s", data)
+	}
+}
+
+// TestNewHierarchyErrors 测试有误的层级描述
+func TestNewHierarchyErrors(t *testing.T) {
+	for _, root := range []HierarchyZone{
+		{Origin: "com"},
+		{Origin: ".", Children: []HierarchyZone{{Origin: "com", Children: []HierarchyZone{{Origin: "example.net"}}}}},
+		{Origin: ".", Children: []HierarchyZone{{Origin: "com"}, {Origin: "com."}}},
+		{Origin: ".", IP: net.ParseIP("::1")},
+		{Origin: ".", Records: "www 3600 A not-an-address\n"},
+	} {
+		if _, err := NewHierarchy(HierarchyConfig{Root: root}); err == nil {
+			t.Errorf("NewHierarchy(%+v) expected an error but got nil", root)
+		}
+	}
+}
+
+// TestHierarchyStart 测试解析器可以在启动后的层级中迭代解析，且回复附带签名及否定证明
+func TestHierarchyStart(t *testing.T) {
+	h, err := NewHierarchy(testHierarchyConfig(t))
+	if err != nil {
+		t.Fatalf("NewHierarchy failed: %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { h.Stop() })
+
+	r := NewIterativeResolver(ResolverConfig{RootHints: h.RootHints(), Port: h.Config.Port}, discardLogger())
+	result, err := r.Resolve("www.example.com", dns.DNSRRTypeA)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v\n%v", err, result.Trace)
+	}
+	if testSectionTypes(result.Answer) != "A A" || len(result.Trace) != 3 ||
+		result.Trace[0].Zone != "." || result.Trace[1].Zone != "com" || result.Trace[2].Zone != "example.com" {
+		t.Errorf("Resolve(www.example.com) got: %v\n%v", result.Answer, result.Trace)
+	}
+	if result.Trace[2].Server != h.Servers["example.com"] {
+		t.Errorf("example.com server got: %q, expected: %q", result.Trace[2].Server, h.Servers["example.com"])
+	}
+
+	for _, c := range []struct {
+		server, name string
+		qtype        dns.DNSType
+		answer       string
+		authority    string
+	}{
+		{".", "www.example.com", dns.DNSRRTypeA, "", "NS DS RRSIG"},
+		{"example.com", "www.example.com", dns.DNSRRTypeA, "A A RRSIG", ""},
+		{"example.com", "example.com", dns.DNSRRTypeDNSKEY, "DNSKEY DNSKEY RRSIG", ""},
+		{"example.com", "zzz.example.com", dns.DNSRRTypeA, "", "SOA RRSIG NSEC RRSIG NSEC RRSIG"},
+		{".", "www.net", dns.DNSRRTypeA, "", "NS NSEC RRSIG"},
+	} {
+		qry := dns.DNSMessage{}
+		qry.DecodeFromBuffer(testQuery(0x1234, c.name, c.qtype, 0, true), 0)
+		resp, err := Exchange(ProtocolUDP, h.Servers[c.server], qry, time.Second)
+		if err != nil {
+			t.Fatalf("Exchange(%s %s) failed: %v", c.name, c.qtype, err)
+		}
+		if testSectionTypes(resp.Answer) != c.answer || testSectionTypes(resp.Authority) != c.authority {
+			t.Errorf("%s %s %s answer, authority got: %q %q, expected: %q %q", c.server, c.name, c.qtype,
+				testSectionTypes(resp.Answer), testSectionTypes(resp.Authority), c.answer, c.authority)
+		}
+	}
+}
+
+// TestHierarchyPort 测试自动选择的端口在所有地址上均可绑定，及指定端口被占用时 Start 报错
+func TestHierarchyPort(t *testing.T) {
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	port, err := probePort(ips)
+	if err != nil {
+		t.Fatalf("probePort failed: %v", err)
+	}
+	for _, ip := range ips {
+		addr := listenAddr(net.ParseIP(ip), port)
+		pktConn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatalf("listen udp on %s failed: %v", addr, err)
+		}
+		defer pktConn.Close()
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("listen tcp on %s failed: %v", addr, err)
+		}
+		defer l.Close()
+	}
+
+	// 端口已被上面的监听器占用
+	conf := testHierarchyConfig(t)
+	conf.Root.IP = net.ParseIP("127.0.0.1")
+	conf.Port = port
+	h, err := NewHierarchy(conf)
+	if err != nil {
+		t.Fatalf("NewHierarchy failed: %v", err)
+	}
+	if err := h.Start(); err == nil {
+		h.Stop()
+		t.Error("Start on a port in use expected an error but got nil")
+	}
+}
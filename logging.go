@@ -0,0 +1,188 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// logging.go 文件定义了 GoDNS 的结构化日志。
+// 各组件（GoDNSServer、Netter、Cacher、Responser）均通过 log/slog 输出日志，
+// 并附带 component 属性以便区分；每个查询的处理结果则以 QueryRecord 的形式记录，
+// 便于在海量实验查询中进行检索与统计。
+
+package godns
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// 日志组件名，用于 DNSServerConfig.LogLevels 及日志中的 component 属性
+const (
+	LogComponentGoDNS     = "godns"
+	LogComponentNetter    = "netter"
+	LogComponentCacher    = "cacher"
+	LogComponentResponser = "responser"
+)
+
+// 日志格式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// NewComponentLogger 根据服务器配置创建指定组件的日志
+// 其接受参数为：
+//   - conf DNSServerConfig，DNS 服务器配置
+//   - component string，组件名
+//
+// 配置了 LogHandler 时使用该处理器，否则根据 LogFormat 向 LogWriter 输出文本或 JSON 日志。
+// 组件的日志级别由 LogLevels 指定，未指定时为 Info。
+// 自定义的 Responser 可以使用 LogComponentResponser 获取其日志。
+func NewComponentLogger(conf DNSServerConfig, component string) *slog.Logger {
+	level, ok := conf.LogLevels[component]
+	if !ok {
+		level = slog.LevelInfo
+	}
+
+	var handler slog.Handler
+	if conf.LogHandler != nil {
+		handler = &levelHandler{Handler: conf.LogHandler, level: level}
+	} else {
+		w := conf.LogWriter
+		if w == nil {
+			w = io.Discard
+		}
+		opts := &slog.HandlerOptions{Level: level}
+		if strings.EqualFold(conf.LogFormat, LogFormatJSON) {
+			handler = slog.NewJSONHandler(w, opts)
+		} else {
+			handler = slog.NewTextHandler(w, opts)
+		}
+	}
+	return slog.New(handler).With("component", component)
+}
+
+// newWriterLogger 为未提供 slog.Logger 的组件创建一个向 w 输出文本日志的日志
+func newWriterLogger(w io.Writer, component string) *slog.Logger {
+	return NewComponentLogger(DNSServerConfig{LogWriter: w}, component)
+}
+
+// levelHandler 为自定义的日志处理器附加最低日志级别
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// QueryRecord 记录一个查询在处理链中的处理结果。
+// GoDNSServer 会为每个查询创建一个 QueryRecord，并通过 ConnectionInfo.Record 在处理链中传递，
+// 中间件可以向其中填写信息（如缓存是否命中），最终由日志中间件输出。
+type QueryRecord struct {
+	Client   net.Addr
+	Protocol Protocol
+
+	QName string
+	QType dns.DNSType
+	RCode dns.DNSResponseCode
+
+	// 回复大小，为 0 时表示未回复
+	Size    int
+	Latency time.Duration
+
+	// 是否查询了缓存，是否命中缓存，以及是否返回了过期的缓存回复
+	CacheLookup bool
+	CacheHit    bool
+	CacheStale  bool
+
+	// 选中的视图名称，未使用视图时为空
+	View string
+	// 给出回复的上游服务器地址，未转发时为空
+	Upstream string
+
+	// DNSSEC 相关标志：查询的 DO、CD 位，回复的 AD 位
+	DO bool
+	CD bool
+	AD bool
+
+	// 查询信息是否已被解析，避免多个中间件重复解析
+	queryFilled bool
+}
+
+// fillQuery 根据查询填写记录中的客户端、查询名称、类型及 DO、CD 位
+func (r *QueryRecord) fillQuery(connInfo ConnectionInfo) {
+	if r.queryFilled {
+		return
+	}
+	r.queryFilled = true
+	r.Client = connInfo.Address
+	r.Protocol = connInfo.Protocol
+
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return
+	}
+	// Z 字段的最低位为 CD 位，详见 RFC 4035 3.2.2 节
+	r.CD = qry.Header.Z&0x01 != 0
+	if len(qry.Question) > 0 {
+		r.QName = qry.Question[0].Name
+		r.QType = qry.Question[0].Type
+	}
+	for _, rr := range qry.Additional {
+		if rr.Type == dns.DNSRRTypeOPT {
+			r.DO = rr.TTL&0x8000 != 0
+		}
+	}
+}
+
+// fillResponse 根据回复填写记录中的大小、回复码及 AD 位
+func (r *QueryRecord) fillResponse(resp []byte) {
+	r.Size = len(resp)
+	if len(resp) >= 4 {
+		r.AD = resp[3]&0x20 != 0
+		r.RCode = dns.DNSResponseCode(resp[3] & 0x0f)
+	}
+}
+
+// Attrs 以 slog 属性的形式返回记录
+func (r *QueryRecord) Attrs() []slog.Attr {
+	client := ""
+	if r.Client != nil {
+		client = r.Client.String()
+	}
+	attrs := []slog.Attr{
+		slog.String("client", client),
+		slog.String("protocol", string(r.Protocol)),
+		slog.String("qname", r.QName),
+		slog.String("qtype", r.QType.String()),
+		slog.String("rcode", r.RCode.String()),
+		slog.Int("size", r.Size),
+		slog.Duration("latency", r.Latency),
+		slog.Bool("cache_hit", r.CacheHit),
+		slog.Bool("do", r.DO),
+		slog.Bool("cd", r.CD),
+		slog.Bool("ad", r.AD),
+	}
+	if r.CacheStale {
+		attrs = append(attrs, slog.Bool("cache_stale", true))
+	}
+	if r.View != "" {
+		attrs = append(attrs, slog.String("view", r.View))
+	}
+	if r.Upstream != "" {
+		attrs = append(attrs, slog.String("upstream", r.Upstream))
+	}
+	return attrs
+}
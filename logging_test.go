@@ -0,0 +1,109 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// logging_test.go 文件定义了对 logging.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// discardLogger 返回一个丢弃所有输出的日志
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// TestLoggingMiddlewareJSON 测试日志中间件以 JSON 格式输出的查询记录
+func TestLoggingMiddlewareJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	conf := DNSServerConfig{
+		IP:        net.IPv4(10, 0, 0, 1),
+		LogWriter: &buf,
+		LogFormat: LogFormatJSON,
+	}
+	logger := NewComponentLogger(conf, LogComponentGoDNS)
+	cacheHit := func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			connInfo.Record.CacheHit = true
+			return next.ServeDNS(connInfo)
+		})
+	}
+	h := Chain(ResponserHandler(&DullResponser{ServerConf: conf}), LoggingMiddleware(logger), cacheHit)
+
+	opt := dns.NewDNSRROPT(1232, int(dns.SetDNSRROPTTTL(0, 0, true, 0)), &dns.DNSRDATAOPT{})
+	qry := dns.DNSMessage{
+		Header: dns.DNSHeader{QDCount: 1, ARCount: 1},
+		Question: []dns.DNSQuestion{
+			{Name: "www.example.com", Type: dns.DNSRRTypeA, Class: dns.DNSClassIN},
+		},
+		Additional: []dns.DNSResourceRecord{*opt},
+	}
+	_, err := h.ServeDNS(ConnectionInfo{
+		Protocol: ProtocolUDP,
+		Address:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353},
+		Packet:   qry.Encode(),
+	})
+	if err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	rec := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("invalid JSON log %q: %v", buf.String(), err)
+	}
+	expected := map[string]any{
+		"component": LogComponentGoDNS,
+		"client":    "127.0.0.1:5353",
+		"protocol":  "udp",
+		"qname":     "www.example.com",
+		"qtype":     dns.DNSRRTypeA.String(),
+		"rcode":     dns.DNSResponseCodeNoErr.String(),
+		"cache_hit": true,
+		"do":        true,
+		"cd":        false,
+	}
+	for k, v := range expected {
+		if rec[k] != v {
+			t.Errorf("log field %s got: %v, expected: %v", k, rec[k], v)
+		}
+	}
+	if size, _ := rec["size"].(float64); size <= 0 {
+		t.Errorf("log field size got: %v, expected: > 0", rec["size"])
+	}
+}
+
+// TestComponentLogLevels 测试各组件独立的日志级别
+func TestComponentLogLevels(t *testing.T) {
+	buf := bytes.Buffer{}
+	conf := DNSServerConfig{
+		LogHandler: slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		LogLevels: map[string]slog.Level{
+			LogComponentNetter: slog.LevelDebug,
+			LogComponentCacher: slog.LevelError,
+		},
+	}
+
+	NewComponentLogger(conf, LogComponentNetter).Debug("netter debug")
+	NewComponentLogger(conf, LogComponentCacher).Warn("cacher warn")
+	NewComponentLogger(conf, LogComponentGoDNS).Debug("godns debug")
+	NewComponentLogger(conf, LogComponentGoDNS).Info("godns info")
+
+	out := buf.String()
+	for _, msg := range []string{"netter debug", "godns info"} {
+		if !bytes.Contains(buf.Bytes(), []byte(msg)) {
+			t.Errorf("log output %q does not contain %q", out, msg)
+		}
+	}
+	for _, msg := range []string{"cacher warn", "godns debug"} {
+		if bytes.Contains(buf.Bytes(), []byte(msg)) {
+			t.Errorf("log output %q unexpectedly contains %q", out, msg)
+		}
+	}
+}
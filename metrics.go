@@ -0,0 +1,365 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// metrics.go 文件实现了 GoDNS 的运行指标。
+// Metrics 记录查询数量、回复码、耗时、Responser 错误、缓存命中及线程池状态等指标，
+// 并以 Prometheus 文本格式输出，可以通过可选的 HTTP 监听器供 Prometheus 抓取，
+// 也可以直接调用 WriteTo 输出，无需依赖任何外部服务。
+
+package godns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/tochusc/godns/dns"
+)
+
+// MetricsConfig 记录指标 HTTP 监听器的配置
+type MetricsConfig struct {
+	// 监听地址，为 nil 时仅监听 127.0.0.1，需要对外提供指标时可设置为 net.IPv4zero
+	ListenIP net.IP
+	// 监听端口
+	Port int
+	// 指标路径，默认为 "/metrics"
+	Path string
+}
+
+// MetricsDurationBuckets 是查询耗时直方图的默认分桶（秒）
+var MetricsDurationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics 记录 GoDNS 的运行指标，可被并发调用。
+// 除内置指标外，中间件可以通过 RegisterCounter 及 Inc 记录自定义的计数器。
+type Metrics struct {
+	// 线程池，不为 nil 时输出其运行及等待中的任务数量
+	Pool *ants.Pool
+
+	mu         sync.Mutex
+	counters   map[string]*metricCounter
+	names      []string
+	histograms map[string]*metricHistogram
+
+	srv *http.Server
+}
+
+// metricCounter 是带标签的计数器
+type metricCounter struct {
+	help   string
+	labels []string
+	values map[string]uint64
+}
+
+// metricHistogram 是一组标签值下的查询耗时直方图
+type metricHistogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// 内置指标名称
+const (
+	metricQueries         = "godns_queries_total"
+	metricResponses       = "godns_responses_total"
+	metricDropped         = "godns_dropped_total"
+	metricResponserErrors = "godns_responser_errors_total"
+	metricCacheHits       = "godns_cache_hits_total"
+	metricCacheMisses     = "godns_cache_misses_total"
+	metricCacheStale      = "godns_cache_stale_answers_total"
+	metricDuration        = "godns_query_duration_seconds"
+)
+
+// metricDurationLabels 是查询耗时直方图的标签，未回复或处理出错的查询的 rcode 为 "none"
+var metricDurationLabels = []string{"protocol", "qtype", "rcode"}
+
+// NewMetrics 创建一个指标记录器，并注册内置指标
+// 其接受参数为：
+//   - pool *ants.Pool，线程池，可以为 nil
+func NewMetrics(pool *ants.Pool) *Metrics {
+	m := &Metrics{
+		Pool:       pool,
+		counters:   make(map[string]*metricCounter),
+		histograms: make(map[string]*metricHistogram),
+	}
+	m.RegisterCounter(metricQueries, "Number of received queries.", "protocol", "qtype")
+	m.RegisterCounter(metricResponses, "Number of sent responses.", "protocol", "rcode")
+	m.RegisterCounter(metricDropped, "Number of queries that were not answered.", "protocol")
+	m.RegisterCounter(metricResponserErrors, "Number of errors returned by the handler chain.", "protocol")
+	m.RegisterCounter(metricCacheHits, "Number of cache hits.")
+	m.RegisterCounter(metricCacheMisses, "Number of cache misses.")
+	m.RegisterCounter(metricCacheStale, "Number of stale answers served from the cache.")
+	return m
+}
+
+// RegisterCounter 注册一个计数器，重复注册同名计数器不会产生任何效果
+// 其接受参数为：
+//   - name string，指标名称
+//   - help string，指标说明
+//   - labels ...string，标签名称
+func (m *Metrics) RegisterCounter(name, help string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.counters[name]; ok {
+		return
+	}
+	m.counters[name] = &metricCounter{help: help, labels: labels, values: make(map[string]uint64)}
+	m.names = append(m.names, name)
+}
+
+// Inc 将计数器加一，标签值的顺序须与注册时的标签名称一致。
+// 未注册的计数器将被忽略。
+func (m *Metrics) Inc(name string, labelValues ...string) {
+	m.Add(name, 1, labelValues...)
+}
+
+// Add 为计数器增加指定的值
+func (m *Metrics) Add(name string, delta uint64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[name]
+	if !ok || len(labelValues) != len(c.labels) {
+		return
+	}
+	c.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+// Counter 返回计数器的当前值，主要用于测试
+func (m *Metrics) Counter(name string, labelValues ...string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[name]
+	if !ok {
+		return 0
+	}
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+// Observe 记录一个查询的处理耗时
+// 其接受参数为：
+//   - protocol Protocol，查询的协议
+//   - qtype string，查询类型的标签值
+//   - rcode string，回复码的标签值
+//   - d time.Duration，处理耗时
+func (m *Metrics) Observe(protocol Protocol, qtype, rcode string, d time.Duration) {
+	key := strings.Join([]string{string(protocol), qtype, rcode}, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &metricHistogram{buckets: MetricsDurationBuckets, counts: make([]uint64, len(MetricsDurationBuckets))}
+		m.histograms[key] = h
+	}
+	sec := d.Seconds()
+	for i, b := range h.buckets {
+		if sec <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += sec
+	h.count++
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	sb := strings.Builder{}
+
+	m.mu.Lock()
+	for _, name := range m.names {
+		c := m.counters[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name)
+		keys := make([]string, 0, len(c.values))
+		for k := range c.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var values []string
+			if len(c.labels) > 0 {
+				values = strings.Split(k, "\xff")
+			}
+			fmt.Fprintf(&sb, "%s%s %d\n", name, formatLabels(c.labels, values), c.values[k])
+		}
+	}
+
+	fmt.Fprintf(&sb, "# HELP %s Time spent handling queries.\n# TYPE %s histogram\n", metricDuration, metricDuration)
+	keys := make([]string, 0, len(m.histograms))
+	for k := range m.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, metricDurationLabels...), "le")
+	for _, k := range keys {
+		h := m.histograms[k]
+		values := strings.Split(k, "\xff")
+		for i, b := range h.buckets {
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", metricDuration, formatLabels(bucketLabels, append(values, fmt.Sprint(b))), h.counts[i])
+		}
+		fmt.Fprintf(&sb, "%s_bucket%s %d\n", metricDuration, formatLabels(bucketLabels, append(values, "+Inf")), h.count)
+		fmt.Fprintf(&sb, "%s_sum%s %g\n", metricDuration, formatLabels(metricDurationLabels, values), h.sum)
+		fmt.Fprintf(&sb, "%s_count%s %d\n", metricDuration, formatLabels(metricDurationLabels, values), h.count)
+	}
+	m.mu.Unlock()
+
+	if m.Pool != nil {
+		gauges := []struct {
+			name, help string
+			value      int
+		}{
+			{"godns_pool_running", "Number of running workers in the pool.", m.Pool.Running()},
+			{"godns_pool_waiting", "Number of tasks waiting for a worker.", m.Pool.Waiting()},
+			{"godns_pool_capacity", "Capacity of the pool, -1 if unlimited.", m.Pool.Cap()},
+		}
+		for _, g := range gauges {
+			fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// formatLabels 将标签格式化为 {name="value",...} 的形式
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + metricLabelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricLabelEscaper 按照 Prometheus 文本格式转义标签值，仅转义反斜杠、双引号及换行符
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP 以 Prometheus 文本格式输出所有指标
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ListenAndServe 在指定地址及端口上启动指标 HTTP 监听器，直至 Shutdown 被调用
+func (m *Metrics) ListenAndServe(conf MetricsConfig) error {
+	if conf.Path == "" {
+		conf.Path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(conf.Path, m)
+	if conf.ListenIP == nil {
+		conf.ListenIP = net.IPv4(127, 0, 0, 1)
+	}
+	srv := &http.Server{Addr: listenAddr(conf.ListenIP, conf.Port), Handler: mux}
+
+	m.mu.Lock()
+	m.srv = srv
+	m.mu.Unlock()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown 关闭指标 HTTP 监听器
+func (m *Metrics) Shutdown() error {
+	m.mu.Lock()
+	srv := m.srv
+	m.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// MetricsMiddleware 返回一个记录查询指标的中间件
+// 其接受参数为：
+//   - m *Metrics，指标记录器
+//
+// 为了记录缓存命中情况，该中间件应位于缓存中间件的外层。
+func MetricsMiddleware(m *Metrics) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			if connInfo.Record == nil {
+				connInfo.Record = &QueryRecord{}
+			}
+			rec := connInfo.Record
+			protocol := string(connInfo.Protocol)
+
+			start := time.Now()
+			resp, err := next.ServeDNS(connInfo)
+			elapsed := time.Since(start)
+
+			rec.fillQuery(connInfo)
+			qtype := metricQType(rec.QType)
+			m.Inc(metricQueries, protocol, qtype)
+			if rec.CacheLookup {
+				if rec.CacheHit {
+					m.Inc(metricCacheHits)
+				} else {
+					m.Inc(metricCacheMisses)
+				}
+			}
+			if rec.CacheStale {
+				m.Inc(metricCacheStale)
+			}
+
+			rcode := "none"
+			switch {
+			case err != nil:
+				m.Inc(metricResponserErrors, protocol)
+			case len(resp) == 0:
+				m.Inc(metricDropped, protocol)
+			default:
+				rec.fillResponse(resp)
+				rcode = metricRCode(rec.RCode)
+				m.Inc(metricResponses, protocol, rcode)
+			}
+			m.Observe(connInfo.Protocol, qtype, rcode, elapsed)
+			return resp, err
+		})
+	}
+}
+
+// metricQType 返回查询类型的标签值，未知类型以 RFC 3597 的 TYPEnnn 形式表示
+func metricQType(t dns.DNSType) string {
+	s := t.String()
+	if strings.HasPrefix(s, "Unknown") {
+		return fmt.Sprintf("TYPE%d", uint16(t))
+	}
+	return s
+}
+
+// metricRCodeNames 为回复码的助记符
+var metricRCodeNames = map[dns.DNSResponseCode]string{
+	dns.DNSResponseCodeNoErr:    "NOERROR",
+	dns.DNSResponseCodeFormErr:  "FORMERR",
+	dns.DNSResponseCodeServFail: "SERVFAIL",
+	dns.DNSResponseCodeNXDomain: "NXDOMAIN",
+	dns.DNSResponseCodeNotImp:   "NOTIMP",
+	dns.DNSResponseCodeRefused:  "REFUSED",
+	dns.DNSResponseCodeYXDomain: "YXDOMAIN",
+	dns.DNSResponseCodeYXRRSet:  "YXRRSET",
+	dns.DNSResponseCodeNXRRSet:  "NXRRSET",
+	dns.DNSResponseCodeNotAuth:  "NOTAUTH",
+	dns.DNSResponseCodeNotZone:  "NOTZONE",
+}
+
+// metricRCode 返回回复码的标签值
+func metricRCode(rcode dns.DNSResponseCode) string {
+	if name, ok := metricRCodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
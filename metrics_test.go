@@ -0,0 +1,119 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// metrics_test.go 文件定义了对 metrics.go 的单元测试
+
+package godns
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/tochusc/godns/dns"
+)
+
+// TestMetricsMiddleware 测试查询、回复码、丢弃、错误及缓存命中的计数
+func TestMetricsMiddleware(t *testing.T) {
+	cacher := NewCacher(CacherConfig{
+		CacheLocation: t.TempDir(),
+		LogWriter:     io.Discard,
+	}, nil)
+	mode := "answer"
+	responser := HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+		switch mode {
+		case "drop":
+			return nil, nil
+		case "error":
+			return nil, errors.New("responser failed")
+		}
+		qry, err := ParseQuery(connInfo)
+		if err != nil {
+			return nil, err
+		}
+		resp := testNXDOMAIN(qry)
+		return resp.Encode(), nil
+	})
+	m := NewMetrics(nil)
+	h := Chain(responser, MetricsMiddleware(m), CacheMiddleware(cacher))
+
+	serve := func(protocol Protocol) {
+		h.ServeDNS(ConnectionInfo{Protocol: protocol, Packet: testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false), Record: &QueryRecord{}})
+	}
+	// 第一次查询未命中缓存，第二次命中缓存
+	serve(ProtocolUDP)
+	serve(ProtocolUDP)
+	// 不经过缓存的丢弃及错误
+	h = Chain(responser, MetricsMiddleware(m))
+	mode = "drop"
+	serve(ProtocolTCP)
+	mode = "error"
+	serve(ProtocolTCP)
+
+	counters := []struct {
+		name     string
+		labels   []string
+		expected uint64
+	}{
+		{metricQueries, []string{"udp", "A"}, 2},
+		{metricQueries, []string{"tcp", "A"}, 2},
+		{metricResponses, []string{"udp", "NXDOMAIN"}, 2},
+		{metricDropped, []string{"tcp"}, 1},
+		{metricResponserErrors, []string{"tcp"}, 1},
+		{metricCacheHits, nil, 1},
+		{metricCacheMisses, nil, 1},
+	}
+	for _, c := range counters {
+		if got := m.Counter(c.name, c.labels...); got != c.expected {
+			t.Errorf("%s%v got: %d, expected: %d", c.name, c.labels, got, c.expected)
+		}
+	}
+
+	sb := strings.Builder{}
+	m.WriteTo(&sb)
+	for _, line := range []string{
+		`godns_queries_total{protocol="udp",qtype="A"} 2`,
+		`godns_responses_total{protocol="udp",rcode="NXDOMAIN"} 2`,
+		`godns_cache_hits_total 1`,
+		`godns_query_duration_seconds_count{protocol="tcp",qtype="A",rcode="none"} 2`,
+		`godns_query_duration_seconds_bucket{protocol="udp",qtype="A",rcode="NXDOMAIN",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("metrics output missing line: %s", line)
+		}
+	}
+}
+
+// TestMetricsHTTP 测试通过 HTTP 输出 Prometheus 文本格式的指标，及线程池指标
+func TestMetricsHTTP(t *testing.T) {
+	pool, err := ants.NewPool(8)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.Release()
+	m := NewMetrics(pool)
+	m.RegisterCounter("godns_custom_total", "Custom counter.", "action")
+	m.Inc("godns_custom_total", "drop")
+	m.Inc("godns_custom_total", "域名\\\"\n")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type got: %s, expected: text/plain; version=0.0.4", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE godns_custom_total counter",
+		`godns_custom_total{action="drop"} 1`,
+		// 仅转义反斜杠、双引号及换行符，其余字符原样输出
+		`godns_custom_total{action="域名\\\"\n"} 1`,
+		"# TYPE godns_pool_running gauge",
+		"godns_pool_capacity 8",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics output missing line: %s", line)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// middleware.go 文件定义了 GoDNS 服务器的处理链。
+// 每个查询都会依次经过若干中间件（Middleware），最终交由 Responser 生成回复。
+// 日志、访问控制、限速、错误注入、缓存等功能均可以实现为中间件，
+// 并通过 GoDNSServer.Use 自由组合。
+
+package godns
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Handler 是一个 DNS 查询处理器接口。
+type Handler interface {
+	// ServeDNS 处理 DNS 查询，并返回需要发送的回复。
+	// 其参数为：
+	//   - connInfo ConnectionInfo，链接信息
+	// 返回值为：
+	//   - []byte，DNS 回复，为空时不发送任何回复（如丢弃查询）
+	//   - error，错误信息
+	ServeDNS(connInfo ConnectionInfo) ([]byte, error)
+}
+
+// HandlerFunc 将普通函数适配为 Handler
+type HandlerFunc func(connInfo ConnectionInfo) ([]byte, error)
+
+// ServeDNS 调用 f(connInfo)
+func (f HandlerFunc) ServeDNS(connInfo ConnectionInfo) ([]byte, error) {
+	return f(connInfo)
+}
+
+// Middleware 是一个中间件，其包装下一个处理器，返回新的处理器。
+// 中间件可以在调用 next 之前检查、修改或拦截查询，
+// 也可以在调用 next 之后检查、修改回复。
+type Middleware func(next Handler) Handler
+
+// ResponserHandler 将 Responser 适配为处理链的末端处理器
+func ResponserHandler(r Responser) Handler {
+	return HandlerFunc(r.Response)
+}
+
+// Chain 将中间件按顺序包装在处理器外层，并返回包装后的处理器。
+// 第一个中间件位于最外层，即 Chain(h, a, b) 等价于 a(b(h))，
+// 查询依次经过 a、b，最终到达 h。
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// LoggingMiddleware 返回一个为每个查询输出结构化记录的中间件
+// 其接受参数为：
+//   - logger *slog.Logger，日志
+//
+// 该中间件会在查询处理完毕后，以 Info 级别输出 ConnectionInfo.Record 中的
+// 客户端、协议、查询名称、类型、回复码、回复大小、耗时、缓存命中及 DNSSEC 标志；
+// 处理出错时以 Error 级别输出，并附带错误信息。
+// 为了使内层中间件填写的信息（如缓存命中）能被记录，该中间件应位于处理链的最外层。
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			ctx := context.Background()
+			if !logger.Enabled(ctx, slog.LevelError) {
+				return next.ServeDNS(connInfo)
+			}
+			if connInfo.Record == nil {
+				connInfo.Record = &QueryRecord{}
+			}
+			rec := connInfo.Record
+
+			start := time.Now()
+			resp, err := next.ServeDNS(connInfo)
+			rec.Latency = time.Since(start)
+
+			if err != nil {
+				rec.fillQuery(connInfo)
+				logger.LogAttrs(ctx, slog.LevelError, "Query failed", append(rec.Attrs(), slog.Any("err", err))...)
+				return resp, err
+			}
+			if logger.Enabled(ctx, slog.LevelInfo) {
+				rec.fillQuery(connInfo)
+				rec.fillResponse(resp)
+				logger.LogAttrs(ctx, slog.LevelInfo, "Query", rec.Attrs()...)
+			}
+			return resp, nil
+		})
+	}
+}
+
+// CacheMiddleware 返回一个基于 Cacher 的缓存中间件
+// 其接受参数为：
+//   - c *Cacher，缓存器
+//
+// 命中缓存时，该中间件直接返回缓存的回复；
+// 否则调用下一个处理器，并将其生成的回复写入缓存。
+func CacheMiddleware(c *Cacher) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			if connInfo.Record != nil {
+				connInfo.Record.CacheLookup = true
+			}
+			cache, err := c.FetchCache(connInfo)
+			if err == nil {
+				if connInfo.Record != nil {
+					connInfo.Record.CacheHit = true
+				}
+				return cache, nil
+			}
+
+			if c.Stale != nil {
+				resp, stale, err := c.resolveOrStale(next, connInfo)
+				if stale && connInfo.Record != nil {
+					connInfo.Record.CacheStale = true
+				}
+				return resp, err
+			}
+
+			resp, err := next.ServeDNS(connInfo)
+			if err == nil && len(resp) > 0 {
+				c.CacheResponse(connInfo, resp)
+			}
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// middleware_test.go 文件定义了对 middleware.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// TestChain 测试中间件的包装顺序
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+				order = append(order, name)
+				return next.ServeDNS(connInfo)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+		order = append(order, "responser")
+		return []byte{0x01}, nil
+	}), mark("a"), mark("b"))
+
+	resp, err := h.ServeDNS(ConnectionInfo{})
+	if err != nil || !bytes.Equal(resp, []byte{0x01}) {
+		t.Errorf("ServeDNS got: %v (%v), expected: [1]", resp, err)
+	}
+	expected := []string{"a", "b", "responser"}
+	if len(order) != len(expected) {
+		t.Fatalf("call order got: %v, expected: %v", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("call order got: %v, expected: %v", order, expected)
+			break
+		}
+	}
+}
+
+// TestCacheMiddleware 测试缓存中间件：首次查询写入缓存，再次查询命中缓存并修正 ID
+func TestCacheMiddleware(t *testing.T) {
+	cacher := NewCacher(CacherConfig{
+		CacheLocation: t.TempDir(),
+		LogWriter:     io.Discard,
+	}, nil)
+
+	calls := 0
+	responser := HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+		calls++
+		qry, err := ParseQuery(connInfo)
+		if err != nil {
+			return nil, err
+		}
+		resp := testNXDOMAIN(qry)
+		return resp.Encode(), nil
+	})
+	h := Chain(responser, CacheMiddleware(cacher))
+
+	qry := dns.DNSMessage{
+		Header: dns.DNSHeader{ID: 0x0001, QDCount: 1},
+		Question: []dns.DNSQuestion{
+			{Name: "www.example.com", Type: dns.DNSRRTypeA, Class: dns.DNSClassIN},
+		},
+	}
+	if _, err := h.ServeDNS(ConnectionInfo{Packet: qry.Encode()}); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	qry.Header.ID = 0x0002
+	resp, err := h.ServeDNS(ConnectionInfo{Packet: qry.Encode()})
+	if err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("responser calls got: %d, expected: 1", calls)
+	}
+	if resp[0] != 0x00 || resp[1] != 0x02 {
+		t.Errorf("cached response ID got: %v, expected: [0 2]", resp[:2])
+	}
+}
+
+// TestHandleConnectionDrop 测试处理链返回空回复时，服务器不发送任何数据
+func TestHandleConnectionDrop(t *testing.T) {
+	logger := discardLogger()
+	sent := 0
+	tp := &recordTransport{reply: func([]byte) { sent++ }}
+	server := &GoDNSServer{
+		GoDNSLogger: logger,
+		Netter:      Netter{NetterLogger: logger},
+		Responer:    &DullResponser{},
+	}
+	server.Use(func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			return nil, nil
+		})
+	})
+
+	server.HandleConnection(ConnectionInfo{Transport: tp})
+	if sent != 0 {
+		t.Errorf("sent packets got: %d, expected: 0", sent)
+	}
+
+	// 不回复时关闭 TCP 链接，并通知 DoH 处理器
+	client, conn := net.Pipe()
+	defer client.Close()
+	reply := make(chan []byte, 1)
+	server.HandleConnection(ConnectionInfo{Protocol: ProtocolTCP, Transport: tp, StreamConn: conn})
+	server.HandleConnection(ConnectionInfo{Protocol: ProtocolDoH, Transport: tp, HTTPReply: reply})
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from dropped tcp connection got: %v, expected: EOF", err)
+	}
+	select {
+	case data := <-reply:
+		if data != nil {
+			t.Errorf("DoH reply got: %v, expected: nil", data)
+		}
+	default:
+		t.Error("DoH handler was not notified of the drop")
+	}
+	if sent != 0 {
+		t.Errorf("sent packets got: %d, expected: 0", sent)
+	}
+}
+
+// testNXDOMAIN 返回一个附带 SOA 记录、可被缓存的 NXDOMAIN 回复
+func testNXDOMAIN(qry dns.DNSMessage) dns.DNSMessage {
+	resp := InitNXDOMAIN(qry)
+	resp.Authority = []dns.DNSResourceRecord{{
+		Name: "example.com", Type: dns.DNSRRTypeSOA, Class: dns.DNSClassIN, TTL: 3600,
+		RData: &dns.DNSRDATASOA{MName: "ns.example.com", RName: "admin.example.com", Minimum: 300},
+	}}
+	FixCount(&resp)
+	return resp
+}
+
+// recordTransport 是一个仅记录回复的传输层
+type recordTransport struct {
+	reply func([]byte)
+}
+
+func (t *recordTransport) Listen(connChan chan<- ConnectionInfo) error { return nil }
+
+func (t *recordTransport) Reply(connInfo ConnectionInfo, data []byte) error {
+	t.reply(data)
+	return nil
+}
+
+func (t *recordTransport) Close() error { return nil }
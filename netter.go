@@ -1,153 +1,189 @@
 package godns
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
 
 	"github.com/panjf2000/ants/v2"
 )
 
 // NetterConfig 结构体用于记录网络监听器的配置
 type NetterConfig struct {
-	Port      int
+	Port int
+	// 监听地址，为 nil 时监听所有地址
+	ListenIP  net.IP
 	LogWriter io.Writer
+	// 日志，为 nil 时向 LogWriter 输出文本日志
+	Logger *slog.Logger
+
+	// UDP 配置
+	UDP UDPConfig
+	// 链接信息通道的缓冲区大小，为 0 时不带缓冲
+	QueueSize int
+
+	// DoH 配置，为 nil 时不启用 DoH
+	DoH *DoHConfig
+
+	// 抓包配置，为 nil 时不抓包
+	Capture *PcapConfig
+	// 服务器地址，用于在抓包时合成 IP 头部
+	IP net.IP
 }
 
 // Netter 数据包监听器：接收、解析、发送数据包，并维护连接状态。
+// Netter 本身不关心具体的传输方式，其会遍历 Transports 中的所有传输层，
+// 汇总它们收到的查询，并将回复交由查询所属的传输层发送。
 type Netter struct {
 	NetterPort   int
+	NetterQueue  int
 	NetterPool   *ants.Pool
-	NetterLogger *log.Logger
+	NetterLogger *slog.Logger
+
+	// 传输层列表，默认包含 UDP、TCP 及（配置时的）DoH 传输层
+	Transports []Transport
+
+	// 抓包写入器，为 nil 时不抓包
+	Capture *PcapWriter
 }
 
 func NewNetter(nConf NetterConfig, pool *ants.Pool) *Netter {
-	netterLogger := log.New(nConf.LogWriter, "Netter: ", log.LstdFlags)
+	netterLogger := nConf.Logger
+	if netterLogger == nil {
+		netterLogger = newWriterLogger(nConf.LogWriter, LogComponentNetter)
+	}
+
+	udp := NewUDPTransport(nConf.Port, nConf.UDP, netterLogger)
+	udp.IP = nConf.ListenIP
+	tcp := NewTCPTransport(nConf.Port, netterLogger)
+	tcp.IP = nConf.ListenIP
+	transports := []Transport{udp, tcp}
+	if nConf.DoH != nil {
+		transports = append(transports, NewDoHTransport(*nConf.DoH, netterLogger))
+	}
+
+	var capture *PcapWriter
+	if nConf.Capture != nil {
+		var err error
+		capture, err = NewPcapWriter(*nConf.Capture, nConf.IP)
+		if err != nil {
+			netterLogger.Error("Error creating capture file", "err", err)
+		}
+	}
 
 	return &Netter{
 		NetterPort:   nConf.Port,
+		NetterQueue:  nConf.QueueSize,
+		NetterPool:   pool,
 		NetterLogger: netterLogger,
+		Transports:   transports,
+		Capture:      capture,
 	}
 }
 
-// Sniff 函数用于监听指定端口，并返回链接信息通道
+// Sniff 函数用于启动所有传输层的监听，并返回链接信息通道
 // 其返回值为：chan ConnectionInfo，链接信息通道
+//
+// 当所有传输层均停止监听后，链接信息通道将被关闭。
+// 启用抓包时，收到的查询会在投递前写入抓包文件。
 func (n *Netter) Sniff() chan ConnectionInfo {
-	connChan := make(chan ConnectionInfo)
+	connChan := make(chan ConnectionInfo, n.NetterQueue)
 
-	// udp
-	pktConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", n.NetterPort))
-	if err != nil {
-		n.NetterLogger.Panicf("Error listening on udp port: %v", err)
-	}
-	ants.Submit(func() { n.handlePktConn(pktConn, connChan) })
-
-	// tcp
-	lstr, err := net.Listen("tcp", fmt.Sprintf(":%d", n.NetterPort))
-	if err != nil {
-		n.NetterLogger.Panicf("Error listening on tcp port: %v", err)
+	var wg sync.WaitGroup
+	for _, t := range n.Transports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := t.Listen(connChan); err != nil {
+				n.NetterLogger.Error("Error listening on transport", "transport", fmt.Sprintf("%T", t), "err", err)
+			}
+		}()
 	}
-	ants.Submit(func() { n.handleListener(lstr, connChan) })
-
-	return connChan
-}
+	go func() {
+		wg.Wait()
+		close(connChan)
+	}()
 
-// handleListener 函数用于处理 TCP 链接
-// 其接收参数为：
-//   - lstr: net.Listener，TCP 监听器
-//   - connChan: chan ConnectionInfo，链接信息通道
-//
-// 该函数将会接受 TCP 链接，并将其发送到链接信息通道中
-func (n *Netter) handleListener(lstr net.Listener, connChan chan ConnectionInfo) {
-	for {
-		conn, err := lstr.Accept()
-		if err != nil {
-			n.NetterLogger.Printf("Error accepting tcp connection: %v", err)
-		} else {
-			ants.Submit(func() { n.handleStreamConn(conn, connChan) })
-		}
+	if n.Capture == nil {
+		return connChan
 	}
-}
-
-// handlePktConn 函数用于处理 数据包 链接
-// 其接收参数为：
-//   - pktConn: net.PacketConn，数据包链接
-//   - connChan: chan ConnectionInfo，链接信息通道
-//
-// 该函数将会读取 数据包链接 中的数据，并将其发送到链接信息通道中
-func (n *Netter) handlePktConn(pktConn net.PacketConn, connChan chan ConnectionInfo) {
-	buf := make([]byte, 65535)
-	for {
-		sz, addr, err := pktConn.ReadFrom(buf)
-		if err != nil {
-			n.NetterLogger.Printf("Error reading udp packet: %v", err)
-			return
-		} else {
-			pkt := make([]byte, sz)
-			copy(pkt, buf[:sz])
-
-			connChan <- ConnectionInfo{
-				Protocol:   ProtocolUDP,
-				Address:    addr,
-				PacketConn: pktConn,
-				Packet:     pkt,
+	captured := make(chan ConnectionInfo, n.NetterQueue)
+	go func() {
+		for connInfo := range connChan {
+			if err := n.Capture.WriteQuery(connInfo); err != nil {
+				n.NetterLogger.Error("Error writing capture", "err", err)
 			}
+			captured <- connInfo
 		}
-	}
+		close(captured)
+	}()
+	return captured
 }
 
-// handleStreamConn 函数用于处理 流式链接
-// 其接收参数为：
-//   - conn: net.Conn，流式链接
-//   - connChan: chan ConnectionInfo，链接信息通道
-//
-// 该函数将会读取 流式链接 中的数据，并将其发送到链接信息通道中
-func (n *Netter) handleStreamConn(conn net.Conn, connChan chan ConnectionInfo) {
-	buf := make([]byte, 65535)
+// AddTransport 向 Netter 中添加一个传输层，需在 Sniff 之前调用
+func (n *Netter) AddTransport(t Transport) {
+	n.Transports = append(n.Transports, t)
+}
 
-	sz, err := conn.Read(buf)
-	if err != nil {
-		n.NetterLogger.Printf("Error reading tcp packet: %v", err)
-		return
+// Close 关闭所有传输层
+func (n *Netter) Close() error {
+	var errs []error
+	for _, t := range n.Transports {
+		if err := t.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-
-	msgSz := int(buf[0])<<8 + int(buf[1])
-	for sz < msgSz {
-		inc, err := conn.Read(buf[sz:])
-		if err != nil {
-			n.NetterLogger.Printf("Error reading tcp packet: %v", err)
-			break
+	if n.Capture != nil {
+		if err := n.Capture.Close(); err != nil {
+			errs = append(errs, err)
 		}
-		sz += inc
 	}
-
-	pkt := make([]byte, msgSz)
-	copy(pkt, buf[2:2+msgSz])
-	connChan <- ConnectionInfo{
-		Protocol:   ProtocolTCP,
-		Address:    conn.RemoteAddr(),
-		StreamConn: conn,
-		Packet:     pkt,
+	if len(errs) > 0 {
+		return fmt.Errorf("error closing netter: %v", errs)
 	}
+	return nil
 }
 
 // ConnectionInfo 结构体用于记录链接信息
 // 其包含以下字段：
 //   - Protocol: Protocol，网络协议
 //   - Address: net.Addr，地址
+//   - LocalAddress: net.Addr，接收该查询的本地地址
 //   - StreamConn: net.Conn，TCP 链接
 //   - PacketConn: net.PacketConn，UDP 链接
+//   - HTTPReply: chan []byte，DoH 回复通道
+//   - Transport: Transport，接收该查询的传输层
 //   - Packet: []byte，数据包
+//   - Record: *QueryRecord，查询的处理记录
 type ConnectionInfo struct {
 	Protocol Protocol // 网络协议
 	Address  net.Addr //	地址
+	// 接收该查询的本地地址，为 nil 时从 StreamConn 或 PacketConn 获取
+	LocalAddress net.Addr
 
 	StreamConn net.Conn       // TCP 链接
 	PacketConn net.PacketConn // UDP 链接
+	HTTPReply  chan []byte    // DoH 回复通道
+
+	Transport Transport // 接收该查询的传输层
 
 	Packet []byte //	数据包
+
+	// 查询的处理记录，由 GoDNSServer 创建，供处理链中的中间件填写
+	Record *QueryRecord
+
+	// pooled 指向 Packet 所在的池化缓冲区，为 nil 时表示 Packet 未被池化
+	pooled *[]byte
+}
+
+// Release 将池化的数据包缓冲区归还缓冲池，由 GoDNSServer 在查询处理完毕后调用。
+// 调用后 Packet 将不再有效；未启用缓冲池时，该方法不做任何处理。
+func (connInfo ConnectionInfo) Release() {
+	if connInfo.pooled != nil {
+		packetPool.Put(connInfo.pooled)
+	}
 }
 
 // Protocol 用于表示网络协议
@@ -156,6 +192,7 @@ type Protocol string
 const (
 	ProtocolUDP Protocol = "udp"
 	ProtocolTCP Protocol = "tcp"
+	ProtocolDoH Protocol = "doh"
 )
 
 func (p *Protocol) String() string {
@@ -165,6 +202,9 @@ func (p *Protocol) String() string {
 	if *p == ProtocolTCP {
 		return "TCP"
 	}
+	if *p == ProtocolDoH {
+		return "DoH"
+	}
 	return "Unknown"
 }
 
@@ -172,25 +212,45 @@ func (p *Protocol) String() string {
 // 其接收参数为：
 //   - connInfo: ConnectionInfo，链接信息
 //   - data: []byte，数据包
+//
+// 数据包将由接收该查询的传输层发送。
+// UDP 回复超出查询通告的负载大小时将被截断并设置 TC 位，客户端将通过 TCP 重试，
+// 因此 Responser 无需关心传输方式的大小限制。
 func (n *Netter) Send(connInfo ConnectionInfo, data []byte) {
+	if connInfo.Transport == nil {
+		n.NetterLogger.Error("Error sending packet: no transport", "client", connInfo.Address)
+		return
+	}
 	if connInfo.Protocol == ProtocolUDP {
-		_, err := connInfo.PacketConn.WriteTo(data, connInfo.Address)
-		if err != nil {
-			n.NetterLogger.Printf("Error writing udp packet: %v", err)
-		}
-	} else if connInfo.Protocol == ProtocolTCP {
-		pktSize := len(data)
-		if pktSize > 0xffff {
-			pktSize = 0xffff
-			n.NetterLogger.Printf("Warning: TCP packet size exceeds 0xffff, truncating to 0xffff")
-		}
+		data = truncateUDP(connInfo.Packet, data)
+	}
+	err := connInfo.Transport.Reply(connInfo, data)
+	if err != nil {
+		n.NetterLogger.Error("Error sending packet", "client", connInfo.Address, "protocol", connInfo.Protocol, "err", err)
+		return
+	}
 
-		lenByte := make([]byte, 2)
-		binary.BigEndian.PutUint16(lenByte, uint16(pktSize))
+	if n.Capture != nil {
+		if err := n.Capture.WriteResponse(connInfo, data); err != nil {
+			n.NetterLogger.Error("Error writing capture", "err", err)
+		}
+	}
+	n.NetterLogger.Debug("Packet sent", "client", connInfo.Address, "protocol", connInfo.Protocol, "size", len(data))
+}
 
-		connInfo.StreamConn.Write(append(lenByte, data...))
+// Drop 函数用于放弃回复查询
+// 其接收参数为：
+//   - connInfo: ConnectionInfo，链接信息
+//
+// UDP 查询无需处理；TCP 链接将被关闭，DoH 处理器将收到空回复并立即返回错误，而不是等待超时。
+func (n *Netter) Drop(connInfo ConnectionInfo) {
+	if connInfo.StreamConn != nil {
 		connInfo.StreamConn.Close()
 	}
-
-	n.NetterLogger.Printf("Packet sent to %s, size: %d", connInfo.Address, len(data))
+	if connInfo.HTTPReply != nil {
+		select {
+		case connInfo.HTTPReply <- nil:
+		default:
+		}
+	}
 }
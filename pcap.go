@@ -0,0 +1,394 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// pcap.go 文件实现了 Netter 的抓包功能。
+// PcapWriter 将 Netter 收到的查询及发出的回复写入 pcap 或 pcapng 文件，
+// 并根据 ConnectionInfo 中的地址合成 IP/UDP/TCP 头部，使 Wireshark 等工具可以直接打开。
+// 文件使用 LINKTYPE_RAW 链路类型，即每个数据包均以 IP 头部开始。
+
+package godns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 抓包文件格式
+const (
+	PcapFormatPcap   = "pcap"
+	PcapFormatPcapng = "pcapng"
+)
+
+// PcapConfig 记录抓包的配置
+type PcapConfig struct {
+	// 抓包文件路径
+	Path string
+	// 文件格式，PcapFormatPcap（默认）或 PcapFormatPcapng
+	Format string
+}
+
+const (
+	// pcapLinkTypeRaw 表示数据包以 IPv4 或 IPv6 头部开始
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 262144
+
+	// 合成头部中使用的 TTL 及 TCP 初始序列号
+	pcapHopLimit = 64
+	pcapTCPISN   = 1
+)
+
+// PcapWriter 将查询及回复以合成的 IP 数据包形式写入抓包文件，可被并发调用。
+// DoH 查询不属于 DNS over UDP/TCP，不会被写入。
+type PcapWriter struct {
+	Config PcapConfig
+
+	// ServerIP 在无法从链接中获知本地地址（如监听 0.0.0.0）时作为服务器地址
+	ServerIP net.IP
+
+	mu      sync.Mutex
+	file    io.WriteCloser
+	bw      *bufio.Writer
+	ng      bool
+	ipID    uint16
+	flushed time.Time
+	closed  bool
+}
+
+// NewPcapWriter 创建抓包文件并写入文件头
+// 其接受参数为：
+//   - conf PcapConfig，抓包配置
+//   - serverIP net.IP，服务器地址
+//
+// 返回值为：
+//   - *PcapWriter，抓包写入器
+//   - error，错误信息
+func NewPcapWriter(conf PcapConfig, serverIP net.IP) (*PcapWriter, error) {
+	format := strings.ToLower(conf.Format)
+	if format != "" && format != PcapFormatPcap && format != PcapFormatPcapng {
+		return nil, fmt.Errorf("unknown capture format %q", conf.Format)
+	}
+
+	file, err := os.Create(conf.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating capture file %s: %v", conf.Path, err)
+	}
+
+	w := &PcapWriter{
+		Config:   conf,
+		ServerIP: serverIP,
+		file:     file,
+		bw:       bufio.NewWriter(file),
+		ng:       format == PcapFormatPcapng,
+		flushed:  time.Now(),
+	}
+	if w.ng {
+		w.writePcapngHeader()
+	} else {
+		w.writePcapHeader()
+	}
+	if err := w.bw.Flush(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error writing capture header: %v", err)
+	}
+	return w, nil
+}
+
+// WriteQuery 写入一个收到的查询
+func (w *PcapWriter) WriteQuery(connInfo ConnectionInfo) error {
+	return w.write(connInfo, connInfo.Packet, true, time.Now())
+}
+
+// WriteResponse 写入一个发出的回复
+func (w *PcapWriter) WriteResponse(connInfo ConnectionInfo, data []byte) error {
+	return w.write(connInfo, data, false, time.Now())
+}
+
+// Close 刷新缓冲区并关闭抓包文件，此后写入的数据包将被忽略
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.bw.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write 合成数据包并写入抓包文件
+func (w *PcapWriter) write(connInfo ConnectionInfo, data []byte, inbound bool, ts time.Time) error {
+	if connInfo.Protocol != ProtocolUDP && connInfo.Protocol != ProtocolTCP {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		// 服务器关闭时仍在处理的查询将不会被写入
+		return nil
+	}
+
+	w.ipID++
+	pkt := w.synthesize(connInfo, data, inbound)
+	if w.ng {
+		w.writePcapngPacket(pkt, inbound, ts)
+	} else {
+		w.writePcapPacket(pkt, ts)
+	}
+
+	// 定期刷新缓冲区，使运行中的抓包文件也可以被读取
+	if ts.Sub(w.flushed) >= time.Second {
+		w.flushed = ts
+		return w.bw.Flush()
+	}
+	return nil
+}
+
+// synthesize 根据链接信息合成包含 IP 及 UDP/TCP 头部的数据包
+func (w *PcapWriter) synthesize(connInfo ConnectionInfo, data []byte, inbound bool) []byte {
+	cIP, cPort := addrIPPort(connInfo.Address)
+	sIP, sPort := connInfo.localAddr()
+	v4 := cIP == nil || cIP.To4() != nil
+	cIP = pcapIP(cIP, v4)
+	if sIP == nil || sIP.IsUnspecified() {
+		sIP = w.ServerIP
+	}
+	sIP = pcapIP(sIP, v4)
+	if sPort == 0 {
+		sPort = 53
+	}
+
+	src, dst, srcPort, dstPort := cIP, sIP, cPort, sPort
+	if !inbound {
+		src, dst, srcPort, dstPort = sIP, cIP, sPort, cPort
+	}
+
+	var l4 []byte
+	var proto byte
+	if connInfo.Protocol == ProtocolTCP {
+		proto = 6
+		l4 = tcpSegment(srcPort, dstPort, inbound, len(connInfo.Packet), data)
+	} else {
+		proto = 17
+		l4 = udpDatagram(srcPort, dstPort, data)
+	}
+	// 计算包含伪头部的校验和
+	csum := checksum(pseudoHeader(src, dst, proto, len(l4)), l4)
+	if proto == 6 {
+		binary.BigEndian.PutUint16(l4[16:], csum)
+	} else {
+		if csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[6:], csum)
+	}
+
+	if v4 {
+		return append(ipv4Header(src, dst, proto, len(l4), w.ipID), l4...)
+	}
+	return append(ipv6Header(src, dst, proto, len(l4)), l4...)
+}
+
+// addrIPPort 返回 UDP 或 TCP 地址中的 IP 及端口
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// pcapIP 返回指定地址族的 IP 地址，地址为空或地址族不符时使用该地址族的回环地址
+func pcapIP(ip net.IP, v4 bool) net.IP {
+	if ip != nil && v4 && ip.To4() != nil {
+		return ip.To4()
+	}
+	if ip != nil && !v4 && ip.To4() == nil {
+		return ip.To16()
+	}
+	if v4 {
+		return net.IPv4(127, 0, 0, 1).To4()
+	}
+	return net.IPv6loopback
+}
+
+// ipv4Header 合成 IPv4 头部
+func ipv4Header(src, dst net.IP, proto byte, payloadLen int, id uint16) []byte {
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45
+	binary.BigEndian.PutUint16(hdr[2:], uint16(20+payloadLen))
+	binary.BigEndian.PutUint16(hdr[4:], id)
+	binary.BigEndian.PutUint16(hdr[6:], 0x4000) // DF
+	hdr[8] = pcapHopLimit
+	hdr[9] = proto
+	copy(hdr[12:], src.To4())
+	copy(hdr[16:], dst.To4())
+	binary.BigEndian.PutUint16(hdr[10:], checksum(nil, hdr))
+	return hdr
+}
+
+// ipv6Header 合成 IPv6 头部
+func ipv6Header(src, dst net.IP, proto byte, payloadLen int) []byte {
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:], uint16(payloadLen))
+	hdr[6] = proto
+	hdr[7] = pcapHopLimit
+	copy(hdr[8:], src.To16())
+	copy(hdr[24:], dst.To16())
+	return hdr
+}
+
+// udpDatagram 合成 UDP 数据报，校验和由调用者填写
+func udpDatagram(srcPort, dstPort int, data []byte) []byte {
+	seg := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(seg[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(seg[4:], uint16(8+len(data)))
+	return append(seg, data...)
+}
+
+// tcpSegment 合成携带 DNS 消息（含两字节长度前缀）的 TCP 报文段，校验和由调用者填写。
+// 每个 TCP 链接仅承载一次查询，因此查询的序列号固定为初始序列号，
+// 回复的确认号则根据查询的长度计算。
+func tcpSegment(srcPort, dstPort int, inbound bool, queryLen int, data []byte) []byte {
+	seg := make([]byte, 20, 22+len(data))
+	binary.BigEndian.PutUint16(seg[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dstPort))
+	seq, ack := uint32(pcapTCPISN), uint32(pcapTCPISN)
+	if !inbound {
+		ack += uint32(2 + queryLen)
+	}
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4
+	seg[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(seg[14:], 0xffff)
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(data)))
+	return append(seg, data...)
+}
+
+// pseudoHeader 返回计算 UDP/TCP 校验和所需的伪头部
+func pseudoHeader(src, dst net.IP, proto byte, l4Len int) []byte {
+	if ip4 := src.To4(); ip4 != nil {
+		ph := append(append([]byte{}, ip4...), dst.To4()...)
+		ph = append(ph, 0, proto)
+		return binary.BigEndian.AppendUint16(ph, uint16(l4Len))
+	}
+	ph := append(append([]byte{}, src.To16()...), dst.To16()...)
+	ph = binary.BigEndian.AppendUint32(ph, uint32(l4Len))
+	return append(ph, 0, 0, 0, proto)
+}
+
+// checksum 计算互联网校验和（RFC 1071）
+func checksum(pseudo, data []byte) uint16 {
+	var sum uint32
+	for _, b := range [][]byte{pseudo, data} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			// 伪头部长度总为偶数，因此仅数据部分可能需要补零
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// writePcapHeader 写入纳秒精度的 pcap 文件头
+func (w *PcapWriter) writePcapHeader() {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b23c4d)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	w.bw.Write(hdr)
+}
+
+// writePcapPacket 写入一个 pcap 数据包记录
+func (w *PcapWriter) writePcapPacket(pkt []byte, ts time.Time) {
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	w.bw.Write(hdr)
+	w.bw.Write(pkt)
+}
+
+// writePcapngHeader 写入 pcapng 的 Section Header Block 及 Interface Description Block
+func (w *PcapWriter) writePcapngHeader() {
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	w.writePcapngBlock(0x0a0d0d0a, shb)
+
+	idb := binary.LittleEndian.AppendUint16(nil, pcapLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, pcapSnapLen)
+	// if_tsresol：纳秒精度
+	idb = appendPcapngOption(idb, 9, []byte{9})
+	idb = appendPcapngOption(idb, 0, nil)
+	w.writePcapngBlock(1, idb)
+}
+
+// writePcapngPacket 写入一个 Enhanced Packet Block，并以 epb_flags 标明方向
+func (w *PcapWriter) writePcapngPacket(pkt []byte, inbound bool, ts time.Time) {
+	nsec := uint64(ts.UnixNano())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nsec>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nsec))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	epb = pcapngPad(epb)
+
+	direction := uint32(2)
+	if inbound {
+		direction = 1
+	}
+	epb = appendPcapngOption(epb, 2, binary.LittleEndian.AppendUint32(nil, direction))
+	epb = appendPcapngOption(epb, 0, nil)
+	w.writePcapngBlock(6, epb)
+}
+
+// writePcapngBlock 写入一个 pcapng 块，body 的长度须为 4 的倍数
+func (w *PcapWriter) writePcapngBlock(blockType uint32, body []byte) {
+	total := uint32(12 + len(body))
+	blk := binary.LittleEndian.AppendUint32(nil, blockType)
+	blk = binary.LittleEndian.AppendUint32(blk, total)
+	blk = append(blk, body...)
+	blk = binary.LittleEndian.AppendUint32(blk, total)
+	w.bw.Write(blk)
+}
+
+// appendPcapngOption 追加一个按 4 字节对齐的 pcapng 选项
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pcapngPad(append(b, value...))
+}
+
+// pcapngPad 将数据补零至 4 字节对齐
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// pcap_test.go 文件定义了对 pcap.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// TestPcapWriter 测试 pcap 格式的抓包文件，及合成的 IPv4/UDP 头部
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godns.pcap")
+	w, err := NewPcapWriter(PcapConfig{Path: path}, net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	connInfo := ConnectionInfo{
+		Protocol: ProtocolUDP,
+		Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+		Packet:   testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false),
+	}
+	resp := []byte{0x12, 0x34, 0x81, 0x80, 0x00}
+	w.WriteQuery(connInfo)
+	w.WriteResponse(connInfo, resp)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading capture: %v", err)
+	}
+	if binary.LittleEndian.Uint32(data) != 0xa1b23c4d || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+		t.Fatalf("invalid pcap header: %v", data[:24])
+	}
+	data = data[24:]
+
+	expected := []struct {
+		src, dst net.IP
+		srcPort  uint16
+		payload  []byte
+	}{
+		{net.IPv4(192, 0, 2, 1), net.IPv4(10, 0, 0, 1), 5353, connInfo.Packet},
+		{net.IPv4(10, 0, 0, 1), net.IPv4(192, 0, 2, 1), 53, resp},
+	}
+	for _, e := range expected {
+		size := binary.LittleEndian.Uint32(data[8:])
+		pkt := data[16 : 16+size]
+		data = data[16+size:]
+
+		if checksum(nil, pkt[:20]) != 0 {
+			t.Errorf("invalid IPv4 header checksum")
+		}
+		if !net.IP(pkt[12:16]).Equal(e.src) || !net.IP(pkt[16:20]).Equal(e.dst) {
+			t.Errorf("addresses got: %v -> %v, expected: %v -> %v", net.IP(pkt[12:16]), net.IP(pkt[16:20]), e.src, e.dst)
+		}
+		udp := pkt[20:]
+		if checksum(pseudoHeader(pkt[12:16], pkt[16:20], 17, len(udp)), udp) != 0 {
+			t.Errorf("invalid UDP checksum")
+		}
+		if binary.BigEndian.Uint16(udp) != e.srcPort {
+			t.Errorf("source port got: %d, expected: %d", binary.BigEndian.Uint16(udp), e.srcPort)
+		}
+		if !bytes.Equal(udp[8:], e.payload) {
+			t.Errorf("payload got: %v, expected: %v", udp[8:], e.payload)
+		}
+	}
+	if len(data) != 0 {
+		t.Errorf("trailing data in capture: %d bytes", len(data))
+	}
+}
+
+// TestPcapngWriter 测试 pcapng 格式的抓包文件，及合成的 IPv6/TCP 头部
+func TestPcapngWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godns.pcapng")
+	w, err := NewPcapWriter(PcapConfig{Path: path, Format: PcapFormatPcapng}, nil)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	connInfo := ConnectionInfo{
+		Protocol: ProtocolTCP,
+		Address:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+		Packet:   testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false),
+	}
+	w.WriteQuery(connInfo)
+	w.WriteResponse(connInfo, []byte{0x12, 0x34, 0x81, 0x80})
+	// DoH 查询不会被写入
+	w.WriteQuery(ConnectionInfo{Protocol: ProtocolDoH, Packet: testQuery(0, "www.example.com", dns.DNSRRTypeA, 0, false)})
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading capture: %v", err)
+	}
+
+	var types []uint32
+	var packets [][]byte
+	for len(data) > 0 {
+		bType := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || binary.LittleEndian.Uint32(data[total-4:]) != total {
+			t.Fatalf("invalid block length %d", total)
+		}
+		if bType == 6 {
+			capLen := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+capLen])
+		}
+		types = append(types, bType)
+		data = data[total:]
+	}
+	expectedTypes := []uint32{0x0a0d0d0a, 1, 6, 6}
+	if len(types) != len(expectedTypes) {
+		t.Fatalf("block types got: %v, expected: %v", types, expectedTypes)
+	}
+
+	query := packets[0]
+	if query[0]>>4 != 6 || query[6] != 6 {
+		t.Fatalf("expected IPv6/TCP packet, got version %d next header %d", query[0]>>4, query[6])
+	}
+	if !net.IP(query[24:40]).Equal(net.IPv6loopback) {
+		t.Errorf("server address got: %v, expected: ::1", net.IP(query[24:40]))
+	}
+	tcp := query[40:]
+	if checksum(pseudoHeader(query[8:24], query[24:40], 6, len(tcp)), tcp) != 0 {
+		t.Errorf("invalid TCP checksum")
+	}
+	if int(binary.BigEndian.Uint16(tcp[20:])) != len(connInfo.Packet) || !bytes.Equal(tcp[22:], connInfo.Packet) {
+		t.Errorf("TCP payload got: %v, expected length-prefixed query", tcp[20:])
+	}
+
+	respTCP := packets[1][40:]
+	if ack := binary.BigEndian.Uint32(respTCP[8:]); ack != uint32(pcapTCPISN+2+len(connInfo.Packet)) {
+		t.Errorf("response ack got: %d, expected: %d", ack, pcapTCPISN+2+len(connInfo.Packet))
+	}
+}
+
+// TestNetterCapture 测试 Netter 发送回复时写入抓包文件
+func TestNetterCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netter.pcap")
+	w, err := NewPcapWriter(PcapConfig{Path: path}, nil)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	netter := &Netter{NetterLogger: discardLogger(), Capture: w}
+	netter.Send(ConnectionInfo{
+		Protocol:  ProtocolUDP,
+		Address:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+		Transport: &recordTransport{reply: func([]byte) {}},
+	}, []byte{0x12, 0x34})
+	netter.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error reading capture: %v", err)
+	}
+	// 文件头 24 字节，记录头 16 字节，IPv4 头 20 字节，UDP 头 8 字节，数据 2 字节
+	if info.Size() != 24+16+20+8+2 {
+		t.Errorf("capture size got: %d, expected: %d", info.Size(), 24+16+20+8+2)
+	}
+}
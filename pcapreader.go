@@ -0,0 +1,348 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// pcapreader.go 文件实现了 pcap/pcapng 抓包文件的读取，
+// 以及从数据包中解析 IPv4/IPv6 与 UDP/TCP 头部的工具函数，供流量回放使用。
+
+package godns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// maxCaptureRecordLen 是读取抓包文件时单个 pcap 记录或 pcapng 块的最大长度，
+// 用于避免被篡改的长度字段导致过量的内存分配
+const maxCaptureRecordLen = 1 << 20
+
+// 支持的链路类型
+const (
+	pcapLinkTypeNull     = 0
+	pcapLinkTypeEthernet = 1
+	pcapLinkTypeRawBSD   = 12
+	pcapLinkTypeRawOpen  = 14
+	pcapLinkTypeSLL      = 113
+	pcapLinkTypeIPv4     = 228
+	pcapLinkTypeIPv6     = 229
+	pcapLinkTypeSLL2     = 276
+)
+
+// PcapPacket 表示抓包文件中的一个数据包
+type PcapPacket struct {
+	// 抓包时间
+	Time time.Time
+	// 链路类型
+	LinkType uint32
+	// 数据包内容（自链路层头部开始）
+	Data []byte
+}
+
+// pcapngInterface 记录 pcapng 文件中接口的链路类型及时间戳精度
+type pcapngInterface struct {
+	linkType uint32
+	// 每秒的时间戳单位数
+	tsUnits uint64
+}
+
+// PcapReader 读取 pcap 或 pcapng 格式的抓包文件，格式由文件头自动识别
+type PcapReader struct {
+	rd    *bufio.Reader
+	order binary.ByteOrder
+
+	// pcap 格式
+	ng       bool
+	linkType uint32
+	nano     bool
+
+	// pcapng 格式
+	ifaces []pcapngInterface
+}
+
+// NewPcapReader 读取抓包文件头，并返回抓包文件读取器
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{rd: bufio.NewReader(r)}
+	magic, err := pr.rd.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("error reading capture header: %v", err)
+	}
+
+	if binary.LittleEndian.Uint32(magic) == 0x0a0d0d0a {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(pr.rd, hdr); err != nil {
+		return nil, fmt.Errorf("error reading pcap header: %v", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr) {
+		case 0xa1b2c3d4:
+			pr.order = order
+		case 0xa1b23c4d:
+			pr.order, pr.nano = order, true
+		}
+		if pr.order != nil {
+			pr.linkType = pr.order.Uint32(hdr[20:]) & 0x0fffffff
+			return pr, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown capture file magic %x", hdr[:4])
+}
+
+// Next 返回下一个数据包，文件结束时返回 io.EOF
+func (pr *PcapReader) Next() (PcapPacket, error) {
+	if pr.ng {
+		return pr.nextPcapng()
+	}
+
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(pr.rd, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return PcapPacket{}, fmt.Errorf("truncated pcap record header")
+		}
+		return PcapPacket{}, err
+	}
+	sec := int64(pr.order.Uint32(hdr))
+	frac := int64(pr.order.Uint32(hdr[4:]))
+	if !pr.nano {
+		frac *= 1000
+	}
+	inclLen := pr.order.Uint32(hdr[8:])
+	if inclLen > maxCaptureRecordLen {
+		return PcapPacket{}, fmt.Errorf("pcap record length %d exceeds %d", inclLen, maxCaptureRecordLen)
+	}
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(pr.rd, data); err != nil {
+		return PcapPacket{}, fmt.Errorf("truncated pcap record: %v", err)
+	}
+	return PcapPacket{Time: time.Unix(sec, frac), LinkType: pr.linkType, Data: data}, nil
+}
+
+// nextPcapng 读取 pcapng 块，直至得到一个数据包
+func (pr *PcapReader) nextPcapng() (PcapPacket, error) {
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(pr.rd, hdr); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return PcapPacket{}, fmt.Errorf("truncated pcapng block header")
+			}
+			return PcapPacket{}, err
+		}
+
+		if binary.LittleEndian.Uint32(hdr) == 0x0a0d0d0a {
+			// Section Header Block：根据字节序魔数确定本节的字节序
+			magic, err := pr.rd.Peek(4)
+			if err != nil {
+				return PcapPacket{}, fmt.Errorf("truncated pcapng section header: %v", err)
+			}
+			switch binary.LittleEndian.Uint32(magic) {
+			case 0x1a2b3c4d:
+				pr.order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				pr.order = binary.BigEndian
+			default:
+				return PcapPacket{}, fmt.Errorf("invalid pcapng byte-order magic %x", magic)
+			}
+			pr.ifaces = nil
+		}
+		if pr.order == nil {
+			return PcapPacket{}, errors.New("pcapng block before section header")
+		}
+
+		bType := pr.order.Uint32(hdr)
+		total := pr.order.Uint32(hdr[4:])
+		if total < 12 || total%4 != 0 || total > maxCaptureRecordLen {
+			return PcapPacket{}, fmt.Errorf("invalid pcapng block length %d", total)
+		}
+		body := make([]byte, total-8)
+		if _, err := io.ReadFull(pr.rd, body); err != nil {
+			return PcapPacket{}, fmt.Errorf("truncated pcapng block: %v", err)
+		}
+		body = body[:len(body)-4]
+
+		switch bType {
+		case 1: // Interface Description Block
+			if len(body) < 8 {
+				return PcapPacket{}, errors.New("truncated pcapng interface block")
+			}
+			tsUnits, err := pcapngTSUnits(pr.order, body[8:])
+			if err != nil {
+				return PcapPacket{}, err
+			}
+			pr.ifaces = append(pr.ifaces, pcapngInterface{
+				linkType: uint32(pr.order.Uint16(body)),
+				tsUnits:  tsUnits,
+			})
+		case 6: // Enhanced Packet Block
+			if len(body) < 20 {
+				return PcapPacket{}, errors.New("truncated pcapng packet block")
+			}
+			id := pr.order.Uint32(body)
+			if int(id) >= len(pr.ifaces) {
+				return PcapPacket{}, fmt.Errorf("pcapng packet refers to unknown interface %d", id)
+			}
+			iface := pr.ifaces[id]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			capLen := pr.order.Uint32(body[12:])
+			if int(capLen) > len(body)-20 {
+				return PcapPacket{}, errors.New("truncated pcapng packet data")
+			}
+			sec := ts / iface.tsUnits
+			// 余数乘以 1e9 可能超出 64 位，使用 128 位中间结果
+			hi, lo := bits.Mul64(ts%iface.tsUnits, uint64(time.Second))
+			nsec, _ := bits.Div64(hi, lo, iface.tsUnits)
+			return PcapPacket{
+				Time:     time.Unix(int64(sec), int64(nsec)),
+				LinkType: iface.linkType,
+				Data:     body[20 : 20+capLen],
+			}, nil
+		case 3: // Simple Packet Block，不包含时间戳
+			if len(body) < 4 || len(pr.ifaces) == 0 {
+				return PcapPacket{}, errors.New("invalid pcapng simple packet block")
+			}
+			capLen := min(int(pr.order.Uint32(body)), len(body)-4)
+			return PcapPacket{LinkType: pr.ifaces[0].linkType, Data: body[4 : 4+capLen]}, nil
+		}
+	}
+}
+
+// pcapngTSUnits 从接口选项中解析 if_tsresol，返回每秒的时间戳单位数，默认为微秒；
+// 单位数超出 64 位时报错
+func pcapngTSUnits(order binary.ByteOrder, opts []byte) (uint64, error) {
+	for len(opts) >= 4 {
+		code := order.Uint16(opts)
+		size := int(order.Uint16(opts[2:]))
+		if code == 0 || len(opts) < 4+size {
+			break
+		}
+		if code == 9 && size >= 1 {
+			res := opts[4]
+			if res&0x80 != 0 {
+				if res&0x7f >= 64 {
+					return 0, fmt.Errorf("invalid pcapng timestamp resolution 2^-%d", res&0x7f)
+				}
+				return uint64(1) << (res & 0x7f), nil
+			}
+			// 10^19 是 64 位无符号整数所能表示的最大的 10 的幂
+			if res > 19 {
+				return 0, fmt.Errorf("invalid pcapng timestamp resolution 10^-%d", res)
+			}
+			units := uint64(1)
+			for i := byte(0); i < res; i++ {
+				units *= 10
+			}
+			return units, nil
+		}
+		opts = opts[4+(size+3)/4*4:]
+	}
+	return 1000000, nil
+}
+
+// ipPacket 表示解析后的 IP 数据包
+type ipPacket struct {
+	src, dst net.IP
+	proto    byte
+	payload  []byte
+}
+
+// decodeLinkLayer 去除链路层头部，返回 IP 数据包，无法解析时返回 false
+func decodeLinkLayer(linkType uint32, data []byte) ([]byte, bool) {
+	switch linkType {
+	case pcapLinkTypeRaw, pcapLinkTypeRawBSD, pcapLinkTypeRawOpen, pcapLinkTypeIPv4, pcapLinkTypeIPv6:
+		return data, true
+	case pcapLinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, off := binary.BigEndian.Uint16(data[12:]), 14
+		// 跳过 802.1Q VLAN 标签
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= off+4 {
+			etherType, off = binary.BigEndian.Uint16(data[off+2:]), off+4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+		return data[off:], true
+	case pcapLinkTypeSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return data[16:], true
+	case pcapLinkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		return data[20:], true
+	case pcapLinkTypeNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	}
+	return nil, false
+}
+
+// decodeIPPacket 解析 IPv4 或 IPv6 数据包。
+// 分片的数据包及无法解析的扩展头部将被忽略。
+func decodeIPPacket(data []byte) (ipPacket, bool) {
+	if len(data) < 1 {
+		return ipPacket{}, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return ipPacket{}, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if ihl < 20 || total < ihl || len(data) < total {
+			return ipPacket{}, false
+		}
+		// MF 位或分片偏移不为 0 时为分片
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+			return ipPacket{}, false
+		}
+		return ipPacket{
+			src:     net.IP(data[12:16]),
+			dst:     net.IP(data[16:20]),
+			proto:   data[9],
+			payload: data[ihl:total],
+		}, true
+	case 6:
+		if len(data) < 40 {
+			return ipPacket{}, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(data[4:]))
+		if len(data) < end {
+			return ipPacket{}, false
+		}
+		pkt := ipPacket{src: net.IP(data[8:24]), dst: net.IP(data[24:40]), proto: data[6]}
+		off := 40
+		for {
+			switch pkt.proto {
+			case 0, 43, 60: // 逐跳选项、路由、目的选项
+				if end < off+8 {
+					return ipPacket{}, false
+				}
+				pkt.proto = data[off]
+				off += (int(data[off+1]) + 1) * 8
+				continue
+			case 44: // 分片
+				return ipPacket{}, false
+			}
+			break
+		}
+		if off > end {
+			return ipPacket{}, false
+		}
+		pkt.payload = data[off:end]
+		return pkt, true
+	}
+	return ipPacket{}, false
+}
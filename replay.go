@@ -0,0 +1,379 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// replay.go 文件实现了抓包流量的离线回放。
+// ReadReplayQueries 从 pcap/pcapng 文件中提取 DNS 查询（UDP 及重组后的 TCP），
+// 并将抓包中的原始回复与查询配对；提取出的查询可以通过 ReplayHandler 直接交由
+// Responser（或处理链）处理，也可以通过 ReplayTransport 注入正在运行的 GoDNSServer，
+// 从而在无网络的环境下，以真实流量检查 Responser 的回归问题。
+
+package godns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrReplayDropped 表示服务器未回复回放的查询（如查询被中间件丢弃或处理出错）
+var ErrReplayDropped = errors.New("replay query dropped")
+
+// ReplayQuery 表示从抓包文件中提取的一个 DNS 查询
+type ReplayQuery struct {
+	// 抓包时间
+	Time time.Time
+	// 网络协议，ProtocolUDP 或 ProtocolTCP
+	Protocol Protocol
+	// 客户端及服务器地址
+	Client net.Addr
+	Server net.Addr
+	// 查询内容
+	Packet []byte
+	// 抓包中该查询对应的原始回复，未找到时为 nil
+	Captured []byte
+}
+
+// ReplayResult 记录一个查询的回放结果
+type ReplayResult struct {
+	Query ReplayQuery
+	// 回放得到的回复，未回复时为 nil
+	Response []byte
+	// 处理耗时
+	Latency time.Duration
+	// 错误信息
+	Err error
+}
+
+// ReadReplayQueries 从抓包文件中提取所有 DNS 查询
+// 其接受参数为：
+//   - r io.Reader，pcap 或 pcapng 格式的抓包文件
+//
+// 返回值为：
+//   - []ReplayQuery，按抓包顺序排列的 DNS 查询
+//   - error，错误信息
+//
+// QR 位为 0 的 DNS 消息被视为查询，QR 位为 1 的消息则按照协议、地址及 ID
+// 与此前的查询配对，作为该查询的原始回复。TCP 流会在重组后按照长度前缀切分为 DNS 消息。
+func ReadReplayQueries(r io.Reader) ([]ReplayQuery, error) {
+	pr, err := NewPcapReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := &replayExtractor{
+		streams: make(map[string]*tcpStream),
+		pending: make(map[string][]int),
+	}
+	for {
+		pkt, err := pr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return ex.queries, err
+		}
+		ex.handlePacket(pkt)
+	}
+	return ex.queries, nil
+}
+
+// replayExtractor 从数据包中提取 DNS 消息
+type replayExtractor struct {
+	queries []ReplayQuery
+	// TCP 流，键为 "源地址>目的地址"
+	streams map[string]*tcpStream
+	// 尚未配对回复的查询下标，键由协议、客户端、服务器及 ID 组成
+	pending map[string][]int
+}
+
+func (ex *replayExtractor) handlePacket(pkt PcapPacket) {
+	data, ok := decodeLinkLayer(pkt.LinkType, pkt.Data)
+	if !ok {
+		return
+	}
+	ip, ok := decodeIPPacket(data)
+	if !ok {
+		return
+	}
+
+	switch ip.proto {
+	case 17:
+		if len(ip.payload) < 8 {
+			return
+		}
+		src := &net.UDPAddr{IP: ip.src, Port: int(binary.BigEndian.Uint16(ip.payload))}
+		dst := &net.UDPAddr{IP: ip.dst, Port: int(binary.BigEndian.Uint16(ip.payload[2:]))}
+		ex.handleMessage(pkt.Time, ProtocolUDP, src, dst, ip.payload[8:])
+	case 6:
+		if len(ip.payload) < 20 {
+			return
+		}
+		off := int(ip.payload[12]>>4) * 4
+		if off < 20 || len(ip.payload) < off {
+			return
+		}
+		src := &net.TCPAddr{IP: ip.src, Port: int(binary.BigEndian.Uint16(ip.payload))}
+		dst := &net.TCPAddr{IP: ip.dst, Port: int(binary.BigEndian.Uint16(ip.payload[2:]))}
+		seq := binary.BigEndian.Uint32(ip.payload[4:])
+		flags := ip.payload[13]
+
+		key := src.String() + ">" + dst.String()
+		stream := ex.streams[key]
+		if stream == nil || flags&0x02 != 0 {
+			// 新的流，或 SYN 表示端口被复用
+			stream = &tcpStream{pending: make(map[uint32][]byte)}
+			ex.streams[key] = stream
+		}
+		if flags&0x02 != 0 {
+			stream.next, stream.started = seq+1, true
+		}
+		for _, msg := range stream.add(seq, ip.payload[off:]) {
+			ex.handleMessage(pkt.Time, ProtocolTCP, src, dst, msg)
+		}
+		if flags&0x05 != 0 {
+			// FIN 或 RST：流结束
+			delete(ex.streams, key)
+		}
+	}
+}
+
+// handleMessage 记录查询，或将回复与此前的查询配对
+func (ex *replayExtractor) handleMessage(ts time.Time, proto Protocol, src, dst net.Addr, msg []byte) {
+	if len(msg) < 12 {
+		return
+	}
+	id := binary.BigEndian.Uint16(msg)
+	if msg[2]&0x80 == 0 {
+		key := fmt.Sprintf("%s|%s|%s|%d", proto, src, dst, id)
+		ex.pending[key] = append(ex.pending[key], len(ex.queries))
+		ex.queries = append(ex.queries, ReplayQuery{
+			Time:     ts,
+			Protocol: proto,
+			Client:   src,
+			Server:   dst,
+			Packet:   append([]byte{}, msg...),
+		})
+		return
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%d", proto, dst, src, id)
+	if idx := ex.pending[key]; len(idx) > 0 {
+		ex.queries[idx[0]].Captured = append([]byte{}, msg...)
+		if len(idx) == 1 {
+			delete(ex.pending, key)
+		} else {
+			ex.pending[key] = idx[1:]
+		}
+	}
+}
+
+// tcpStream 重组单向 TCP 流，并按照两字节长度前缀切分 DNS 消息
+type tcpStream struct {
+	started bool
+	// 下一个期望的序列号
+	next uint32
+	// 已按序接收但尚未组成完整消息的数据
+	buf []byte
+	// 乱序到达的报文段
+	pending map[uint32][]byte
+}
+
+// add 添加一个报文段，并返回因此而完整的 DNS 消息
+func (s *tcpStream) add(seq uint32, payload []byte) [][]byte {
+	if len(payload) == 0 {
+		return nil
+	}
+	if !s.started {
+		s.next, s.started = seq, true
+	}
+	s.pending[seq] = append([]byte{}, payload...)
+
+	// 将可以衔接的报文段按序拼接，重传的数据将被忽略
+	for progressed := true; progressed; {
+		progressed = false
+		for sq, p := range s.pending {
+			diff := int32(sq - s.next)
+			if diff > 0 {
+				continue
+			}
+			delete(s.pending, sq)
+			if int(-diff) >= len(p) {
+				continue
+			}
+			s.buf = append(s.buf, p[-diff:]...)
+			s.next += uint32(int32(len(p)) + diff)
+			progressed = true
+		}
+	}
+
+	var msgs [][]byte
+	for len(s.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(s.buf))
+		if len(s.buf) < 2+size {
+			break
+		}
+		msgs = append(msgs, s.buf[2:2+size])
+		s.buf = s.buf[2+size:]
+	}
+	return msgs
+}
+
+// connInfo 返回回放该查询时使用的链接信息
+func (q ReplayQuery) connInfo() ConnectionInfo {
+	return ConnectionInfo{
+		Protocol:     q.Protocol,
+		Address:      q.Client,
+		LocalAddress: q.Server,
+		Packet:       append([]byte{}, q.Packet...),
+		Record:       &QueryRecord{},
+	}
+}
+
+// ReplayHandler 将查询依次交由处理器处理，并记录回复及耗时
+// 其接受参数为：
+//   - h Handler，处理器，可以通过 ResponserHandler 将 Responser 转换为处理器
+//   - queries []ReplayQuery，待回放的查询
+//
+// 返回值为：
+//   - []ReplayResult，与查询一一对应的回放结果
+func ReplayHandler(h Handler, queries []ReplayQuery) []ReplayResult {
+	results := make([]ReplayResult, len(queries))
+	for i, q := range queries {
+		start := time.Now()
+		resp, err := h.ServeDNS(q.connInfo())
+		results[i] = ReplayResult{
+			Query:    q,
+			Response: resp,
+			Latency:  time.Since(start),
+			Err:      err,
+		}
+	}
+	return results
+}
+
+// ReplayTransport 是一个用于回放的传输层。
+// 将其添加到 GoDNSServer 后，可以通过 Replay 将查询注入正在运行的服务器，
+// 查询会经过完整的处理链，回复则由 Reply 交还给 Replay。
+type ReplayTransport struct {
+	// 等待回复的超时时间，默认为 5 秒
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	connChan chan<- ConnectionInfo
+	ready    chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewReplayTransport 创建一个回放传输层
+func NewReplayTransport() *ReplayTransport {
+	return &ReplayTransport{
+		Timeout: 5 * time.Second,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Listen 记录链接信息通道，并阻塞直至传输层被关闭
+func (t *ReplayTransport) Listen(connChan chan<- ConnectionInfo) error {
+	t.mu.Lock()
+	t.connChan = connChan
+	t.mu.Unlock()
+	close(t.ready)
+	<-t.done
+
+	// 等待正在投递的查询放弃投递，此后链接信息通道可能被关闭
+	t.mu.Lock()
+	t.connChan = nil
+	t.mu.Unlock()
+	return nil
+}
+
+// Reply 将回复交还给等待中的 Replay
+func (t *ReplayTransport) Reply(connInfo ConnectionInfo, data []byte) error {
+	// 与 DoH 一致，回复经由带缓冲的回复通道传递
+	select {
+	case connInfo.HTTPReply <- data:
+		return nil
+	default:
+		return fmt.Errorf("replay reply to %s dropped", connInfo.Address)
+	}
+}
+
+// Close 关闭回放传输层，使 Listen 返回
+func (t *ReplayTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// Replay 将查询依次注入服务器，并记录回复及耗时。
+// 服务器丢弃的查询（如被中间件丢弃）将立即记录 ErrReplayDropped，
+// 超时仍未处理的查询则记录超时错误。
+func (t *ReplayTransport) Replay(queries []ReplayQuery) []ReplayResult {
+	results := make([]ReplayResult, len(queries))
+	for i, q := range queries {
+		results[i] = t.replay(q)
+	}
+	return results
+}
+
+func (t *ReplayTransport) replay(q ReplayQuery) ReplayResult {
+	res := ReplayResult{Query: q}
+	timer := time.NewTimer(t.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-t.ready:
+	case <-t.done:
+		res.Err = net.ErrClosed
+		return res
+	case <-timer.C:
+		res.Err = errors.New("replay transport is not listening")
+		return res
+	}
+
+	connInfo := q.connInfo()
+	reply := make(chan []byte, 1)
+	connInfo.HTTPReply = reply
+	connInfo.Transport = t
+
+	start := time.Now()
+	if err := t.submit(connInfo, timer.C); err != nil {
+		res.Err = err
+		return res
+	}
+
+	select {
+	case res.Response = <-reply:
+		res.Latency = time.Since(start)
+		if res.Response == nil {
+			// Netter.Drop 以 nil 回复通知查询被丢弃
+			res.Err = ErrReplayDropped
+		}
+	case <-t.done:
+		res.Err = net.ErrClosed
+	case <-timer.C:
+		res.Err = errors.New("timeout waiting for response")
+	}
+	return res
+}
+
+// submit 将查询投递到链接信息通道中，投递期间持有锁，以免 Listen 返回后通道被关闭
+func (t *ReplayTransport) submit(connInfo ConnectionInfo, timeout <-chan time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connChan == nil {
+		return net.ErrClosed
+	}
+	select {
+	case t.connChan <- connInfo:
+		return nil
+	case <-t.done:
+		return net.ErrClosed
+	case <-timeout:
+		return errors.New("timeout submitting query")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// replay_test.go 文件定义了对 replay.go 及 pcapreader.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// writeTestCapture 使用 PcapWriter 生成包含 UDP 及 TCP 查询与回复的抓包文件
+func writeTestCapture(t *testing.T, format string, responser Responser) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replay."+format)
+	w, err := NewPcapWriter(PcapConfig{Path: path, Format: format}, net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	conns := []ConnectionInfo{
+		{
+			Protocol: ProtocolUDP,
+			Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Packet:   testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false),
+		},
+		{
+			Protocol: ProtocolTCP,
+			Address:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000},
+			Packet:   testQuery(2, "tcp.example.com", dns.DNSRRTypeA, 0, false),
+		},
+	}
+	for _, connInfo := range conns {
+		resp, err := responser.Response(connInfo)
+		if err != nil {
+			t.Fatalf("Response failed: %v", err)
+		}
+		w.WriteQuery(connInfo)
+		w.WriteResponse(connInfo, resp)
+	}
+	w.Close()
+	return path
+}
+
+// TestReadReplayQueries 测试从 pcap 及 pcapng 文件中提取查询并配对原始回复
+func TestReadReplayQueries(t *testing.T) {
+	responser := &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(10, 0, 0, 1)}}
+	for _, format := range []string{PcapFormatPcap, PcapFormatPcapng} {
+		path := writeTestCapture(t, format, responser)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("error opening capture: %v", err)
+		}
+		queries, err := ReadReplayQueries(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: ReadReplayQueries failed: %v", format, err)
+		}
+		if len(queries) != 2 {
+			t.Fatalf("%s: queries got: %d, expected: 2", format, len(queries))
+		}
+
+		expected := []struct {
+			proto  Protocol
+			client string
+			packet []byte
+		}{
+			{ProtocolUDP, "192.0.2.1:5353", testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false)},
+			{ProtocolTCP, "192.0.2.2:40000", testQuery(2, "tcp.example.com", dns.DNSRRTypeA, 0, false)},
+		}
+		for i, e := range expected {
+			q := queries[i]
+			if q.Protocol != e.proto || q.Client.String() != e.client || q.Server.String() != "10.0.0.1:53" {
+				t.Errorf("%s: query %d got: %s %s -> %s, expected: %s %s -> 10.0.0.1:53",
+					format, i, q.Protocol, q.Client, q.Server, e.proto, e.client)
+			}
+			if !bytes.Equal(q.Packet, e.packet) {
+				t.Errorf("%s: query %d packet got: %v, expected: %v", format, i, q.Packet, e.packet)
+			}
+			if q.Captured == nil {
+				t.Errorf("%s: query %d has no captured response", format, i)
+			}
+			if q.Time.IsZero() || time.Since(q.Time) > time.Minute {
+				t.Errorf("%s: query %d time got: %v, expected: now", format, i, q.Time)
+			}
+		}
+
+		// 回放结果应与抓包中的原始回复一致
+		for i, res := range ReplayHandler(ResponserHandler(responser), queries) {
+			if res.Err != nil || !bytes.Equal(res.Response, res.Query.Captured) {
+				t.Errorf("%s: replay %d got: %v (%v), expected: %v", format, i, res.Response, res.Err, res.Query.Captured)
+			}
+		}
+	}
+}
+
+// ethernetTCPFrame 合成一个以太网承载的 IPv4/TCP 帧
+func ethernetTCPFrame(src, dst *net.TCPAddr, seq uint32, flags byte, payload []byte) []byte {
+	seg := make([]byte, 20)
+	binary.BigEndian.PutUint16(seg[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	seg[12] = 5 << 4
+	seg[13] = flags
+	seg = append(seg, payload...)
+	frame := make([]byte, 12, 14)
+	frame = binary.BigEndian.AppendUint16(frame, 0x0800)
+	frame = append(frame, ipv4Header(src.IP, dst.IP, 6, len(seg), 1)...)
+	return append(frame, seg...)
+}
+
+// TestReplayTCPReassembly 测试乱序、重传及跨报文段的 TCP 流重组
+func TestReplayTCPReassembly(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 40000}
+	server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 53}
+
+	q1, q2 := testQuery(1, "a.example.com", dns.DNSRRTypeA, 0, false), testQuery(2, "b.example.com", dns.DNSRRTypeA, 0, false)
+	stream := binary.BigEndian.AppendUint16(nil, uint16(len(q1)))
+	stream = append(stream, q1...)
+	stream = binary.BigEndian.AppendUint16(stream, uint16(len(q2)))
+	stream = append(stream, q2...)
+
+	const isn = 1000
+	split := len(q1) + 7
+	frames := [][]byte{
+		ethernetTCPFrame(client, server, isn, 0x02, nil),
+		// 第二段先于第一段到达
+		ethernetTCPFrame(client, server, isn+1+uint32(split), 0x18, stream[split:]),
+		ethernetTCPFrame(client, server, isn+1, 0x18, stream[:split]),
+		// 重传的第一段
+		ethernetTCPFrame(client, server, isn+1, 0x18, stream[:split]),
+	}
+
+	buf := bytes.Buffer{}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeEthernet)
+	buf.Write(hdr)
+	for i, frame := range frames {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec, 1700000000)
+		binary.LittleEndian.PutUint32(rec[4:], uint32(i))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+
+	queries, err := ReadReplayQueries(&buf)
+	if err != nil {
+		t.Fatalf("ReadReplayQueries failed: %v", err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("queries got: %d, expected: 2", len(queries))
+	}
+	for i, expected := range [][]byte{q1, q2} {
+		if !bytes.Equal(queries[i].Packet, expected) {
+			t.Errorf("query %d got: %v, expected: %v", i, queries[i].Packet, expected)
+		}
+	}
+}
+
+// TestReplayTransport 测试通过回放传输层向运行中的服务器注入查询
+func TestReplayTransport(t *testing.T) {
+	conf := DNSServerConfig{IP: net.IPv4(10, 0, 0, 1), PoolCapcity: -1}
+	responser := &DullResponser{ServerConf: conf}
+	server := NewGoDNSServer(conf, responser)
+	server.Use(func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			if binary.BigEndian.Uint16(connInfo.Packet) == 8 {
+				return nil, nil
+			}
+			return next.ServeDNS(connInfo)
+		})
+	})
+	rt := NewReplayTransport()
+	server.Netter.Transports = []Transport{rt}
+	done := make(chan struct{})
+	go func() {
+		server.Start()
+		close(done)
+	}()
+	defer func() {
+		server.Stop()
+		<-done
+		server.ThreadPool.Release()
+	}()
+
+	queries := []ReplayQuery{
+		{
+			Protocol: ProtocolUDP,
+			Client:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+			Packet:   testQuery(7, "www.example.com", dns.DNSRRTypeA, 0, false),
+		},
+	}
+	results := rt.Replay(queries)
+	if results[0].Err != nil {
+		t.Fatalf("Replay failed: %v", results[0].Err)
+	}
+	expected, _ := responser.Response(queries[0].connInfo())
+	if !bytes.Equal(results[0].Response, expected) {
+		t.Errorf("replay response got: %v, expected: %v", results[0].Response, expected)
+	}
+	if results[0].Latency <= 0 {
+		t.Errorf("replay latency got: %v, expected: > 0", results[0].Latency)
+	}
+
+	// 被中间件丢弃的查询应立即返回 ErrReplayDropped，而非等待超时
+	rt.Timeout = time.Minute
+	start := time.Now()
+	queries[0].Packet = testQuery(8, "www.example.com", dns.DNSRRTypeA, 0, false)
+	results = rt.Replay(queries)
+	if !errors.Is(results[0].Err, ErrReplayDropped) || results[0].Response != nil {
+		t.Errorf("dropped replay got: %v %v, expected: %v", results[0].Response, results[0].Err, ErrReplayDropped)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("dropped replay took: %v, expected: immediate", elapsed)
+	}
+}
+
+// testPcapngFile 合成一个仅含一个接口的小端 pcapng 文件，res 为接口的 if_tsresol 选项，
+// 随后附加一个时间戳为 ts 的 Enhanced Packet Block
+func testPcapngFile(res byte, ts uint64) []byte {
+	le := binary.LittleEndian
+	block := func(bType uint32, body []byte) []byte {
+		b := le.AppendUint32(nil, bType)
+		b = le.AppendUint32(b, uint32(12+len(body)))
+		b = append(b, body...)
+		return le.AppendUint32(b, uint32(12+len(body)))
+	}
+	shb := le.AppendUint32(nil, 0x1a2b3c4d)
+	shb = append(shb, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	idb := []byte{pcapLinkTypeIPv4, 0, 0, 0, 0, 0, 1, 0, 9, 0, 1, 0, res, 0, 0, 0, 0, 0, 0, 0}
+	epb := le.AppendUint32(nil, 0)
+	epb = le.AppendUint32(epb, uint32(ts>>32))
+	epb = le.AppendUint32(epb, uint32(ts))
+	epb = le.AppendUint32(epb, 4)
+	epb = le.AppendUint32(epb, 4)
+	epb = append(epb, 0x45, 0, 0, 0)
+	file := block(0x0a0d0d0a, shb)
+	file = append(file, block(1, idb)...)
+	return append(file, block(6, epb)...)
+}
+
+// TestPcapReaderMalformed 测试读取被篡改的抓包文件时报错而不是崩溃或分配过量内存
+func TestPcapReaderMalformed(t *testing.T) {
+	// 时间戳精度超出 64 位
+	for _, res := range []byte{0x80 | 64, 0x80 | 127, 20, 127} {
+		pr, err := NewPcapReader(bytes.NewReader(testPcapngFile(res, 1)))
+		if err != nil {
+			t.Fatalf("NewPcapReader failed: %v", err)
+		}
+		if _, err := pr.Next(); err == nil {
+			t.Errorf("if_tsresol %#x expected an error but got nil", res)
+		}
+	}
+
+	// 最大的合法精度
+	pr, _ := NewPcapReader(bytes.NewReader(testPcapngFile(19, 1<<63|12345)))
+	if pkt, err := pr.Next(); err != nil || pkt.Time.Unix() != int64((1<<63|12345)/uint64(1e19)) {
+		t.Errorf("if_tsresol 10^-19 got: %v %v", pkt.Time, err)
+	}
+
+	// 记录长度超出上限
+	pcap := binary.LittleEndian.AppendUint32(nil, 0xa1b2c3d4)
+	pcap = append(pcap, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, pcapLinkTypeEthernet, 0, 0, 0)
+	pcap = append(pcap, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	pr, err := NewPcapReader(bytes.NewReader(pcap))
+	if err != nil {
+		t.Fatalf("NewPcapReader failed: %v", err)
+	}
+	if _, err := pr.Next(); err == nil {
+		t.Error("oversized pcap record expected an error but got nil")
+	}
+}
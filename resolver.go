@@ -0,0 +1,468 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// resolver.go 文件实现了一个最简的迭代解析器 IterativeResolver。
+// IterativeResolver 从根提示出发，依次跟随权威服务器的委派，使用委派中的胶水记录
+// （缺少胶水记录时另行解析域名服务器的地址），并在回答为 CNAME 时从根重新解析其目标。
+// 可选地启用 RFC 9156 查询名称最小化，每次仅向权威服务器暴露比当前区域多一个标签的名称。
+// 每次解析的所有查询都会记录在 Resolution.Trace 中，便于研究解析器的行为。
+// IterativeResolver 不缓存结果，也不验证 DNSSEC 签名。
+
+package godns
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+const (
+	// DefaultResolverTimeout 是等待权威服务器回复的默认超时时间
+	DefaultResolverTimeout = 2 * time.Second
+	// DefaultResolverMaxQueries 是一次解析最多发送的查询数量
+	DefaultResolverMaxQueries = 64
+	// DefaultResolverMaxDepth 是一次解析中跟随 CNAME 及解析域名服务器地址的最大嵌套深度
+	DefaultResolverMaxDepth = 8
+)
+
+// ResolverConfig 记录迭代解析器的配置
+type ResolverConfig struct {
+	// 根提示：根服务器的地址，形如 "198.41.0.4" 或 "127.0.0.2:5353"，省略端口时使用 Port
+	RootHints []string
+	// 查询权威服务器所用的端口，胶水记录中仅含地址，默认为 53
+	Port int
+	// 是否启用查询名称最小化，详见 RFC 9156
+	QNameMinimisation bool
+	// 每次查询等待回复的超时时间，默认为 DefaultResolverTimeout
+	Timeout time.Duration
+	// 一次解析最多发送的查询数量，默认为 DefaultResolverMaxQueries
+	MaxQueries int
+	// 跟随 CNAME 及解析域名服务器地址的最大嵌套深度，默认为 DefaultResolverMaxDepth
+	MaxDepth int
+	// 是否在 Response 中以 Info 级别记录每次解析的查询过程
+	Trace bool
+}
+
+// TraceStep 记录解析过程中向权威服务器发送的一次查询
+type TraceStep struct {
+	// 查询时所在的区域
+	Zone string
+	// 权威服务器地址
+	Server string
+	// 实际发送的查询名称及类型，启用查询名称最小化时可能与原查询不同
+	QName string
+	QType dns.DNSType
+	// 回复的 RCode，查询失败时无意义
+	RCode dns.DNSResponseCode
+	// 对回复的处理结果，如 "referral to example.com"
+	Result  string
+	Latency time.Duration
+	// 查询失败时的错误信息
+	Err error
+}
+
+// String 返回查询步骤的单行描述
+func (s TraceStep) String() string {
+	if s.Err != nil {
+		return fmt.Sprintf("[%s] %s %s @%s: error: %v", s.Zone, s.QName, s.QType, s.Server, s.Err)
+	}
+	return fmt.Sprintf("[%s] %s %s @%s: %s %s (%s)", s.Zone, s.QName, s.QType, s.Server, s.RCode, s.Result, s.Latency)
+}
+
+// Resolution 是一次迭代解析的结果
+type Resolution struct {
+	RCode dns.DNSResponseCode
+	// 回答部分，包括 CNAME 链
+	Answer []dns.DNSResourceRecord
+	// 否定回答时权威服务器给出的权威部分
+	Authority []dns.DNSResourceRecord
+	// 解析过程中发送的所有查询
+	Trace []TraceStep
+}
+
+// IterativeResolver 是一个迭代解析器，同时也是一个 Responser，可被并发调用
+type IterativeResolver struct {
+	Config         ResolverConfig
+	ResolverLogger *slog.Logger
+}
+
+// NewIterativeResolver 创建一个迭代解析器
+// 其接受参数为：
+//   - conf ResolverConfig，解析器配置
+//   - logger *slog.Logger，日志记录器，为 nil 时丢弃日志
+func NewIterativeResolver(conf ResolverConfig, logger *slog.Logger) *IterativeResolver {
+	if logger == nil {
+		logger = newWriterLogger(nil, LogComponentResponser)
+	}
+	return &IterativeResolver{Config: conf, ResolverLogger: logger}
+}
+
+// resolution 记录一次解析的状态
+type resolution struct {
+	result  *Resolution
+	queries int
+}
+
+// note 记录第 i 个查询步骤的处理结果
+func (res *resolution) note(i int, result string) {
+	res.result.Trace[i].Result = result
+}
+
+// errResolutionLimit 表示解析超出了查询数量或嵌套深度的限制
+var errResolutionLimit = errors.New("resolution limit exceeded")
+
+// Resolve 迭代解析指定的名称及类型
+// 其接受参数为：
+//   - qname string，查询名称
+//   - qtype dns.DNSType，查询类型
+//
+// 返回值为：
+//   - *Resolution，解析结果，即使解析失败也包含已发送查询的记录
+//   - error，解析失败时的错误信息，此时 RCode 为 SERVFAIL
+func (r *IterativeResolver) Resolve(qname string, qtype dns.DNSType) (*Resolution, error) {
+	res := &resolution{result: &Resolution{}}
+	if len(r.Config.RootHints) == 0 {
+		res.result.RCode = dns.DNSResponseCodeServFail
+		return res.result, errors.New("no root hints configured")
+	}
+	err := r.resolve(res, r.roots(), canonicalName(qname), qtype, 0)
+	if err != nil {
+		res.result.RCode = dns.DNSResponseCodeServFail
+	}
+	return res.result, err
+}
+
+// roots 返回根提示中的服务器地址
+func (r *IterativeResolver) roots() []string {
+	roots := make([]string, len(r.Config.RootHints))
+	for i, hint := range r.Config.RootHints {
+		roots[i] = r.serverAddr(hint)
+	}
+	return roots
+}
+
+// serverAddr 为未指定端口的服务器地址补充配置的端口
+func (r *IterativeResolver) serverAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := r.Config.Port
+	if port == 0 {
+		port = 53
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// nextName 返回 name 在 zone 之下、比 zone 多一个标签的祖先名称，用于查询名称最小化
+func nextName(zone, name string) string {
+	if zone == "." {
+		return name[strings.LastIndexByte(name, '.')+1:]
+	}
+	prefix := strings.TrimSuffix(name, "."+zone)
+	return prefix[strings.LastIndexByte(prefix, '.')+1:] + "." + zone
+}
+
+// resolve 从 servers 所服务的根区域出发解析 name，并将回答追加至结果中
+func (r *IterativeResolver) resolve(res *resolution, servers []string, name string, qtype dns.DNSType, depth int) error {
+	maxDepth := r.Config.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultResolverMaxDepth
+	}
+	if depth > maxDepth {
+		return errResolutionLimit
+	}
+
+	zone, known := ".", "."
+	for {
+		// 查询名称最小化时，仅查询比已知名称多一个标签的名称，类型使用 A，详见 RFC 9156 第 3 节
+		qn, qt := name, qtype
+		if r.Config.QNameMinimisation && known != name {
+			if qn = nextName(known, name); qn != name {
+				qt = dns.DNSRRTypeA
+			}
+		}
+
+		resp, step, err := r.query(res, servers, zone, qn, qt)
+		if err != nil {
+			return err
+		}
+		cut, err := referralCut(resp, zone, qn)
+		if err != nil {
+			res.note(step, "bogus referral")
+			return err
+		}
+		switch {
+		case resp.Header.RCode == dns.DNSResponseCodeNXDomain:
+			// 祖先名称不存在时，其下的所有名称均不存在，详见 RFC 8020
+			res.note(step, "name error")
+			res.result.RCode = dns.DNSResponseCodeNXDomain
+			res.result.Authority = resp.Authority
+			return nil
+		case cut != "":
+			res.note(step, "referral to "+cut)
+			next, err := r.delegationServers(res, resp, zone, cut, depth)
+			if err != nil {
+				return err
+			}
+			zone, known, servers = cut, cut, next
+		case qn != name:
+			// 最小化的查询名称存在（有回答或 NODATA），继续查询下一个标签
+			res.note(step, "minimised name exists")
+			known = qn
+		case len(resp.Answer) > 0:
+			return r.collectAnswer(res, step, resp, name, qtype, depth)
+		default:
+			res.note(step, "no data")
+			res.result.RCode = dns.DNSResponseCodeNoErr
+			res.result.Authority = resp.Authority
+			return nil
+		}
+	}
+}
+
+// query 依次向 servers 发送查询，直到收到 NOERROR 或 NXDOMAIN 回复
+// 返回值中的 int 为结果中记录该查询的步骤的下标，调用者可以通过 note 补充其处理结果。
+func (r *IterativeResolver) query(res *resolution, servers []string, zone, qname string, qtype dns.DNSType) (dns.DNSMessage, int, error) {
+	maxQueries := r.Config.MaxQueries
+	if maxQueries <= 0 {
+		maxQueries = DefaultResolverMaxQueries
+	}
+	timeout := r.Config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultResolverTimeout
+	}
+	qry := dns.DNSMessage{
+		Header:     dns.DNSHeader{OpCode: dns.DNSOpCodeQuery, QDCount: 1},
+		Question:   []dns.DNSQuestion{{Name: qname, Type: qtype, Class: dns.DNSClassIN}},
+		Additional: []dns.DNSResourceRecord{*dns.NewDNSRROPT(1232, 0, &dns.DNSRDATAOPT{})},
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		if res.queries >= maxQueries {
+			return dns.DNSMessage{}, 0, errResolutionLimit
+		}
+		res.queries++
+		start := time.Now()
+		resp, err := Exchange(ProtocolUDP, server, qry, timeout)
+		step := TraceStep{Zone: zone, Server: server, QName: qname, QType: qtype, Latency: time.Since(start), Err: err}
+		if err == nil {
+			step.RCode = resp.Header.RCode
+			if resp.Header.RCode != dns.DNSResponseCodeNoErr && resp.Header.RCode != dns.DNSResponseCodeNXDomain {
+				step.Result = "server failure"
+				err = fmt.Errorf("%s answered %s", server, resp.Header.RCode)
+			}
+		}
+		res.result.Trace = append(res.result.Trace, step)
+		if err == nil {
+			return resp, len(res.result.Trace) - 1, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no reachable server for zone %s", zone)
+	}
+	return dns.DNSMessage{}, 0, lastErr
+}
+
+// referralCut 判断回复是否为委派，并返回委派点的名称
+// 委派回复不含回答，AA 位为 0，且权威部分含有位于当前区域之下的 NS 记录。
+// 委派点须为查询名称本身或其祖先，否则该回复被视为错误，以免解析被引向无关的区域。
+func referralCut(resp dns.DNSMessage, zone, qname string) (string, error) {
+	if resp.Header.AA || len(resp.Answer) > 0 {
+		return "", nil
+	}
+	bogus := ""
+	for _, rr := range resp.Authority {
+		owner := canonicalName(rr.Name)
+		if rr.Type != dns.DNSRRTypeNS || owner == zone || !IsSubDomain(zone, owner) {
+			continue
+		}
+		if IsSubDomain(owner, qname) {
+			return owner, nil
+		}
+		bogus = owner
+	}
+	if bogus != "" {
+		return "", fmt.Errorf("referral to %s is not an ancestor of %s", bogus, qname)
+	}
+	return "", nil
+}
+
+// delegationServers 返回委派点的域名服务器地址
+// 仅使用附加部分中位于给出委派的区域 zone 之内的胶水记录，以免被区域外的地址记录投毒；
+// 缺少可用的胶水记录时从根解析域名服务器的地址。
+func (r *IterativeResolver) delegationServers(res *resolution, resp dns.DNSMessage, zone, cut string, depth int) ([]string, error) {
+	var targets []string
+	for _, rr := range resp.Authority {
+		if ns, ok := rr.RData.(*dns.DNSRDATANS); ok && rr.Type == dns.DNSRRTypeNS && canonicalName(rr.Name) == cut {
+			targets = append(targets, canonicalName(ns.NSDNAME))
+		}
+	}
+
+	var servers []string
+	for _, target := range targets {
+		if !IsSubDomain(zone, target) {
+			continue
+		}
+		for _, rr := range resp.Additional {
+			if canonicalName(rr.Name) != target {
+				continue
+			}
+			if ip := addressOf(rr); ip != nil {
+				servers = append(servers, r.serverAddr(ip.String()))
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	// 无胶水记录的委派：从根解析域名服务器的地址，详见 RFC 1034 5.3.3 节
+	var lastErr error
+	for _, target := range targets {
+		sub := &resolution{result: &Resolution{}, queries: res.queries}
+		err := r.resolve(sub, r.roots(), target, dns.DNSRRTypeA, depth+1)
+		res.queries = sub.queries
+		res.result.Trace = append(res.result.Trace, sub.result.Trace...)
+		if err != nil {
+			if errors.Is(err, errResolutionLimit) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		for _, rr := range sub.result.Answer {
+			// 回答可能含有 CNAME 链，链末端的地址即为域名服务器的地址
+			if ip := addressOf(rr); ip != nil {
+				servers = append(servers, r.serverAddr(ip.String()))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address found for the name servers of %s", cut)
+	}
+	return nil, lastErr
+}
+
+// addressOf 返回 A 或 AAAA 记录中的地址，其他记录返回 nil
+func addressOf(rr dns.DNSResourceRecord) net.IP {
+	switch rdata := rr.RData.(type) {
+	case *dns.DNSRDATAA:
+		if rr.Type == dns.DNSRRTypeA {
+			return rdata.Address
+		}
+	case *dns.DNSRDATAUnknown:
+		if rr.Type == dns.DNSRRTypeAAAA && len(rdata.RData) == net.IPv6len {
+			return net.IP(rdata.RData)
+		}
+	}
+	return nil
+}
+
+// collectAnswer 沿 CNAME 链从回答中收集 name 的记录
+// CNAME 的目标不在回答中时，从根重新解析该目标。
+func (r *IterativeResolver) collectAnswer(res *resolution, step int, resp dns.DNSMessage, name string, qtype dns.DNSType, depth int) error {
+	res.result.RCode = dns.DNSResponseCodeNoErr
+	seen := map[string]bool{}
+	for current := name; ; {
+		if seen[current] {
+			res.note(step, "cname loop")
+			return fmt.Errorf("cname loop at %s", current)
+		}
+		seen[current] = true
+
+		var cname string
+		found := false
+		for _, rr := range resp.Answer {
+			if canonicalName(rr.Name) != current {
+				continue
+			}
+			switch {
+			case rr.Type == qtype || qtype == dns.DNSQTypeANY:
+				res.result.Answer = append(res.result.Answer, rr)
+				found = true
+			case rr.Type == dns.DNSRRTypeCNAME:
+				res.result.Answer = append(res.result.Answer, rr)
+				if target, ok := domainTarget(rr); ok {
+					cname = target
+				}
+			case rr.Type == dns.DNSRRTypeRRSIG:
+				res.result.Answer = append(res.result.Answer, rr)
+			}
+		}
+		switch {
+		case found:
+			res.note(step, "answer")
+			return nil
+		case cname == "":
+			res.note(step, "no data")
+			res.result.Authority = resp.Authority
+			return nil
+		}
+
+		// CNAME 的目标同样在回答中时继续沿链查找，否则从根重新解析
+		inAnswer := false
+		for _, rr := range resp.Answer {
+			if canonicalName(rr.Name) == cname {
+				inAnswer = true
+				break
+			}
+		}
+		if !inAnswer {
+			res.note(step, "cname to "+cname)
+			return r.resolve(res, r.roots(), cname, qtype, depth+1)
+		}
+		current = cname
+	}
+}
+
+// Response 迭代解析查询的第一个问题，并以解析结果作答
+// 回复的 RA 位为 1；解析失败时回复 SERVFAIL；超出 UDP 负载大小的回复由 Netter 截断。
+func (r *IterativeResolver) Response(connInfo ConnectionInfo) ([]byte, error) {
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(qry.Question) != 1 || qry.Header.OpCode != dns.DNSOpCodeQuery {
+		resp := InitRefused(qry)
+		resp.Header.RCode = dns.DNSResponseCodeFormErr
+		if qry.Header.OpCode != dns.DNSOpCodeQuery {
+			resp.Header.RCode = dns.DNSResponseCodeNotImp
+		}
+		return resp.Encode(), nil
+	}
+
+	q := qry.Question[0]
+	result, err := r.Resolve(q.Name, q.Type)
+	if err != nil {
+		r.ResolverLogger.Debug("Resolution failed", "qname", q.Name, "qtype", q.Type.String(), "err", err)
+	}
+	if r.Config.Trace {
+		for i, step := range result.Trace {
+			r.ResolverLogger.Info("Resolution trace", "qname", q.Name, "qtype", q.Type.String(), "step", i+1, "trace", step.String())
+		}
+	}
+
+	resp := InitRefused(qry)
+	resp.Header.RCode = result.RCode
+	resp.Header.RA = true
+	resp.Answer = result.Answer
+	resp.Authority = result.Authority
+	for _, rr := range qry.Additional {
+		if rr.Type == dns.DNSRRTypeOPT {
+			resp.Additional = append(resp.Additional, *dns.NewDNSRROPT(1232, 0, &dns.DNSRDATAOPT{}))
+			break
+		}
+	}
+	FixCount(&resp)
+	return resp.Encode(), nil
+}
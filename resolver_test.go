@@ -0,0 +1,237 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// resolver_test.go 文件定义了对 resolver.go 的单元测试，
+// 测试在回环地址上运行的 GoDNS 权威服务器层级中进行，无需访问互联网。
+
+package godns
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testHierarchyZones 是测试层级中各服务器所服务的区域，键为服务器地址
+// 127.0.0.2 服务根区域，127.0.0.3 服务 com 及 net，127.0.0.4 服务 example.com，127.0.0.5 服务 other.com，
+// 其中 other.com 的域名服务器位于 net 区域，因此其委派不含胶水记录。
+var testHierarchyZones = map[string]map[string]string{
+	"127.0.0.2": {
+		".": `@ 3600 SOA a.root. hostmaster.root. 1 7200 3600 1209600 300
+@ 3600 NS a.root.
+a.root. 3600 A 127.0.0.2
+com. 3600 NS ns.com.
+ns.com. 3600 A 127.0.0.3
+net. 3600 NS ns.net.
+ns.net. 3600 A 127.0.0.3
+`,
+	},
+	"127.0.0.3": {
+		"com": `@ 3600 SOA ns hostmaster 1 7200 3600 1209600 300
+@ 3600 NS ns
+ns 3600 A 127.0.0.3
+example 3600 NS ns1.example
+ns1.example 3600 A 127.0.0.4
+other 3600 NS ns.hosting.net.
+`,
+		"net": `@ 3600 SOA ns hostmaster 1 7200 3600 1209600 300
+@ 3600 NS ns
+ns 3600 A 127.0.0.3
+ns.hosting 3600 A 127.0.0.5
+`,
+	},
+	"127.0.0.4": {
+		"example.com": `@ 3600 SOA ns1 hostmaster 1 7200 3600 1209600 300
+@ 3600 NS ns1
+ns1 3600 A 127.0.0.4
+www 3600 A 192.0.2.1
+alias 3600 CNAME www.other.com.
+a.b.c 3600 TXT "deep"
+`,
+	},
+	"127.0.0.5": {
+		"other.com": `@ 3600 SOA ns.hosting.net. hostmaster 1 7200 3600 1209600 300
+@ 3600 NS ns.hosting.net.
+www 3600 A 192.0.2.2
+`,
+	},
+}
+
+// testFreePort 返回一个当前未被占用的端口
+func testFreePort(t *testing.T) int {
+	t.Helper()
+	pktConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp failed: %v", err)
+	}
+	defer pktConn.Close()
+	return pktConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// testServe 在指定的地址及端口上启动 GoDNS 服务器，并在测试结束时停止
+func testServe(t *testing.T, ip net.IP, port int, responser Responser) {
+	t.Helper()
+	server := NewGoDNSServer(DNSServerConfig{
+		IP:          ip,
+		ListenIP:    ip,
+		Port:        port,
+		LogWriter:   io.Discard,
+		PoolCapcity: -1,
+	}, responser)
+	go server.Start()
+	t.Cleanup(func() { server.Stop() })
+	for _, tp := range server.Netter.Transports {
+		if a, ok := tp.(interface{ Addr() net.Addr }); ok {
+			waitAddr(t, a.Addr)
+		}
+	}
+}
+
+// testHierarchy 启动 testHierarchyZones 所描述的权威服务器层级，并返回各服务器所用的端口
+func testHierarchy(t *testing.T) int {
+	t.Helper()
+	port := testFreePort(t)
+	for ip, files := range testHierarchyZones {
+		var zones []*dns.Zone
+		for origin, file := range files {
+			z, err := dns.LoadZone(strings.NewReader(file), origin)
+			if err != nil {
+				t.Fatalf("LoadZone(%s) failed: %v", origin, err)
+			}
+			zones = append(zones, z)
+		}
+		testServe(t, net.ParseIP(ip), port, NewAuthoritativeResponser(zones...))
+	}
+	return port
+}
+
+// testTraceNames 返回解析过程中各查询的名称
+func testTraceNames(trace []TraceStep) string {
+	names := []string{}
+	for _, step := range trace {
+		names = append(names, step.QName)
+	}
+	return strings.Join(names, " ")
+}
+
+// TestIterativeResolver 测试跟随委派、胶水记录、CNAME 及无胶水记录的委派
+func TestIterativeResolver(t *testing.T) {
+	port := testHierarchy(t)
+	r := NewIterativeResolver(ResolverConfig{RootHints: []string{"127.0.0.2"}, Port: port}, discardLogger())
+
+	for _, c := range []struct {
+		name   string
+		qtype  dns.DNSType
+		rcode  dns.DNSResponseCode
+		answer string
+		trace  string
+	}{
+		{"www.example.com", dns.DNSRRTypeA, dns.DNSResponseCodeNoErr, "A",
+			"www.example.com www.example.com www.example.com"},
+		// CNAME 指向的 other.com 的域名服务器需要从根另行解析
+		{"alias.example.com", dns.DNSRRTypeA, dns.DNSResponseCodeNoErr, "CNAME A",
+			"alias.example.com alias.example.com alias.example.com www.other.com www.other.com ns.hosting.net ns.hosting.net www.other.com"},
+		{"nothere.example.com", dns.DNSRRTypeA, dns.DNSResponseCodeNXDomain, "",
+			"nothere.example.com nothere.example.com nothere.example.com"},
+		{"www.example.com", dns.DNSRRTypeTXT, dns.DNSResponseCodeNoErr, "",
+			"www.example.com www.example.com www.example.com"},
+	} {
+		result, err := r.Resolve(c.name, c.qtype)
+		if err != nil {
+			t.Fatalf("Resolve(%s %s) failed: %v\n%v", c.name, c.qtype, err, result.Trace)
+		}
+		if result.RCode != c.rcode || testSectionTypes(result.Answer) != c.answer {
+			t.Errorf("Resolve(%s %s) rcode, answer got: %v %q, expected: %v %q", c.name, c.qtype, result.RCode, testSectionTypes(result.Answer), c.rcode, c.answer)
+		}
+		if got := testTraceNames(result.Trace); got != c.trace {
+			t.Errorf("Resolve(%s %s) trace got: %q, expected: %q", c.name, c.qtype, got, c.trace)
+		}
+	}
+
+	result, _ := r.Resolve("alias.example.com", dns.DNSRRTypeA)
+	if a, ok := result.Answer[1].RData.(*dns.DNSRDATAA); !ok || !a.Address.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("Resolve(alias.example.com) address got: %v, expected: 192.0.2.2", result.Answer[1])
+	}
+	if result.Trace[0].Zone != "." || result.Trace[1].Zone != "com" || result.Trace[2].Result != "cname to www.other.com" {
+		t.Errorf("Resolve(alias.example.com) trace got:\n%v", result.Trace)
+	}
+}
+
+// TestIterativeResolverQNameMinimisation 测试查询名称最小化时各服务器所见的查询名称
+func TestIterativeResolverQNameMinimisation(t *testing.T) {
+	port := testHierarchy(t)
+	r := NewIterativeResolver(ResolverConfig{RootHints: []string{"127.0.0.2"}, Port: port, QNameMinimisation: true}, discardLogger())
+
+	result, err := r.Resolve("a.b.c.example.com", dns.DNSRRTypeTXT)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if testSectionTypes(result.Answer) != "TXT" {
+		t.Errorf("answer got: %q, expected: TXT", testSectionTypes(result.Answer))
+	}
+	expected := "com example.com c.example.com b.c.example.com a.b.c.example.com"
+	if got := testTraceNames(result.Trace); got != expected {
+		t.Errorf("trace got: %q, expected: %q", got, expected)
+	}
+	if result.Trace[0].QType != dns.DNSRRTypeA || result.Trace[4].QType != dns.DNSRRTypeTXT {
+		t.Errorf("trace types got: %v %v, expected: A TXT", result.Trace[0].QType, result.Trace[4].QType)
+	}
+
+	// 祖先名称不存在时直接回复 NXDOMAIN
+	result, _ = r.Resolve("x.nothere.example.com", dns.DNSRRTypeA)
+	if result.RCode != dns.DNSResponseCodeNXDomain || len(result.Trace) != 3 {
+		t.Errorf("rcode, queries got: %v %d, expected: NXDOMAIN 3", result.RCode, len(result.Trace))
+	}
+}
+
+// TestIterativeResolverResponse 测试作为 Responser 使用时的回复及解析失败时的 SERVFAIL
+func TestIterativeResolverResponse(t *testing.T) {
+	port := testHierarchy(t)
+	r := NewIterativeResolver(ResolverConfig{RootHints: []string{"127.0.0.2"}, Port: port, Trace: true}, discardLogger())
+
+	resp := dns.DNSMessage{}
+	data, _ := r.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, true)})
+	if _, err := resp.DecodeFromBuffer(data, 0); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if resp.Header.ID != 0x1234 || !resp.Header.RA || resp.Header.AA || testSectionTypes(resp.Answer) != "A" || len(resp.Additional) != 1 {
+		t.Errorf("response got: %v, expected: ID 0x1234 with RA, an A answer and OPT", resp)
+	}
+
+	// 根服务器不可达
+	r = NewIterativeResolver(ResolverConfig{RootHints: []string{"127.0.0.9"}, Port: port, Timeout: 200 * time.Millisecond}, discardLogger())
+	data, _ = r.Response(ConnectionInfo{Protocol: ProtocolUDP, Packet: testQuery(0x1234, "www.example.com", dns.DNSRRTypeA, 0, false)})
+	resp = dns.DNSMessage{}
+	resp.DecodeFromBuffer(data, 0)
+	if resp.Header.RCode != dns.DNSResponseCodeServFail {
+		t.Errorf("rcode got: %v, expected: SERVFAIL", resp.Header.RCode)
+	}
+}
+
+// TestReferralCut 测试委派点的判断，委派点不是查询名称的祖先时视为错误
+func TestReferralCut(t *testing.T) {
+	referral := func(owner string) dns.DNSMessage {
+		return dns.DNSMessage{Authority: []dns.DNSResourceRecord{{
+			Name: owner, Type: dns.DNSRRTypeNS, Class: dns.DNSClassIN, TTL: 3600,
+			RData: &dns.DNSRDATANS{NSDNAME: "ns." + owner},
+		}}}
+	}
+	for _, c := range []struct {
+		owner, qname string
+		cut          string
+		bogus        bool
+	}{
+		{"example.com", "www.example.com", "example.com", false},
+		{"Example.COM.", "example.com", "example.com", false},
+		{"evil.com", "www.example.com", "", true},
+		{"com", "www.example.com", "", false},
+	} {
+		cut, err := referralCut(referral(c.owner), "com", c.qname)
+		if cut != c.cut || (err != nil) != c.bogus {
+			t.Errorf("referralCut(%s, %s) got: %q %v, expected: %q, error %v", c.owner, c.qname, cut, err, c.cut, c.bogus)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+//go:build linux
+
+// reuseport_linux.go 文件实现了 Linux 下的 SO_REUSEPORT 支持。
+
+package godns
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported 表示当前平台是否支持 SO_REUSEPORT
+const reusePortSupported = true
+
+// reusePortControl 在套接字绑定前为其设置 SO_REUSEPORT 选项，
+// 使多个套接字可以绑定同一端口，并由内核在它们之间分发数据包。
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
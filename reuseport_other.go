@@ -0,0 +1,17 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+//go:build !linux
+
+// reuseport_other.go 文件为非 Linux 平台提供 SO_REUSEPORT 的占位实现。
+
+package godns
+
+import "syscall"
+
+// reusePortSupported 表示当前平台是否支持 SO_REUSEPORT
+const reusePortSupported = false
+
+// reusePortControl 在非 Linux 平台上不做任何处理
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
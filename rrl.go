@@ -0,0 +1,352 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// rrl.go 文件实现了 BIND 风格的回复速率限制（Response Rate Limiting，RRL）。
+// GoDNS 常被用于构造放大效果显著的回复（如 ANY 查询、庞大的 DNSKEY 集合），
+// RRL 按照客户端前缀及回复类别统计回复速率，超出限制的回复将被丢弃，
+// 或以一定的比例替换为截断（TC）回复，使真实的客户端可以改用 TCP 重试。
+
+package godns
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// RRLCategory 表示回复的类别，不同类别的回复分别计算速率
+type RRLCategory string
+
+const (
+	// 含有回答的正常回复
+	RRLCategoryResponse RRLCategory = "response"
+	// 名称存在但不存在所查询类型的记录
+	RRLCategoryNoData RRLCategory = "nodata"
+	// 名称不存在
+	RRLCategoryNXDomain RRLCategory = "nxdomain"
+	// 委派至子区域
+	RRLCategoryReferral RRLCategory = "referral"
+	// 其他错误回复，如 SERVFAIL、REFUSED、FORMERR
+	RRLCategoryError RRLCategory = "error"
+)
+
+// RRLAction 表示 RRL 对一个回复采取的动作
+type RRLAction string
+
+const (
+	// 正常发送回复
+	RRLActionPass RRLAction = "pass"
+	// 丢弃回复
+	RRLActionDrop RRLAction = "drop"
+	// 以截断（TC）回复代替原回复
+	RRLActionSlip RRLAction = "slip"
+)
+
+// RRLConfig 记录回复速率限制的配置，与 BIND 的 rate-limit 配置项相对应
+type RRLConfig struct {
+	// 每个客户端前缀每秒允许的相同回复数量，为 0 时不限制
+	ResponsesPerSecond int
+	// 各类别回复每秒允许的数量，为 0 时与 ResponsesPerSecond 相同，为负数时不限制
+	NoDataPerSecond    int
+	NXDomainsPerSecond int
+	ReferralsPerSecond int
+	ErrorsPerSecond    int
+
+	// 统计窗口（秒），超出限制的客户端最多将在该时间内持续受限，默认为 15
+	Window int
+	// 每 Slip 个受限回复中有一个以截断回复代替，其余被丢弃，
+	// 默认为 2，为 1 时总是发送截断回复，为负数时总是丢弃
+	Slip int
+
+	// 客户端前缀长度，默认分别为 24 与 56
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+
+	// 不受限制的客户端
+	Exempt []*net.IPNet
+
+	// 仅记录日志而不实际限制
+	LogOnly bool
+
+	// 状态表的最大条目数，默认为 100000，表满时新的客户端不受限制
+	MaxEntries int
+}
+
+// RRL 实现回复速率限制，可被并发调用
+type RRL struct {
+	Config    RRLConfig
+	RRLLogger *slog.Logger
+	// 指标记录器，不为 nil 时记录受限回复的数量
+	Metrics *Metrics
+
+	mu      sync.Mutex
+	entries map[string]*rrlEntry
+	sweep   time.Time
+	// 当前时间，便于测试时替换
+	now func() time.Time
+}
+
+// rrlEntry 记录一个（客户端前缀、回复类别、名称）组合的信用额度
+type rrlEntry struct {
+	// 剩余额度，每秒恢复 rate，低于 0 时受限
+	balance float64
+	last    time.Time
+	// 受限回复的计数，用于决定是否发送截断回复
+	slip int
+	// 是否已输出受限日志，额度恢复后重置
+	logged bool
+}
+
+// metricRRL 是受限回复数量的指标名称
+const metricRRL = "godns_rrl_limited_total"
+
+// NewRRL 创建一个回复速率限制器
+// 其接受参数为：
+//   - conf RRLConfig，速率限制配置
+//   - logger *slog.Logger，日志记录器，可以为 nil
+func NewRRL(conf RRLConfig, logger *slog.Logger) *RRL {
+	if conf.Window <= 0 {
+		conf.Window = 15
+	}
+	if conf.Slip == 0 {
+		conf.Slip = 2
+	}
+	if conf.IPv4PrefixLength <= 0 || conf.IPv4PrefixLength > 32 {
+		conf.IPv4PrefixLength = 24
+	}
+	if conf.IPv6PrefixLength <= 0 || conf.IPv6PrefixLength > 128 {
+		conf.IPv6PrefixLength = 56
+	}
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = 100000
+	}
+	if logger == nil {
+		logger = newWriterLogger(nil, LogComponentGoDNS)
+	}
+	return &RRL{
+		Config:    conf,
+		RRLLogger: logger,
+		entries:   make(map[string]*rrlEntry),
+		now:       time.Now,
+	}
+}
+
+// SetMetrics 设置指标记录器，并注册受限回复数量的计数器
+func (r *RRL) SetMetrics(m *Metrics) {
+	m.RegisterCounter(metricRRL, "Number of responses limited by RRL.", "category", "action")
+	r.Metrics = m
+}
+
+// rate 返回指定类别每秒允许的回复数量，为 0 时不限制
+func (r *RRL) rate(category RRLCategory) int {
+	var rate int
+	switch category {
+	case RRLCategoryNoData:
+		rate = r.Config.NoDataPerSecond
+	case RRLCategoryNXDomain:
+		rate = r.Config.NXDomainsPerSecond
+	case RRLCategoryReferral:
+		rate = r.Config.ReferralsPerSecond
+	case RRLCategoryError:
+		rate = r.Config.ErrorsPerSecond
+	}
+	if rate == 0 {
+		rate = r.Config.ResponsesPerSecond
+	}
+	return max(rate, 0)
+}
+
+// prefix 返回客户端地址所在的前缀
+func (r *RRL) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(r.Config.IPv4PrefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(r.Config.IPv6PrefixLength, 128)).String()
+}
+
+// Check 判断对客户端发送该回复时应采取的动作，并更新速率状态
+// 其接受参数为：
+//   - client net.IP，客户端地址
+//   - resp dns.DNSMessage，解析后的回复
+//
+// 返回值为：
+//   - RRLAction，应采取的动作，LogOnly 模式下总是返回 RRLActionPass
+//   - RRLCategory，回复的类别
+func (r *RRL) Check(client net.IP, resp dns.DNSMessage) (RRLAction, RRLCategory) {
+	category, name := ClassifyResponse(resp)
+	rate := r.rate(category)
+	if rate == 0 || client == nil {
+		return RRLActionPass, category
+	}
+	for _, n := range r.Config.Exempt {
+		if n.Contains(client) {
+			return RRLActionPass, category
+		}
+	}
+
+	prefix := r.prefix(client)
+	key := prefix + "|" + string(category) + "|" + name
+
+	r.mu.Lock()
+	now := r.now()
+	e, ok := r.entries[key]
+	if !ok {
+		if len(r.entries) >= r.Config.MaxEntries {
+			r.expire(now)
+		}
+		if len(r.entries) >= r.Config.MaxEntries {
+			r.mu.Unlock()
+			return RRLActionPass, category
+		}
+		e = &rrlEntry{balance: float64(rate), last: now}
+		r.entries[key] = e
+	}
+
+	// 按经过的时间恢复额度，额度上限为 rate，下限为 -rate*Window
+	e.balance += now.Sub(e.last).Seconds() * float64(rate)
+	e.balance = min(e.balance, float64(rate)) - 1
+	e.balance = max(e.balance, -float64(rate*r.Config.Window))
+	e.last = now
+	if e.balance >= 0 {
+		e.logged = false
+		r.mu.Unlock()
+		return RRLActionPass, category
+	}
+
+	action := RRLActionDrop
+	e.slip++
+	if r.Config.Slip > 0 && e.slip%r.Config.Slip == 0 {
+		action = RRLActionSlip
+	}
+	logged := e.logged
+	e.logged = true
+	r.mu.Unlock()
+
+	if r.Metrics != nil {
+		r.Metrics.Inc(metricRRL, string(category), string(action))
+	}
+	if !logged {
+		msg := "Response rate limited"
+		if r.Config.LogOnly {
+			msg = "Response would be rate limited"
+		}
+		r.RRLLogger.Info(msg, "client", client, "prefix", prefix, "category", category, "name", name, "action", action)
+	}
+	if r.Config.LogOnly {
+		return RRLActionPass, category
+	}
+	return action, category
+}
+
+// expire 删除超过统计窗口未更新的条目，需持有锁
+func (r *RRL) expire(now time.Time) {
+	// 避免表满时频繁遍历
+	if now.Sub(r.sweep) < time.Second {
+		return
+	}
+	r.sweep = now
+	window := time.Duration(r.Config.Window) * time.Second
+	for key, e := range r.entries {
+		if now.Sub(e.last) > window {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// ClassifyResponse 判断回复的类别，并返回计算速率时使用的名称
+// 其接受参数为：
+//   - resp dns.DNSMessage，解析后的回复
+//
+// 返回值为：
+//   - RRLCategory，回复的类别
+//   - string，正常回复使用查询名称及类型，NODATA 及 NXDOMAIN 使用区域（SOA 记录的所有者）名称，
+//     委派使用子区域名称，错误回复不区分名称
+func ClassifyResponse(resp dns.DNSMessage) (RRLCategory, string) {
+	qname, qtype := "", ""
+	if len(resp.Question) > 0 {
+		qname = strings.ToLower(resp.Question[0].Name)
+		qtype = resp.Question[0].Type.String()
+	}
+	// 区域名称，未找到 SOA 记录时使用查询名称
+	owner := func(t dns.DNSType) string {
+		for _, rr := range resp.Authority {
+			if rr.Type == t {
+				return strings.ToLower(rr.Name)
+			}
+		}
+		return qname
+	}
+
+	switch resp.Header.RCode {
+	case dns.DNSResponseCodeNoErr:
+	case dns.DNSResponseCodeNXDomain:
+		return RRLCategoryNXDomain, owner(dns.DNSRRTypeSOA)
+	default:
+		return RRLCategoryError, ""
+	}
+	if len(resp.Answer) > 0 {
+		return RRLCategoryResponse, qname + "/" + qtype
+	}
+	if !resp.Header.AA {
+		for _, rr := range resp.Authority {
+			if rr.Type == dns.DNSRRTypeNS {
+				return RRLCategoryReferral, owner(dns.DNSRRTypeNS)
+			}
+		}
+	}
+	return RRLCategoryNoData, owner(dns.DNSRRTypeSOA)
+}
+
+// SlipResponse 根据原回复生成截断回复：保留头部、问题部分及 OPT 记录，并设置 TC 位
+func SlipResponse(resp dns.DNSMessage) []byte {
+	slip := dns.DNSMessage{
+		Header:   resp.Header,
+		Question: resp.Question,
+	}
+	slip.Header.TC = true
+	slip.Header.QDCount = uint16(len(slip.Question))
+	for _, rr := range resp.Additional {
+		if rr.Type == dns.DNSRRTypeOPT {
+			slip.Additional = append(slip.Additional, rr)
+		}
+	}
+	FixCount(&slip)
+	return slip.Encode()
+}
+
+// RRLMiddleware 返回一个回复速率限制中间件
+// 其接受参数为：
+//   - r *RRL，回复速率限制器
+//
+// 仅 UDP 回复受到限制，TCP 及 DoH 的客户端地址无法伪造，因而不受限制。
+// 受限的回复将被丢弃（返回空回复），或被替换为截断回复。
+func RRLMiddleware(r *RRL) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+			resp, err := next.ServeDNS(connInfo)
+			if err != nil || len(resp) == 0 || connInfo.Protocol != ProtocolUDP {
+				return resp, err
+			}
+
+			msg := dns.DNSMessage{}
+			if _, derr := msg.DecodeFromBuffer(resp, 0); derr != nil {
+				// 无法解析的回复按错误回复处理
+				msg = dns.DNSMessage{Header: dns.DNSHeader{RCode: dns.DNSResponseCodeServFail}}
+			}
+			ip, _ := addrIPPort(connInfo.Address)
+			switch action, _ := r.Check(ip, msg); action {
+			case RRLActionDrop:
+				return nil, nil
+			case RRLActionSlip:
+				if len(msg.Question) == 0 {
+					return nil, nil
+				}
+				return SlipResponse(msg), nil
+			}
+			return resp, nil
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// rrl_test.go 文件定义了对 rrl.go 的单元测试
+
+package godns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testRRLResponse 返回一个指定名称的回复，rcode 为 NXDOMAIN 时附带 SOA 记录
+func testRRLResponse(name string, rcode dns.DNSResponseCode) dns.DNSMessage {
+	resp := dns.DNSMessage{
+		Header: dns.DNSHeader{ID: 1, QR: true, AA: true, RCode: rcode, QDCount: 1},
+		Question: []dns.DNSQuestion{
+			{Name: name, Type: dns.DNSRRTypeA, Class: dns.DNSClassIN},
+		},
+	}
+	if rcode == dns.DNSResponseCodeNoErr {
+		resp.Answer = []dns.DNSResourceRecord{{
+			Name: name, Type: dns.DNSRRTypeA, Class: dns.DNSClassIN, TTL: 60,
+			RData: &dns.DNSRDATAA{Address: net.IPv4(10, 0, 0, 1)},
+		}}
+	} else {
+		resp.Authority = []dns.DNSResourceRecord{{
+			Name: "example.com", Type: dns.DNSRRTypeSOA, Class: dns.DNSClassIN, TTL: 60,
+			RData: &dns.DNSRDATASOA{MName: "ns.example.com", RName: "admin.example.com", Minimum: 60},
+		}}
+	}
+	FixCount(&resp)
+	return resp
+}
+
+// TestClassifyResponse 测试回复类别的判断
+func TestClassifyResponse(t *testing.T) {
+	referral := dns.DNSMessage{
+		Header:   dns.DNSHeader{QR: true},
+		Question: []dns.DNSQuestion{{Name: "www.sub.example.com", Type: dns.DNSRRTypeA, Class: dns.DNSClassIN}},
+		Authority: []dns.DNSResourceRecord{{
+			Name: "sub.example.com", Type: dns.DNSRRTypeNS, Class: dns.DNSClassIN,
+			RData: &dns.DNSRDATANS{NSDNAME: "ns.sub.example.com"},
+		}},
+	}
+	noData := testRRLResponse("www.example.com", dns.DNSResponseCodeNoErr)
+	noData.Answer = nil
+	noData.Authority = testRRLResponse("www.example.com", dns.DNSResponseCodeNXDomain).Authority
+
+	cases := []struct {
+		resp     dns.DNSMessage
+		category RRLCategory
+		name     string
+	}{
+		{testRRLResponse("WWW.example.com", dns.DNSResponseCodeNoErr), RRLCategoryResponse, "www.example.com/A"},
+		{testRRLResponse("a.example.com", dns.DNSResponseCodeNXDomain), RRLCategoryNXDomain, "example.com"},
+		{noData, RRLCategoryNoData, "example.com"},
+		{referral, RRLCategoryReferral, "sub.example.com"},
+		{dns.DNSMessage{Header: dns.DNSHeader{RCode: dns.DNSResponseCodeRefused}}, RRLCategoryError, ""},
+	}
+	for _, c := range cases {
+		category, name := ClassifyResponse(c.resp)
+		if category != c.category || name != c.name {
+			t.Errorf("ClassifyResponse got: %s %s, expected: %s %s", category, name, c.category, c.name)
+		}
+	}
+}
+
+// TestRRLCheck 测试额度耗尽后的丢弃与截断、额度恢复、前缀聚合及 LogOnly 模式
+func TestRRLCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rrl := NewRRL(RRLConfig{ResponsesPerSecond: 2, Window: 5}, discardLogger())
+	rrl.now = func() time.Time { return now }
+	resp := testRRLResponse("www.example.com", dns.DNSResponseCodeNoErr)
+
+	var actions []RRLAction
+	for i := 0; i < 5; i++ {
+		// 同一 /24 前缀内的不同客户端共享额度
+		action, _ := rrl.Check(net.IPv4(192, 0, 2, byte(i)), resp)
+		actions = append(actions, action)
+	}
+	expected := []RRLAction{RRLActionPass, RRLActionPass, RRLActionDrop, RRLActionSlip, RRLActionDrop}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Fatalf("actions got: %v, expected: %v", actions, expected)
+		}
+	}
+
+	// 其他前缀及其他名称不受影响
+	if action, _ := rrl.Check(net.IPv4(198, 51, 100, 1), resp); action != RRLActionPass {
+		t.Errorf("other prefix action got: %s, expected: pass", action)
+	}
+	if action, _ := rrl.Check(net.IPv4(192, 0, 2, 1), testRRLResponse("mail.example.com", dns.DNSResponseCodeNoErr)); action != RRLActionPass {
+		t.Errorf("other name action got: %s, expected: pass", action)
+	}
+
+	// 额度为 -3，2 秒后恢复至 1
+	now = now.Add(2 * time.Second)
+	if action, _ := rrl.Check(net.IPv4(192, 0, 2, 1), resp); action != RRLActionPass {
+		t.Errorf("action after recovery got: %s, expected: pass", action)
+	}
+
+	logOnly := NewRRL(RRLConfig{ResponsesPerSecond: 1, LogOnly: true}, discardLogger())
+	for i := 0; i < 3; i++ {
+		if action, _ := logOnly.Check(net.IPv4(192, 0, 2, 1), resp); action != RRLActionPass {
+			t.Errorf("log-only action got: %s, expected: pass", action)
+		}
+	}
+}
+
+// TestRRLMiddleware 测试中间件仅限制 UDP 回复，并生成截断回复
+func TestRRLMiddleware(t *testing.T) {
+	rrl := NewRRL(RRLConfig{ResponsesPerSecond: 1, Slip: 1}, discardLogger())
+	m := NewMetrics(nil)
+	rrl.SetMetrics(m)
+	resp := testRRLResponse("www.example.com", dns.DNSResponseCodeNoErr)
+	h := Chain(HandlerFunc(func(ConnectionInfo) ([]byte, error) {
+		return resp.Encode(), nil
+	}), RRLMiddleware(rrl))
+
+	serve := func(protocol Protocol) dns.DNSMessage {
+		out, err := h.ServeDNS(ConnectionInfo{
+			Protocol: protocol,
+			Address:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+		})
+		if err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		msg := dns.DNSMessage{}
+		if _, err := msg.DecodeFromBuffer(out, 0); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		return msg
+	}
+
+	if msg := serve(ProtocolUDP); msg.Header.TC || len(msg.Answer) != 1 {
+		t.Errorf("first response got: TC=%v answers=%d, expected: full response", msg.Header.TC, len(msg.Answer))
+	}
+	msg := serve(ProtocolUDP)
+	if !msg.Header.TC || len(msg.Answer) != 0 || len(msg.Question) != 1 {
+		t.Errorf("slip response got: TC=%v answers=%d questions=%d, expected: truncated", msg.Header.TC, len(msg.Answer), len(msg.Question))
+	}
+	if msg := serve(ProtocolTCP); msg.Header.TC {
+		t.Errorf("TCP response should not be limited")
+	}
+	if got := m.Counter(metricRRL, "response", "slip"); got != 1 {
+		t.Errorf("rrl metric got: %d, expected: 1", got)
+	}
+}
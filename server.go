@@ -9,7 +9,7 @@ package godns
 
 import (
 	"io"
-	"log"
+	"log/slog"
 	"net"
 
 	"github.com/panjf2000/ants/v2"
@@ -20,72 +20,223 @@ import (
 //   - ServerConfig: DNS 服务器配置
 //   - Sniffer: 数据包嗅探器
 //   - Handler: 数据包处理器
+//
+// 每个查询都会依次经过 Middlewares 中的中间件，最终交由 Responer 生成回复。
 type GoDNSServer struct {
 	SeverConfig DNSServerConfig
 	// GoDNS 服务器的日志
-	GoDNSLogger *log.Logger
+	GoDNSLogger *slog.Logger
 
 	ThreadPool *ants.Pool
 
 	Netter   Netter
-	Cacher   Cacher
+	Cacher   *Cacher
 	Responer Responser
+
+	// 处理链中的中间件，第一个中间件位于最外层。
+	// 默认包含日志中间件，启用缓存时还包含缓存中间件。
+	Middlewares []Middleware
+	// dnstap 输出，未配置 dnstap 时为 nil
+	Dnstap *DnstapWriter
+	// 运行指标，未配置指标时为 nil
+	Metrics *Metrics
+	// 回复速率限制，未配置 RRL 时为 nil
+	RRL *RRL
+	// 访问控制列表，未配置 ACL 时为 nil
+	ACL *ACL
+	// 故障注入器，未配置故障注入时为 nil
+	Faults *FaultInjector
+	// 缓存管理接口，未配置时为 nil
+	CacheAdmin *CacheAdmin
+
+	// 在 Start 时构建的处理链
+	handler Handler
 }
 
+// NewGoDNSServer 创建一个 GoDNS 服务器，创建失败时将引发 panic。
+// 需要自行处理创建错误（如 dnstap 输出无法打开）时，请使用 NewGoDNSServerE。
 func NewGoDNSServer(serverConf DNSServerConfig, responser Responser) *GoDNSServer {
-	godnsLogger := log.New(serverConf.LogWriter, "GoDNS: ", log.LstdFlags)
+	server, err := NewGoDNSServerE(serverConf, responser)
+	if err != nil {
+		panic(err)
+	}
+	return server
+}
+
+// NewGoDNSServerE 创建一个 GoDNS 服务器，其接受参数为：
+//   - serverConf DNSServerConfig，服务器配置
+//   - responser Responser，生成回复的 Responser
+//
+// 返回值为：
+//   - *GoDNSServer，创建的 GoDNS 服务器
+//   - error，协程池或 dnstap 输出创建失败时返回错误
+func NewGoDNSServerE(serverConf DNSServerConfig, responser Responser) (*GoDNSServer, error) {
+	godnsLogger := NewComponentLogger(serverConf, LogComponentGoDNS)
+
+	var dnstap *DnstapWriter
+	if serverConf.Dnstap != nil {
+		var err error
+		dnstap, err = NewDnstapWriter(*serverConf.Dnstap, godnsLogger)
+		if err != nil {
+			godnsLogger.Error("Error creating dnstap writer", "err", err)
+			return nil, err
+		}
+	}
+
+	if serverConf.Views != nil {
+		views := *serverConf.Views
+		if views.Default == nil {
+			views.Default = responser
+		}
+		responser = NewViewResponser(views)
+	}
+
 	pool, err := ants.NewPool(serverConf.PoolCapcity)
 	if err != nil {
-		godnsLogger.Panicf("Error creating ants pool: %v", err)
+		godnsLogger.Error("Error creating ants pool", "err", err)
+		if dnstap != nil {
+			dnstap.Close()
+		}
+		return nil, err
 	}
 
 	netter := NewNetter(NetterConfig{
 		Port:      serverConf.Port,
+		ListenIP:  serverConf.ListenIP,
 		LogWriter: serverConf.LogWriter,
+		Logger:    NewComponentLogger(serverConf, LogComponentNetter),
+		UDP:       serverConf.UDP,
+		QueueSize: serverConf.QueueSize,
+		DoH:       serverConf.DoH,
+		Capture:   serverConf.Capture,
+		IP:        serverConf.IP,
 	}, pool)
 
 	cacher := NewCacher(CacherConfig{
 		CacheLocation: serverConf.CacheLocation,
 		LogWriter:     serverConf.LogWriter,
+		Logger:        NewComponentLogger(serverConf, LogComponentCacher),
+		MaxEntries:    serverConf.CacheMaxEntries,
+		MaxBytes:      serverConf.CacheMaxBytes,
+		Key:           serverConf.CacheKey,
+		Stale:         serverConf.CacheServeStale,
+		Cache:         serverConf.CacheBackend,
 	}, pool)
 
-	return &GoDNSServer{
+	server := &GoDNSServer{
 		SeverConfig: serverConf,
 		GoDNSLogger: godnsLogger,
 
 		ThreadPool: pool,
 
 		Netter:   *netter,
-		Cacher:   *cacher,
+		Cacher:   cacher,
 		Responer: responser,
 	}
+	server.Use(LoggingMiddleware(godnsLogger))
+	if serverConf.Metrics != nil {
+		server.Metrics = NewMetrics(pool)
+		server.Use(MetricsMiddleware(server.Metrics))
+	}
+	// dnstap 与日志、指标同处外层，记录包括被 ACL、RRL 拒绝在内的所有查询
+	if dnstap != nil {
+		server.Dnstap = dnstap
+		server.Use(DnstapMiddleware(dnstap))
+	}
+	// 访问控制位于速率限制的外层，被拒绝的查询不占用其他客户端的速率额度
+	if serverConf.ACL != nil {
+		server.ACL = NewACL(*serverConf.ACL, godnsLogger)
+		if server.Metrics != nil {
+			server.ACL.SetMetrics(server.Metrics)
+		}
+		server.Use(ACLMiddleware(server.ACL))
+	}
+	if serverConf.RRL != nil {
+		server.RRL = NewRRL(*serverConf.RRL, godnsLogger)
+		if server.Metrics != nil {
+			server.RRL.SetMetrics(server.Metrics)
+		}
+		server.Use(RRLMiddleware(server.RRL))
+	}
+	if serverConf.Faults != nil {
+		server.Faults = NewFaultInjector(*serverConf.Faults, godnsLogger)
+		if server.Metrics != nil {
+			server.Faults.SetMetrics(server.Metrics)
+		}
+		server.Use(FaultMiddleware(server.Faults))
+	}
+	if serverConf.EnebleCache {
+		server.Use(CacheMiddleware(server.Cacher))
+	}
+	if serverConf.CacheAdmin != nil {
+		server.CacheAdmin = NewCacheAdmin(server.Cacher, serverConf.CacheAdmin.Path)
+	}
+	return server, nil
+}
+
+// Use 将中间件追加到处理链的末尾（即最靠近 Responser 的位置），需在 Start 之前调用
+func (s *GoDNSServer) Use(mws ...Middleware) {
+	s.Middlewares = append(s.Middlewares, mws...)
+	s.handler = nil
+}
+
+// Handler 返回由中间件及 Responser 组成的完整处理链
+func (s *GoDNSServer) Handler() Handler {
+	if s.handler != nil {
+		return s.handler
+	}
+	return Chain(ResponserHandler(s.Responer), s.Middlewares...)
 }
 
+// HandleConnection 将查询交由处理链处理，并发送其生成的回复
 func (s *GoDNSServer) HandleConnection(connInfo ConnectionInfo) {
-	// 从缓存中查找响应
-	if s.SeverConfig.EnebleCache {
-		cache, err := s.Cacher.FetchCache(connInfo)
-		if err == nil {
-			s.Netter.Send(connInfo, cache)
-			return
-		}
+	defer connInfo.Release()
+	if connInfo.Record == nil {
+		connInfo.Record = &QueryRecord{}
 	}
-	resp, err := s.Responer.Response(connInfo)
+
+	resp, err := s.Handler().ServeDNS(connInfo)
 	if err != nil {
-		s.GoDNSLogger.Printf("Error generating response: %v", err)
+		s.GoDNSLogger.Debug("Error generating response", "client", connInfo.Address, "err", err)
+		s.Netter.Drop(connInfo)
 		return
 	}
-
-	s.Netter.Send(connInfo, resp)
-	if s.SeverConfig.EnebleCache {
-		s.Cacher.CacheResponse(resp)
+	if len(resp) == 0 {
+		// 处理链选择不回复该查询
+		s.Netter.Drop(connInfo)
+		return
 	}
+	s.Netter.Send(connInfo, resp)
+}
+
+// AddTransport 为 GoDNS 服务器添加一个传输层，需在 Start 之前调用
+func (s *GoDNSServer) AddTransport(t Transport) {
+	s.Netter.AddTransport(t)
 }
 
 // Start 启动 GoDNS 服务器
+// 服务器会遍历所有传输层进行监听，直至所有传输层均被关闭。
 func (s *GoDNSServer) Start() {
 	// GoDNS 启动！
-	s.GoDNSLogger.Printf("GoDNS Starts!")
+	s.GoDNSLogger.Info("GoDNS Starts!", "port", s.SeverConfig.Port)
+
+	s.handler = Chain(ResponserHandler(s.Responer), s.Middlewares...)
+
+	if s.Metrics != nil && s.SeverConfig.Metrics.Port != 0 {
+		go func() {
+			if err := s.Metrics.ListenAndServe(*s.SeverConfig.Metrics); err != nil {
+				s.GoDNSLogger.Error("Error serving metrics", "port", s.SeverConfig.Metrics.Port, "err", err)
+			}
+		}()
+	}
+
+	if s.CacheAdmin != nil && s.SeverConfig.CacheAdmin.Port != 0 {
+		go func() {
+			if err := s.CacheAdmin.ListenAndServe(*s.SeverConfig.CacheAdmin); err != nil {
+				s.GoDNSLogger.Error("Error serving cache admin", "port", s.SeverConfig.CacheAdmin.Port, "err", err)
+			}
+		}()
+	}
 
 	connChan := s.Netter.Sniff()
 	for connInfo := range connChan {
@@ -93,20 +244,89 @@ func (s *GoDNSServer) Start() {
 	}
 }
 
+// Stop 关闭所有传输层，使 Start 返回，并关闭 dnstap 输出、指标及缓存管理监听器和缓存后端
+func (s *GoDNSServer) Stop() error {
+	err := s.Netter.Close()
+	if s.Metrics != nil {
+		if merr := s.Metrics.Shutdown(); err == nil {
+			err = merr
+		}
+	}
+	if s.Dnstap != nil {
+		if derr := s.Dnstap.Close(); err == nil {
+			err = derr
+		}
+	}
+	if s.CacheAdmin != nil {
+		if aerr := s.CacheAdmin.Shutdown(); err == nil {
+			err = aerr
+		}
+	}
+	if cerr := s.Cacher.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // DNSServerConfig 记录 DNS 服务器的相关配置
 type DNSServerConfig struct {
 	// DNS 服务器的 IP 地址
 	IP net.IP
 	// DNS 服务器的端口
 	Port int
+	// UDP 及 TCP 的监听地址，为 nil 时监听所有地址
+	ListenIP net.IP
 
 	// 日志输出
 	LogWriter io.Writer
+	// 日志格式，LogFormatText（默认）或 LogFormatJSON
+	LogFormat string
+	// 自定义日志处理器，不为 nil 时忽略 LogWriter 与 LogFormat
+	LogHandler slog.Handler
+	// 各组件的日志级别，键为组件名（如 LogComponentNetter），未指定时为 Info
+	LogLevels map[string]slog.Level
 
 	// 线程池容量
 	PoolCapcity int
 
+	// UDP 配置，可启用多套接字（SO_REUSEPORT）及缓冲池
+	UDP UDPConfig
+	// 链接信息通道的缓冲区大小，为 0 时不带缓冲
+	QueueSize int
+
 	// 缓存功能
-	EnebleCache   bool
+	EnebleCache bool
+	// 缓存持久化层所在的目录，为空时仅使用内存缓存
 	CacheLocation string
+	// 内存缓存的条目数及字节数上限，详见 CacherConfig
+	CacheMaxEntries int
+	CacheMaxBytes   int
+	// 缓存键的组成，为 nil 时使用 DefaultCacheKeyConfig
+	CacheKey *CacheKeyConfig
+	// 过期缓存回复（RFC 8767），不为 nil 时在后端失败或超时时返回过期的缓存回复
+	CacheServeStale *ServeStaleConfig
+	// 缓存管理接口，不为 nil 时在 Port 上提供 HTTP 管理接口，详见 CacheAdmin
+	CacheAdmin *CacheAdminConfig
+	// 缓存的存储后端，如 MemoryCache、DiskCache 或 FileCache；
+	// 为 nil 时使用内存缓存，并在 CacheLocation 不为空时叠加磁盘持久化层；服务器停止时后端将被关闭
+	CacheBackend Cache
+
+	// DoH 配置，为 nil 时不启用 DoH
+	DoH *DoHConfig
+
+	// dnstap 配置，为 nil 时不输出 dnstap，输出无法创建时 NewGoDNSServerE 返回错误
+	Dnstap *DnstapConfig
+	// 抓包配置，为 nil 时不抓包
+	Capture *PcapConfig
+	// 指标配置，为 nil 时不记录指标，端口为 0 时仅记录而不启动 HTTP 监听器
+	Metrics *MetricsConfig
+	// 回复速率限制配置，为 nil 时不限制
+	RRL *RRLConfig
+	// 访问控制列表配置，为 nil 时允许所有查询
+	ACL *ACLConfig
+	// 故障注入配置，为 nil 时不注入故障
+	Faults *FaultConfig
+	// 视图配置，不为 nil 时由 ViewResponser 按视图选择 Responser；
+	// 其 Default 为 nil 时，以传入 NewGoDNSServer 的 Responser 作为默认 Responser
+	Views *ViewConfig
 }
@@ -0,0 +1,185 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// servestale.go 文件实现了 RFC 8767 所定义的过期缓存回复（serve-stale）。
+// 启用后，Cacher 会在条目过期后继续保留一段时间，
+// 当后端回复器返回错误、SERVFAIL 或在限定时间内未能回复时，
+// 以较短的 TTL 返回过期的缓存回复，并附带 Extended DNS Error 选项（信息代码 3）。
+
+package godns
+
+import (
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// 过期缓存回复的默认配置，取自 RFC 8767 第 5 节的建议值
+const (
+	DefaultStaleWindow    = 86400
+	DefaultStaleAnswerTTL = 30
+	DefaultStaleTimeout   = 1800 * time.Millisecond
+)
+
+// ServeStaleConfig 是过期缓存回复的配置
+type ServeStaleConfig struct {
+	// 条目过期后继续保留的时间（秒），默认为 DefaultStaleWindow
+	Window uint32
+	// 过期回复中记录的 TTL（秒），默认为 DefaultStaleAnswerTTL
+	AnswerTTL uint32
+	// 等待后端回复的时间，超时后若存在过期条目则直接返回，后端的回复仍会被写入缓存；
+	// 默认为 DefaultStaleTimeout，为负数时总是等待后端回复
+	Timeout time.Duration
+}
+
+// withDefaults 返回填充了默认值的配置
+func (conf ServeStaleConfig) withDefaults() ServeStaleConfig {
+	if conf.Window == 0 {
+		conf.Window = DefaultStaleWindow
+	}
+	if conf.AnswerTTL == 0 {
+		conf.AnswerTTL = DefaultStaleAnswerTTL
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultStaleTimeout
+	}
+	return conf
+}
+
+// staleExpired 判断条目在 now 时是否已超出过期缓存的保留期限
+func (c *Cacher) staleExpired(e *CacheEntry, now time.Time) bool {
+	if c.Stale == nil {
+		return e.Expired(now)
+	}
+	return now.Sub(e.Stored) >= time.Duration(e.TTL+c.Stale.Window)*time.Second
+}
+
+// FetchStale 返回该查询已过期但仍在保留期限内的缓存回复
+// 回复中记录的 TTL 均为 AnswerTTL；查询含有 OPT 记录时，
+// 回复会附带信息代码为 EDECodeStaleAnswer（NXDOMAIN 回复为 EDECodeStaleNXDomainAnswer）的 EDE 选项。
+// 未启用过期缓存回复，或者不存在可用的过期条目时，返回 ErrCacheMiss。
+func (c *Cacher) FetchStale(connInfo ConnectionInfo) ([]byte, error) {
+	if c.Stale == nil {
+		return []byte{}, ErrCacheMiss
+	}
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return []byte{}, err
+	}
+	ident, err := c.CacheKey(connInfo, qry)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	now := c.now()
+	entry, err := c.Cache.Get(ident)
+	if err != nil || !entry.Expired(now) || c.staleExpired(entry, now) {
+		return []byte{}, ErrCacheMiss
+	}
+
+	resp := dns.DNSMessage{}
+	if _, err := resp.DecodeFromBuffer(entry.Data, 0); err != nil {
+		c.CacherLogger.Error("Error decoding cached response", "key", ident, "err", err)
+		c.Cache.Delete(ident)
+		return []byte{}, err
+	}
+	for _, rrs := range [][]dns.DNSResourceRecord{resp.Answer, resp.Authority, resp.Additional} {
+		for i := range rrs {
+			if rrs[i].Type != dns.DNSRRTypeOPT {
+				rrs[i].TTL = c.Stale.AnswerTTL
+			}
+		}
+	}
+	resp.Header.ID = qry.Header.ID
+	resp.Header.RD = qry.Header.RD
+	resp.Question = qry.Question
+	resp.Header.QDCount = uint16(len(qry.Question))
+
+	// 仅向支持 EDNS(0) 的客户端附带 EDE 选项
+	var qryOPT *dns.DNSResourceRecord
+	for i := range qry.Additional {
+		if qry.Additional[i].Type == dns.DNSRRTypeOPT {
+			qryOPT = &qry.Additional[i]
+		}
+	}
+	if qryOPT != nil {
+		code := EDECodeStaleAnswer
+		if resp.Header.RCode == dns.DNSResponseCodeNXDomain {
+			code = EDECodeStaleNXDomainAnswer
+		}
+		if !AppendEDNSOption(&resp, ExtendedDNSError(code, "")) {
+			do := qryOPT.TTL&0x8000 != 0
+			resp.Additional = append(resp.Additional, *dns.NewDNSRROPT(1232, int(dns.SetDNSRROPTTTL(0, 0, do, 0)), &dns.DNSRDATAOPT{}))
+			AppendEDNSOption(&resp, ExtendedDNSError(code, ""))
+		}
+		FixCount(&resp)
+	}
+	c.CacherLogger.Debug("Serving stale cache", "key", ident, "age", now.Sub(entry.Stored).Truncate(time.Second))
+	return resp.Encode(), nil
+}
+
+// staleFailure 判断后端的回复是否应当以过期缓存回复替代
+func staleFailure(resp []byte, err error) bool {
+	return err != nil || len(resp) < 4 || dns.DNSResponseCode(resp[3]&0x0f) == dns.DNSResponseCodeServFail
+}
+
+// resolveOrStale 向后端查询并缓存其回复，后端失败或超时时返回过期的缓存回复
+// 其接受参数为：
+//   - next Handler，后端处理器
+//   - connInfo ConnectionInfo，查询的链接信息
+//
+// 返回值为：
+//   - []byte，DNS 回复
+//   - bool，回复是否来自过期缓存
+//   - error，后端返回的错误
+func (c *Cacher) resolveOrStale(next Handler, connInfo ConnectionInfo) ([]byte, bool, error) {
+	type result struct {
+		resp []byte
+		err  error
+	}
+	// 超时后后端仍在运行，需要使用独立的查询副本及记录
+	backend := connInfo
+	backend.Packet = append([]byte{}, connInfo.Packet...)
+	if connInfo.Record != nil {
+		rec := *connInfo.Record
+		backend.Record = &rec
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := next.ServeDNS(backend)
+		if err == nil && len(resp) > 0 {
+			c.CacheResponse(backend, resp)
+		}
+		done <- result{resp, err}
+	}()
+
+	var timeout <-chan time.Time
+	if c.Stale.Timeout > 0 {
+		timer := time.NewTimer(c.Stale.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-done:
+		if connInfo.Record != nil {
+			*connInfo.Record = *backend.Record
+		}
+		if staleFailure(r.resp, r.err) {
+			if stale, err := c.FetchStale(connInfo); err == nil {
+				c.CacherLogger.Info("Serving stale answer after backend failure", "err", r.err)
+				return stale, true, nil
+			}
+		}
+		return r.resp, false, r.err
+	case <-timeout:
+		if stale, err := c.FetchStale(connInfo); err == nil {
+			c.CacherLogger.Info("Serving stale answer after backend timeout", "timeout", c.Stale.Timeout)
+			return stale, true, nil
+		}
+		r := <-done
+		if connInfo.Record != nil {
+			*connInfo.Record = *backend.Record
+		}
+		return r.resp, false, r.err
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// servestale_test.go 文件定义了对 servestale.go 的单元测试
+
+package godns
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testStaleCacher 返回一个启用了过期缓存回复的 Cacher，及用于推进其时钟的函数
+func testStaleCacher(conf ServeStaleConfig) (*Cacher, func(time.Duration)) {
+	cacher := NewCacher(CacherConfig{Logger: discardLogger(), Stale: &conf}, nil)
+	var now atomic.Int64
+	now.Store(time.Unix(1700000000, 0).UnixNano())
+	cacher.now = func() time.Time { return time.Unix(0, now.Load()) }
+	return cacher, func(d time.Duration) { now.Add(int64(d)) }
+}
+
+// testStaleEDE 返回回复中 EDE 选项的信息代码
+func testStaleEDE(t *testing.T, resp []byte) (uint16, bool) {
+	t.Helper()
+	msg := dns.DNSMessage{}
+	if _, err := msg.DecodeFromBuffer(resp, 0); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	for _, opt := range EDNSOptions(msg) {
+		if opt.OptionCode == EDNSOptionCodeEDE && len(opt.OptionData) >= 2 {
+			return binary.BigEndian.Uint16(opt.OptionData), true
+		}
+	}
+	return 0, false
+}
+
+// TestServeStale 测试后端失败时返回过期的缓存回复
+func TestServeStale(t *testing.T) {
+	cacher, advance := testStaleCacher(ServeStaleConfig{Window: 600, Timeout: -1})
+	cacher.CacheResponse(testAnswerConn(1, "www.example.com", 60))
+
+	var backendErr error
+	var backendResp []byte
+	handler := Chain(HandlerFunc(func(ConnectionInfo) ([]byte, error) {
+		return backendResp, backendErr
+	}), CacheMiddleware(cacher))
+
+	// 过期后的条目不再命中缓存，但在保留期限内仍可作为过期回复
+	advance(120 * time.Second)
+	if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false)}); err != ErrCacheMiss {
+		t.Errorf("expired entry got: %v, expected: %v", err, ErrCacheMiss)
+	}
+
+	cases := []struct {
+		name string
+		resp []byte
+		err  error
+	}{
+		{"error", nil, errors.New("upstream unreachable")},
+		{"servfail", func() []byte {
+			resp := testAnswer(2, "www.example.com")
+			resp[3] = resp[3]&0xf0 | byte(dns.DNSResponseCodeServFail)
+			return resp
+		}(), nil},
+	}
+	for _, c := range cases {
+		backendResp, backendErr = c.resp, c.err
+		rec := &QueryRecord{}
+		resp, err := handler.ServeDNS(ConnectionInfo{Packet: testQuery(0x4242, "www.example.com", dns.DNSRRTypeA, 1232, false), Record: rec})
+		if err != nil {
+			t.Fatalf("%s: stale answer got error: %v", c.name, err)
+		}
+		msg := dns.DNSMessage{}
+		msg.DecodeFromBuffer(resp, 0)
+		if msg.Header.ID != 0x4242 || len(msg.Answer) != 1 {
+			t.Fatalf("%s: stale answer got: ID %#x, %d answers, expected: ID 0x4242, 1 answer", c.name, msg.Header.ID, len(msg.Answer))
+		}
+		if msg.Answer[0].TTL != DefaultStaleAnswerTTL {
+			t.Errorf("%s: stale answer TTL got: %d, expected: %d", c.name, msg.Answer[0].TTL, DefaultStaleAnswerTTL)
+		}
+		if code, ok := testStaleEDE(t, resp); !ok || code != EDECodeStaleAnswer {
+			t.Errorf("%s: EDE got: %d %v, expected: %d", c.name, code, ok, EDECodeStaleAnswer)
+		}
+		if !rec.CacheStale {
+			t.Errorf("%s: QueryRecord.CacheStale got: false, expected: true", c.name)
+		}
+	}
+
+	// 不含 OPT 记录的查询不附带 EDE 选项
+	backendResp, backendErr = nil, errors.New("upstream unreachable")
+	resp, err := handler.ServeDNS(ConnectionInfo{Packet: testQuery(3, "www.example.com", dns.DNSRRTypeA, 0, false)})
+	if err != nil {
+		t.Fatalf("stale answer without EDNS got error: %v", err)
+	}
+	if _, ok := testStaleEDE(t, resp); ok {
+		t.Errorf("EDE in answer to a query without EDNS got: present, expected: absent")
+	}
+
+	// 超出保留期限后返回后端的错误，条目被删除
+	advance(600 * time.Second)
+	if _, err := handler.ServeDNS(ConnectionInfo{Packet: testQuery(4, "www.example.com", dns.DNSRRTypeA, 0, false)}); err == nil {
+		t.Errorf("error after the stale window got: nil, expected: backend error")
+	}
+	if n := cacher.Cache.Stats().Entries; n != 0 {
+		t.Errorf("entries after the stale window got: %d, expected: 0", n)
+	}
+}
+
+// TestServeStaleTimeout 测试后端超时时返回过期回复，后端稍后的回复仍会刷新缓存
+func TestServeStaleTimeout(t *testing.T) {
+	cacher, advance := testStaleCacher(ServeStaleConfig{Timeout: 20 * time.Millisecond})
+	cacher.CacheResponse(testAnswerConn(1, "www.example.com", 60))
+	advance(120 * time.Second)
+
+	release := make(chan struct{})
+	refreshed := make(chan struct{})
+	handler := Chain(HandlerFunc(func(connInfo ConnectionInfo) ([]byte, error) {
+		<-release
+		return testAnswer(0, "www.example.com", 300), nil
+	}), CacheMiddleware(cacher))
+
+	start := time.Now()
+	resp, err := handler.ServeDNS(ConnectionInfo{Packet: testQuery(7, "www.example.com", dns.DNSRRTypeA, 1232, false)})
+	if err != nil {
+		t.Fatalf("stale answer after timeout got error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stale answer latency got: %v, expected: about the timeout", elapsed)
+	}
+	if code, ok := testStaleEDE(t, resp); !ok || code != EDECodeStaleAnswer {
+		t.Errorf("EDE got: %d %v, expected: %d", code, ok, EDECodeStaleAnswer)
+	}
+
+	// 后端回复后刷新缓存
+	close(release)
+	go func() {
+		for {
+			if _, err := cacher.FetchCache(ConnectionInfo{Packet: testQuery(8, "www.example.com", dns.DNSRRTypeA, 0, false)}); err == nil {
+				close(refreshed)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("cache was not refreshed by the late backend response")
+	}
+}
+
+// TestServeStaleNXDomain 测试过期的 NXDOMAIN 回复附带信息代码 19
+func TestServeStaleNXDomain(t *testing.T) {
+	cacher, advance := testStaleCacher(ServeStaleConfig{})
+	qry := dns.DNSMessage{}
+	qry.DecodeFromBuffer(testQuery(1, "nx.example.com", dns.DNSRRTypeA, 0, false), 0)
+	nx := testNXDOMAIN(qry)
+	cacher.CacheResponse(ConnectionInfo{Packet: testQuery(1, "nx.example.com", dns.DNSRRTypeA, 0, false)}, nx.Encode())
+	advance(time.Hour)
+
+	resp, err := cacher.FetchStale(ConnectionInfo{Packet: testQuery(2, "nx.example.com", dns.DNSRRTypeA, 1232, false)})
+	if err != nil {
+		t.Fatalf("FetchStale failed: %v", err)
+	}
+	if code, ok := testStaleEDE(t, resp); !ok || code != EDECodeStaleNXDomainAnswer {
+		t.Errorf("EDE got: %d %v, expected: %d", code, ok, EDECodeStaleNXDomainAnswer)
+	}
+	msg := dns.DNSMessage{}
+	msg.DecodeFromBuffer(resp, 0)
+	if msg.Header.RCode != dns.DNSResponseCodeNXDomain || msg.Authority[0].TTL != DefaultStaleAnswerTTL {
+		t.Errorf("stale NXDOMAIN got: %v TTL %d, expected: NXDOMAIN TTL %d", msg.Header.RCode, msg.Authority[0].TTL, DefaultStaleAnswerTTL)
+	}
+}
+
+// TestAppendEDNSOption 测试向 OPT 记录追加选项
+func TestAppendEDNSOption(t *testing.T) {
+	msg := dns.DNSMessage{}
+	if AppendEDNSOption(&msg, ExtendedDNSError(EDECodeStaleAnswer, "")) {
+		t.Errorf("AppendEDNSOption without OPT got: true, expected: false")
+	}
+	msg.DecodeFromBuffer(testQuery(1, "www.example.com", dns.DNSRRTypeA, 1232, true), 0)
+	AppendEDNSOption(&msg, dns.DNSRDATAOPT{OptionCode: 10, OptionLength: 8, OptionData: []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	AppendEDNSOption(&msg, ExtendedDNSError(EDECodeStaleAnswer, "stale"))
+
+	decoded := dns.DNSMessage{}
+	if _, err := decoded.DecodeFromBuffer(msg.Encode(), 0); err != nil {
+		t.Fatalf("error decoding message: %v", err)
+	}
+	opts := EDNSOptions(decoded)
+	if len(opts) != 2 || opts[0].OptionCode != 10 || opts[1].OptionCode != EDNSOptionCodeEDE || string(opts[1].OptionData[2:]) != "stale" {
+		t.Errorf("options got: %v, expected: COOKIE followed by EDE", opts)
+	}
+}
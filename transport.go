@@ -0,0 +1,404 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// transport.go 文件定义了 Transport 接口及 UDP、TCP 两种传输层实现。
+// Netter 会遍历其持有的所有 Transport，
+// 因此可以通过实现 Transport 接口来添加新的传输方式（如内存、TLS、HTTPS、pcap 回放等），
+// 而无需修改 netter.go。
+
+package godns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/panjf2000/ants/v2"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Transport 是一个传输层接口。
+// 实现该接口的结构体负责监听查询，并将回复发送给客户端。
+type Transport interface {
+	// Listen 开始监听，并将收到的查询投递到链接信息通道中。
+	// 投递的 ConnectionInfo 的 Transport 字段应指向该传输层本身。
+	// 该方法会一直阻塞，直至传输层被关闭（返回 nil）或出现错误。
+	Listen(connChan chan<- ConnectionInfo) error
+
+	// Reply 将回复发送给链接信息所对应的客户端。
+	Reply(connInfo ConnectionInfo, data []byte) error
+
+	// Close 关闭传输层，使 Listen 返回。
+	Close() error
+}
+
+// UDPConfig 记录 UDP 传输层的配置
+type UDPConfig struct {
+	// Sockets 为使用 SO_REUSEPORT 绑定同一端口的套接字数量，每个套接字拥有独立的读取协程。
+	// 小于等于 1，或当前平台不支持 SO_REUSEPORT（非 Linux）时，仅使用单个套接字。
+	Sockets int
+
+	// PoolBuffers 为 true 时，ConnectionInfo.Packet 将从缓冲池中分配，
+	// 并在查询处理完毕后（ConnectionInfo.Release）归还。
+	// 启用后，Responser 不应在返回后继续持有 Packet。
+	PoolBuffers bool
+
+	// BatchSize 大于 1 时，在 Linux 上使用 recvmmsg/sendmmsg 批量收发数据包，
+	// 每批至多 BatchSize 个；其他平台上回退为逐包收发。
+	BatchSize int
+}
+
+// pooledPacketSize 是缓冲池中数据包缓冲区的容量，超出该大小的数据包将单独分配
+const pooledPacketSize = 4096
+
+// packetPool 是 UDP 数据包的接收缓冲池
+var packetPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, pooledPacketSize)
+		return &buf
+	},
+}
+
+// listenAddr 返回监听地址，ip 为 nil 时监听所有地址
+func listenAddr(ip net.IP, port int) string {
+	if ip == nil {
+		return fmt.Sprintf(":%d", port)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// UDPTransport 是基于 UDP 的传输层实现。
+type UDPTransport struct {
+	// 监听端口
+	Port int
+	// 监听地址，为 nil 时监听所有地址
+	IP net.IP
+	// UDP 配置
+	Config UDPConfig
+	// 日志
+	UDPLogger *slog.Logger
+
+	mu       sync.Mutex
+	pktConns []net.PacketConn
+}
+
+// NewUDPTransport 创建一个监听指定端口的 UDP 传输层
+func NewUDPTransport(port int, conf UDPConfig, logger *slog.Logger) *UDPTransport {
+	return &UDPTransport{
+		Port:      port,
+		Config:    conf,
+		UDPLogger: logger,
+	}
+}
+
+// Listen 监听 UDP 端口，并将收到的数据包投递到链接信息通道中。
+// 配置了多个套接字时，每个套接字均由一个独立的读取协程处理。
+func (t *UDPTransport) Listen(connChan chan<- ConnectionInfo) error {
+	sockets := t.Config.Sockets
+	if sockets > 1 && !reusePortSupported {
+		t.UDPLogger.Warn("SO_REUSEPORT is not supported on this platform, using a single socket")
+	}
+	if sockets < 1 || !reusePortSupported {
+		sockets = 1
+	}
+	batch := t.Config.BatchSize > 1
+	if batch && !batchSupported {
+		t.UDPLogger.Warn("Batched udp I/O is not supported on this platform, falling back")
+		batch = false
+	}
+
+	lc := net.ListenConfig{}
+	if sockets > 1 {
+		lc.Control = reusePortControl
+	}
+
+	port := t.Port
+	pktConns := make([]net.PacketConn, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		pktConn, err := lc.ListenPacket(context.Background(), "udp", listenAddr(t.IP, port))
+		if err != nil {
+			for _, c := range pktConns {
+				c.Close()
+			}
+			return fmt.Errorf("error listening on udp port: %v", err)
+		}
+		// 未指定端口时，其余套接字绑定到第一个套接字所分配的端口上
+		port = pktConn.LocalAddr().(*net.UDPAddr).Port
+		pktConns = append(pktConns, pktConn)
+	}
+	t.mu.Lock()
+	t.pktConns = pktConns
+	t.mu.Unlock()
+
+	errChan := make(chan error, sockets)
+	for _, pktConn := range pktConns {
+		if batch {
+			go func() { errChan <- t.handlePktConnBatch(pktConn, connChan) }()
+		} else {
+			go func() { errChan <- t.handlePktConn(pktConn, connChan) }()
+		}
+	}
+	var err error
+	for i := 0; i < sockets; i++ {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Addr 返回 UDP 传输层实际监听的地址，尚未开始监听时返回 nil
+func (t *UDPTransport) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pktConns) == 0 {
+		return nil
+	}
+	return t.pktConns[0].LocalAddr()
+}
+
+// handlePktConn 函数用于处理 数据包 链接
+// 其接收参数为：
+//   - pktConn: net.PacketConn，数据包链接
+//   - connChan: chan<- ConnectionInfo，链接信息通道
+//
+// 该函数将会读取 数据包链接 中的数据，并将其发送到链接信息通道中
+func (t *UDPTransport) handlePktConn(pktConn net.PacketConn, connChan chan<- ConnectionInfo) error {
+	buf := make([]byte, 65535)
+	parseDst := dstControl(pktConn)
+	udpConn, ok := pktConn.(*net.UDPConn)
+	if !ok {
+		parseDst = nil
+	}
+	oob := make([]byte, dstControlSize)
+	for {
+		var sz int
+		var addr, local net.Addr
+		var err error
+		if parseDst != nil {
+			var oobn int
+			var uAddr *net.UDPAddr
+			sz, oobn, _, uAddr, err = udpConn.ReadMsgUDP(buf, oob)
+			addr = uAddr
+			local = parseDst(oob[:oobn])
+		} else {
+			sz, addr, err = pktConn.ReadFrom(buf)
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("error reading udp packet: %v", err)
+		}
+
+		connInfo := ConnectionInfo{
+			Protocol:     ProtocolUDP,
+			Address:      addr,
+			LocalAddress: local,
+			PacketConn:   pktConn,
+			Transport:    t,
+		}
+		if t.Config.PoolBuffers && sz <= pooledPacketSize {
+			connInfo.pooled = packetPool.Get().(*[]byte)
+			connInfo.Packet = (*connInfo.pooled)[:sz]
+		} else {
+			connInfo.Packet = make([]byte, sz)
+		}
+		copy(connInfo.Packet, buf[:sz])
+
+		connChan <- connInfo
+	}
+}
+
+// dstControlSize 是接收目的地址控制消息所需的缓冲区大小
+var dstControlSize = len(ipv6.NewControlMessage(ipv6.FlagDst))
+
+// dstControl 为监听未指定地址的数据包链接开启目的地址控制消息（IP_PKTINFO / IPV6_PKTINFO），
+// 并返回从控制消息中解析出接收数据包的本地地址的函数。
+// 链接绑定了具体地址（其即为本地地址）或当前平台不支持控制消息时返回 nil。
+// 解析函数在控制消息中没有目的地址时返回 nil。
+func dstControl(pktConn net.PacketConn) func(oob []byte) net.Addr {
+	local, ok := pktConn.LocalAddr().(*net.UDPAddr)
+	if !ok || !local.IP.IsUnspecified() {
+		return nil
+	}
+	toAddr := func(ip net.IP) net.Addr {
+		if ip == nil {
+			return nil
+		}
+		return &net.UDPAddr{IP: ip, Port: local.Port}
+	}
+	if local.IP.To4() != nil {
+		if err := ipv4.NewPacketConn(pktConn).SetControlMessage(ipv4.FlagDst, true); err != nil {
+			return nil
+		}
+		return func(oob []byte) net.Addr {
+			var cm ipv4.ControlMessage
+			if cm.Parse(oob) != nil {
+				return nil
+			}
+			return toAddr(cm.Dst)
+		}
+	}
+	// 监听 ":port" 时为双栈套接字，IPv4 数据包的目的地址以 IPv4 映射地址的形式给出
+	if err := ipv6.NewPacketConn(pktConn).SetControlMessage(ipv6.FlagDst, true); err != nil {
+		return nil
+	}
+	return func(oob []byte) net.Addr {
+		var cm ipv6.ControlMessage
+		if cm.Parse(oob) != nil {
+			return nil
+		}
+		return toAddr(cm.Dst)
+	}
+}
+
+// Reply 将回复以 UDP 数据包的形式发送给客户端
+func (t *UDPTransport) Reply(connInfo ConnectionInfo, data []byte) error {
+	_, err := connInfo.PacketConn.WriteTo(data, connInfo.Address)
+	if err != nil {
+		return fmt.Errorf("error writing udp packet: %v", err)
+	}
+	return nil
+}
+
+// Close 关闭所有 UDP 套接字
+func (t *UDPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	for _, pktConn := range t.pktConns {
+		if e := pktConn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// TCPTransport 是基于 TCP 的传输层实现。
+// 每个 TCP 链接仅处理一个查询，回复后即关闭链接。
+type TCPTransport struct {
+	// 监听端口
+	Port int
+	// 监听地址，为 nil 时监听所有地址
+	IP net.IP
+	// 日志
+	TCPLogger *slog.Logger
+
+	mu   sync.Mutex
+	lstr net.Listener
+}
+
+// NewTCPTransport 创建一个监听指定端口的 TCP 传输层
+func NewTCPTransport(port int, logger *slog.Logger) *TCPTransport {
+	return &TCPTransport{
+		Port:      port,
+		TCPLogger: logger,
+	}
+}
+
+// Listen 监听 TCP 端口，接受链接并将其中的查询投递到链接信息通道中。
+func (t *TCPTransport) Listen(connChan chan<- ConnectionInfo) error {
+	lstr, err := net.Listen("tcp", listenAddr(t.IP, t.Port))
+	if err != nil {
+		return fmt.Errorf("error listening on tcp port: %v", err)
+	}
+	t.mu.Lock()
+	t.lstr = lstr
+	t.mu.Unlock()
+
+	for {
+		conn, err := lstr.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			t.TCPLogger.Error("Error accepting tcp connection", "err", err)
+			continue
+		}
+		ants.Submit(func() { t.handleStreamConn(conn, connChan) })
+	}
+}
+
+// handleStreamConn 函数用于处理 流式链接
+// 其接收参数为：
+//   - conn: net.Conn，流式链接
+//   - connChan: chan<- ConnectionInfo，链接信息通道
+//
+// 该函数将会读取 流式链接 中以两字节长度为前缀的 DNS 消息，并将其发送到链接信息通道中
+func (t *TCPTransport) handleStreamConn(conn net.Conn, connChan chan<- ConnectionInfo) {
+	pkt, err := ReadStreamMessage(conn)
+	if err != nil {
+		t.TCPLogger.Debug("Error reading tcp packet", "client", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	connChan <- ConnectionInfo{
+		Protocol:   ProtocolTCP,
+		Address:    conn.RemoteAddr(),
+		StreamConn: conn,
+		Transport:  t,
+		Packet:     pkt,
+	}
+}
+
+// Reply 将带有两字节长度前缀的回复写入 TCP 链接，并关闭链接
+func (t *TCPTransport) Reply(connInfo ConnectionInfo, data []byte) error {
+	defer connInfo.StreamConn.Close()
+	if len(data) > 0xffff {
+		t.TCPLogger.Warn("TCP packet size exceeds 0xffff, truncating to 0xffff", "size", len(data))
+	}
+	return WriteStreamMessage(connInfo.StreamConn, data)
+}
+
+// Addr 返回 TCP 传输层实际监听的地址，尚未开始监听时返回 nil
+func (t *TCPTransport) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lstr == nil {
+		return nil
+	}
+	return t.lstr.Addr()
+}
+
+// Close 关闭 TCP 监听器
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lstr == nil {
+		return nil
+	}
+	return t.lstr.Close()
+}
+
+// ReadStreamMessage 从流式链接中读取一个以两字节长度为前缀的 DNS 消息
+func ReadStreamMessage(r io.Reader) ([]byte, error) {
+	lenByte := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenByte); err != nil {
+		return nil, err
+	}
+	pkt := make([]byte, binary.BigEndian.Uint16(lenByte))
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// WriteStreamMessage 向流式链接中写入一个以两字节长度为前缀的 DNS 消息。
+// 消息长度超过 0xffff 时会被截断。
+func WriteStreamMessage(w io.Writer, data []byte) error {
+	if len(data) > 0xffff {
+		data = data[:0xffff]
+	}
+	lenByte := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(lenByte, uint16(len(data)))
+	_, err := w.Write(append(lenByte, data...))
+	return err
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// transport_test.go 文件定义了对 transport.go 的单元测试
+
+package godns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestStreamMessage 测试 WriteStreamMessage 与 ReadStreamMessage 的往返编解码
+func TestStreamMessage(t *testing.T) {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01}
+	buf := bytes.Buffer{}
+	if err := WriteStreamMessage(&buf, msg); err != nil {
+		t.Fatalf("WriteStreamMessage failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes()[:2], []byte{0x00, 0x06}) {
+		t.Errorf("length prefix got: %v, expected: [0 6]", buf.Bytes()[:2])
+	}
+
+	got, err := ReadStreamMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadStreamMessage failed: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("ReadStreamMessage got: %v, expected: %v", got, msg)
+	}
+
+	// 数据不完整
+	buf.Write([]byte{0x00, 0x06, 0x12})
+	if _, err := ReadStreamMessage(&buf); err == nil {
+		t.Error("ReadStreamMessage expected an error but got nil")
+	}
+}
+
+// waitAddr 等待传输层开始监听，并返回其监听地址
+func waitAddr(t *testing.T, addr func() net.Addr) net.Addr {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if a := addr(); a != nil {
+			return a
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("transport did not start listening")
+	return nil
+}
+
+// TestUDPTransportSockets 测试多套接字及缓冲池模式下的 UDP 传输层
+func TestUDPTransportSockets(t *testing.T) {
+	testUDPEcho(t, UDPConfig{Sockets: 4, PoolBuffers: true})
+}
+
+// TestUDPTransportBatch 测试批量收发模式下的 UDP 传输层，非 Linux 平台上将回退为逐包收发
+func TestUDPTransportBatch(t *testing.T) {
+	testUDPEcho(t, UDPConfig{Sockets: 2, PoolBuffers: true, BatchSize: 16})
+}
+
+// testUDPEcho 以指定配置启动 UDP 传输层，并测试其能否正确收发数据包
+func testUDPEcho(t *testing.T, conf UDPConfig) {
+	tp := NewUDPTransport(0, conf, discardLogger())
+	connChan := make(chan ConnectionInfo, 16)
+	errChan := make(chan error, 1)
+	go func() { errChan <- tp.Listen(connChan) }()
+
+	port := waitAddr(t, tp.Addr).(*net.UDPAddr).Port
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		msg := []byte{byte(i), 0x01, 0x02, 0x03}
+		conn.Write(msg)
+
+		connInfo := <-connChan
+		if !bytes.Equal(connInfo.Packet, msg) {
+			t.Errorf("packet got: %v, expected: %v", connInfo.Packet, msg)
+		}
+		// 监听未指定地址时，本地地址从控制消息中获取
+		if ip, _ := connInfo.localAddr(); runtime.GOOS == "linux" && !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("local address got: %v, expected: 127.0.0.1", ip)
+		}
+		if err := tp.Reply(connInfo, connInfo.Packet); err != nil {
+			t.Errorf("Reply failed: %v", err)
+		}
+		connInfo.Release()
+
+		buf := make([]byte, 512)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		sz, err := conn.Read(buf)
+		if err != nil || !bytes.Equal(buf[:sz], msg) {
+			t.Errorf("reply got: %v (%v), expected: %v", buf[:sz], err, msg)
+		}
+		conn.Close()
+	}
+
+	tp.Close()
+	if err := <-errChan; err != nil {
+		t.Errorf("Listen returned error after Close: %v", err)
+	}
+}
+
+// BenchmarkUDPTransport 比较逐包收发与批量收发模式下 UDP 传输层的吞吐量
+func BenchmarkUDPTransport(b *testing.B) {
+	b.Run("ReadFrom", func(b *testing.B) { benchmarkUDPEcho(b, UDPConfig{}) })
+	b.Run("ReadBatch", func(b *testing.B) { benchmarkUDPEcho(b, UDPConfig{BatchSize: 64}) })
+}
+
+// benchmarkUDPEcho 由客户端持续发送查询，传输层将查询原样回复，统计每秒收到的回复数量。
+// 客户端最多同时保持 window 个未回复的查询，超时未回复的查询视为丢失。
+func benchmarkUDPEcho(b *testing.B, conf UDPConfig) {
+	conf.PoolBuffers = true
+	tp := NewUDPTransport(0, conf, discardLogger())
+	connChan := make(chan ConnectionInfo, 1024)
+	listenDone := make(chan struct{})
+	go func() {
+		tp.Listen(connChan)
+		close(listenDone)
+	}()
+	// 先关闭传输层并等待 Listen 返回，再关闭通道，以免仍在接收的协程向已关闭的通道发送
+	defer func() {
+		tp.Close()
+		<-listenDone
+		close(connChan)
+	}()
+
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		addr = tp.Addr()
+		time.Sleep(time.Millisecond)
+	}
+	if addr == nil {
+		b.Fatal("transport did not start listening")
+	}
+	go func() {
+		for connInfo := range connChan {
+			tp.Reply(connInfo, connInfo.Packet)
+			connInfo.Release()
+		}
+	}()
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", addr.(*net.UDPAddr).Port))
+	if err != nil {
+		b.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	const window = 256
+	tokens := make(chan struct{}, window)
+	received := 0
+	sent := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 512)
+		for received < b.N {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := conn.Read(buf); err != nil {
+				// 超时：视为窗口内的查询全部丢失，释放窗口
+				for len(tokens) > 0 {
+					<-tokens
+				}
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					return
+				}
+				select {
+				case <-sent:
+					// 查询已全部发出，剩余的查询视为丢失
+					return
+				default:
+				}
+				continue
+			}
+			received++
+			select {
+			case <-tokens:
+			default:
+			}
+		}
+	}()
+
+	msg := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		select {
+		case tokens <- struct{}{}:
+		case <-done:
+			i = b.N
+			continue
+		}
+		conn.Write(msg)
+	}
+	close(sent)
+	<-done
+	b.StopTimer()
+	b.ReportMetric(float64(received)/b.Elapsed().Seconds(), "replies/s")
+}
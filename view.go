@@ -0,0 +1,178 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// view.go 文件实现了分离视图（Split-horizon）。
+// ViewResponser 按照客户端地址、网络协议、EDNS Client Subnet、TSIG 密钥名称
+// 或接收查询的本地地址，从多个子 Responser 中选择一个生成回复，
+// 从而使不同的客户端对同一名称得到不同的回答。
+
+package godns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// View 是一个视图：匹配条件及该视图使用的 Responser。
+// 视图的各个条件同时满足时匹配，为空的条件匹配任意查询。
+type View struct {
+	// 视图名称，会被记录在 QueryRecord 中
+	Name string
+
+	// 客户端地址所在的网段
+	Networks []*net.IPNet
+	// 网络协议
+	Protocols []Protocol
+	// EDNS Client Subnet 地址所在的网段，查询不含 ECS 选项时不匹配
+	ClientSubnets []*net.IPNet
+	// TSIG 密钥名称（不校验签名），查询不含 TSIG 记录时不匹配
+	TSIGKeys []string
+	// 接收查询的本地地址所在的网段，无法获知本地地址时不匹配。
+	// UDP 监听未指定地址时，本地地址从控制消息（IP_PKTINFO）中获取，
+	// 当前平台不支持时须通过 ListenIP 绑定具体地址
+	Destinations []*net.IPNet
+
+	// 该视图使用的 Responser
+	Responser Responser
+}
+
+// ViewConfig 记录视图的配置
+type ViewConfig struct {
+	// 视图列表，按顺序匹配，以第一个匹配的视图为准
+	Views []View
+	// 没有视图匹配时使用的 Responser，为 nil 时回复 REFUSED
+	Default Responser
+}
+
+// ViewResponser 是一个按照视图选择子 Responser 的回复器
+type ViewResponser struct {
+	Config ViewConfig
+}
+
+// NewViewResponser 创建一个视图回复器
+// 其接受参数为：
+//   - conf ViewConfig，视图配置
+func NewViewResponser(conf ViewConfig) *ViewResponser {
+	return &ViewResponser{Config: conf}
+}
+
+// viewQuery 记录视图匹配所需的查询属性
+type viewQuery struct {
+	client    net.IP
+	local     net.IP
+	protocol  Protocol
+	subnet    *net.IPNet
+	tsigKey   string
+	hasSubnet bool
+}
+
+// newViewQuery 从链接信息及解析后的查询中提取视图匹配所需的属性
+func newViewQuery(connInfo ConnectionInfo, qry dns.DNSMessage) viewQuery {
+	q := viewQuery{protocol: connInfo.Protocol}
+	q.client, _ = addrIPPort(connInfo.Address)
+	q.local, _ = connInfo.localAddr()
+	q.subnet, q.hasSubnet = ClientSubnet(qry)
+	// TSIG 记录须为附加部分的最后一条记录，详见 RFC 8945 5.1 节
+	if n := len(qry.Additional); n > 0 && qry.Additional[n-1].Type == dns.DNSRRTypeTSIG {
+		q.tsigKey = strings.ToLower(strings.TrimSuffix(qry.Additional[n-1].Name, "."))
+	}
+	return q
+}
+
+// containsIP 判断 IP 地址是否位于任一网段中
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// match 判断视图是否匹配该查询
+func (v *View) match(q viewQuery) bool {
+	if len(v.Networks) > 0 && !containsIP(v.Networks, q.client) {
+		return false
+	}
+	if len(v.Protocols) > 0 {
+		matched := false
+		for _, p := range v.Protocols {
+			if p == q.protocol {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(v.ClientSubnets) > 0 && (!q.hasSubnet || !containsIP(v.ClientSubnets, q.subnet.IP)) {
+		return false
+	}
+	if len(v.TSIGKeys) > 0 {
+		matched := false
+		for _, key := range v.TSIGKeys {
+			if q.tsigKey != "" && strings.EqualFold(strings.TrimSuffix(key, "."), q.tsigKey) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(v.Destinations) > 0 && !containsIP(v.Destinations, q.local) {
+		return false
+	}
+	return true
+}
+
+// Select 返回匹配该查询的第一个视图，没有视图匹配时返回 nil
+// 其接受参数为：
+//   - connInfo ConnectionInfo，链接信息
+//
+// 返回值为：
+//   - *View，匹配的视图
+//   - error，查询无法解析时返回的错误信息
+func (r *ViewResponser) Select(connInfo ConnectionInfo) (*View, error) {
+	qry, err := ParseQuery(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	q := newViewQuery(connInfo, qry)
+	for i := range r.Config.Views {
+		if r.Config.Views[i].match(q) {
+			return &r.Config.Views[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Response 根据匹配的视图生成 DNS 回复信息，并将视图名称记录在 QueryRecord 中
+func (r *ViewResponser) Response(connInfo ConnectionInfo) ([]byte, error) {
+	view, err := r.Select(connInfo)
+	if err != nil {
+		return []byte{}, err
+	}
+	if view != nil {
+		if connInfo.Record != nil {
+			connInfo.Record.View = view.Name
+		}
+		if view.Responser == nil {
+			return []byte{}, fmt.Errorf("view %q has no responser", view.Name)
+		}
+		return view.Responser.Response(connInfo)
+	}
+
+	if r.Config.Default != nil {
+		return r.Config.Default.Response(connInfo)
+	}
+	qry, _ := ParseQuery(connInfo)
+	resp := InitRefused(qry)
+	return resp.Encode(), nil
+}
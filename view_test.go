@@ -0,0 +1,153 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// view_test.go 文件定义了对 view.go 及 edns.go 的单元测试
+
+package godns
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// testViewQuery 返回一个 A 记录查询，可以附带 ECS 选项及 TSIG 记录
+func testViewQuery(ecs []byte, tsigKey string) []byte {
+	qry := dns.DNSMessage{}
+	qry.DecodeFromBuffer(testQuery(1, "www.example.com", dns.DNSRRTypeA, 0, false), 0)
+	if ecs != nil {
+		// ECS 之前放置一个 Cookie 选项，以测试多个选项的切分
+		data := []byte{0x00, 0x0a, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 7, 8}
+		data = append(data, 0x00, 0x08, 0x00, byte(len(ecs)))
+		data = append(data, ecs...)
+		opt := dns.DNSRDATAOPT{}
+		if _, err := opt.DecodeFromBuffer(data, 0, len(data)); err != nil {
+			panic(err)
+		}
+		qry.Additional = append(qry.Additional, *dns.NewDNSRROPT(1232, 0, &opt))
+	}
+	if tsigKey != "" {
+		qry.Additional = append(qry.Additional, dns.DNSResourceRecord{
+			Name: tsigKey, Type: dns.DNSRRTypeTSIG, Class: dns.DNSClassANY,
+			RData: &dns.DNSRDATAUnknown{RRType: dns.DNSRRTypeTSIG, RData: []byte{0}},
+		})
+	}
+	FixCount(&qry)
+	return qry.Encode()
+}
+
+// TestClientSubnet 测试 ECS 选项的解析
+func TestClientSubnet(t *testing.T) {
+	msg := dns.DNSMessage{}
+	msg.DecodeFromBuffer(testViewQuery([]byte{0x00, 0x01, 24, 0, 198, 51, 100}, ""), 0)
+	subnet, ok := ClientSubnet(msg)
+	if !ok || subnet.String() != "198.51.100.0/24" {
+		t.Errorf("ClientSubnet got: %v %v, expected: 198.51.100.0/24", subnet, ok)
+	}
+	if opts := EDNSOptions(msg); len(opts) != 2 || opts[0].OptionCode != 10 {
+		t.Errorf("EDNSOptions got: %v, expected: cookie and ECS", opts)
+	}
+}
+
+// TestViewResponser 测试按照各个条件选择视图
+func TestViewResponser(t *testing.T) {
+	lab, _ := ParseCIDRs("10.0.0.0/8")
+	ecsNet, _ := ParseCIDRs("198.51.100.0/24")
+	dst, _ := ParseCIDRs("192.0.2.53")
+	responser := func(ip net.IP) Responser {
+		return &DullResponser{ServerConf: DNSServerConfig{IP: ip}}
+	}
+	vr := NewViewResponser(ViewConfig{
+		Views: []View{
+			{Name: "tsig", TSIGKeys: []string{"lab-key."}, Responser: responser(net.IPv4(1, 1, 1, 1))},
+			{Name: "ecs", ClientSubnets: ecsNet, Responser: responser(net.IPv4(2, 2, 2, 2))},
+			{Name: "lab-tcp", Networks: lab, Protocols: []Protocol{ProtocolTCP}, Responser: responser(net.IPv4(3, 3, 3, 3))},
+			{Name: "dst", Destinations: dst, Responser: responser(net.IPv4(4, 4, 4, 4))},
+		},
+	})
+
+	cases := []struct {
+		protocol Protocol
+		client   net.IP
+		local    net.Addr
+		packet   []byte
+		view     string
+	}{
+		{ProtocolUDP, net.IPv4(10, 0, 0, 1), nil, testViewQuery(nil, "Lab-Key"), "tsig"},
+		{ProtocolUDP, net.IPv4(10, 0, 0, 1), nil, testViewQuery([]byte{0x00, 0x01, 24, 0, 198, 51, 100}, ""), "ecs"},
+		{ProtocolTCP, net.IPv4(10, 0, 0, 1), nil, testViewQuery(nil, ""), "lab-tcp"},
+		{ProtocolUDP, net.IPv4(10, 0, 0, 1), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}, testViewQuery(nil, ""), "dst"},
+		{ProtocolUDP, net.IPv4(10, 0, 0, 1), nil, testViewQuery(nil, ""), ""},
+	}
+	for _, c := range cases {
+		connInfo := ConnectionInfo{
+			Protocol:     c.protocol,
+			Address:      &net.UDPAddr{IP: c.client, Port: 5353},
+			LocalAddress: c.local,
+			Packet:       c.packet,
+			Record:       &QueryRecord{},
+		}
+		resp, err := vr.Response(connInfo)
+		if err != nil {
+			t.Fatalf("Response failed: %v", err)
+		}
+		if connInfo.Record.View != c.view {
+			t.Errorf("view got: %q, expected: %q", connInfo.Record.View, c.view)
+		}
+		msg := dns.DNSMessage{}
+		if _, err := msg.DecodeFromBuffer(resp, 0); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		if c.view == "" {
+			if msg.Header.RCode != dns.DNSResponseCodeRefused {
+				t.Errorf("default rcode got: %v, expected: REFUSED", msg.Header.RCode)
+			}
+		} else if len(msg.Answer) != 1 {
+			t.Errorf("view %s answers got: %d, expected: 1", c.view, len(msg.Answer))
+		}
+	}
+}
+
+// TestServerViews 测试通过服务器配置启用视图，未设置默认 Responser 时使用服务器的 Responser
+func TestServerViews(t *testing.T) {
+	lab, _ := ParseCIDRs("10.0.0.0/8")
+	server := NewGoDNSServer(DNSServerConfig{
+		LogWriter:   io.Discard,
+		PoolCapcity: -1,
+		Views: &ViewConfig{Views: []View{
+			{Name: "lab", Networks: lab, Responser: &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(1, 1, 1, 1)}}},
+		}},
+	}, &DullResponser{ServerConf: DNSServerConfig{IP: net.IPv4(2, 2, 2, 2)}})
+
+	cases := []struct {
+		client net.IP
+		view   string
+		answer net.IP
+	}{
+		{net.IPv4(10, 0, 0, 1), "lab", net.IPv4(1, 1, 1, 1)},
+		{net.IPv4(192, 0, 2, 1), "", net.IPv4(2, 2, 2, 2)},
+	}
+	for _, c := range cases {
+		connInfo := ConnectionInfo{
+			Protocol: ProtocolUDP,
+			Address:  &net.UDPAddr{IP: c.client, Port: 5353},
+			Packet:   testViewQuery(nil, ""),
+			Record:   &QueryRecord{},
+		}
+		resp, err := server.Handler().ServeDNS(connInfo)
+		if err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		if connInfo.Record.View != c.view {
+			t.Errorf("view got: %q, expected: %q", connInfo.Record.View, c.view)
+		}
+		msg := dns.DNSMessage{}
+		if _, err := msg.DecodeFromBuffer(resp, 0); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		if len(msg.Answer) != 1 || !msg.Answer[0].RData.(*dns.DNSRDATAA).Address.Equal(c.answer) {
+			t.Errorf("client %s answer got: %v, expected: %s", c.client, msg.Answer, c.answer)
+		}
+	}
+}
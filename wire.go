@@ -0,0 +1,105 @@
+// Copyright 2024 TochusC AOSP Lab. All rights reserved.
+
+// wire.go 文件定义了直接读取 DNS 消息线路格式的工具函数。
+// 与解码为 dns.DNSMessage 再重新编码不同，这些函数只定位资源记录中的字段，
+// 便于在不改变消息其余字节（如名称压缩）的情况下修改 TTL 或 RDATA。
+
+package godns
+
+import (
+	"encoding/binary"
+
+	"github.com/tochusc/godns/dns"
+)
+
+// 资源记录所在的部分
+const (
+	wireSectionAnswer = iota
+	wireSectionAuthority
+	wireSectionAdditional
+)
+
+// wireRR 记录消息中一条资源记录的位置
+type wireRR struct {
+	// 所在的部分
+	section int
+	// 所有者名称的起始偏移量
+	name   int
+	rrType dns.DNSType
+	// TTL 字段的偏移量
+	ttl int
+	// RDATA 区间 [start, end)
+	rdata [2]int
+}
+
+// skipName 跳过消息中 offset 处的域名，返回其后的偏移量，格式错误时返回 -1
+func skipName(msg []byte, offset int) int {
+	for offset < len(msg) {
+		l := int(msg[offset])
+		switch {
+		case l == 0:
+			return offset + 1
+		case l&0xc0 == 0xc0:
+			// 压缩指针，域名在此结束
+			if offset+2 > len(msg) {
+				return -1
+			}
+			return offset + 2
+		case l&0xc0 != 0:
+			return -1
+		}
+		offset += 1 + l
+	}
+	return -1
+}
+
+// wireRRs 返回消息中所有资源记录的位置
+// 其接受参数为：
+//   - msg []byte，DNS 消息
+//
+// 返回值为：
+//   - []wireRR，按顺序排列的资源记录
+//   - bool，消息是否被完整解析，格式错误时返回已解析的部分及 false
+func wireRRs(msg []byte) ([]wireRR, bool) {
+	if len(msg) < 12 {
+		return nil, false
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(msg[6:])),
+		int(binary.BigEndian.Uint16(msg[8:])),
+		int(binary.BigEndian.Uint16(msg[10:])),
+	}
+
+	offset := 12
+	for i := 0; i < qd; i++ {
+		if offset = skipName(msg, offset); offset < 0 || offset+4 > len(msg) {
+			return nil, false
+		}
+		offset += 4
+	}
+
+	var rrs []wireRR
+	for section, count := range counts {
+		for i := 0; i < count; i++ {
+			name := offset
+			if offset = skipName(msg, offset); offset < 0 || offset+10 > len(msg) {
+				return rrs, false
+			}
+			rdLen := int(binary.BigEndian.Uint16(msg[offset+8:]))
+			start := offset + 10
+			if start+rdLen > len(msg) {
+				return rrs, false
+			}
+			rrs = append(rrs, wireRR{
+				section: section,
+				name:    name,
+				rrType:  dns.DNSType(binary.BigEndian.Uint16(msg[offset:])),
+				ttl:     offset + 4,
+				rdata:   [2]int{start, start + rdLen},
+			})
+			offset = start + rdLen
+		}
+	}
+	return rrs, true
+}